@@ -3,40 +3,138 @@ package commonapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fabioluissilva/microservicetemplate/commonconfig"
 	"github.com/fabioluissilva/microservicetemplate/commonlogger"
 	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
 	"github.com/fabioluissilva/microservicetemplate/commonscheduler"
 	"github.com/fabioluissilva/microservicetemplate/utilities"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
 )
 
-// RouteMap is a mapping of route paths to their handler functions
+// RouteMap is a mapping of route paths to their handler functions.
+// Keys are a method and a path ("POST /orders") using the Go 1.22 ServeMux patterns, so that several
+// handlers can share a path. A bare path ("/orders") is GET-only, and "* /orders" (see AnyMethod)
+// matches every method. Other methods get 405 Method Not Allowed and OPTIONS lists the allowed ones.
 type RouteMap map[string]http.HandlerFunc
 
+// AnyMethod is the method of a route handling every method itself
+const AnyMethod = "*"
+
+// Route declares the handler of a method and a path. An empty Method means GET.
+type Route struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+}
+
+// Routes builds a RouteMap from routes, to be passed to StartAPI like any RouteMap, e.g.
+//
+//	commonapi.Routes(commonapi.Route{Method: http.MethodPost, Path: "/orders", Handler: createOrder})
+func Routes(routes ...Route) RouteMap {
+	m := make(RouteMap, len(routes))
+	for _, route := range routes {
+		method := route.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		m[MethodRoute(method, route.Path)] = route.Handler
+	}
+	return m
+}
+
+var routeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// MethodRoute builds a RouteMap key restricted to the given HTTP method, e.g. MethodRoute("POST", "/orders")
+func MethodRoute(method string, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+// splitRouteKey splits a RouteMap key into its method (empty for a bare path) and path
+func splitRouteKey(key string) (string, string, error) {
+	method, path, found := strings.Cut(strings.TrimSpace(key), " ")
+	if !found {
+		method, path = "", method
+	}
+	path = strings.TrimSpace(path)
+	if method != "" && method != AnyMethod && !routeMethods[method] {
+		return "", "", fmt.Errorf("invalid method %q in route %q", method, key)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", "", fmt.Errorf("invalid path %q in route %q: must start with /", path, key)
+	}
+	return method, path, nil
+}
+
+// routePattern returns the ServeMux pattern of a route: bare paths are GET-only
+func routePattern(method string, path string) string {
+	switch method {
+	case "":
+		return MethodRoute(http.MethodGet, path)
+	case AnyMethod:
+		return path
+	}
+	return MethodRoute(method, path)
+}
+
 func defaultRoutes(cfg commonconfig.Config) RouteMap {
 
-	return RouteMap{
-		"/ping":          pingHandler,
-		"/config":        WithAPIKey(configHandler(cfg)), // needs cfg
-		"/releasenotes":  releaseNotesHandler,
-		"/metrics":       promhttp.Handler().ServeHTTP,
-		"/health":        healthHandler,
-		"/liveness":      livenessHandler,
-		"/readiness":     readinessHandler,
-		"/runningjobs":   WithAPIKey(runningJobsHandler),
-		"/scheduledjobs": WithAPIKey(scheduledJobsHandler),
+	routes := Routes(
+		Route{Path: "/ping", Handler: pingHandler},
+		Route{Path: "/config", Handler: WithAPIKey(configHandler)},
+		Route{Method: http.MethodPost, Path: "/config/refresh", Handler: WithAPIKey(configRefreshHandler)},
+		Route{Path: "/releasenotes", Handler: releaseNotesHandler},
+		Route{Path: "/metrics", Handler: commonmetrics.Handler().ServeHTTP},
+		Route{Path: "/health", Handler: healthHandler},
+		Route{Path: "/liveness", Handler: livenessHandler},
+		Route{Path: "/readiness", Handler: readinessHandler(nil)},
+		Route{Path: "/runningjobs", Handler: WithAPIKey(runningJobsHandler)},
+		Route{Path: "/scheduledjobs", Handler: WithAPIKey(scheduledJobsHandler)},
+		Route{Path: "/mqstats", Handler: WithAPIKey(mqStatsHandler)},
+		Route{Method: http.MethodPost, Path: "/mqshovel", Handler: WithAPIKey(mqShovelHandler)},
+		Route{Path: "/status", Handler: WithAPIKey(statusHandler)},
+		Route{Path: "/metrics.json", Handler: WithAPIKey(metricsJSONHandler)},
+		Route{Path: "/loglevel", Handler: WithAPIKey(logLevelHandler)},
+		Route{Method: http.MethodPut, Path: "/loglevel", Handler: WithAPIKey(logLevelHandler)},
+		Route{Method: http.MethodPost, Path: "/loglevel", Handler: WithAPIKey(logLevelHandler)},
+		Route{Path: "/jobhistory", Handler: WithAPIKey(jobHistoryHandler)},
+	)
+	if cfg.GetDebugEndpoints() {
+		commonlogger.Warn("Debug endpoints are enabled", "environment", cfg.GetEnvironment())
+		routes["POST /metrics/reset"] = WithAPIKey(metricsResetHandler)
 	}
+	return routes
 }
 
 // Middleware to check if the X-API-KEY is present and valid according to the configuration
@@ -54,21 +152,114 @@ func WithAPIKey(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// WithMaxConcurrent limits the number of concurrent requests running the handler to n.
+// Requests beyond the limit are rejected with 429 Too Many Requests.
+// The current concurrency is exposed in the concurrent_requests gauge labeled by path.
+func WithMaxConcurrent(path string, n int, fn http.HandlerFunc) http.HandlerFunc {
+	semaphore := make(chan struct{}, n)
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case semaphore <- struct{}{}:
+		default:
+			commonlogger.Warn(fmt.Sprintf("Too many concurrent requests for %s (limit %d)", path, n))
+			WriteJSONError(w, http.StatusTooManyRequests, ErrorResponse{Error: "Too many concurrent requests"})
+			return
+		}
+		gauge := commonmetrics.ConcurrentRequests.WithLabelValues(path)
+		gauge.Inc()
+		defer func() {
+			gauge.Dec()
+			<-semaphore
+		}()
+		fn(w, r)
+	}
+}
+
 func WriteJSONResponse(w http.ResponseWriter, response interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func testHttpMethod(r *http.Request, w *http.ResponseWriter, method string, handler string) bool {
-	if r.Method != method {
+// ErrorResponse is the standardized error envelope returned by the API helpers
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes a single field that failed validation
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+// WriteJSONError writes the standardized error envelope with the given status code
+func WriteJSONError(w http.ResponseWriter, status int, response ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	// Report field names as they appear in the JSON payload
+	v.RegisterTagNameFunc(func(sf reflect.StructField) string {
+		name := strings.SplitN(sf.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return sf.Name
+		}
+		return name
+	})
+	return v
+}
+
+// DecodeJSON decodes the request body into v.
+// If the body is not valid JSON it writes a 400 response and returns false.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
 		commonmetrics.NumberOfErrors.Inc()
-		http.Error(*w, fmt.Sprintf(`{"error": "Only %s method is allowed"}`, method), http.StatusMethodNotAllowed)
-		commonlogger.Error(fmt.Sprintf("%s: Only %s method is allowed", handler, method))
+		commonlogger.Error("Failed to decode JSON body", "error", err.Error())
+		WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Invalid JSON body: %s", err.Error())})
 		return false
 	}
 	return true
 }
 
+// DecodeAndValidate decodes the request body into v and validates it using its `validate` struct tags.
+// If validation fails it writes a 422 response listing each failing field and rule and returns false.
+func DecodeAndValidate(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !DecodeJSON(w, r, v) {
+		return false
+	}
+	err := validate.Struct(v)
+	if err == nil {
+		return true
+	}
+	commonmetrics.NumberOfErrors.Inc()
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		commonlogger.Error("Failed to validate JSON body", "error", err.Error())
+		WriteJSONError(w, http.StatusInternalServerError, ErrorResponse{Error: "Failed to validate request"})
+		return false
+	}
+	response := ErrorResponse{Error: "Validation failed"}
+	for _, fe := range validationErrors {
+		response.Fields = append(response.Fields, FieldError{
+			Field: fe.Field(),
+			Rule:  fe.Tag(),
+			Param: fe.Param(),
+		})
+	}
+	commonlogger.Debug(fmt.Sprintf("Validation failed: %v", response.Fields))
+	WriteJSONError(w, http.StatusUnprocessableEntity, response)
+	return false
+}
+
 func readReleaseNotes() (string, error) {
 	releaseNotesPath := "releasenotes.txt"
 	commonlogger.Debug(fmt.Sprintf("Reading Release Notes from: %s", releaseNotesPath))
@@ -81,9 +272,6 @@ func readReleaseNotes() (string, error) {
 }
 
 func releaseNotesHandler(w http.ResponseWriter, r *http.Request) {
-	if !testHttpMethod(r, &w, http.MethodGet, "releaseNotesHandler") {
-		return
-	}
 	notes, err := readReleaseNotes()
 	if err != nil {
 		commonmetrics.NumberOfErrors.Inc()
@@ -95,107 +283,562 @@ func releaseNotesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func pingHandler(w http.ResponseWriter, r *http.Request) {
-	if !testHttpMethod(r, &w, http.MethodGet, "pingHandler") {
-		return
-	}
 	message := r.URL.Query().Get("message")
 	if message == "" {
 		message = "No message provided"
 	}
 	commonlogger.Debug(fmt.Sprintf("Ping request received: %s", message))
 
-	response := map[string]string{
-		"service":   commonconfig.GetConfig().GetServiceName(),
-		"version":   commonconfig.GetConfig().GetVersion(),
-		"timestamp": time.Now().Format(time.RFC3339),
-		"status":    "ok",
-		"message":   message,
+	response := map[string]interface{}{
+		"service":        commonconfig.GetConfig().GetServiceName(),
+		"version":        commonconfig.GetConfig().GetVersion(),
+		"timestamp":      utilities.Now().Format(time.RFC3339),
+		"status":         "ok",
+		"message":        message,
+		"uptime_seconds": commonmetrics.Uptime().Seconds(),
 	}
 	commonmetrics.NumberOfPings.Inc()
 	WriteJSONResponse(w, response)
 }
 
-func configHandler(cfg commonconfig.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		commonlogger.Debug("Config request received")
-		if r.Method != http.MethodGet {
-			commonmetrics.NumberOfErrors.Inc()
-			http.Error(w, `{"error": "Only GET method is allowed"}`, http.StatusMethodNotAllowed)
-			commonlogger.Error("Only GET method is allowed")
+// configHandler returns the current configuration with the sensitive values masked
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	commonlogger.Debug("Config request received")
+	w.Header().Set("Content-Type", "application/json")
+	commonmetrics.NumberOfConfigRequests.Inc()
+	cfg := commonconfig.GetConfig()
+	maskedJson, err := utilities.ToMaskedJSON(&cfg)
+	if err != nil {
+		commonmetrics.NumberOfErrors.Inc()
+		http.Error(w, `{"error": "Failed to generate config JSON"}`, http.StatusInternalServerError)
+		commonlogger.Error("Failed to generate config JSON", "error", err.Error())
+		return
+	}
+	w.Write([]byte(maskedJson))
+}
+
+// configRefreshHandler reloads the configuration on demand and returns the changed keys and the masked result
+func configRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	commonlogger.Info("Config refresh request received")
+	changes, err := commonconfig.Reload()
+	if err != nil {
+		commonmetrics.NumberOfErrors.Inc()
+		commonlogger.Error("Failed to reload config", "error", err.Error())
+		WriteJSONError(w, http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to reload config: %s", err.Error())})
+		return
+	}
+	commonmetrics.NumberOfConfigRequests.Inc()
+	maskedConfig, err := utilities.ToMaskedMap(commonconfig.GetConfig())
+	if err != nil {
+		commonmetrics.NumberOfErrors.Inc()
+		WriteJSONError(w, http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate config JSON"})
+		commonlogger.Error("Failed to generate config JSON", "error", err.Error())
+		return
+	}
+	WriteJSONResponse(w, map[string]interface{}{
+		"changes": changes,
+		"config":  maskedConfig,
+	})
+}
+
+// metricsJSONHandler serves the gathered metrics as JSON for lightweight dashboards
+func metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	families, err := commonmetrics.GatherJSON()
+	if err != nil {
+		commonmetrics.NumberOfErrors.Inc()
+		commonlogger.Error("Failed to gather metrics", "error", err.Error())
+		WriteJSONError(w, http.StatusInternalServerError, ErrorResponse{Error: "Failed to gather metrics"})
+		return
+	}
+	WriteJSONResponse(w, families)
+}
+
+// metricsResetHandler clears the metrics state; it is only registered when debug endpoints are enabled
+func metricsResetHandler(w http.ResponseWriter, r *http.Request) {
+	// Check again at request time in case the configuration changed since startup
+	if !commonconfig.GetConfig().GetDebugEndpoints() {
+		WriteJSONError(w, http.StatusNotFound, ErrorResponse{Error: "Debug endpoints are disabled"})
+		return
+	}
+	commonmetrics.Reset()
+	WriteJSONResponse(w, map[string]string{"status": "reset"})
+}
+
+var logLevels = map[string]bool{"DEBUG": true, "INFO": true, "WARN": true, "WARNING": true, "ERROR": true}
+
+// logLevelHandler returns the current log level on GET and changes it on PUT or POST,
+// taking the level from the "level" query parameter or a {"level": "..."} JSON body
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	current := commonlogger.GetLogLevel().Level().String()
+	switch r.Method {
+	case http.MethodGet:
+		WriteJSONResponse(w, map[string]string{"level": current})
+		return
+	case http.MethodPut, http.MethodPost:
+	default:
+		commonmetrics.NumberOfErrors.Inc()
+		WriteJSONError(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Only GET, PUT and POST methods are allowed"})
+		return
+	}
+
+	level := r.URL.Query().Get("level")
+	if level == "" {
+		var body struct {
+			Level string `json:"level"`
 		}
-		w.Header().Set("Content-Type", "application/json")
-		commonmetrics.NumberOfConfigRequests.Inc()
-		maskedJson, err := utilities.ToMaskedJSON(&cfg)
-		if err != nil {
-			commonmetrics.NumberOfErrors.Inc()
-			http.Error(w, `{"error": "Failed to generate config JSON"}`, http.StatusInternalServerError)
-			commonlogger.Error("Failed to generate config JSON", "error", err.Error())
+		if !DecodeJSON(w, r, &body) {
 			return
 		}
-		w.Write([]byte(maskedJson))
+		level = body.Level
+	}
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if !logLevels[level] {
+		WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Invalid log level %q: use DEBUG, INFO, WARN or ERROR", level)})
+		return
 	}
+	commonlogger.SetLogLevel(level)
+	updated := commonlogger.GetLogLevel().Level().String()
+	commonlogger.Warn(fmt.Sprintf("Log level changed from %s to %s", current, updated), "remote_addr", r.RemoteAddr)
+	WriteJSONResponse(w, map[string]string{"level": updated, "previous": current})
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, `{"error": "Only GET method is allowed"}`, http.StatusMethodNotAllowed)
-		commonlogger.Error("Only GET method is allowed", "package", "api")
-		return
-	}
 	WriteJSONResponse(w, map[string]string{"status": "ok"})
 }
 
 func livenessHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, `{"error": "Only GET method is allowed"}`, http.StatusMethodNotAllowed)
-		return
-	}
 	WriteJSONResponse(w, map[string]string{"status": "alive"})
 }
 
-func readinessHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, `{"error": "Only GET method is allowed"}`, http.StatusMethodNotAllowed)
-		return
+// BuildCommit and BuildTime describe the build, e.g. with
+// -ldflags "-X github.com/fabioluissilva/microservicetemplate/commonapi.BuildCommit=$(git rev-parse HEAD)".
+// When they are not set, the VCS information stamped by the Go toolchain is used.
+var (
+	BuildCommit string
+	BuildTime   string
+)
+
+// buildInfo returns the build commit and time
+func buildInfo() (string, string) {
+	commit, buildTime := BuildCommit, BuildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "":
+				buildTime = setting.Value
+			}
+		}
 	}
-	// TODO: Add readiness check
-	WriteJSONResponse(w, map[string]string{"status": "ready"})
+	return commit, buildTime
+}
+
+// infoHandler returns the service metadata in one document: name, version, build, uptime,
+// Go version and the enabled API features
+func infoHandler(options *apiOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := commonconfig.GetConfig()
+		commit, buildTime := buildInfo()
+		WriteJSONResponse(w, map[string]interface{}{
+			"service":        cfg.GetServiceName(),
+			"version":        cfg.GetVersion(),
+			"build_commit":   commit,
+			"build_time":     buildTime,
+			"go_version":     runtime.Version(),
+			"started_at":     commonmetrics.StartTime().Format(time.RFC3339),
+			"uptime_seconds": int64(commonmetrics.Uptime().Seconds()),
+			"features":       options.features(cfg),
+		})
+	}
+}
+
+// statusHandler returns a detailed document aggregating the state of every subsystem
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	commonlogger.Debug("Status request received")
+	commonmetrics.NumberOfStatusRequests.Inc()
+
+	mqStats := commonmqengine.Stats()
+	jobNames := []string{}
+	for _, job := range commonscheduler.GetScheduledJobs() {
+		jobNames = append(jobNames, job.Name)
+	}
+	cfg := commonconfig.GetConfig()
+	startup := GetStartupState()
+	WriteJSONResponse(w, map[string]interface{}{
+		"status":         startup.Status,
+		"subsystems":     startup.Subsystems,
+		"service":        cfg.GetServiceName(),
+		"version":        cfg.GetVersion(),
+		"go_version":     runtime.Version(),
+		"started_at":     commonmetrics.StartTime().Format(time.RFC3339),
+		"uptime_seconds": int64(commonmetrics.Uptime().Seconds()),
+		"mq": map[string]interface{}{
+			"connected": mqStats.Connected,
+			"host":      mqStats.Host,
+			"port":      mqStats.Port,
+			"vhost":     mqStats.VHost,
+			"queues":    mqStats.Queues,
+		},
+		"scheduler": map[string]interface{}{
+			"job_count": len(jobNames),
+			"jobs":      jobNames,
+		},
+	})
+}
+
+// tagFilter reads the tag filter of the jobs endpoints: ?tag=a&tag=b (or ?tag=a,b) with
+// match=any (default, the job has one of the tags) or match=all (the job has every tag).
+// It returns a nil filter when no tag is requested and writes a 400 response on an invalid match.
+func tagFilter(w http.ResponseWriter, r *http.Request) (func(jobTags []string) bool, bool) {
+	var tags []string
+	for _, value := range r.URL.Query()["tag"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	matchAll := false
+	switch match := strings.ToLower(r.URL.Query().Get("match")); match {
+	case "", "any":
+	case "all":
+		matchAll = true
+	default:
+		WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Invalid match %q, expected any or all", match)})
+		return nil, false
+	}
+	if len(tags) == 0 {
+		return nil, true
+	}
+	return func(jobTags []string) bool {
+		for _, tag := range tags {
+			found := slices.Contains(jobTags, tag)
+			if found && !matchAll {
+				return true
+			}
+			if !found && matchAll {
+				return false
+			}
+		}
+		return matchAll
+	}, true
 }
 
 func runningJobsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, `{"error": "Only GET method is allowed"}`, http.StatusMethodNotAllowed)
+	match, ok := tagFilter(w, r)
+	if !ok {
 		return
 	}
 	commonlogger.Debug("Scheduled jobs request received")
 	jobs := commonscheduler.GetJobsInfo()
+	if match != nil {
+		jobs = slices.DeleteFunc(jobs, func(job commonscheduler.JobInfo) bool { return !match(job.Tags) })
+	}
 	commonlogger.Debug(fmt.Sprintf("Scheduled jobs response: %v", jobs))
 	WriteJSONResponse(w, jobs)
 }
 
+func jobHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: "The name query parameter is required"})
+		return
+	}
+	WriteJSONResponse(w, commonscheduler.GetJobHistory(name))
+}
+
 func scheduledJobsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, `{"error": "Only GET method is allowed"}`, http.StatusMethodNotAllowed)
+	match, ok := tagFilter(w, r)
+	if !ok {
 		return
 	}
 	commonlogger.Debug("Scheduled jobs request received")
 	jobs := commonscheduler.GetScheduledJobs()
+	if match != nil {
+		// Filter a copy, the slice belongs to the scheduler
+		jobs = slices.DeleteFunc(slices.Clone(jobs), func(job commonscheduler.CronJob) bool { return !match(job.Tags) })
+	}
 	commonlogger.Debug(fmt.Sprintf("Scheduled jobs response: %v", jobs))
 	WriteJSONResponse(w, jobs)
 }
 
-func StartAPI(cfg commonconfig.Config, overrides RouteMap) (chan struct{}, error) {
-	done := make(chan struct{})
-	commonlogger.Info(fmt.Sprintf("Starting Prometheus Metrics Listener on %d", cfg.GetMetricsPort()))
+// Server is returned by StartAPI and lets the caller follow the lifecycle of the API.
+// Done is closed once the graceful shutdown has completed. ShutdownReason is nil when the
+// shutdown was triggered by a signal and holds the triggering error otherwise; it must only
+// be read after Done is closed.
+type Server struct {
+	Done           chan struct{}
+	ShutdownReason error
+
+	shutdown     chan error
+	shutdownOnce sync.Once
+
+	mux      *http.ServeMux
+	routesMu sync.Mutex
+	routes   map[string]bool
+	// fallbacks are the paths whose unhandled methods are answered by registerFallback
+	fallbacks map[string]bool
+}
+
+// AddRoute registers a route on the running server. It can be called at any time after StartAPI,
+// e.g. by plugins. The path accepts the same keys as RouteMap; registering an existing or
+// conflicting route returns an error.
+func (s *Server) AddRoute(path string, handler http.HandlerFunc) error {
+	if err := s.register(path, handler); err != nil {
+		return err
+	}
+	return s.registerFallback(path)
+}
+
+// allowedMethods returns the methods registered on the path. ok is false when a route
+// registered with AnyMethod handles every method of the path itself.
+func (s *Server) allowedMethods(path string) (methods []string, ok bool) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	for key := range s.routes {
+		method, routePath, err := splitRouteKey(key)
+		if err != nil || routePath != path {
+			continue
+		}
+		switch method {
+		case AnyMethod:
+			return nil, false
+		case "":
+			method = http.MethodGet
+		}
+		if !slices.Contains(methods, method) {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	return methods, true
+}
+
+// waitForShutdown blocks until a termination signal is received or Shutdown is called
+func (s *Server) waitForShutdown(sigChan <-chan os.Signal) {
+	for {
+		select {
+		case sig := <-sigChan:
+			// SIGHUP reloads the config instead when commonconfig.WatchConfig is running
+			if sig == syscall.SIGHUP && commonconfig.IsWatchingConfig() {
+				continue
+			}
+			commonlogger.Info(fmt.Sprintf("Received signal: %v", sig))
+			return
+		case reason := <-s.shutdown:
+			s.ShutdownReason = reason
+			if reason != nil {
+				commonlogger.Error(fmt.Sprintf("Shutting down due to error: %s", reason.Error()))
+			} else {
+				commonlogger.Info("Shutdown requested")
+			}
+			return
+		}
+	}
+}
+
+// registerFallback registers, once per path, the handler of the methods no route of the path
+// handles: OPTIONS gets 204 with the Allow header, any other method gets 405 Method Not Allowed.
+// Paths with an AnyMethod route don't get one.
+func (s *Server) registerFallback(key string) (err error) {
+	_, path, err := splitRouteKey(key)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.allowedMethods(path); !ok {
+		return nil
+	}
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	if s.fallbacks[path] {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to register the method fallback of %s: %v", path, r)
+		}
+	}()
+	s.mux.HandleFunc(path, WithAccessLog(path, func(w http.ResponseWriter, r *http.Request) {
+		// Computed per request so that routes added later are listed
+		methods, _ := s.allowedMethods(path)
+		allowed := strings.Join(methods, ", ")
+		w.Header().Set("Allow", allowed)
+		if r.Method == http.MethodOptions {
+			// Preflight requests of the routes wrapped with WithCORS land here
+			writeCORSHeaders(w, r, allowed)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		commonmetrics.NumberOfErrors.Inc()
+		commonlogger.Error(fmt.Sprintf("%s %s: only %s allowed", r.Method, r.URL.Path, allowed))
+		WriteJSONError(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("Only %s allowed", allowed)})
+	}))
+	s.fallbacks[path] = true
+	return nil
+}
+
+func (s *Server) register(path string, handler http.HandlerFunc) (err error) {
+	method, routePath, err := splitRouteKey(path)
+	if err != nil {
+		return err
+	}
+	if handler == nil {
+		return fmt.Errorf("handler for route %s is nil", path)
+	}
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	if s.routes[path] {
+		return fmt.Errorf("route already registered: %s", path)
+	}
+	// ServeMux panics on conflicting patterns; report it as an error instead
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to register route %s: %v", path, r)
+		}
+	}()
+	handlerName := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	commonlogger.Debug(fmt.Sprintf("Registering route: %s with handler: %s", path, handlerName))
+	s.mux.HandleFunc(routePattern(method, routePath), WithAccessLog(path, WithMetrics(path, WithRecovery(handler))))
+	s.routes[path] = true
+	return nil
+}
+
+// Shutdown triggers a graceful shutdown of the API. A non-nil reason marks the shutdown as
+// error-driven so that main can exit with a non-zero code. Only the first call has an effect.
+func (s *Server) Shutdown(reason error) {
+	s.shutdownOnce.Do(func() {
+		s.shutdown <- reason
+	})
+}
 
-	// Create servers
-	metricsServer := &http.Server{
-		Addr:    ":" + strconv.Itoa(cfg.GetMetricsPort()),
-		Handler: nil,
+// ExitCode returns the process exit code matching the shutdown reason: 0 for a signal-driven
+// shutdown and 1 for an error-driven one.
+func (s *Server) ExitCode() int {
+	if s.ShutdownReason != nil {
+		return 1
+	}
+	return 0
+}
+
+func mqStatsHandler(w http.ResponseWriter, r *http.Request) {
+	commonlogger.Debug("MQ stats request received")
+	WriteJSONResponse(w, commonmqengine.Stats())
+}
+
+// mqShovelHandler moves messages between queues: POST /mqshovel?source=a&dest=b&max=100
+func mqShovelHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	dest := r.URL.Query().Get("dest")
+	if source == "" || dest == "" {
+		commonmetrics.NumberOfErrors.Inc()
+		WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: "source and dest query parameters are required"})
+		return
+	}
+	max := 0
+	if value := r.URL.Query().Get("max"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			commonmetrics.NumberOfErrors.Inc()
+			WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid max: %s", value)})
+			return
+		}
+		max = parsed
+	}
+	moved, err := commonmqengine.ShovelQueue(r.Context(), source, dest, max)
+	if err != nil {
+		commonmetrics.NumberOfErrors.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "moved": moved})
+		return
+	}
+	WriteJSONResponse(w, map[string]interface{}{"source": source, "dest": dest, "moved": moved})
+}
+
+// logStartupBanner emits a single structured record summarizing the resolved, non-sensitive configuration
+func logStartupBanner(cfg commonconfig.Config) {
+	if !cfg.GetStartupBanner() {
+		return
+	}
+	commonlogger.Info("Startup configuration",
+		"version", cfg.GetVersion(),
+		"port", cfg.GetPort(),
+		"metrics_port", cfg.GetMetricsPort(),
+		"log_level", cfg.GetLogLevel(),
+		"api_key", utilities.MaskValue(cfg.GetApiKey()),
+		"heartbeat_cron", cfg.GetHeartBeatCron(),
+		"heartbeat_debug", cfg.GetHeartBeatDebug(),
+		"max_header_bytes", cfg.GetMaxHeaderBytes(),
+		"max_connections", cfg.GetMaxConnections(),
+	)
+}
+
+// StartAPI starts the API and metrics servers. Any number of override maps can be given as options
+// to add or replace routes; they are merged in order so later maps win over earlier ones.
+// Other options (e.g. WithH2C) customize the servers. If the metrics server fails the API keeps
+// running and the service is reported degraded, see GetStartupState.
+func StartAPI(cfg commonconfig.Config, opts ...Option) (*Server, error) {
+	options := newAPIOptions(opts)
+	// Each server has its own mux so that several servers can run in the same process
+	server := &Server{
+		Done:      make(chan struct{}),
+		shutdown:  make(chan error, 1),
+		mux:       http.NewServeMux(),
+		routes:    map[string]bool{},
+		fallbacks: map[string]bool{},
+	}
+	logStartupBanner(cfg)
+	options.logFeatures(cfg)
+
+	// Create servers. A metrics port of 0 disables the dedicated metrics server;
+	// /metrics stays available on the API port.
+	metricsHandler := commonmetrics.Handler().ServeHTTP
+	if options.protectedMetrics {
+		commonlogger.Info("/metrics requires the API key")
+		metricsHandler = WithAPIKey(metricsHandler)
+	}
+	var metricsServer *http.Server
+	if cfg.GetMetricsPort() != 0 {
+		commonlogger.Info(fmt.Sprintf("Starting Prometheus Metrics Listener on %d", cfg.GetMetricsPort()))
+		// The metrics server only serves the metrics and, when enabled, the log level endpoint
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", metricsHandler)
+		if cfg.GetLogLevelOnMetricsPort() {
+			commonlogger.Info("Serving /loglevel on the metrics port")
+			metricsMux.HandleFunc("/loglevel", WithAccessLog("/loglevel", WithAPIKey(logLevelHandler)))
+		}
+		metricsServer = &http.Server{
+			Addr:    ":" + strconv.Itoa(cfg.GetMetricsPort()),
+			Handler: metricsMux,
+		}
+	} else {
+		commonlogger.Info(fmt.Sprintf("METRICS_PORT is 0: metrics server disabled, serving /metrics on the API port %d", cfg.GetPort()))
 	}
 	apiServer := &http.Server{
-		Addr:    ":" + strconv.Itoa(cfg.GetPort()),
-		Handler: nil,
+		Addr:           ":" + strconv.Itoa(cfg.GetPort()),
+		Handler:        server.mux,
+		MaxHeaderBytes: cfg.GetMaxHeaderBytes(),
+	}
+	if options.h2c {
+		commonlogger.Info("HTTP/2 cleartext (h2c) enabled on the API server")
+		apiServer.Handler = h2c.NewHandler(server.mux, &http2.Server{})
+	}
+
+	// Bind the API listener up front so bind errors are reported to the caller
+	listenConfig := net.ListenConfig{}
+	if options.reusePort {
+		commonlogger.Info("Binding the API listener with SO_REUSEPORT", "supported", reusePortSupported)
+		listenConfig.Control = reusePortControl
+	}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", apiServer.Addr)
+	if err != nil {
+		commonlogger.Error(fmt.Sprintf("Failed to bind API listener on %s: %s", apiServer.Addr, err.Error()))
+		return nil, fmt.Errorf("failed to bind API listener on %s: %w", apiServer.Addr, err)
+	}
+	if maxConnections := cfg.GetMaxConnections(); maxConnections > 0 {
+		commonlogger.Info(fmt.Sprintf("Limiting API server to %d concurrent connections", maxConnections))
+		listener = netutil.LimitListener(listener, maxConnections)
 	}
 
 	// Setup signal handling
@@ -203,49 +846,132 @@ func StartAPI(cfg commonconfig.Config, overrides RouteMap) (chan struct{}, error
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
 
 	// Start metrics server
-	go func() {
-		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
-			commonlogger.Error(fmt.Sprintf("Metrics server error: %s", err.Error()))
-		}
-	}()
+	if metricsServer != nil {
+		SetSubsystemStatus("metrics_server", SubsystemOK, "")
+		utilities.Go(func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				// The metrics are also served on the API port, so the service keeps running degraded
+				commonlogger.Error(fmt.Sprintf("Metrics server error, continuing without it: %s", err.Error()))
+				SetSubsystemStatus("metrics_server", SubsystemDegraded, err.Error())
+			}
+		})
+	}
 
 	// ✅ Apply overrides if provided
 	finalRoutes := defaultRoutes(cfg)
-	for path, handler := range overrides {
-		commonlogger.Debug(fmt.Sprintf("Overriding/adding route: %s", path))
-		finalRoutes[path] = handler
+	finalRoutes["GET /metrics"] = metricsHandler
+	finalRoutes["GET /info"] = WithAPIKey(infoHandler(options))
+	finalRoutes["GET /readiness"] = readinessHandler(options.readiness)
+	for _, static := range options.static {
+		key, handler, err := static.route()
+		if err != nil {
+			commonlogger.Error(fmt.Sprintf("Skipping static directory %s: %s", static.dir, err.Error()))
+			continue
+		}
+		commonlogger.Info(fmt.Sprintf("Serving static directory %s under %s", static.dir, static.prefix))
+		finalRoutes[key] = handler
+	}
+	defaults := maps.Clone(finalRoutes)
+	for _, routes := range options.routes {
+		for path, handler := range routes {
+			commonlogger.Debug(fmt.Sprintf("Overriding/adding route: %s", path))
+			// A bare path or AnyMethod route replaces the default routes of its path, whatever their method
+			if method, routePath, err := splitRouteKey(path); err == nil && (method == "" || method == AnyMethod) {
+				for key := range defaults {
+					if _, defaultPath, _ := splitRouteKey(key); defaultPath == routePath {
+						delete(finalRoutes, key)
+					}
+				}
+			}
+			finalRoutes[path] = handler
+		}
 	}
-	// Register all routes
+	// Register all routes, then answer the other methods of their paths
 	for path, handler := range finalRoutes {
-		handlerName := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
-		commonlogger.Debug(fmt.Sprintf("Registering route: %s with handler: %s", path, handlerName))
-		http.HandleFunc(path, handler)
+		if err := server.register(path, handler); err != nil {
+			commonlogger.Error(fmt.Sprintf("Skipping route: %s", err.Error()))
+		}
+	}
+	for path := range finalRoutes {
+		if err := server.registerFallback(path); err != nil {
+			commonlogger.Error(fmt.Sprintf("Skipping method fallback: %s", err.Error()))
+		}
 	}
 
 	// Start API server
-	go func() {
+	utilities.Go(func() {
 		commonlogger.Info(fmt.Sprintf("Starting API on port %d", cfg.GetPort()))
-		if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+		if err := apiServer.Serve(listener); err != http.ErrServerClosed {
 			commonlogger.Error(fmt.Sprintf("API server error: %s", err.Error()))
+			server.Shutdown(fmt.Errorf("api server error: %w", err))
 		}
-	}()
+	})
 
 	// Graceful shutdown
-	go func() {
-		sig := <-sigChan
-		commonlogger.Info(fmt.Sprintf("Received signal: %v", sig))
+	utilities.Go(func() {
+		server.waitForShutdown(sigChan)
+		signal.Stop(sigChan)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		// In-flight requests get up to the shutdown timeout to complete before the servers close them
+		shutdownTimeout := cfg.GetShutdownTimeout()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 
-		if err := metricsServer.Shutdown(ctx); err != nil {
-			commonlogger.Error(fmt.Sprintf("Metrics server shutdown error: %s", err.Error()))
+		inFlight := activeRequests.Load()
+		commonlogger.Info(fmt.Sprintf("Granting in-flight requests %.0f seconds to complete", shutdownTimeout.Seconds()), "in_flight_requests", inFlight)
+		metricsStopped := false
+		if metricsServer != nil {
+			if err := metricsServer.Shutdown(ctx); err != nil {
+				commonlogger.Error(fmt.Sprintf("Metrics server shutdown error: %s", err.Error()))
+			} else {
+				metricsStopped = true
+			}
 		}
+		apiStopped := true
 		if err := apiServer.Shutdown(ctx); err != nil {
-			commonlogger.Error(fmt.Sprintf("API server shutdown error: %s", err.Error()))
+			apiStopped = false
+			if errors.Is(err, context.DeadlineExceeded) {
+				commonlogger.Warn(fmt.Sprintf("Shutdown timed out after %.0f seconds, closing the remaining requests", shutdownTimeout.Seconds()))
+				apiServer.Close()
+			} else {
+				commonlogger.Error(fmt.Sprintf("API server shutdown error: %s", err.Error()))
+			}
+		} else {
+			commonlogger.Info("API server shut down cleanly")
 		}
-		close(done)
-	}()
+		jobsDrained, err := commonscheduler.ShutdownAll()
+		schedulerStopped := err == nil
+		mqClosed := false
+		if commonmqengine.IsConnected() {
+			commonmqengine.Close()
+			mqClosed = true
+		}
+		commonlogger.Info("Shutdown summary",
+			"api_server_stopped", apiStopped,
+			"metrics_server_stopped", metricsStopped,
+			"in_flight_requests", inFlight,
+			"in_flight_requests_completed", apiStopped,
+			"scheduler_stopped", schedulerStopped,
+			"jobs_drained", jobsDrained,
+			"mq_closed", mqClosed,
+		)
+		close(server.Done)
+	})
+
+	return server, nil
+}
 
-	return done, nil
+// Serve starts the API like StartAPI and blocks until it has shut down. It returns the error that
+// triggered the shutdown, or nil when it was triggered by a signal or Shutdown(nil), e.g.:
+//
+//	if err := commonapi.Serve(&cfg); err != nil {
+//		log.Fatal(err)
+//	}
+func Serve(cfg commonconfig.Config, opts ...Option) error {
+	server, err := StartAPI(cfg, opts...)
+	if err != nil {
+		return err
+	}
+	<-server.Done
+	return server.ShutdownReason
 }
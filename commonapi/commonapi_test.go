@@ -0,0 +1,1537 @@
+package commonapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
+	"github.com/fabioluissilva/microservicetemplate/commonscheduler"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+)
+
+const testApiKey = "test-api-key"
+
+// testConfig is the configuration loaded for the whole package
+var testConfig = commonconfig.MapLoader{
+	"API_KEY":      testApiKey,
+	"SERVICE_NAME": "svc",
+	"ENVIRONMENT":  "test",
+	"METRICS_PORT": 0,
+}
+
+func TestMain(m *testing.M) {
+	commonlogger.Discard()
+	if err := commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, testConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize the test config: %s\n", err.Error())
+		os.Exit(1)
+	}
+	// TestHandlersWithoutInitializeMetrics runs the test binary again without the metrics
+	if os.Getenv(withoutMetricsEnv) == "" {
+		commonmetrics.InitializeMetrics()
+	}
+	os.Exit(m.Run())
+}
+
+// withoutMetricsEnv makes TestMain skip InitializeMetrics
+const withoutMetricsEnv = "COMMONAPI_TEST_WITHOUT_METRICS"
+
+// useConfig initializes the package config with loader until the end of the test, when the test config is restored
+func useConfig(t *testing.T, loader commonconfig.Loader) {
+	t.Helper()
+	commonconfig.ResetForTest()
+	t.Cleanup(func() {
+		commonconfig.ResetForTest()
+		if err := commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, testConfig); err != nil {
+			t.Errorf("failed to restore the test config: %v", err)
+		}
+	})
+	if err := commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, loader); err != nil {
+		t.Fatalf("failed to initialize the config: %v", err)
+	}
+}
+
+// testConfigWith returns the test config with the values overridden
+func testConfigWith(values map[string]interface{}) commonconfig.MapLoader {
+	loader := commonconfig.MapLoader{}
+	for key, value := range testConfig {
+		loader[key] = value
+	}
+	for key, value := range values {
+		loader[key] = value
+	}
+	return loader
+}
+
+// freePort returns a TCP port that is free at the time of the call
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// testServerConfig returns a copy of the package config listening on a free port, without metrics server
+func testServerConfig(t *testing.T) *commonconfig.BaseConfig {
+	t.Helper()
+	cfg := *commonconfig.GetConfig().(*commonconfig.BaseConfig)
+	cfg.Port = freePort(t)
+	cfg.MetricsPort = 0
+	return &cfg
+}
+
+// startTestServer starts the API with cfg and returns its base URL. The server is shut down with the test.
+func startTestServer(t *testing.T, cfg *commonconfig.BaseConfig, opts ...Option) (*Server, string) {
+	t.Helper()
+	server, err := StartAPI(cfg, opts...)
+	if err != nil {
+		t.Fatalf("StartAPI failed: %v", err)
+	}
+	t.Cleanup(func() {
+		// Idle keep-alive connections that never carried a request delay the shutdown by 5 seconds
+		http.DefaultClient.CloseIdleConnections()
+		server.Shutdown(nil)
+		waitDone(t, server)
+	})
+	return server, fmt.Sprintf("http://127.0.0.1:%d", cfg.Port)
+}
+
+// waitListening waits for a server to accept connections on port
+func waitListening(t *testing.T, port int) {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	t.Fatalf("nothing listening on %s", addr)
+}
+
+// waitDone waits for the shutdown of the server to complete
+func waitDone(t *testing.T, server *Server) {
+	t.Helper()
+	select {
+	case <-server.Done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("the server did not shut down")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of the logger
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs makes the logger write to the returned buffer until the end of the test
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	commonlogger.SetOutput(buf)
+	t.Cleanup(commonlogger.Discard)
+	return buf
+}
+
+func TestShutdownReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		reason   error
+		exitCode int
+	}{
+		{name: "requested", reason: nil, exitCode: 0},
+		{name: "error", reason: errors.New("database lost"), exitCode: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := startTestServer(t, testServerConfig(t))
+			server.Shutdown(tt.reason)
+			// Only the first call has an effect
+			server.Shutdown(errors.New("second call"))
+			waitDone(t, server)
+			if server.ShutdownReason != tt.reason {
+				t.Errorf("ShutdownReason = %v, want %v", server.ShutdownReason, tt.reason)
+			}
+			if got := server.ExitCode(); got != tt.exitCode {
+				t.Errorf("ExitCode() = %d, want %d", got, tt.exitCode)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	cfg := testServerConfig(t)
+	cfg.MaxHeaderBytes = 1024
+	_, url := startTestServer(t, cfg)
+
+	tests := []struct {
+		name       string
+		headerSize int
+		status     int
+	}{
+		{name: "within the limit", headerSize: 100, status: http.StatusOK},
+		// net/http tolerates a few kilobytes on top of MaxHeaderBytes
+		{name: "oversized", headerSize: 64 << 10, status: http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, url+"/ping", nil)
+			req.Header.Set("X-Padding", strings.Repeat("a", tt.headerSize))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	cfg := testServerConfig(t)
+	cfg.MaxConnections = 1
+	_, url := startTestServer(t, cfg)
+
+	// An idle connection takes the only slot
+	held, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer held.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	done := make(chan int, 1)
+	go func() {
+		resp, err := client.Get(url + "/ping")
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	select {
+	case status := <-done:
+		t.Fatalf("the request was served while the connection limit was reached, status %d", status)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	held.Close()
+	select {
+	case status := <-done:
+		if status != http.StatusOK {
+			t.Errorf("status = %d, want %d", status, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not served once the connection was released")
+	}
+}
+
+func TestDecodeAndValidate(t *testing.T) {
+	type order struct {
+		Email    string `json:"email" validate:"required,email"`
+		Quantity int    `json:"quantity" validate:"min=1"`
+	}
+	tests := []struct {
+		name   string
+		body   string
+		ok     bool
+		status int
+		fields []FieldError
+	}{
+		{name: "valid", body: `{"email":"a@b.com","quantity":2}`, ok: true, status: http.StatusOK},
+		{name: "invalid JSON", body: `{"email":`, status: http.StatusBadRequest},
+		{name: "missing field", body: `{"quantity":2}`, status: http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "email", Rule: "required"}}},
+		{name: "several failures", body: `{"email":"nope","quantity":0}`, status: http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "email", Rule: "email"}, {Field: "quantity", Rule: "min", Param: "1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body))
+			var v order
+			if ok := DecodeAndValidate(w, r, &v); ok != tt.ok {
+				t.Fatalf("DecodeAndValidate() = %v, want %v", ok, tt.ok)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.ok {
+				return
+			}
+			var response ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid error response %q: %v", w.Body.String(), err)
+			}
+			if response.Error == "" {
+				t.Error("the error response has no message")
+			}
+			if !reflect.DeepEqual(response.Fields, tt.fields) {
+				t.Errorf("fields = %+v, want %+v", response.Fields, tt.fields)
+			}
+		})
+	}
+}
+
+// request sends a request to the test server, with the API key when apiKey is not empty,
+// and returns the status code and the body
+func request(t *testing.T, method, url, apiKey string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("invalid request: %v", err)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-KEY", apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestMQStats(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t))
+	tests := []struct {
+		name   string
+		apiKey string
+		status int
+	}{
+		{name: "with the API key", apiKey: testApiKey, status: http.StatusOK},
+		{name: "without the API key", status: http.StatusUnauthorized},
+		{name: "with a wrong API key", apiKey: "wrong", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(t, http.MethodGet, url+"/mqstats", tt.apiKey)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			var stats commonmqengine.EngineStats
+			if err := json.Unmarshal([]byte(body), &stats); err != nil {
+				t.Fatalf("invalid stats %q: %v", body, err)
+			}
+			if stats.Connected {
+				t.Error("connected = true without MQ engine")
+			}
+		})
+	}
+}
+
+// textHandler answers with the text
+func textHandler(text string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(text))
+	}
+}
+
+func TestStartAPIOverrides(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		path string
+		body string
+	}{
+		{name: "no overrides", path: "/health", body: `{"status":"ok"}`},
+		{name: "nil map", opts: []Option{RouteMap(nil)}, path: "/health", body: `{"status":"ok"}`},
+		{name: "nil option", opts: []Option{nil}, path: "/health", body: `{"status":"ok"}`},
+		{name: "empty map", opts: []Option{RouteMap{}}, path: "/health", body: `{"status":"ok"}`},
+		{name: "one map adds a route", opts: []Option{RouteMap{"/custom": textHandler("first")}}, path: "/custom", body: "first"},
+		{name: "one map replaces a default route", opts: []Option{RouteMap{"/health": textHandler("custom health")}}, path: "/health", body: "custom health"},
+		{
+			name: "later maps win",
+			opts: []Option{RouteMap{"/custom": textHandler("first")}, RouteMap{"/custom": textHandler("second")}},
+			path: "/custom",
+			body: "second",
+		},
+		{
+			name: "maps are merged",
+			opts: []Option{RouteMap{"/first": textHandler("first")}, RouteMap{"/second": textHandler("second")}},
+			path: "/first",
+			body: "first",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := startTestServer(t, testServerConfig(t), tt.opts...)
+			status, body := request(t, http.MethodGet, url+tt.path, "")
+			if status != http.StatusOK || strings.TrimSpace(body) != tt.body {
+				t.Errorf("GET %s = %d %q, want 200 %q", tt.path, status, body, tt.body)
+			}
+		})
+	}
+}
+
+func TestMethodRoutes(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t), RouteMap{
+		"GET /orders":  textHandler("list"),
+		"POST /orders": textHandler("create"),
+		MethodRoute(AnyMethod, "/any"): func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Method))
+		},
+	})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{name: "GET handler", method: http.MethodGet, path: "/orders", status: http.StatusOK, body: "list"},
+		{name: "POST handler on the same path", method: http.MethodPost, path: "/orders", status: http.StatusOK, body: "create"},
+		{name: "unregistered method", method: http.MethodDelete, path: "/orders", status: http.StatusMethodNotAllowed},
+		{name: "any method with GET", method: http.MethodGet, path: "/any", status: http.StatusOK, body: "GET"},
+		{name: "any method with PATCH", method: http.MethodPatch, path: "/any", status: http.StatusOK, body: "PATCH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(t, tt.method, url+tt.path, "")
+			if status != tt.status {
+				t.Fatalf("%s %s status = %d, want %d", tt.method, tt.path, status, tt.status)
+			}
+			if tt.body != "" && body != tt.body {
+				t.Errorf("%s %s body = %q, want %q", tt.method, tt.path, body, tt.body)
+			}
+		})
+	}
+}
+
+func TestStartupBanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		want    []string
+	}{
+		{name: "enabled", enabled: true, want: []string{"Startup configuration", "port=8123", "metrics_port=9123", "api_key=te****ey", "max_connections=5"}},
+		{name: "disabled", enabled: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testServerConfig(t)
+			cfg.Port, cfg.MetricsPort, cfg.MaxConnections = 8123, 9123, 5
+			cfg.StartupBanner = tt.enabled
+			logStartupBanner(cfg)
+			output := logs.String()
+			if !tt.enabled && output != "" {
+				t.Fatalf("banner logged while disabled: %s", output)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(output, want) {
+					t.Errorf("banner %q does not contain %q", output, want)
+				}
+			}
+			if strings.Contains(output, testApiKey) {
+				t.Errorf("banner %q contains the API key", output)
+			}
+		})
+	}
+}
+
+func TestMQShovelParameters(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "no parameters", query: ""},
+		{name: "no destination", query: "?source=failed"},
+		{name: "no source", query: "?dest=orders"},
+		{name: "invalid max", query: "?source=failed&dest=orders&max=many"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mqShovelHandler(w, httptest.NewRequest(http.MethodPost, "/mqshovel"+tt.query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t))
+	tests := []struct {
+		name   string
+		apiKey string
+		status int
+	}{
+		{name: "with the API key", apiKey: testApiKey, status: http.StatusOK},
+		{name: "without the API key", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(t, http.MethodGet, url+"/status", tt.apiKey)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			var document map[string]interface{}
+			if err := json.Unmarshal([]byte(body), &document); err != nil {
+				t.Fatalf("invalid status %q: %v", body, err)
+			}
+			for _, key := range []string{"status", "subsystems", "service", "version", "go_version", "started_at", "uptime_seconds", "mq", "scheduler"} {
+				if _, ok := document[key]; !ok {
+					t.Errorf("status document has no %s: %s", key, body)
+				}
+			}
+			if document["status"] != string(SubsystemOK) || document["service"] != "svc" {
+				t.Errorf("status = %v, service = %v, want ok and svc", document["status"], document["service"])
+			}
+			mq, _ := document["mq"].(map[string]interface{})
+			if connected, ok := mq["connected"].(bool); !ok || connected {
+				t.Errorf("mq.connected = %v, want false", mq["connected"])
+			}
+		})
+	}
+}
+
+func TestUptime(t *testing.T) {
+	time.Sleep(10 * time.Millisecond)
+	ping := func() float64 {
+		w := httptest.NewRecorder()
+		pingHandler(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid ping response %q: %v", w.Body.String(), err)
+		}
+		uptime, _ := response["uptime_seconds"].(float64)
+		return uptime
+	}
+	tests := []struct {
+		name   string
+		uptime func() float64
+	}{
+		{name: "ping", uptime: ping},
+		{name: "metric", uptime: func() float64 { return testutil.ToFloat64(commonmetrics.UptimeSeconds) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := tt.uptime()
+			if first <= 0 {
+				t.Fatalf("uptime = %v, want > 0", first)
+			}
+			time.Sleep(10 * time.Millisecond)
+			if second := tt.uptime(); second <= first {
+				t.Errorf("uptime did not increase: %v then %v", first, second)
+			}
+		})
+	}
+}
+
+func TestConfigRefresh(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiKey      string
+		env         map[string]string
+		status      int
+		environment string
+		changed     []string
+	}{
+		{name: "environment variable changed", apiKey: testApiKey, env: map[string]string{"ENVIRONMENT": "staging"}, status: http.StatusOK, environment: "staging", changed: []string{"ENVIRONMENT"}},
+		{name: "nothing changed", apiKey: testApiKey, status: http.StatusOK, environment: "test", changed: []string{}},
+		{name: "invalid value keeps the config", apiKey: testApiKey, env: map[string]string{"ENVIRONMENT": "staging", "MAX_CONNECTIONS": "many"}, status: http.StatusInternalServerError, environment: "test"},
+		{name: "missing api key", env: map[string]string{"ENVIRONMENT": "staging"}, status: http.StatusUnauthorized, environment: "test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.toml")
+			content := fmt.Sprintf("API_KEY=%q\nSERVICE_NAME=\"svc\"\nENVIRONMENT=\"test\"\nMETRICS_PORT=0\n", testApiKey)
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", file)
+			useConfig(t, commonconfig.ViperLoader{})
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/config/refresh", nil)
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rec := httptest.NewRecorder()
+			WithAPIKey(configRefreshHandler)(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if got := commonconfig.GetConfig().GetEnvironment(); got != tt.environment {
+				t.Errorf("ENVIRONMENT = %q after the refresh, want %q", got, tt.environment)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var body struct {
+				Changes []struct {
+					Key string `json:"key"`
+				} `json:"changes"`
+				Config map[string]any `json:"config"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+			}
+			changed := []string{}
+			for _, change := range body.Changes {
+				changed = append(changed, change.Key)
+			}
+			if !reflect.DeepEqual(changed, tt.changed) {
+				t.Errorf("changed keys = %v, want %v", changed, tt.changed)
+			}
+			if body.Config["API_KEY"] == testApiKey {
+				t.Error("the refreshed config exposes the api key")
+			}
+		})
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		limit int
+	}{
+		{name: "single request", path: "/limited-one", limit: 1},
+		{name: "several requests", path: "/limited-three", limit: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			handler := WithMaxConcurrent(tt.path, tt.limit, func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			})
+			gauge := commonmetrics.ConcurrentRequests.WithLabelValues(tt.path)
+
+			var wg sync.WaitGroup
+			codes := make(chan int, tt.limit)
+			for i := 0; i < tt.limit; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					handler(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+					codes <- rec.Code
+				}()
+			}
+			for i := 0; i < tt.limit; i++ {
+				<-started
+			}
+			if got := testutil.ToFloat64(gauge); got != float64(tt.limit) {
+				t.Errorf("concurrent_requests = %v while the limit is reached, want %d", got, tt.limit)
+			}
+
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != http.StatusTooManyRequests {
+				t.Errorf("status beyond the limit = %d, want %d", rec.Code, http.StatusTooManyRequests)
+			}
+
+			close(release)
+			wg.Wait()
+			close(codes)
+			for code := range codes {
+				if code != http.StatusOK {
+					t.Errorf("status within the limit = %d, want %d", code, http.StatusOK)
+				}
+			}
+			if got := testutil.ToFloat64(gauge); got != 0 {
+				t.Errorf("concurrent_requests = %v after the requests completed, want 0", got)
+			}
+		})
+	}
+}
+
+func TestSlowRequests(t *testing.T) {
+	useConfig(t, testConfigWith(map[string]interface{}{"SLOW_REQUEST_THRESHOLD": "20ms"}))
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		slow    bool
+	}{
+		{name: "fast request", handler: textHandler("ok")},
+		{name: "slow request", handler: func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+		}, slow: true},
+		{name: "slow streaming request", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			before := testutil.ToFloat64(commonmetrics.SlowRequests)
+			WithAccessLog("/slow", tt.handler)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+			counted := testutil.ToFloat64(commonmetrics.SlowRequests) - before
+			logged := strings.Contains(logs.String(), "level=WARN") && strings.Contains(logs.String(), "Slow request: GET /slow")
+			if tt.slow {
+				if counted != 1 || !logged {
+					t.Errorf("slow_requests_total increased by %v, warn logged %t, want 1 and true: %s", counted, logged, logs.String())
+				}
+				if !strings.Contains(logs.String(), "path=/slow") || !strings.Contains(logs.String(), "duration_ms=") {
+					t.Errorf("the slow request log lacks the path or the duration: %s", logs.String())
+				}
+				return
+			}
+			if counted != 0 || logged {
+				t.Errorf("slow_requests_total increased by %v, warn logged %t, want 0 and false", counted, logged)
+			}
+		})
+	}
+}
+
+func TestMetricsReset(t *testing.T) {
+	tests := []struct {
+		name        string
+		debug       bool
+		environment string
+		apiKey      string
+		status      int
+		reset       bool
+	}{
+		{name: "debug endpoints enabled", debug: true, environment: "staging", apiKey: testApiKey, status: http.StatusOK, reset: true},
+		{name: "missing api key", debug: true, environment: "staging", status: http.StatusUnauthorized},
+		{name: "debug endpoints disabled", debug: false, environment: "staging", apiKey: testApiKey, status: http.StatusNotFound},
+		{name: "never in production", debug: true, environment: "production", apiKey: testApiKey, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, testConfigWith(map[string]interface{}{"DEBUG_ENDPOINTS": tt.debug, "ENVIRONMENT": tt.environment}))
+			_, url := startTestServer(t, testServerConfig(t))
+
+			commonmetrics.NumberOfConfigRequests.Inc()
+			before := testutil.ToFloat64(commonmetrics.NumberOfConfigRequests)
+			status, body := request(t, http.MethodPost, url+"/metrics/reset", tt.apiKey)
+			if status != tt.status {
+				t.Fatalf("POST /metrics/reset = %d, want %d: %s", status, tt.status, body)
+			}
+			after := testutil.ToFloat64(commonmetrics.NumberOfConfigRequests)
+			if tt.reset && after != 0 {
+				t.Errorf("config_requests_count = %v after the reset, want 0", after)
+			}
+			if !tt.reset && after != before {
+				t.Errorf("config_requests_count = %v, want it left at %v", after, before)
+			}
+		})
+	}
+}
+
+func TestMetricsPortZero(t *testing.T) {
+	tests := []struct {
+		name          string
+		metricsServer bool
+	}{
+		{name: "metrics port 0 disables the metrics server", metricsServer: false},
+		{name: "metrics port set starts the metrics server", metricsServer: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testServerConfig(t)
+			if tt.metricsServer {
+				cfg.MetricsPort = freePort(t)
+			}
+			_, url := startTestServer(t, cfg)
+
+			if status, body := request(t, http.MethodGet, url+"/metrics", ""); status != http.StatusOK || !strings.Contains(body, "go_goroutines") {
+				t.Errorf("GET /metrics on the API port = %d, want 200 with the metrics", status)
+			}
+			started := strings.Contains(logs.String(), "Starting Prometheus Metrics Listener")
+			disabled := strings.Contains(logs.String(), "METRICS_PORT is 0: metrics server disabled")
+			if started != tt.metricsServer || disabled == tt.metricsServer {
+				t.Errorf("metrics server started %t, disabled logged %t, want started %t", started, disabled, tt.metricsServer)
+			}
+			if !tt.metricsServer {
+				return
+			}
+			metricsURL := fmt.Sprintf("http://127.0.0.1:%d/metrics", cfg.MetricsPort)
+			var status int
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if resp, err := http.Get(metricsURL); err == nil {
+					status = resp.StatusCode
+					resp.Body.Close()
+					break
+				}
+			}
+			if status != http.StatusOK {
+				t.Errorf("GET /metrics on the metrics port = %d, want 200", status)
+			}
+		})
+	}
+}
+
+func TestAddRoute(t *testing.T) {
+	server, url := startTestServer(t, testServerConfig(t))
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		wantErr bool
+		request string
+		status  int
+		body    string
+	}{
+		{name: "new route", path: "/plugin", handler: textHandler("plugin"), request: "GET /plugin", status: http.StatusOK, body: "plugin"},
+		{name: "new method route", path: "POST /plugin/items", handler: textHandler("created"), request: "POST /plugin/items", status: http.StatusOK, body: "created"},
+		{name: "duplicate route", path: "/plugin", handler: textHandler("again"), wantErr: true, request: "GET /plugin", status: http.StatusOK, body: "plugin"},
+		{name: "built-in route", path: "/ping", handler: textHandler("pong"), wantErr: true},
+		{name: "nil handler", path: "/nil", wantErr: true, request: "GET /nil", status: http.StatusNotFound},
+		{name: "invalid method", path: "FETCH /plugin", handler: textHandler("fetch"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := server.AddRoute(tt.path, tt.handler)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddRoute(%q) error = %v, want error %t", tt.path, err, tt.wantErr)
+			}
+			if tt.request == "" {
+				return
+			}
+			method, path, _ := strings.Cut(tt.request, " ")
+			status, body := request(t, method, url+path, "")
+			if status != tt.status || (tt.body != "" && body != tt.body) {
+				t.Errorf("%s = %d %q, want %d %q", tt.request, status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestMetricsJSON(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t))
+	commonmetrics.NumberOfStatusRequests.Inc()
+	tests := []struct {
+		name   string
+		apiKey string
+		status int
+	}{
+		{name: "with api key", apiKey: testApiKey, status: http.StatusOK},
+		{name: "without api key", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(t, http.MethodGet, url+"/metrics.json", tt.apiKey)
+			if status != tt.status {
+				t.Fatalf("GET /metrics.json = %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			var families []commonmetrics.MetricFamily
+			if err := json.Unmarshal([]byte(body), &families); err != nil {
+				t.Fatalf("invalid JSON %q: %v", body, err)
+			}
+			want := testutil.ToFloat64(commonmetrics.NumberOfStatusRequests)
+			for _, family := range families {
+				if family.Name == "svc_status_requests_count" {
+					if got := family.Metrics[0].Value; got == nil || *got != want {
+						t.Errorf("svc_status_requests_count = %v, want %v", got, want)
+					}
+					return
+				}
+			}
+			t.Error("svc_status_requests_count missing from /metrics.json")
+		})
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	tests := []struct {
+		name          string
+		metricsServer bool
+		inFlight      bool
+		fields        []string
+	}{
+		{name: "api server only", fields: []string{
+			"api_server_stopped=true", "metrics_server_stopped=false", "in_flight_requests=0",
+			"in_flight_requests_completed=true", "scheduler_stopped=true", "jobs_drained=0", "mq_closed=false",
+		}},
+		{name: "with metrics server", metricsServer: true, fields: []string{"api_server_stopped=true", "metrics_server_stopped=true"}},
+		{name: "in-flight request completed", inFlight: true, fields: []string{"in_flight_requests=1", "in_flight_requests_completed=true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testServerConfig(t)
+			if tt.metricsServer {
+				cfg.MetricsPort = freePort(t)
+			}
+			started := make(chan struct{})
+			slow := func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+			}
+			server, url := startTestServer(t, cfg, Routes(Route{Path: "/slow", Handler: slow}))
+
+			var wg sync.WaitGroup
+			if tt.inFlight {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					request(t, http.MethodGet, url+"/slow", "")
+				}()
+				<-started
+			}
+			server.Shutdown(nil)
+			waitDone(t, server)
+			wg.Wait()
+
+			var summary string
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, "Shutdown summary") {
+					summary = line
+				}
+			}
+			if summary == "" {
+				t.Fatalf("no shutdown summary logged: %s", logs.String())
+			}
+			for _, field := range tt.fields {
+				if !strings.Contains(summary, field) {
+					t.Errorf("summary lacks %s: %s", field, summary)
+				}
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	tests := []struct {
+		name      string
+		h2c       bool
+		client    *http.Client
+		wantProto string
+	}{
+		{name: "h2c with prior knowledge", h2c: true, client: h2cClient, wantProto: "HTTP/2.0"},
+		{name: "HTTP/1.1 still served with h2c", h2c: true, client: http.DefaultClient, wantProto: "HTTP/1.1"},
+		{name: "h2c disabled", h2c: false, client: h2cClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := startTestServer(t, testServerConfig(t), WithH2C(tt.h2c))
+
+			resp, err := tt.client.Get(url + "/ping")
+			if tt.wantProto == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("h2c request to a server without h2c succeeded with %s", resp.Proto)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GET /ping failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Proto != tt.wantProto {
+				t.Errorf("GET /ping = %d over %s, want 200 over %s", resp.StatusCode, resp.Proto, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestLogLevelOnMetricsPort(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		apiKey     string
+		wantStatus int
+		wantLevel  string
+	}{
+		{name: "changes the level with the API key", enabled: true, apiKey: testApiKey, wantStatus: http.StatusOK, wantLevel: "DEBUG"},
+		{name: "requires the API key", enabled: true, wantStatus: http.StatusUnauthorized, wantLevel: "INFO"},
+		{name: "not served when disabled", enabled: false, apiKey: testApiKey, wantStatus: http.StatusNotFound, wantLevel: "INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commonlogger.SetLogLevel("INFO")
+			t.Cleanup(func() { commonlogger.SetLogLevel("INFO") })
+			cfg := testServerConfig(t)
+			cfg.MetricsPort = freePort(t)
+			cfg.LogLevelOnMetricsPort = tt.enabled
+			startTestServer(t, cfg)
+
+			metricsURL := fmt.Sprintf("http://127.0.0.1:%d", cfg.MetricsPort)
+			waitListening(t, cfg.MetricsPort)
+			status, body := request(t, http.MethodPut, metricsURL+"/loglevel?level=debug", tt.apiKey)
+			if status != tt.wantStatus {
+				t.Errorf("PUT /loglevel on the metrics port = %d %s, want %d", status, body, tt.wantStatus)
+			}
+			if got := commonlogger.GetLogLevel().Level().String(); got != tt.wantLevel {
+				t.Errorf("log level = %s, want %s", got, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		name     string
+		portUsed bool
+		err      string
+	}{
+		{name: "returns nil after SIGTERM"},
+		{name: "returns the bind error when the port is in use", portUsed: true, err: "failed to bind API listener"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testServerConfig(t)
+			if tt.portUsed {
+				listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+				if err != nil {
+					t.Fatalf("listen failed: %v", err)
+				}
+				defer listener.Close()
+			}
+			served := make(chan error, 1)
+			go func() { served <- Serve(cfg) }()
+
+			if !tt.portUsed {
+				url := fmt.Sprintf("http://127.0.0.1:%d/ping", cfg.Port)
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					if resp, err := http.Get(url); err == nil {
+						resp.Body.Close()
+						break
+					}
+				}
+				http.DefaultClient.CloseIdleConnections()
+				if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+					t.Fatalf("SIGTERM failed: %v", err)
+				}
+			}
+			select {
+			case err := <-served:
+				if tt.err == "" && err != nil {
+					t.Errorf("Serve() = %v, want nil", err)
+				}
+				if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+					t.Errorf("Serve() = %v, want an error with %q", err, tt.err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Serve did not return")
+			}
+		})
+	}
+}
+
+func TestProtectedMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		protected  bool
+		apiKey     string
+		wantStatus int
+	}{
+		{name: "unprotected by default", wantStatus: http.StatusOK},
+		{name: "protected without the API key", protected: true, wantStatus: http.StatusUnauthorized},
+		{name: "protected with a wrong API key", protected: true, apiKey: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "protected with the API key", protected: true, apiKey: testApiKey, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testServerConfig(t)
+			cfg.MetricsPort = freePort(t)
+			_, url := startTestServer(t, cfg, WithProtectedMetrics(tt.protected))
+			waitListening(t, cfg.MetricsPort)
+
+			for _, metricsURL := range []string{url + "/metrics", fmt.Sprintf("http://127.0.0.1:%d/metrics", cfg.MetricsPort)} {
+				if status, _ := request(t, http.MethodGet, metricsURL, tt.apiKey); status != tt.wantStatus {
+					t.Errorf("GET %s = %d, want %d", metricsURL, status, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestFeaturesLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		config func(cfg *commonconfig.BaseConfig)
+		fields []string
+	}{
+		{name: "defaults", fields: []string{"h2c=false", "protected_metrics=false", "reuse_port=false", "metrics_server=false", "static_dirs=false"}},
+		{name: "options enabled", opts: []Option{WithH2C(true), WithProtectedMetrics(true)},
+			fields: []string{"h2c=true", "protected_metrics=true", "reuse_port=false"}},
+		{name: "config enabled", config: func(cfg *commonconfig.BaseConfig) {
+			cfg.MetricsPort = freePort(t)
+			cfg.LogLevelOnMetricsPort = true
+			cfg.MaxConnections = 10
+		}, fields: []string{"metrics_server=true", "loglevel_on_metrics_port=true", "connection_limit=true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testServerConfig(t)
+			if tt.config != nil {
+				tt.config(cfg)
+			}
+			startTestServer(t, cfg, tt.opts...)
+
+			var record string
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, "API features") {
+					record = line
+				}
+			}
+			if record == "" {
+				t.Fatalf("no features record logged: %s", logs.String())
+			}
+			for _, field := range tt.fields {
+				if !strings.Contains(record, field) {
+					t.Errorf("features record lacks %s: %s", field, record)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlersWithoutInitializeMetrics(t *testing.T) {
+	if os.Getenv(withoutMetricsEnv) == "" {
+		// The metrics of this process are initialized, so the handlers run in a new one
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHandlersWithoutInitializeMetrics$", "-test.v")
+		cmd.Env = append(os.Environ(), withoutMetricsEnv+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil || !strings.Contains(string(out), "--- PASS") {
+			t.Fatalf("handlers failed without InitializeMetrics: %v\n%s", err, out)
+		}
+		return
+	}
+	routes := defaultRoutes(commonconfig.GetConfig())
+	tests := []struct {
+		name   string
+		route  string
+		apiKey string
+		status int
+	}{
+		{name: "ping", route: "GET /ping", status: http.StatusOK},
+		{name: "health", route: "GET /health", status: http.StatusOK},
+		{name: "unauthorized", route: "GET /status", status: http.StatusUnauthorized},
+		{name: "invalid log level", route: "PUT /loglevel", apiKey: testApiKey, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, path, _ := strings.Cut(tt.route, " ")
+			req := httptest.NewRequest(method, path+"?level=loud", nil)
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-KEY", tt.apiKey)
+			}
+			rec := httptest.NewRecorder()
+			WithAccessLog(path, routes[tt.route])(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("%s = %d, want %d", tt.route, rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+// fixedClock is a utilities.Clock stopped at a given time
+type fixedClock struct{ now time.Time }
+
+func (c fixedClock) Now() time.Time { return c.now }
+
+func TestPingClock(t *testing.T) {
+	t.Cleanup(func() { utilities.SetClock(nil) })
+	start := time.Date(2030, 5, 17, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		offset    time.Duration
+		timestamp string
+	}{
+		{name: "at the fake time", timestamp: "2030-05-17T08:30:00Z"},
+		{name: "after the fake clock moved", offset: 90 * time.Second, timestamp: "2030-05-17T08:31:30Z"},
+	}
+	var firstUptime float64
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			utilities.SetClock(fixedClock{now: start.Add(tt.offset)})
+			w := httptest.NewRecorder()
+			pingHandler(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+			var response struct {
+				Timestamp string  `json:"timestamp"`
+				Uptime    float64 `json:"uptime_seconds"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid ping response %q: %v", w.Body.String(), err)
+			}
+			if response.Timestamp != tt.timestamp {
+				t.Errorf("timestamp = %s, want %s", response.Timestamp, tt.timestamp)
+			}
+			if i == 0 {
+				firstUptime = response.Uptime
+			} else if got := response.Uptime - firstUptime; math.Abs(got-tt.offset.Seconds()) > 1e-3 {
+				t.Errorf("uptime grew by %v seconds, want %v", got, tt.offset.Seconds())
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t), WithH2C(true))
+	tests := []struct {
+		name    string
+		path    string
+		apiKey  string
+		status  int
+		fields  []string
+		missing []string
+	}{
+		{name: "info", path: "/info", apiKey: testApiKey, status: http.StatusOK,
+			fields: []string{"service", "version", "build_commit", "build_time", "go_version", "started_at", "uptime_seconds", "features"}},
+		{name: "info requires the API key", path: "/info", status: http.StatusUnauthorized},
+		{name: "ping stays minimal", path: "/ping", status: http.StatusOK,
+			fields: []string{"service", "timestamp", "status"}, missing: []string{"features", "go_version", "build_commit"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(t, http.MethodGet, url+tt.path, tt.apiKey)
+			if status != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			var document map[string]interface{}
+			if err := json.Unmarshal([]byte(body), &document); err != nil {
+				t.Fatalf("invalid document %q: %v", body, err)
+			}
+			for _, key := range tt.fields {
+				if _, ok := document[key]; !ok {
+					t.Errorf("%s has no %s: %s", tt.path, key, body)
+				}
+			}
+			for _, key := range tt.missing {
+				if _, ok := document[key]; ok {
+					t.Errorf("%s has %s: %s", tt.path, key, body)
+				}
+			}
+			if features, ok := document["features"].(map[string]interface{}); ok && (features["h2c"] != true || document["service"] != "svc") {
+				t.Errorf("features = %v, service = %v, want h2c enabled and svc", features, document["service"])
+			}
+		})
+	}
+}
+
+func TestApiKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(keyFile, []byte("  file-key-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, testConfigWith(map[string]interface{}{"API_KEY_FILE": keyFile}))
+	handler := WithAPIKey(textHandler("ok"))
+	steps := []struct {
+		name    string
+		rotate  string
+		allowed map[string]bool
+	}{
+		{name: "file key takes precedence over API_KEY", allowed: map[string]bool{"file-key-1": true, testApiKey: false, "": false}},
+		{name: "rotated key applies after a reload", rotate: "file-key-2", allowed: map[string]bool{"file-key-2": true, "file-key-1": false}},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if step.rotate != "" {
+				if err := os.WriteFile(keyFile, []byte(step.rotate), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := commonconfig.Reload(); err != nil {
+					t.Fatalf("Reload() error = %v", err)
+				}
+			}
+			for key, allowed := range step.allowed {
+				req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+				req.Header.Set("X-API-KEY", key)
+				w := httptest.NewRecorder()
+				handler(w, req)
+				if (w.Code == http.StatusOK) != allowed {
+					t.Errorf("key %q got %d, allowed %t", key, w.Code, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t), RouteMap{
+		"GET /orders":  textHandler("list"),
+		"POST /orders": textHandler("create"),
+		MethodRoute(AnyMethod, "/any"): func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Method))
+		},
+	})
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		allow  string
+	}{
+		{name: "ping", path: "/ping", status: http.StatusNoContent, allow: "GET"},
+		{name: "several methods", path: "/orders", status: http.StatusNoContent, allow: "GET, POST"},
+		{name: "any method route handles OPTIONS itself", path: "/any", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodOptions, url+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("OPTIONS %s failed: %v", tt.path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("OPTIONS %s status = %d, want %d", tt.path, resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.allow {
+				t.Errorf("OPTIONS %s Allow = %q, want %q", tt.path, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestJobTagFilter(t *testing.T) {
+	noop := func() {}
+	commonscheduler.InitScheduler([]commonscheduler.CronJob{
+		{Name: "report", CronExpr: "0 0 1 1 *", Job: noop, Tags: []string{"custom", "reports"}},
+		{Name: "cleanup", CronExpr: "0 0 1 1 *", Job: noop, Tags: []string{"custom"}},
+		{Name: "export", CronExpr: "0 0 1 1 *", Job: noop, Tags: []string{"reports"}},
+	})
+	t.Cleanup(func() { commonscheduler.Shutdown() })
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		jobs   []string
+	}{
+		{name: "no filter", query: "", status: http.StatusOK, jobs: []string{"cleanup", "export", "heartbeatjob", "report"}},
+		{name: "one tag", query: "?tag=custom", status: http.StatusOK, jobs: []string{"cleanup", "report"}},
+		{name: "any of several tags", query: "?tag=custom&tag=reports", status: http.StatusOK, jobs: []string{"cleanup", "export", "report"}},
+		{name: "all of several tags", query: "?tag=custom,reports&match=all", status: http.StatusOK, jobs: []string{"report"}},
+		{name: "unknown tag", query: "?tag=missing", status: http.StatusOK, jobs: []string{}},
+		{name: "invalid match", query: "?tag=custom&match=some", status: http.StatusBadRequest},
+	}
+	endpoints := map[string]http.HandlerFunc{"/scheduledjobs": scheduledJobsHandler, "/runningjobs": runningJobsHandler}
+	for path, handler := range endpoints {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodGet, path+tt.query, nil))
+				if w.Code != tt.status {
+					t.Fatalf("GET %s%s status = %d, want %d", path, tt.query, w.Code, tt.status)
+				}
+				if tt.status != http.StatusOK {
+					return
+				}
+				var jobs []struct{ Name string }
+				if err := json.Unmarshal(w.Body.Bytes(), &jobs); err != nil {
+					t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+				}
+				names := []string{}
+				for _, job := range jobs {
+					names = append(names, job.Name)
+				}
+				sort.Strings(names)
+				if !reflect.DeepEqual(names, tt.jobs) {
+					t.Errorf("GET %s%s jobs = %v, want %v", path, tt.query, names, tt.jobs)
+				}
+			})
+		}
+	}
+}
+
+func TestTwoServers(t *testing.T) {
+	first, second := testServerConfig(t), testServerConfig(t)
+	first.MetricsPort, second.MetricsPort = freePort(t), freePort(t)
+	_, firstUrl := startTestServer(t, first, Routes(Route{Path: "/first", Handler: textHandler("first")}))
+	_, secondUrl := startTestServer(t, second, Routes(Route{Path: "/second", Handler: textHandler("second")}))
+	waitListening(t, first.MetricsPort)
+	waitListening(t, second.MetricsPort)
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{name: "first route on the first server", url: firstUrl + "/first", status: http.StatusOK},
+		{name: "second route on the second server", url: secondUrl + "/second", status: http.StatusOK},
+		{name: "routes don't leak to the other server", url: firstUrl + "/second", status: http.StatusNotFound},
+		{name: "built-in routes on both servers", url: secondUrl + "/ping", status: http.StatusOK},
+		{name: "first metrics server", url: fmt.Sprintf("http://127.0.0.1:%d/metrics", first.MetricsPort), status: http.StatusOK},
+		{name: "second metrics server", url: fmt.Sprintf("http://127.0.0.1:%d/metrics", second.MetricsPort), status: http.StatusOK},
+		{name: "API routes are not on the metrics server", url: fmt.Sprintf("http://127.0.0.1:%d/first", first.MetricsPort), status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := request(t, http.MethodGet, tt.url, ""); status != tt.status {
+				t.Errorf("GET %s = %d, want %d", tt.url, status, tt.status)
+			}
+		})
+	}
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, "/ping", nil)); pattern != "" {
+		t.Errorf("the routes were registered on http.DefaultServeMux (%q)", pattern)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	if got := commonconfig.GetConfig().GetShutdownTimeout(); got != 10*time.Second {
+		t.Errorf("default GetShutdownTimeout() = %s, want 10s", got)
+	}
+	tests := []struct {
+		name     string
+		duration time.Duration
+		log      string
+		complete bool
+	}{
+		{name: "request completes within the timeout", duration: 100 * time.Millisecond, log: "API server shut down cleanly", complete: true},
+		{name: "request outlives the timeout", duration: 10 * time.Second, log: "Shutdown timed out after 1 seconds, closing the remaining requests"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testServerConfig(t)
+			cfg.ShutdownTimeoutSeconds = 1
+			started := make(chan struct{})
+			slow := func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(tt.duration):
+				case <-r.Context().Done():
+				}
+			}
+			server, url := startTestServer(t, cfg, Routes(Route{Path: "/slow", Handler: slow}))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// The request fails when the server closes it
+				if resp, err := http.Get(url + "/slow"); err == nil {
+					resp.Body.Close()
+				}
+			}()
+			<-started
+			begin := time.Now()
+			server.Shutdown(nil)
+			waitDone(t, server)
+			<-done
+			if elapsed := time.Since(begin); elapsed > 3*time.Second {
+				t.Errorf("shutdown took %s with a 1s timeout", elapsed)
+			}
+			for _, want := range []string{
+				"Granting in-flight requests 1 seconds to complete",
+				tt.log,
+				fmt.Sprintf("in_flight_requests_completed=%t", tt.complete),
+			} {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logs lack %q: %s", want, logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRoutesBuilder(t *testing.T) {
+	routes := Routes(
+		Route{Path: "/items", Handler: textHandler("list")},
+		Route{Method: http.MethodPost, Path: "/orders", Handler: textHandler("created")},
+		Route{Method: "delete", Path: "/orders", Handler: textHandler("deleted")},
+	)
+	for _, key := range []string{"GET /items", "POST /orders", "DELETE /orders"} {
+		if routes[key] == nil {
+			t.Errorf("Routes() lacks %q: %v", key, slices.Collect(maps.Keys(routes)))
+		}
+	}
+	_, url := startTestServer(t, testServerConfig(t), routes, RouteMap{"/bare": textHandler("bare")})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{name: "route without method is GET", method: http.MethodGet, path: "/items", status: http.StatusOK, body: "list"},
+		{name: "route without method rejects POST", method: http.MethodPost, path: "/items", status: http.StatusMethodNotAllowed, body: "Only GET allowed", allow: "GET"},
+		{name: "POST route", method: http.MethodPost, path: "/orders", status: http.StatusOK, body: "created"},
+		{name: "lower case method", method: http.MethodDelete, path: "/orders", status: http.StatusOK, body: "deleted"},
+		{name: "wrong verb", method: http.MethodGet, path: "/orders", status: http.StatusMethodNotAllowed, body: "Only DELETE, POST allowed", allow: "DELETE, POST"},
+		{name: "bare handler is GET only", method: http.MethodPut, path: "/bare", status: http.StatusMethodNotAllowed, allow: "GET"},
+		{name: "default routes are method-aware", method: http.MethodPost, path: "/ping", status: http.StatusMethodNotAllowed, allow: "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, url+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s failed: %v", tt.method, tt.path, err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.body) {
+				t.Errorf("%s %s = %d %q, want %d with %q", tt.method, tt.path, resp.StatusCode, body, tt.status, tt.body)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.allow {
+				t.Errorf("%s %s Allow = %q, want %q", tt.method, tt.path, got, tt.allow)
+			}
+		})
+	}
+}
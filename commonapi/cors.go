@@ -0,0 +1,70 @@
+package commonapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+)
+
+const (
+	// corsMethods are the methods WithCORS allows in preflight responses
+	corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	// corsHeaders are the request headers allowed in preflight responses
+	corsHeaders = "Content-Type, Authorization, X-API-Key, Idempotency-Key"
+)
+
+// corsOrigin returns the Access-Control-Allow-Origin value for the request, or "" when its
+// origin is not in CORS_ALLOWED_ORIGINS
+func corsOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range commonconfig.GetConfig().GetCORSAllowedOrigins() {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// writeCORSHeaders sets the CORS headers of the response when the origin is allowed.
+// Preflight responses also list the allowed methods and headers.
+func writeCORSHeaders(w http.ResponseWriter, r *http.Request, methods string) {
+	w.Header().Add("Vary", "Origin")
+	origin := corsOrigin(r)
+	if origin == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if isPreflight(r) {
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+}
+
+// WithCORS adds CORS headers for the origins in CORS_ALLOWED_ORIGINS and answers preflight requests
+// with 204. Wrap the routes the browser frontend calls in the overrides map, e.g.
+//
+//	commonapi.RouteMap{"POST /orders": commonapi.WithCORS(createOrder)}
+//
+// Preflight requests of method-specific routes are answered by the OPTIONS handling of the server.
+func WithCORS(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeCORSHeaders(w, r, corsMethods)
+		if isPreflight(r) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fn(w, r)
+	}
+}
@@ -0,0 +1,72 @@
+package commonapi
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name      string
+		origins   string
+		method    string
+		path      string
+		origin    string
+		preflight string
+		status    int
+		allowed   string
+		methods   string
+	}{
+		{name: "allowed origin", origins: "https://app.example, https://admin.example", method: http.MethodGet, path: "/any",
+			origin: "https://admin.example", status: http.StatusOK, allowed: "https://admin.example"},
+		{name: "other origin", origins: "https://app.example", method: http.MethodGet, path: "/any",
+			origin: "https://evil.example", status: http.StatusOK},
+		{name: "no origin", origins: "https://app.example", method: http.MethodGet, path: "/any", status: http.StatusOK},
+		{name: "wildcard", origins: "*", method: http.MethodGet, path: "/any",
+			origin: "https://anything.example", status: http.StatusOK, allowed: "*"},
+		{name: "preflight", origins: "https://app.example", method: http.MethodOptions, path: "/any", origin: "https://app.example",
+			preflight: http.MethodPut, status: http.StatusNoContent, allowed: "https://app.example", methods: corsMethods},
+		{name: "preflight of a method route", origins: "https://app.example", method: http.MethodOptions, path: "/orders", origin: "https://app.example",
+			preflight: http.MethodPost, status: http.StatusNoContent, allowed: "https://app.example", methods: "POST"},
+		{name: "preflight from another origin", origins: "https://app.example", method: http.MethodOptions, path: "/any", origin: "https://evil.example",
+			preflight: http.MethodPut, status: http.StatusNoContent},
+		{name: "method route from an allowed origin", origins: "https://app.example", method: http.MethodPost, path: "/orders",
+			origin: "https://app.example", status: http.StatusOK, allowed: "https://app.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, testConfigWith(map[string]interface{}{"CORS_ALLOWED_ORIGINS": tt.origins}))
+			_, url := startTestServer(t, testServerConfig(t), RouteMap{
+				MethodRoute(AnyMethod, "/any"): WithCORS(textHandler("any")),
+				"POST /orders":                 WithCORS(textHandler("created")),
+			})
+			req, err := http.NewRequest(tt.method, url+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.preflight)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s failed: %v", tt.method, tt.path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.allowed {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowed)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Methods"); got != tt.methods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.methods)
+			}
+			if tt.methods != "" && resp.Header.Get("Access-Control-Allow-Headers") != corsHeaders {
+				t.Errorf("Access-Control-Allow-Headers = %q, want %q", resp.Header.Get("Access-Control-Allow-Headers"), corsHeaders)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package commonapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+)
+
+// IdempotencyKeyHeader is the request header carrying the client-chosen idempotency key
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// CachedResponse is a response stored for an idempotency key
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// RequestHash is the SHA-256 of the request body the response was produced for
+	RequestHash string
+}
+
+// IdempotencyStore keeps the responses of idempotent requests until their TTL expires
+type IdempotencyStore interface {
+	Get(key string) (CachedResponse, bool)
+	Set(key string, response CachedResponse, ttl time.Duration)
+}
+
+type idempotencyEntry struct {
+	response CachedResponse
+	expires  time.Time
+}
+
+// MemoryIdempotencyStore is the default in-memory IdempotencyStore. It is local to the process,
+// so replicas behind a load balancer need a shared store instead.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]idempotencyEntry)}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (CachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return CachedResponse{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		return CachedResponse{}, false
+	}
+	return entry.response, true
+}
+
+func (s *MemoryIdempotencyStore) Set(key string, response CachedResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// Drop expired entries so keys that are never repeated don't pile up
+	for k, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.entries[key] = idempotencyEntry{response: response, expires: now.Add(ttl)}
+}
+
+// captureWriter records the response while writing it to the client
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// WithIdempotency replays the stored response when a request repeats an Idempotency-Key within ttl,
+// instead of running the handler again. Requests without the header always run the handler.
+// Keys are scoped to the caller, identified by its API key or Authorization header, and to the endpoint.
+// Reusing a key with a different request body gets 422 Unprocessable Entity, and a request arriving
+// while the first one with the same key is still running gets 409 Conflict.
+// Server errors (5xx) are not stored so that the client can retry them. A nil store uses an in-memory one.
+func WithIdempotency(store IdempotencyStore, ttl time.Duration, fn http.HandlerFunc) http.HandlerFunc {
+	if store == nil {
+		store = NewMemoryIdempotencyStore()
+	}
+	var (
+		inFlightMu sync.Mutex
+		inFlight   = map[string]bool{}
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" {
+			fn(w, r)
+			return
+		}
+		key := fmt.Sprintf("%s %s %s %s", hashHex([]byte(idempotencyPrincipal(r))), r.Method, r.URL.Path, idempotencyKey)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, ErrorResponse{Error: "Failed to read the request body"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := hashHex(body)
+
+		if cached, ok := store.Get(key); ok {
+			replayIdempotent(w, r, cached, requestHash)
+			return
+		}
+
+		inFlightMu.Lock()
+		if inFlight[key] {
+			inFlightMu.Unlock()
+			WriteJSONError(w, http.StatusConflict, ErrorResponse{Error: "A request with the same idempotency key is in progress"})
+			return
+		}
+		inFlight[key] = true
+		inFlightMu.Unlock()
+		defer func() {
+			inFlightMu.Lock()
+			delete(inFlight, key)
+			inFlightMu.Unlock()
+		}()
+
+		// The first request with the key may have completed between the lookup and taking the slot
+		if cached, ok := store.Get(key); ok {
+			replayIdempotent(w, r, cached, requestHash)
+			return
+		}
+
+		capture := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		fn(capture, r)
+		if capture.status >= http.StatusInternalServerError {
+			return
+		}
+		store.Set(key, CachedResponse{
+			Status:      capture.status,
+			Header:      w.Header().Clone(),
+			Body:        capture.body.Bytes(),
+			RequestHash: requestHash,
+		}, ttl)
+	}
+}
+
+// replayIdempotent writes the stored response of a repeated request, or 422 when its body differs
+func replayIdempotent(w http.ResponseWriter, r *http.Request, cached CachedResponse, requestHash string) {
+	if cached.RequestHash != requestHash {
+		WriteJSONError(w, http.StatusUnprocessableEntity, ErrorResponse{Error: "The idempotency key was already used with a different request body"})
+		return
+	}
+	commonlogger.Debug(fmt.Sprintf("Replaying response for idempotency key %s", r.Header.Get(IdempotencyKeyHeader)), "path", r.URL.Path)
+	for name, values := range cached.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(cached.Status)
+	w.Write(cached.Body)
+}
+
+// idempotencyPrincipal identifies the caller, so that a client reusing another client's key doesn't get
+// its response. It is hashed in the store key, which may live in a shared store.
+func idempotencyPrincipal(r *http.Request) string {
+	if apiKey := r.Header.Get("X-API-KEY"); apiKey != "" {
+		return "apikey:" + apiKey
+	}
+	return "authorization:" + r.Header.Get("Authorization")
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
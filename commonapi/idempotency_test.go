@@ -0,0 +1,190 @@
+package commonapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	type step struct {
+		key      string
+		apiKey   string
+		path     string
+		body     string
+		wait     time.Duration
+		status   int
+		replayed bool
+	}
+	tests := []struct {
+		name   string
+		failed bool
+		steps  []step
+		runs   int32
+	}{
+		{name: "repeated key replays the response", steps: []step{
+			{key: "k1", body: "a", status: http.StatusCreated},
+			{key: "k1", body: "a", status: http.StatusCreated, replayed: true},
+			{key: "k1", body: "a", status: http.StatusCreated, replayed: true},
+		}, runs: 1},
+		{name: "different keys", steps: []step{
+			{key: "k1", status: http.StatusCreated},
+			{key: "k2", status: http.StatusCreated},
+		}, runs: 2},
+		{name: "no key", steps: []step{
+			{status: http.StatusCreated},
+			{status: http.StatusCreated},
+		}, runs: 2},
+		{name: "key reused with another body", steps: []step{
+			{key: "k1", body: "a", status: http.StatusCreated},
+			{key: "k1", body: "b", status: http.StatusUnprocessableEntity},
+		}, runs: 1},
+		{name: "keys are scoped to the caller", steps: []step{
+			{key: "k1", apiKey: "alice", status: http.StatusCreated},
+			{key: "k1", apiKey: "bob", status: http.StatusCreated},
+		}, runs: 2},
+		{name: "keys are scoped to the endpoint", steps: []step{
+			{key: "k1", path: "/orders", status: http.StatusCreated},
+			{key: "k1", path: "/payments", status: http.StatusCreated},
+		}, runs: 2},
+		{name: "expired key runs again", steps: []step{
+			{key: "k1", status: http.StatusCreated},
+			{key: "k1", wait: 100 * time.Millisecond, status: http.StatusCreated},
+		}, runs: 2},
+		{name: "server errors are not stored", failed: true, steps: []step{
+			{key: "k1", status: http.StatusInternalServerError},
+			{key: "k1", status: http.StatusInternalServerError},
+		}, runs: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs atomic.Int32
+			handler := WithIdempotency(nil, 50*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+				runs.Add(1)
+				if tt.failed {
+					http.Error(w, "failed", http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("created"))
+			})
+			for i, s := range tt.steps {
+				time.Sleep(s.wait)
+				path := s.path
+				if path == "" {
+					path = "/orders"
+				}
+				req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(s.body))
+				if s.key != "" {
+					req.Header.Set(IdempotencyKeyHeader, s.key)
+				}
+				if s.apiKey != "" {
+					req.Header.Set("X-API-KEY", s.apiKey)
+				}
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+				if rec.Code != s.status {
+					t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, s.status)
+				}
+				if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != s.replayed {
+					t.Errorf("request %d: replayed = %t, want %t", i+1, replayed, s.replayed)
+				}
+				if s.replayed && rec.Body.String() != "created" {
+					t.Errorf("request %d: replayed body = %q, want %q", i+1, rec.Body.String(), "created")
+				}
+			}
+			if got := runs.Load(); got != tt.runs {
+				t.Errorf("handler ran %d times, want %d", got, tt.runs)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := WithIdempotency(nil, time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+		req.Header.Set(IdempotencyKeyHeader, "k1")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	first := make(chan int)
+	go func() { first <- request().Code }()
+	<-started
+	if got := request().Code; got != http.StatusConflict {
+		t.Errorf("concurrent request status = %d, want %d", got, http.StatusConflict)
+	}
+	close(release)
+	if got := <-first; got != http.StatusCreated {
+		t.Errorf("first request status = %d, want %d", got, http.StatusCreated)
+	}
+}
+
+// pausingStore is a memory store that can pause a lookup after it missed, until resumed
+type pausingStore struct {
+	*MemoryIdempotencyStore
+	pauseNextMiss atomic.Bool
+	paused        chan struct{}
+	resume        chan struct{}
+}
+
+func (s *pausingStore) Get(key string) (CachedResponse, bool) {
+	cached, ok := s.MemoryIdempotencyStore.Get(key)
+	if !ok && s.pauseNextMiss.CompareAndSwap(true, false) {
+		close(s.paused)
+		<-s.resume
+	}
+	return cached, ok
+}
+
+func TestIdempotencyCompletedDuringLookup(t *testing.T) {
+	store := &pausingStore{MemoryIdempotencyStore: NewMemoryIdempotencyStore(), paused: make(chan struct{}), resume: make(chan struct{})}
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var runs atomic.Int32
+	handler := WithIdempotency(store, time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		runs.Add(1)
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+		req.Header.Set(IdempotencyKeyHeader, "k1")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	first := make(chan int)
+	go func() { first <- request().Code }()
+	<-started
+	// The second request misses the store while the first one runs, then the first one completes
+	store.pauseNextMiss.Store(true)
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- request() }()
+	<-store.paused
+	close(release)
+	if got := <-first; got != http.StatusCreated {
+		t.Errorf("first request status = %d, want %d", got, http.StatusCreated)
+	}
+	close(store.resume)
+	rec := <-second
+	if rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("second request = %d replayed %q, want the replayed 201", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if got := runs.Load(); got != 1 {
+		t.Errorf("handler ran %d times, want 1", got)
+	}
+}
@@ -0,0 +1,122 @@
+package commonapi
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+)
+
+// responseRecorder wraps a ResponseWriter to capture the status code and response size
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytes     int
+	streaming bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush marks the response as streaming and forwards the flush when supported
+func (r *responseRecorder) Flush() {
+	r.streaming = true
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// activeRequests counts the requests currently being served by routes wrapped with WithAccessLog
+var activeRequests atomic.Int64
+
+// WithAccessLog logs every request with its status and duration at Debug level.
+// Requests slower than SLOW_REQUEST_THRESHOLD are logged at Warn level and counted in the
+// slow_requests_total metric. Streaming responses (handlers that flush) are excluded.
+func WithAccessLog(route string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+		start := time.Now()
+		recorder := newResponseRecorder(w)
+		fn(recorder, r)
+		duration := time.Since(start)
+
+		threshold := commonconfig.GetConfig().GetSlowRequestThreshold()
+		if threshold > 0 && duration > threshold && !recorder.streaming {
+			commonmetrics.SlowRequests.Inc()
+			commonlogger.Warn(fmt.Sprintf("Slow request: %s %s took %s", r.Method, r.URL.Path, duration),
+				"route", route, "path", r.URL.Path, "status", recorder.status, "duration_ms", duration.Milliseconds())
+			return
+		}
+		commonlogger.Debug(fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, recorder.status),
+			"route", route, "duration_ms", duration.Milliseconds(), "bytes", recorder.bytes)
+	}
+}
+
+// WithMetrics updates the HTTP metrics of the route: the in-flight requests gauge, the request
+// duration and response size histograms and the responses counter by status code. They are all
+// labeled with the route path, duration and status also with the request method, for RED dashboards.
+// The /metrics route is left out so that scrapes don't show up in the metrics.
+func WithMetrics(route string, fn http.HandlerFunc) http.HandlerFunc {
+	path := route
+	if _, p, err := splitRouteKey(route); err == nil {
+		path = p
+	}
+	if path == "/metrics" {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		commonmetrics.HTTPInflightRequests.Inc()
+		defer commonmetrics.HTTPInflightRequests.Dec()
+		observe := commonmetrics.ObserveDuration(commonmetrics.HTTPRequestDuration.WithLabelValues(path, r.Method))
+		recorder := newResponseRecorder(w)
+		fn(recorder, r)
+		observe()
+		commonmetrics.HTTPResponses.WithLabelValues(path, r.Method, strconv.Itoa(recorder.status)).Inc()
+		commonmetrics.HTTPResponseSize.WithLabelValues(path).Observe(float64(recorder.bytes))
+	}
+}
+
+// WithRecovery recovers from a panic in the handler so that it cannot take down the service:
+// the panic is logged with its stack trace, counted as an error and answered with a JSON 500.
+// http.ErrAbortHandler is let through, as it is the way to abort a response on purpose.
+func WithRecovery(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			commonmetrics.NumberOfErrors.Inc()
+			commonlogger.Error(fmt.Sprintf("Panic serving %s %s: %v", r.Method, r.URL.Path, rec), "stack", string(debug.Stack()))
+			WriteJSONError(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error"})
+		}()
+		fn(w, r)
+	}
+}
@@ -0,0 +1,175 @@
+package commonapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogram returns the sample count and sum of a histogram
+func histogram(t *testing.T, observer prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("failed to read the histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestInflightAndResponseSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    string
+		size     int
+		observed bool
+	}{
+		{name: "route", route: "/sized", size: 1234, observed: true},
+		{name: "method route", route: "POST /sized", size: 10, observed: true},
+		{name: "empty body", route: "/empty", observed: true},
+		{name: "metrics excluded", route: "/metrics", size: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, path, _ := splitRouteKey(tt.route)
+			sizes := commonmetrics.HTTPResponseSize.WithLabelValues(path)
+			count, sum := histogram(t, sizes)
+			idle := testutil.ToFloat64(commonmetrics.HTTPInflightRequests)
+			var inflight float64
+			handler := WithMetrics(tt.route, func(w http.ResponseWriter, r *http.Request) {
+				inflight = testutil.ToFloat64(commonmetrics.HTTPInflightRequests)
+				w.Write([]byte(strings.Repeat("x", tt.size)))
+			})
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+
+			want := idle
+			if tt.observed {
+				want++
+			}
+			if inflight != want {
+				t.Errorf("in-flight requests during the request = %v, want %v", inflight, want)
+			}
+			if got := testutil.ToFloat64(commonmetrics.HTTPInflightRequests); got != idle {
+				t.Errorf("in-flight requests after the request = %v, want %v", got, idle)
+			}
+			newCount, newSum := histogram(t, sizes)
+			wantCount, wantSum := count, sum
+			if tt.observed {
+				wantCount, wantSum = count+1, sum+float64(tt.size)
+			}
+			if newCount != wantCount || newSum != wantSum {
+				t.Errorf("response sizes = %d samples summing %v, want %d summing %v", newCount, newSum, wantCount, wantSum)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	_, url := startTestServer(t, testServerConfig(t), Routes(
+		Route{Path: "/boom", Handler: func(w http.ResponseWriter, r *http.Request) { panic("boom") }},
+		Route{Path: "/error", Handler: func(w http.ResponseWriter, r *http.Request) { panic(errors.New("broken")) }},
+		Route{Path: "/abort", Handler: func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }},
+	))
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		errors float64
+		log    string
+	}{
+		{name: "panic with a string", path: "/boom", status: http.StatusInternalServerError, errors: 1, log: "Panic serving GET /boom: boom"},
+		{name: "panic with an error", path: "/error", status: http.StatusInternalServerError, errors: 1, log: "Panic serving GET /error: broken"},
+		{name: "no panic", path: "/ping", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			before := testutil.ToFloat64(commonmetrics.NumberOfErrors)
+			status, body := request(t, http.MethodGet, url+tt.path, "")
+			if status != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, status, tt.status)
+			}
+			if got := testutil.ToFloat64(commonmetrics.NumberOfErrors) - before; got != tt.errors {
+				t.Errorf("error count increased by %v, want %v", got, tt.errors)
+			}
+			if tt.log == "" {
+				return
+			}
+			if !strings.Contains(body, `"error":"Internal server error"`) {
+				t.Errorf("body = %s, want a JSON error", body)
+			}
+			if !strings.Contains(logs.String(), tt.log) || !strings.Contains(logs.String(), "stack=") {
+				t.Errorf("logs lack %q with the stack: %s", tt.log, logs.String())
+			}
+		})
+	}
+
+	t.Run("aborted handler is not recovered", func(t *testing.T) {
+		if _, err := http.Get(url + "/abort"); err == nil {
+			t.Error("GET /abort succeeded, want the connection aborted")
+		}
+		// The service survives every panic
+		if status, _ := request(t, http.MethodGet, url+"/ping", ""); status != http.StatusOK {
+			t.Errorf("GET /ping after the panics = %d, want 200", status)
+		}
+	})
+}
+
+func TestREDMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   string
+		method  string
+		handler http.HandlerFunc
+		code    string
+		minimum float64
+	}{
+		{name: "implicit 200", route: "/red", method: http.MethodGet, handler: textHandler("ok"), code: "200"},
+		{name: "method route", route: "POST /red", method: http.MethodPost, code: "201",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) }},
+		{name: "server error", route: "/red/fail", method: http.MethodGet, code: "500",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "failed", http.StatusInternalServerError) }},
+		{name: "slow request", route: "/red/slow", method: http.MethodGet, code: "200", minimum: 0.05,
+			handler: func(w http.ResponseWriter, r *http.Request) { time.Sleep(50 * time.Millisecond) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, path, _ := splitRouteKey(tt.route)
+			durations := commonmetrics.HTTPRequestDuration.WithLabelValues(path, tt.method)
+			responses := commonmetrics.HTTPResponses.WithLabelValues(path, tt.method, tt.code)
+			count, sum := histogram(t, durations)
+			before := testutil.ToFloat64(responses)
+
+			WithMetrics(tt.route, tt.handler)(httptest.NewRecorder(), httptest.NewRequest(tt.method, path, nil))
+
+			newCount, newSum := histogram(t, durations)
+			if newCount-count != 1 {
+				t.Errorf("request duration observed %d times, want once", newCount-count)
+			}
+			if observed := newSum - sum; observed < tt.minimum {
+				t.Errorf("observed duration = %vs, want at least %vs", observed, tt.minimum)
+			}
+			if got := testutil.ToFloat64(responses) - before; got != 1 {
+				t.Errorf("responses with code %s increased by %v, want 1", tt.code, got)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	commonmetrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, series := range []string{
+		`svc_http_request_duration_seconds_count{method="POST",route="/red"}`,
+		`svc_http_responses_total{code="500",method="GET",route="/red/fail"}`,
+	} {
+		if !strings.Contains(w.Body.String(), series) {
+			t.Errorf("/metrics lacks %s", series)
+		}
+	}
+}
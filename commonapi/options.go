@@ -0,0 +1,93 @@
+package commonapi
+
+import (
+	"sort"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+)
+
+// Option customizes StartAPI. A RouteMap is an Option too: its routes are added to the default
+// routes, overriding the ones with the same key, so StartAPI(cfg, overrides) keeps working.
+type Option interface {
+	apply(*apiOptions)
+}
+
+type apiOptions struct {
+	routes           []RouteMap
+	h2c              bool
+	protectedMetrics bool
+	reusePort        bool
+	readiness        []*queueGate
+	static           []staticDir
+}
+
+type optionFunc func(*apiOptions)
+
+func (f optionFunc) apply(o *apiOptions) { f(o) }
+
+func (m RouteMap) apply(o *apiOptions) {
+	o.routes = append(o.routes, m)
+}
+
+func newAPIOptions(opts []Option) *apiOptions {
+	options := &apiOptions{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt.apply(options)
+		}
+	}
+	return options
+}
+
+// WithH2C enables HTTP/2 over cleartext (h2c) on the API server, both with prior knowledge and
+// through the HTTP/1.1 Upgrade header. HTTP/1.1 clients keep working.
+func WithH2C(enabled bool) Option {
+	return optionFunc(func(o *apiOptions) { o.h2c = enabled })
+}
+
+// WithProtectedMetrics requires the API key on /metrics, both on the metrics port and the API port.
+// It is off by default as Prometheus scrapers can't always send custom headers.
+func WithProtectedMetrics(enabled bool) Option {
+	return optionFunc(func(o *apiOptions) { o.protectedMetrics = enabled })
+}
+
+// WithReusePort binds the API listener with SO_REUSEPORT so that a new instance can bind the same port
+// before the old one exits, for zero-downtime deploys on a single host. The kernel then balances new
+// connections between the instances. It is supported on Linux and the BSDs (including macOS); on other
+// platforms StartAPI fails to bind. Note that on macOS and the BSDs the connections are not balanced:
+// the last instance that bound the port gets them.
+func WithReusePort(enabled bool) Option {
+	return optionFunc(func(o *apiOptions) { o.reusePort = enabled })
+}
+
+// features tells which optional features of the API are enabled
+func (o *apiOptions) features(cfg commonconfig.Config) map[string]bool {
+	return map[string]bool{
+		"h2c":                      o.h2c,
+		"protected_metrics":        o.protectedMetrics,
+		"reuse_port":               o.reusePort,
+		"metrics_server":           cfg.GetMetricsPort() != 0,
+		"loglevel_on_metrics_port": cfg.GetMetricsPort() != 0 && cfg.GetLogLevelOnMetricsPort(),
+		"debug_endpoints":          cfg.GetDebugEndpoints(),
+		"connection_limit":         cfg.GetMaxConnections() > 0,
+		"job_history":              cfg.GetJobHistorySize() > 0,
+		"queue_readiness":          len(o.readiness) > 0,
+		"static_dirs":              len(o.static) > 0,
+	}
+}
+
+// logFeatures logs a single record telling which optional features of the API are enabled
+func (o *apiOptions) logFeatures(cfg commonconfig.Config) {
+	features := o.features(cfg)
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]interface{}, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, name, features[name])
+	}
+	commonlogger.Info("API features", args...)
+}
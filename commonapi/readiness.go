@@ -0,0 +1,117 @@
+package commonapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+// queueStats inspects a queue; it is a variable so it can be replaced in tests
+var queueStats = commonmqengine.GetQueueStats
+
+// mqState reports the connection to RabbitMQ; it is a variable so it can be replaced in tests
+var mqState = commonmqengine.State
+
+// queueInspectTimeout bounds the inspection of a queue by a readiness probe, well under the probe timeouts
+var queueInspectTimeout = 2 * time.Second
+
+// queueGate keeps the service not ready until a queue has been inspected successfully
+type queueGate struct {
+	queue       string
+	maxMessages int
+	open        atomic.Bool
+	// inspecting is set while an inspection runs, so that slow probes don't pile up inspections
+	inspecting atomic.Bool
+}
+
+// queueInspection is the result of an inspection of the gate's queue
+type queueInspection struct {
+	stats commonmqengine.QueueStats
+	err   error
+}
+
+// WithQueueReadiness makes /readiness report not ready until the MQ engine has inspected the queue,
+// and, when maxMessages is not negative, until the queue holds at most maxMessages messages, e.g. to
+// drain an initial backlog first. Inspection errors count as not ready. Once passed, the gate stays open.
+func WithQueueReadiness(queue string, maxMessages int) Option {
+	return optionFunc(func(o *apiOptions) {
+		o.readiness = append(o.readiness, &queueGate{queue: queue, maxMessages: maxMessages})
+	})
+}
+
+// check reports whether the gate is open, with the reason when it is not. The queue is only inspected
+// while connected, and for at most queueInspectTimeout, so that a probe never waits for RabbitMQ.
+func (g *queueGate) check() (bool, string) {
+	if g.open.Load() {
+		return true, ""
+	}
+	if state := mqState(); state != commonmqengine.StateConnected {
+		return false, fmt.Sprintf("queue %s cannot be inspected: RabbitMQ is %s", g.queue, state)
+	}
+	if !g.inspecting.CompareAndSwap(false, true) {
+		return false, fmt.Sprintf("queue %s cannot be inspected: the previous inspection is still running", g.queue)
+	}
+	result := make(chan queueInspection, 1)
+	utilities.Go(func() {
+		var inspection queueInspection
+		func() {
+			defer g.inspecting.Store(false)
+			inspection.stats, inspection.err = queueStats(g.queue)
+		}()
+		result <- inspection
+	})
+	var inspection queueInspection
+	select {
+	case inspection = <-result:
+	case <-time.After(queueInspectTimeout):
+		return false, fmt.Sprintf("queue %s cannot be inspected: no answer after %s", g.queue, queueInspectTimeout)
+	}
+	stats, err := inspection.stats, inspection.err
+	if err != nil {
+		return false, fmt.Sprintf("queue %s cannot be inspected: %s", g.queue, err.Error())
+	}
+	if g.maxMessages >= 0 && stats.Messages > g.maxMessages {
+		return false, fmt.Sprintf("queue %s has %d messages, waiting for at most %d", g.queue, stats.Messages, g.maxMessages)
+	}
+	commonlogger.Info(fmt.Sprintf("Readiness gate for queue %s passed", g.queue), "messages", stats.Messages)
+	g.open.Store(true)
+	return true, ""
+}
+
+func readinessHandler(gates []*queueGate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reasons []string
+		startup := GetStartupState()
+		names := slices.Sorted(maps.Keys(startup.Subsystems))
+		for _, name := range names {
+			if subsystem := startup.Subsystems[name]; subsystem.Critical && subsystem.Status != SubsystemOK {
+				reasons = append(reasons, subsystem.Detail)
+			}
+		}
+		for _, gate := range gates {
+			if ready, reason := gate.check(); !ready {
+				reasons = append(reasons, reason)
+			}
+		}
+		if len(reasons) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "not ready", "reasons": reasons})
+			return
+		}
+		// A degraded service still serves traffic, so it stays ready
+		if startup.Status == SubsystemDegraded {
+			WriteJSONResponse(w, map[string]interface{}{"status": "degraded", "subsystems": startup.Subsystems})
+			return
+		}
+		WriteJSONResponse(w, map[string]string{"status": "ready"})
+	}
+}
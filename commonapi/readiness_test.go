@@ -0,0 +1,102 @@
+package commonapi
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
+)
+
+// fakeQueue replaces the connection state and the queue inspection of the readiness gates until the
+// end of the test, returning a function setting them from a step
+func fakeQueue(t *testing.T) func(step readinessStep) {
+	t.Helper()
+	useStartupState(t, commonmqengine.StateConnected, false)
+	var mu sync.Mutex
+	current := readinessStep{err: errors.New("not connected")}
+	previousStats, previousState := queueStats, mqState
+	queueStats = func(queue string) (commonmqengine.QueueStats, error) {
+		mu.Lock()
+		step := current
+		mu.Unlock()
+		time.Sleep(step.delay)
+		return commonmqengine.QueueStats{Name: queue, Messages: step.messages}, step.err
+	}
+	mqState = func() commonmqengine.ConnectionState {
+		mu.Lock()
+		defer mu.Unlock()
+		if current.mq == "" {
+			return commonmqengine.StateConnected
+		}
+		return current.mq
+	}
+	t.Cleanup(func() { queueStats, mqState = previousStats, previousState })
+	return func(step readinessStep) {
+		mu.Lock()
+		defer mu.Unlock()
+		current = step
+	}
+}
+
+// readinessStep is the state of RabbitMQ and the queue, and the /readiness response expected with them
+type readinessStep struct {
+	// mq is the connection state, connected when empty
+	mq       commonmqengine.ConnectionState
+	messages int
+	err      error
+	// delay is the time the inspection of the queue takes
+	delay time.Duration
+	// wait is the time to wait before the request
+	wait   time.Duration
+	status int
+	body   string
+}
+
+func TestQueueReadiness(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxMessages int
+		steps       []readinessStep
+	}{
+		{name: "reachable queue", maxMessages: -1, steps: []readinessStep{
+			{err: errors.New("connection refused"), status: http.StatusServiceUnavailable, body: "queue orders cannot be inspected: connection refused"},
+			{messages: 500, status: http.StatusOK, body: `"ready"`},
+			{err: errors.New("connection refused"), status: http.StatusOK, body: `"ready"`},
+		}},
+		{name: "broker down", maxMessages: -1, steps: []readinessStep{
+			{mq: commonmqengine.StateReconnecting, status: http.StatusServiceUnavailable, body: "queue orders cannot be inspected: RabbitMQ is reconnecting"},
+			{status: http.StatusOK, body: `"ready"`},
+		}},
+		{name: "slow inspection", maxMessages: -1, steps: []readinessStep{
+			{delay: 300 * time.Millisecond, status: http.StatusServiceUnavailable, body: "queue orders cannot be inspected: no answer after 50ms"},
+			{status: http.StatusServiceUnavailable, body: "the previous inspection is still running"},
+			{wait: 400 * time.Millisecond, status: http.StatusOK, body: `"ready"`},
+		}},
+		{name: "backlog drained", maxMessages: 10, steps: []readinessStep{
+			{messages: 500, status: http.StatusServiceUnavailable, body: "queue orders has 500 messages, waiting for at most 10"},
+			{messages: 10, status: http.StatusOK, body: `"ready"`},
+			{messages: 500, status: http.StatusOK, body: `"ready"`},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setStep := fakeQueue(t)
+			previous := queueInspectTimeout
+			queueInspectTimeout = 50 * time.Millisecond
+			t.Cleanup(func() { queueInspectTimeout = previous })
+			_, url := startTestServer(t, testServerConfig(t), WithQueueReadiness("orders", tt.maxMessages))
+			for i, step := range tt.steps {
+				setStep(step)
+				time.Sleep(step.wait)
+				status, body := request(t, http.MethodGet, url+"/readiness", "")
+				if status != step.status || !strings.Contains(body, step.body) {
+					t.Errorf("step %d: /readiness = %d %s, want %d with %s", i, status, body, step.status, step.body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package commonapi
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	tests := []struct {
+		name      string
+		reusePort bool
+		bindErr   bool
+	}{
+		{name: "second instance binds the same port", reusePort: true},
+		{name: "second instance fails without the option", reusePort: false, bindErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testServerConfig(t)
+			_, url := startTestServer(t, cfg, WithReusePort(tt.reusePort))
+
+			second, err := StartAPI(cfg, WithReusePort(tt.reusePort))
+			if tt.bindErr {
+				if err == nil || !strings.Contains(err.Error(), "failed to bind API listener") {
+					t.Fatalf("StartAPI() error = %v, want a bind error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StartAPI() error = %v", err)
+			}
+			// One instance exits, the other keeps serving the port
+			second.Shutdown(nil)
+			waitDone(t, second)
+			// The closed listener can linger in the SO_REUSEPORT group for a moment and reset a connection
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				var resp *http.Response
+				if resp, err = client.Get(url + "/ping"); err == nil {
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						t.Errorf("GET /ping after the first instance stopped = %d, want 200", resp.StatusCode)
+					}
+					return
+				}
+			}
+			t.Errorf("GET /ping after the first instance stopped failed: %v", err)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package commonapi
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
+)
+
+// SubsystemStatus is the status of a subsystem of the service
+type SubsystemStatus string
+
+const (
+	// SubsystemOK means the subsystem works
+	SubsystemOK SubsystemStatus = "ok"
+	// SubsystemDegraded means the subsystem failed but the service keeps running without it
+	SubsystemDegraded SubsystemStatus = "degraded"
+)
+
+// SubsystemState is the status of a subsystem with the reason it is degraded
+type SubsystemState struct {
+	Status SubsystemStatus `json:"status"`
+	Detail string          `json:"detail,omitempty"`
+	// Critical subsystems make the service not ready when they fail, instead of degraded
+	Critical bool `json:"critical"`
+}
+
+// StartupState aggregates the status of the subsystems: the service is degraded when one of them is
+type StartupState struct {
+	Status     SubsystemStatus           `json:"status"`
+	Subsystems map[string]SubsystemState `json:"subsystems"`
+}
+
+// mqRequired tells whether RabbitMQ is critical; it is a variable so it can be replaced in tests
+var mqRequired = commonmqengine.ConnectionRequired
+
+var (
+	subsystemsMu sync.Mutex
+	subsystems   = map[string]SubsystemState{}
+)
+
+// SetSubsystemStatus records the status of a subsystem the service can run without, e.g. a cache that
+// failed to start. A degraded subsystem is reported by /readiness and /status without making the service
+// not ready. RabbitMQ is reported on its own once the MQ engine is initialized.
+func SetSubsystemStatus(name string, status SubsystemStatus, detail string) {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	subsystems[name] = SubsystemState{Status: status, Detail: detail}
+}
+
+// GetStartupState returns the status of every subsystem. RabbitMQ is critical when the engine was
+// configured with RequireConnectionAtStartup, and degraded while disconnected otherwise.
+func GetStartupState() StartupState {
+	subsystemsMu.Lock()
+	state := StartupState{Status: SubsystemOK, Subsystems: maps.Clone(subsystems)}
+	subsystemsMu.Unlock()
+
+	if mq := mqState(); mq != commonmqengine.StateNotInitialized {
+		rabbitmq := SubsystemState{Status: SubsystemOK, Critical: mqRequired()}
+		if mq != commonmqengine.StateConnected {
+			rabbitmq.Status = SubsystemDegraded
+			rabbitmq.Detail = fmt.Sprintf("RabbitMQ is %s", mq)
+		}
+		state.Subsystems["rabbitmq"] = rabbitmq
+	}
+	for _, subsystem := range state.Subsystems {
+		if subsystem.Status != SubsystemOK {
+			state.Status = SubsystemDegraded
+		}
+	}
+	return state
+}
@@ -0,0 +1,110 @@
+package commonapi
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
+)
+
+// useStartupState replaces the RabbitMQ state and clears the subsystems, restoring them with the test
+func useStartupState(t *testing.T, mq commonmqengine.ConnectionState, required bool) {
+	t.Helper()
+	previousState, previousRequired := mqState, mqRequired
+	mqState = func() commonmqengine.ConnectionState { return mq }
+	mqRequired = func() bool { return required }
+	clearSubsystems := func() {
+		subsystemsMu.Lock()
+		defer subsystemsMu.Unlock()
+		clear(subsystems)
+	}
+	clearSubsystems()
+	t.Cleanup(func() {
+		mqState, mqRequired = previousState, previousRequired
+		clearSubsystems()
+	})
+}
+
+func TestStartupState(t *testing.T) {
+	tests := []struct {
+		name       string
+		mq         commonmqengine.ConnectionState
+		mqRequired bool
+		degrade    string
+		// busyMetricsPort makes the metrics server fail to start
+		busyMetricsPort bool
+		wantStatus      SubsystemStatus
+		wantSubsystem   string
+		wantDetail      string
+		readiness       int
+		readinessBody   string
+	}{
+		{name: "everything started", mq: commonmqengine.StateNotInitialized, wantStatus: SubsystemOK,
+			readiness: http.StatusOK, readinessBody: `"ready"`},
+		{name: "rabbitmq connected", mq: commonmqengine.StateConnected, wantStatus: SubsystemOK,
+			readiness: http.StatusOK, readinessBody: `"ready"`},
+		{name: "rabbitmq degraded", mq: commonmqengine.StateReconnecting, wantStatus: SubsystemDegraded,
+			wantSubsystem: "rabbitmq", wantDetail: "RabbitMQ is reconnecting", readiness: http.StatusOK, readinessBody: `"degraded"`},
+		{name: "rabbitmq required and down", mq: commonmqengine.StateDisconnected, mqRequired: true, wantStatus: SubsystemDegraded,
+			wantSubsystem: "rabbitmq", wantDetail: "RabbitMQ is disconnected", readiness: http.StatusServiceUnavailable, readinessBody: "RabbitMQ is disconnected"},
+		{name: "subsystem reported degraded", mq: commonmqengine.StateNotInitialized, degrade: "cache", wantStatus: SubsystemDegraded,
+			wantSubsystem: "cache", wantDetail: "cache unreachable", readiness: http.StatusOK, readinessBody: `"degraded"`},
+		{name: "metrics server failed", mq: commonmqengine.StateNotInitialized, busyMetricsPort: true, wantStatus: SubsystemDegraded,
+			wantSubsystem: "metrics_server", wantDetail: "address already in use", readiness: http.StatusOK, readinessBody: `"degraded"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStartupState(t, tt.mq, tt.mqRequired)
+			cfg := testServerConfig(t)
+			if tt.busyMetricsPort {
+				listener, err := net.Listen("tcp", ":0")
+				if err != nil {
+					t.Fatalf("failed to occupy a port: %v", err)
+				}
+				t.Cleanup(func() { listener.Close() })
+				cfg.MetricsPort = listener.Addr().(*net.TCPAddr).Port
+			}
+			_, url := startTestServer(t, cfg)
+			if tt.degrade != "" {
+				SetSubsystemStatus(tt.degrade, SubsystemDegraded, tt.wantDetail)
+			}
+			if tt.busyMetricsPort {
+				for deadline := time.Now().Add(5 * time.Second); GetStartupState().Status == SubsystemOK && time.Now().Before(deadline); {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			// The service keeps serving whatever the state of its subsystems
+			if status, _ := request(t, http.MethodGet, url+"/ping", ""); status != http.StatusOK {
+				t.Errorf("GET /ping = %d, want 200", status)
+			}
+			status, body := request(t, http.MethodGet, url+"/readiness", "")
+			if status != tt.readiness || !strings.Contains(body, tt.readinessBody) {
+				t.Errorf("GET /readiness = %d %s, want %d with %s", status, body, tt.readiness, tt.readinessBody)
+			}
+
+			status, body = request(t, http.MethodGet, url+"/status", testApiKey)
+			if status != http.StatusOK {
+				t.Fatalf("GET /status = %d %s, want 200", status, body)
+			}
+			var got StartupState
+			if err := json.Unmarshal([]byte(body), &got); err != nil {
+				t.Fatalf("invalid /status body %s: %v", body, err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("/status status = %q, want %q", got.Status, tt.wantStatus)
+			}
+			if tt.wantSubsystem == "" {
+				return
+			}
+			subsystem, ok := got.Subsystems[tt.wantSubsystem]
+			if !ok || subsystem.Status != SubsystemDegraded || !strings.Contains(subsystem.Detail, tt.wantDetail) || subsystem.Critical != tt.mqRequired {
+				t.Errorf("/status subsystem %s = %+v, want degraded with %q", tt.wantSubsystem, subsystem, tt.wantDetail)
+			}
+		})
+	}
+}
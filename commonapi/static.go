@@ -0,0 +1,66 @@
+package commonapi
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// staticDir is a directory served by StartAPI under a URL prefix
+type staticDir struct {
+	prefix string
+	dir    string
+}
+
+// WithStaticDir serves the files of dir under urlPrefix, e.g. WithStaticDir("/docs", "./docs") serves
+// ./docs/changelog.html as /docs/changelog.html. The content type is inferred from the file extension.
+// Directories are only served through their index.html, never listed, and requests cannot reach
+// files outside of dir, neither with ".." nor through symlinks. The files are served without API key.
+func WithStaticDir(urlPrefix, dir string) Option {
+	return optionFunc(func(o *apiOptions) {
+		o.static = append(o.static, staticDir{prefix: "/" + strings.Trim(urlPrefix, "/"), dir: dir})
+	})
+}
+
+// route returns the route key and the handler serving the directory
+func (s staticDir) route() (string, http.HandlerFunc, error) {
+	// os.Root refuses paths escaping the directory, including through symlinks
+	root, err := os.OpenRoot(s.dir)
+	if err != nil {
+		return "", nil, err
+	}
+	pattern := strings.TrimSuffix(s.prefix, "/") + "/"
+	fileServer := http.FileServer(noListingFS{http.FS(root.FS())})
+	return "GET " + pattern, http.StripPrefix(strings.TrimSuffix(pattern, "/"), fileServer).ServeHTTP, nil
+}
+
+// noListingFS hides the directories without an index.html, so that http.FileServer answers 404
+// instead of listing them
+type noListingFS struct {
+	http.FileSystem
+}
+
+func (fsys noListingFS) Open(name string) (http.File, error) {
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return nil, err
+		}
+		// Including the paths refused by os.Root for escaping the directory
+		return nil, fs.ErrNotExist
+	}
+	stat, err := f.Stat()
+	if err != nil || !stat.IsDir() {
+		return f, err
+	}
+	index, err := fsys.FileSystem.Open(path.Join(name, "index.html"))
+	if err != nil {
+		f.Close()
+		return nil, fs.ErrNotExist
+	}
+	index.Close()
+	return f, nil
+}
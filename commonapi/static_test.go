@@ -0,0 +1,93 @@
+package commonapi
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticDir(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "docs")
+	files := map[string]string{
+		"docs/changelog.html":   "<h1>Changelog</h1>",
+		"docs/logo.png":         "\x89PNG\r\n\x1a\n",
+		"docs/notes/readme.txt": "notes",
+		"docs/guide/index.html": "<h1>Guide</h1>",
+		"secret.txt":            "secret",
+		"docs2/private.txt":     "private",
+	}
+	for name, content := range files {
+		path := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	_, url := startTestServer(t, testServerConfig(t), WithStaticDir("/docs/", dir))
+
+	tests := []struct {
+		name        string
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{name: "html file", path: "/docs/changelog.html", status: http.StatusOK, contentType: "text/html; charset=utf-8", body: "<h1>Changelog</h1>"},
+		{name: "image", path: "/docs/logo.png", status: http.StatusOK, contentType: "image/png"},
+		{name: "nested file", path: "/docs/notes/readme.txt", status: http.StatusOK, contentType: "text/plain; charset=utf-8", body: "notes"},
+		{name: "directory with an index", path: "/docs/guide/", status: http.StatusOK, body: "<h1>Guide</h1>"},
+		{name: "directory listing", path: "/docs/notes/", status: http.StatusNotFound},
+		{name: "root listing", path: "/docs/", status: http.StatusNotFound},
+		{name: "missing file", path: "/docs/missing.html", status: http.StatusNotFound},
+		{name: "traversal", path: "/docs/../secret.txt", status: http.StatusNotFound},
+		{name: "encoded traversal", path: "/docs/%2e%2e/secret.txt", status: http.StatusNotFound},
+		{name: "traversal to a sibling directory", path: "/docs/..%2fdocs2/private.txt", status: http.StatusNotFound},
+		{name: "symlink out of the directory", path: "/docs/link.txt", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(url + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", tt.path, err)
+			}
+			defer resp.Body.Close()
+			body := new(strings.Builder)
+			if _, err := io.Copy(body, resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+			}
+			if strings.Contains(body.String(), "secret") || strings.Contains(body.String(), "private") {
+				t.Errorf("GET %s leaked a file outside of the directory: %q", tt.path, body)
+			}
+			if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+				t.Errorf("GET %s Content-Type = %q, want %q", tt.path, resp.Header.Get("Content-Type"), tt.contentType)
+			}
+			if tt.body != "" && body.String() != tt.body {
+				t.Errorf("GET %s body = %q, want %q", tt.path, body, tt.body)
+			}
+		})
+	}
+
+	t.Run("unreadable file", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can read files without permission")
+		}
+		if err := os.WriteFile(filepath.Join(dir, "locked.html"), []byte("locked"), 0o000); err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := request(t, http.MethodGet, url+"/docs/locked.html", ""); status != http.StatusForbidden {
+			t.Errorf("GET /docs/locked.html = %d, want 403", status)
+		}
+	})
+}
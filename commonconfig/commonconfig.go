@@ -1,35 +1,115 @@
 package commonconfig
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
 	"github.com/spf13/viper"
 )
 
+// Config is read by every template package, so it grows whenever a setting is added. It is made of
+// role interfaces, so that code needing only some of the settings can depend on a smaller one, e.g.
+// a LogConfig. New settings always come with their getter on BaseConfig: a service config that embeds
+// BaseConfig keeps satisfying Config across upgrades, while one implementing it from scratch must add them.
 type Config interface {
+	ServiceConfig
+	ServerConfig
+	LogConfig
+	SchedulerConfig
+	RuntimeConfig
+}
+
+// ServiceConfig identifies the service and its API key
+type ServiceConfig interface {
 	GetVersion() string
-	GetLogLevel() string
 	GetServiceName() string
+	GetEnvironment() string
 	GetApiKey() string
-	GetMetricsPort() int
+	GetApiKeyFile() string
+}
+
+// ServerConfig holds the settings of the API and metrics servers
+type ServerConfig interface {
 	GetPort() int
+	GetMetricsPort() int
+	GetMaxHeaderBytes() int
+	GetMaxConnections() int
+	GetStartupBanner() bool
+	GetSlowRequestThreshold() time.Duration
+	GetDebugEndpoints() bool
+	GetLogLevelOnMetricsPort() bool
+	GetShutdownTimeout() time.Duration
+	GetCORSAllowedOrigins() []string
+}
+
+// LogConfig holds the settings of the logger
+type LogConfig interface {
+	GetLogLevel() string
+	GetLogSampleEvery() int
+	GetLogSampleInterval() time.Duration
+	GetLogTimeFormat() string
+	GetLogRedaction() bool
+	GetLogFormat() string
+}
+
+// SchedulerConfig holds the settings of the scheduler and its heartbeat
+type SchedulerConfig interface {
 	GetHeartBeatDebug() bool
 	GetHeartBeatCron() string
+	GetJobHistorySize() int
+	GetSchedulerJobs() []string
+}
+
+// RuntimeConfig holds the settings of the Go runtime and its monitoring
+type RuntimeConfig interface {
+	GetAutoMaxProcs() bool
+	GetGoroutineMonitorInterval() time.Duration
+	GetGoroutineThreshold() int
 }
 
+// A service config embeds BaseConfig (with `mapstructure:",squash"`), which already implements Config,
+// so the getters don't need to be written again. Add a compile-time check next to it so a broken
+// implementation is reported where the type is declared, e.g.:
+//
+//	var _ commonconfig.Config = (*ServiceConfig)(nil)
+var _ Config = (*BaseConfig)(nil)
+
 type BaseConfig struct {
-	Version        string `mapstructure:"VERSION"`
-	LogLevel       string `mapstructure:"LOG_LEVEL"`
-	ServiceName    string `mapstructure:"SERVICE_NAME"`
-	ApiKey         string `mapstructure:"API_KEY" sensitive:"true"`
-	MetricsPort    int    `mapstructure:"METRICS_PORT"`
-	Port           int    `mapstructure:"PORT"`
-	HeartBeatDebug bool   `mapstructure:"HEARTBEAT_DEBUG"`
-	HeartBeatCron  string `mapstructure:"HEARTBEAT_CRON"`
+	Version                  string        `mapstructure:"VERSION"`
+	LogLevel                 string        `mapstructure:"LOG_LEVEL"`
+	ServiceName              string        `mapstructure:"SERVICE_NAME"`
+	ApiKey                   string        `mapstructure:"API_KEY" sensitive:"true"`
+	MetricsPort              int           `mapstructure:"METRICS_PORT"`
+	Port                     int           `mapstructure:"PORT"`
+	HeartBeatDebug           bool          `mapstructure:"HEARTBEAT_DEBUG"`
+	HeartBeatCron            string        `mapstructure:"HEARTBEAT_CRON"`
+	MaxHeaderBytes           int           `mapstructure:"MAX_HEADER_BYTES"`
+	MaxConnections           int           `mapstructure:"MAX_CONNECTIONS"`
+	StartupBanner            bool          `mapstructure:"STARTUP_BANNER"`
+	LogSampleEvery           int           `mapstructure:"LOG_SAMPLE_EVERY"`
+	LogSampleInterval        time.Duration `mapstructure:"LOG_SAMPLE_INTERVAL"`
+	SlowRequestThreshold     time.Duration `mapstructure:"SLOW_REQUEST_THRESHOLD"`
+	Environment              string        `mapstructure:"ENVIRONMENT"`
+	DebugEndpoints           bool          `mapstructure:"DEBUG_ENDPOINTS"`
+	LogTimeFormat            string        `mapstructure:"LOG_TIME_FORMAT"`
+	LogLevelOnMetricsPort    bool          `mapstructure:"LOGLEVEL_ON_METRICS_PORT"`
+	JobHistorySize           int           `mapstructure:"JOB_HISTORY_SIZE"`
+	AutoMaxProcs             bool          `mapstructure:"AUTO_MAXPROCS"`
+	LogRedaction             bool          `mapstructure:"LOG_REDACTION"`
+	ApiKeyFile               string        `mapstructure:"API_KEY_FILE"`
+	GoroutineMonitorInterval time.Duration `mapstructure:"GOROUTINE_MONITOR_INTERVAL"`
+	GoroutineThreshold       int           `mapstructure:"GOROUTINE_THRESHOLD"`
+	ShutdownTimeoutSeconds   int           `mapstructure:"SHUTDOWN_TIMEOUT_SECONDS"`
+	CORSAllowedOrigins       string        `mapstructure:"CORS_ALLOWED_ORIGINS"`
+	SchedulerJobs            string        `mapstructure:"SCHEDULER_JOBS"`
+	LogFormat                string        `mapstructure:"LOG_FORMAT"`
 }
 
 func (c *BaseConfig) GetVersion() string {
@@ -61,55 +141,494 @@ func (c *BaseConfig) GetHeartBeatCron() string {
 	return c.HeartBeatCron
 }
 
+func (c *BaseConfig) GetMaxHeaderBytes() int {
+	return c.MaxHeaderBytes
+}
+
+// GetMaxConnections returns the maximum number of concurrent connections accepted by the API server.
+// A value of 0 or less means unlimited.
+func (c *BaseConfig) GetMaxConnections() int {
+	return c.MaxConnections
+}
+
+func (c *BaseConfig) GetStartupBanner() bool {
+	return c.StartupBanner
+}
+
+func (c *BaseConfig) GetLogSampleEvery() int {
+	return c.LogSampleEvery
+}
+
+func (c *BaseConfig) GetLogSampleInterval() time.Duration {
+	return c.LogSampleInterval
+}
+
+func (c *BaseConfig) GetSlowRequestThreshold() time.Duration {
+	return c.SlowRequestThreshold
+}
+
+func (c *BaseConfig) GetEnvironment() string {
+	return c.Environment
+}
+
+// GetDebugEndpoints reports whether debug endpoints (e.g. /metrics/reset) are enabled.
+// They are always disabled in production, whatever DEBUG_ENDPOINTS says.
+func (c *BaseConfig) GetDebugEndpoints() bool {
+	return c.DebugEndpoints && !IsProduction(c.Environment)
+}
+
+// GetLogTimeFormat returns the log timestamp format: rfc3339, rfc3339nano, unix, unixmilli,
+// or empty for the handler default
+func (c *BaseConfig) GetLogTimeFormat() string {
+	return c.LogTimeFormat
+}
+
+// GetLogLevelOnMetricsPort reports whether the API-key protected /loglevel endpoint is also
+// served on the metrics port, for deployments that only expose that port internally
+func (c *BaseConfig) GetLogLevelOnMetricsPort() bool {
+	return c.LogLevelOnMetricsPort
+}
+
+// GetJobHistorySize returns the number of executions kept per scheduled job. 0 disables the history.
+func (c *BaseConfig) GetJobHistorySize() int {
+	return c.JobHistorySize
+}
+
+// GetAutoMaxProcs reports whether GOMAXPROCS is set from the container CPU limit at startup
+func (c *BaseConfig) GetAutoMaxProcs() bool {
+	return c.AutoMaxProcs
+}
+
+// GetApiKeyFile returns the path of the file the API key is read from, e.g. a mounted Kubernetes secret.
+// When set, the key in the file takes precedence over API_KEY.
+func (c *BaseConfig) GetApiKeyFile() string {
+	return c.ApiKeyFile
+}
+
+// GetGoroutineMonitorInterval returns how often the number of goroutines is sampled. 0 disables the monitor.
+func (c *BaseConfig) GetGoroutineMonitorInterval() time.Duration {
+	return c.GoroutineMonitorInterval
+}
+
+// GetGoroutineThreshold returns the number of goroutines above which the monitor logs a warning
+func (c *BaseConfig) GetGoroutineThreshold() int {
+	return c.GoroutineThreshold
+}
+
+// GetShutdownTimeout returns how long in-flight requests are given to complete on shutdown
+// before the server closes them
+func (c *BaseConfig) GetShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second
+}
+
+// GetCORSAllowedOrigins returns the origins allowed by commonapi.WithCORS, from the comma-separated
+// CORS_ALLOWED_ORIGINS. "*" allows every origin.
+func (c *BaseConfig) GetCORSAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(c.CORSAllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// GetSchedulerJobs returns the job specs declared in SCHEDULER_JOBS, separated by semicolons.
+// Each spec is "name|cron expression|handler", see commonscheduler.RegisterJobHandler.
+func (c *BaseConfig) GetSchedulerJobs() []string {
+	var specs []string
+	for _, spec := range strings.Split(c.SchedulerJobs, ";") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// GetLogFormat returns the format of the log records: text or json
+func (c *BaseConfig) GetLogFormat() string {
+	return c.LogFormat
+}
+
+func (c *BaseConfig) baseConfig() *BaseConfig {
+	return c
+}
+
+func (c *BaseConfig) setApiKey(key string) {
+	c.ApiKey = key
+}
+
+// loadApiKeyFile replaces the API key of the target with the content of API_KEY_FILE, if set.
+// It runs on every load so that a rotated secret is picked up by Reload.
+func loadApiKeyFile(target Config) error {
+	path := target.GetApiKeyFile()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading API_KEY_FILE: %w", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return fmt.Errorf("API_KEY_FILE %s is empty", path)
+	}
+	// The setter is promoted from BaseConfig, which every service config embeds
+	setter, ok := target.(interface{ setApiKey(string) })
+	if !ok {
+		return fmt.Errorf("API_KEY_FILE requires the config %T to embed BaseConfig", target)
+	}
+	setter.setApiKey(key)
+	return nil
+}
+
+// GetLogRedaction reports whether log attributes with sensitive keys are masked
+func (c *BaseConfig) GetLogRedaction() bool {
+	return c.LogRedaction
+}
+
+// IsProduction reports whether the environment name designates a production environment
+func IsProduction(environment string) bool {
+	switch strings.ToLower(strings.TrimSpace(environment)) {
+	case "prod", "production", "prd":
+		return true
+	}
+	return false
+}
+
+// ValidateConfigImplementation checks that the getters of c return sensible values.
+// All the problems found are returned joined in a single error.
+func ValidateConfigImplementation(c Config) error {
+	if c == nil {
+		return fmt.Errorf("config is nil")
+	}
+	var errs []error
+	if strings.TrimSpace(c.GetServiceName()) == "" {
+		errs = append(errs, fmt.Errorf("SERVICE_NAME must not be empty"))
+	}
+	if strings.TrimSpace(c.GetVersion()) == "" {
+		errs = append(errs, fmt.Errorf("VERSION must not be empty"))
+	}
+	if port := c.GetPort(); port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be between 1 and 65535, got %d", port))
+	}
+	// METRICS_PORT 0 disables the dedicated metrics server
+	if port := c.GetMetricsPort(); port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("METRICS_PORT must be between 0 and 65535, got %d", port))
+	}
+	if c.GetMetricsPort() != 0 && c.GetMetricsPort() == c.GetPort() {
+		errs = append(errs, fmt.Errorf("METRICS_PORT must differ from PORT (%d)", c.GetPort()))
+	}
+	if strings.TrimSpace(c.GetHeartBeatCron()) == "" {
+		errs = append(errs, fmt.Errorf("HEARTBEAT_CRON must not be empty"))
+	}
+	if c.GetMaxHeaderBytes() < 0 {
+		errs = append(errs, fmt.Errorf("MAX_HEADER_BYTES must not be negative, got %d", c.GetMaxHeaderBytes()))
+	}
+	if c.GetShutdownTimeout() <= 0 {
+		errs = append(errs, fmt.Errorf("SHUTDOWN_TIMEOUT_SECONDS must be positive, got %s", c.GetShutdownTimeout()))
+	}
+	return errors.Join(errs...)
+}
+
+// cpuQuota is the source of the CPU limit used by AUTO_MAXPROCS; it is a variable so it can be replaced in tests
+var cpuQuota utilities.CPUQuotaSource = utilities.CgroupCPUQuota
+
+// applyAutoMaxProcs sets GOMAXPROCS from the container CPU limit and logs the chosen value
+func applyAutoMaxProcs() {
+	procs, changed, err := utilities.SetMaxProcsFromQuota(cpuQuota)
+	if err != nil {
+		commonlogger.Warn(fmt.Sprintf("AUTO_MAXPROCS: could not read the CPU limit, keeping GOMAXPROCS=%d: %s", procs, err.Error()))
+		return
+	}
+	if !changed {
+		commonlogger.Info(fmt.Sprintf("AUTO_MAXPROCS: no CPU limit found, keeping GOMAXPROCS=%d", procs))
+		return
+	}
+	commonlogger.Info(fmt.Sprintf("AUTO_MAXPROCS: GOMAXPROCS set to %d from the CPU limit", procs))
+}
+
 var (
-	conf Config
-	once sync.Once
+	// conf is the target passed to Initialize, which Reload updates in place
+	conf        Config
+	initMu      sync.Mutex
+	initialized bool
+	reloadMu    sync.Mutex
+	loader      Loader
+
+	// published is the copy of conf returned by GetConfig. It is replaced, never modified, on every
+	// load so that readers never see a half updated config.
+	publishedMu sync.RWMutex
+	published   Config
 )
 
 func setConfig(c Config) {
 	conf = c
+	publish(copyConfig(c))
+}
+
+// publish makes c the config returned by GetConfig. c must not be modified afterwards.
+func publish(c Config) {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+	published = c
 }
 
+// GetConfig returns the current configuration. The value returned is not modified by Reload,
+// which publishes a new one instead, so call GetConfig again to see the reloaded settings.
 func GetConfig() Config {
-	return conf
+	publishedMu.RLock()
+	defer publishedMu.RUnlock()
+	return published
 }
 
-func Initialize(target Config) {
-	once.Do(func() {
-		// defaults
+// copyConfig returns a shallow copy of a config that is a pointer to a struct, or c itself otherwise
+func copyConfig(c Config) Config {
+	v := reflect.ValueOf(c)
+	if c == nil || v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return c
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return cp.Interface().(Config)
+}
+
+// ResetForTest clears the loaded configuration and the viper state so that Initialize
+// can load a different configuration. It is meant for test suites only.
+func ResetForTest() {
+	initMu.Lock()
+	defer initMu.Unlock()
+	initialized = false
+	setConfig(nil)
+	loader = nil
+	viper.Reset()
+	stopWatchingConfig()
+}
+
+// Loader loads the configuration into the target
+type Loader interface {
+	Load(target Config) error
+}
+
+// ViperLoader is the default Loader: it reads the .env file (toml) from the current or parent
+// directory and lets environment variables override its values. A missing file is not an error.
+// When CONFIG_FILE is set, that file is read instead, in the format of its extension, and it must exist.
+// Values are resolved with this precedence, from lowest to highest:
+//
+//	defaults < .env file < environment variables < Overrides
+type ViperLoader struct {
+	// Overrides are keyed like the config file, e.g. {"PORT": 9000}, and win over every other source
+	Overrides map[string]interface{}
+}
+
+func (l ViperLoader) Load(target Config) error {
+	configFile, configType, err := configFileFromEnv()
+	if err != nil {
+		return err
+	}
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		viper.SetConfigType(configType)
+	} else {
 		viper.SetConfigFile(".env")
 		viper.AddConfigPath(".")
 		viper.AddConfigPath("..")
 		viper.SetConfigType("toml")
-		viper.SetDefault("VERSION", "0.0.0")
-		viper.SetDefault("SERVICE_NAME", "servicetemplate")
-		viper.SetDefault("LOG_LEVEL", "INFO")
-		viper.SetDefault("METRICS_PORT", 9091)
-		viper.SetDefault("PORT", 8001)
-		viper.SetDefault("HEARTBEAT_DEBUG", false)
-		viper.SetDefault("HEARTBEAT_CRON", "*/1 * * * *")
-		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
-		viper.AutomaticEnv()
-
-		err := viper.ReadInConfig()
-		if err != nil {
-			// don't use logger here yet!
-			fmt.Fprintf(os.Stderr, "[commonconfig] Error loading config file: %s\n", err.Error())
-			os.Exit(1)
-		}
+	}
+	setDefaults(viper.GetViper())
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
+	bindEnvKeys(viper.GetViper(), target)
 
-		err = viper.Unmarshal(target)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[commonconfig] Error parsing config: %s\n", err.Error())
-			os.Exit(1)
+	if err := viper.ReadInConfig(); err != nil {
+		err = classifyConfigFileError(viper.ConfigFileUsed(), err)
+		if !errors.Is(err, ErrConfigFileNotFound) || configFile != "" {
+			return err
 		}
+		// A missing file is not fatal, the config then comes from the environment and the defaults.
+		// The logger is not configured yet at this point.
+		fmt.Fprintf(os.Stderr, "[commonconfig] %s, using environment variables and defaults\n", err.Error())
+	}
+	for key, value := range l.Overrides {
+		viper.Set(key, value)
+	}
+	if err := checkValueTypes(viper.GetViper(), target); err != nil {
+		return fmt.Errorf("error parsing config: %w", err)
+	}
+	if err := viper.Unmarshal(target); err != nil {
+		return fmt.Errorf("error parsing config: %w", err)
+	}
+	return loadApiKeyFile(target)
+}
+
+// MapLoader loads the configuration from an in-memory map keyed like the config file,
+// e.g. {"API_KEY": "1234"}. Defaults apply to missing keys. Useful for tests and alternative sources.
+type MapLoader map[string]interface{}
+
+func (m MapLoader) Load(target Config) error {
+	v := viper.New()
+	setDefaults(v)
+	for key, value := range m {
+		v.Set(key, value)
+	}
+	if err := checkValueTypes(v, target); err != nil {
+		return fmt.Errorf("error parsing config: %w", err)
+	}
+	if err := v.Unmarshal(target); err != nil {
+		return fmt.Errorf("error parsing config: %w", err)
+	}
+	return loadApiKeyFile(target)
+}
+
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("VERSION", "0.0.0")
+	v.SetDefault("SERVICE_NAME", "servicetemplate")
+	v.SetDefault("LOG_LEVEL", "INFO")
+	v.SetDefault("METRICS_PORT", 9091)
+	v.SetDefault("PORT", 8001)
+	v.SetDefault("HEARTBEAT_DEBUG", false)
+	v.SetDefault("HEARTBEAT_CRON", "*/1 * * * *")
+	v.SetDefault("MAX_HEADER_BYTES", 1<<20)
+	v.SetDefault("MAX_CONNECTIONS", 0)
+	v.SetDefault("STARTUP_BANNER", true)
+	v.SetDefault("LOG_SAMPLE_EVERY", 0)
+	v.SetDefault("LOG_SAMPLE_INTERVAL", "1s")
+	v.SetDefault("SLOW_REQUEST_THRESHOLD", "1s")
+	v.SetDefault("ENVIRONMENT", "production")
+	v.SetDefault("DEBUG_ENDPOINTS", false)
+	v.SetDefault("LOG_TIME_FORMAT", "")
+	v.SetDefault("LOGLEVEL_ON_METRICS_PORT", false)
+	v.SetDefault("JOB_HISTORY_SIZE", 20)
+	v.SetDefault("AUTO_MAXPROCS", false)
+	v.SetDefault("LOG_REDACTION", false)
+	v.SetDefault("API_KEY_FILE", "")
+	v.SetDefault("GOROUTINE_MONITOR_INTERVAL", "0s")
+	v.SetDefault("GOROUTINE_THRESHOLD", 10000)
+	v.SetDefault("SHUTDOWN_TIMEOUT_SECONDS", 10)
+	v.SetDefault("CORS_ALLOWED_ORIGINS", "")
+	v.SetDefault("SCHEDULER_JOBS", "")
+	v.SetDefault("LOG_FORMAT", "text")
+}
+
+// ErrApiKeyRequired is returned when the loaded configuration has no API key
+var ErrApiKeyRequired = errors.New("API_KEY is required")
+
+// Initialize loads the configuration into the target and exits the process if it fails, see InitializeE
+func Initialize(target Config) {
+	InitializeWithLoader(target, ViperLoader{})
+}
+
+// InitializeE is Initialize returning the error instead of exiting, for tests and callers that
+// handle the failure themselves. After a failure the configuration can be initialized again.
+func InitializeE(target Config) error {
+	return InitializeWithLoaderE(target, ViperLoader{})
+}
+
+// InitializeWithOverrides is Initialize with explicit values that take precedence over the
+// .env file and the environment variables, e.g. to pin settings in tests. See ViperLoader.
+// The overrides still apply when the config is reloaded.
+func InitializeWithOverrides(target Config, overrides map[string]interface{}) {
+	InitializeWithLoader(target, ViperLoader{Overrides: overrides})
+}
+
+// InitializeWithLoader loads the configuration with the given loader instead of the default viper one.
+// The same loader is used by Reload. It exits the process if the configuration cannot be loaded.
+func InitializeWithLoader(target Config, configLoader Loader) {
+	if err := InitializeWithLoaderE(target, configLoader); err != nil {
+		// the logger may not be configured, write to stderr
+		fmt.Fprintf(os.Stderr, "[commonconfig] %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// InitializeWithLoaderE is InitializeWithLoader returning the error instead of exiting.
+// Only the first successful call loads the configuration, the next ones do nothing.
+func InitializeWithLoaderE(target Config, configLoader Loader) error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if initialized {
+		return nil
+	}
+	if err := configLoader.Load(target); err != nil {
+		return err
+	}
+	if err := ValidateConfigImplementation(target); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if target.GetApiKey() == "" {
+		return ErrApiKeyRequired
+	}
+
+	loader = configLoader
+	setConfig(target)
+	initialized = true
+	applyLogSettings(conf)
+	if conf.GetAutoMaxProcs() {
+		applyAutoMaxProcs()
+	}
+	commonlogger.Debug("Successfully Loaded configuration", "service", conf.GetServiceName())
+	return nil
+}
+
+// applyLogSettings configures the logger from the log settings
+func applyLogSettings(c LogConfig) {
+	commonlogger.SetLogFormat(c.GetLogFormat())
+	commonlogger.SetLogLevel(c.GetLogLevel())
+	commonlogger.SetSampling(c.GetLogSampleEvery(), c.GetLogSampleInterval())
+	commonlogger.SetTimeFormat(c.GetLogTimeFormat())
+	commonlogger.SetRedaction(c.GetLogRedaction())
+}
+
+// Reload re-reads the config file and environment into a new value of the type of the target passed to
+// Initialize, then publishes it to GetConfig and applies the new log settings. The target itself is not
+// modified, so that the readers holding it never see a half updated struct: it goes stale after a reload,
+// and callers must read the settings with GetConfig. Settings only read at startup, such as PORT, keep
+// their value. If anything fails the current config is left intact. It returns the changed keys, with
+// sensitive values omitted.
+func Reload() ([]utilities.Change, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if conf == nil || loader == nil {
+		return nil, fmt.Errorf("config has not been initialized")
+	}
+
+	current := reflect.ValueOf(conf)
+	if current.Kind() != reflect.Pointer || current.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a pointer to a struct, got %T", conf)
+	}
+	fresh := reflect.New(current.Elem().Type()).Interface().(Config)
+	if err := loader.Load(fresh); err != nil {
+		return nil, err
+	}
+	if fresh.GetApiKey() == "" {
+		return nil, ErrApiKeyRequired
+	}
+	if err := ValidateConfigImplementation(fresh); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// Copy the startup values of the restart-only settings from the target into the new config
+	keepRestartOnlySettings(conf, fresh)
+
+	changes, err := utilities.MaskedDiff(GetConfig(), fresh)
+	if err != nil {
+		return nil, fmt.Errorf("error computing config diff: %w", err)
+	}
 
-		setConfig(target)
-		commonlogger.SetLogLevel(conf.GetLogLevel())
-		if conf.GetApiKey() == "" {
-			commonlogger.GetLogger().Error("API_KEY is required", "service", conf.GetServiceName())
-			os.Exit(1)
+	publish(fresh)
+	applyLogSettings(fresh)
+	changedKeys := make([]string, 0, len(changes))
+	for _, change := range changes {
+		changedKeys = append(changedKeys, change.Key)
+	}
+	commonlogger.Info("Configuration reloaded", "service", fresh.GetServiceName(), "changed_keys", changedKeys)
+	for _, change := range changes {
+		if change.Sensitive {
+			commonlogger.Info(fmt.Sprintf("Config key %s changed (sensitive value omitted)", change.Key))
+			continue
 		}
-		commonlogger.Debug("Successfully Loaded configuration", "service", conf.GetServiceName())
-	})
+		commonlogger.Info(fmt.Sprintf("Config key %s changed: %v -> %v", change.Key, change.Old, change.New))
+	}
+	return changes, nil
 }
@@ -0,0 +1,511 @@
+package commonconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+func TestMain(m *testing.M) {
+	commonlogger.Discard()
+	os.Exit(m.Run())
+}
+
+// resetConfig clears the loaded configuration now and at the end of the test
+func resetConfig(t *testing.T) {
+	t.Helper()
+	ResetForTest()
+	t.Cleanup(ResetForTest)
+}
+
+func TestResetForTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		reset   bool
+		service string
+	}{
+		{name: "without reset the first config is kept", reset: false, service: "first"},
+		{name: "after reset the second config is loaded", reset: true, service: "second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			if err := InitializeWithLoaderE(&BaseConfig{}, MapLoader{"API_KEY": "k", "SERVICE_NAME": "first"}); err != nil {
+				t.Fatalf("first initialization failed: %v", err)
+			}
+			if tt.reset {
+				ResetForTest()
+				if GetConfig() != nil {
+					t.Fatal("GetConfig() is not nil after ResetForTest")
+				}
+			}
+			if err := InitializeWithLoaderE(&BaseConfig{}, MapLoader{"API_KEY": "k", "SERVICE_NAME": "second"}); err != nil {
+				t.Fatalf("second initialization failed: %v", err)
+			}
+			if got := GetConfig().GetServiceName(); got != tt.service {
+				t.Errorf("GetServiceName() = %q, want %q", got, tt.service)
+			}
+		})
+	}
+}
+
+func TestMapLoader(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  MapLoader
+		check   func(c Config) bool
+		wantErr bool
+	}{
+		{name: "defaults apply to missing keys", values: MapLoader{"API_KEY": "k"}, check: func(c Config) bool {
+			return c.GetServiceName() == "servicetemplate" && c.GetPort() == 8001 && c.GetLogLevel() == "INFO"
+		}},
+		{name: "values override the defaults", values: MapLoader{"API_KEY": "k", "SERVICE_NAME": "orders", "PORT": 9000}, check: func(c Config) bool {
+			return c.GetServiceName() == "orders" && c.GetPort() == 9000
+		}},
+		{name: "strings are decoded", values: MapLoader{"API_KEY": "k", "PORT": "9000", "SLOW_REQUEST_THRESHOLD": "250ms"}, check: func(c Config) bool {
+			return c.GetPort() == 9000 && c.GetSlowRequestThreshold() == 250*time.Millisecond
+		}},
+		{name: "missing api key", values: MapLoader{"SERVICE_NAME": "orders"}, wantErr: true},
+		{name: "invalid value", values: MapLoader{"API_KEY": "k", "PORT": "http"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			err := InitializeWithLoaderE(&BaseConfig{}, tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InitializeWithLoaderE() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(GetConfig()) {
+				t.Errorf("unexpected config %+v", GetConfig())
+			}
+		})
+	}
+}
+
+// countingLoader is a Loader counting its calls and delegating to a MapLoader
+type countingLoader struct {
+	calls  int
+	values MapLoader
+}
+
+func (l *countingLoader) Load(target Config) error {
+	l.calls++
+	return l.values.Load(target)
+}
+
+func TestCustomLoader(t *testing.T) {
+	resetConfig(t)
+	loader := &countingLoader{values: MapLoader{"API_KEY": "k", "ENVIRONMENT": "staging"}}
+	if err := InitializeWithLoaderE(&BaseConfig{}, loader); err != nil {
+		t.Fatalf("InitializeWithLoaderE() error = %v", err)
+	}
+	if loader.calls != 1 || GetConfig().GetEnvironment() != "staging" {
+		t.Fatalf("after Initialize: %d loads, environment %q, want 1 and staging", loader.calls, GetConfig().GetEnvironment())
+	}
+
+	loader.values["ENVIRONMENT"] = "qa"
+	if _, err := Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if loader.calls != 2 || GetConfig().GetEnvironment() != "qa" {
+		t.Errorf("after Reload: %d loads, environment %q, want 2 and qa", loader.calls, GetConfig().GetEnvironment())
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   any
+		changed []string
+		logged  string
+		hidden  string
+	}{
+		{name: "one field", key: "ENVIRONMENT", value: "qa", changed: []string{"ENVIRONMENT"}, logged: "Config key ENVIRONMENT changed: staging -> qa"},
+		{name: "sensitive field", key: "API_KEY", value: "new-secret-key", changed: []string{"API_KEY"}, logged: "Config key API_KEY changed (sensitive value omitted)", hidden: "new-secret-key"},
+		{name: "same value", key: "ENVIRONMENT", value: "staging", changed: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			loader := MapLoader{"API_KEY": "old-secret-key", "ENVIRONMENT": "staging"}
+			if err := InitializeWithLoaderE(&BaseConfig{}, loader); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			var logs bytes.Buffer
+			commonlogger.SetOutput(&logs)
+			t.Cleanup(commonlogger.Discard)
+
+			loader[tt.key] = tt.value
+			changes, err := Reload()
+			if err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			changed := []string{}
+			for _, change := range changes {
+				changed = append(changed, change.Key)
+			}
+			if !slices.Equal(changed, tt.changed) {
+				t.Errorf("changed keys = %v, want %v", changed, tt.changed)
+			}
+			if tt.logged != "" && !strings.Contains(logs.String(), tt.logged) {
+				t.Errorf("log lacks %q: %s", tt.logged, logs.String())
+			}
+			if tt.hidden != "" && strings.Contains(logs.String(), tt.hidden) {
+				t.Errorf("log exposes the sensitive value: %s", logs.String())
+			}
+		})
+	}
+}
+
+// serviceConfig is a service config embedding BaseConfig
+type serviceConfig struct {
+	BaseConfig `mapstructure:",squash"`
+	Database   string `mapstructure:"DATABASE"`
+}
+
+func TestValidateConfigImplementation(t *testing.T) {
+	tests := []struct {
+		name   string
+		values MapLoader
+		errs   []string
+	}{
+		{name: "defaults are valid", values: MapLoader{}},
+		{name: "missing port", values: MapLoader{"PORT": 0}, errs: []string{"PORT must be between 1 and 65535, got 0"}},
+		{name: "port out of range", values: MapLoader{"PORT": 70000}, errs: []string{"PORT must be between 1 and 65535"}},
+		{name: "metrics port disabled", values: MapLoader{"METRICS_PORT": 0}},
+		{name: "negative metrics port", values: MapLoader{"METRICS_PORT": -1}, errs: []string{"METRICS_PORT must be between 0 and 65535"}},
+		{name: "same ports", values: MapLoader{"PORT": 9000, "METRICS_PORT": 9000}, errs: []string{"METRICS_PORT must differ from PORT (9000)"}},
+		{name: "empty service name", values: MapLoader{"SERVICE_NAME": " "}, errs: []string{"SERVICE_NAME must not be empty"}},
+		{name: "empty heartbeat cron", values: MapLoader{"HEARTBEAT_CRON": ""}, errs: []string{"HEARTBEAT_CRON must not be empty"}},
+		{name: "every error is reported", values: MapLoader{"PORT": 0, "VERSION": ""}, errs: []string{"PORT must be", "VERSION must not be empty"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &serviceConfig{}
+			if err := tt.values.Load(cfg); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			err := ValidateConfigImplementation(cfg)
+			if (err != nil) != (len(tt.errs) > 0) {
+				t.Fatalf("ValidateConfigImplementation() error = %v, want %v", err, tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q lacks %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInitializeValidatesConfig(t *testing.T) {
+	resetConfig(t)
+	err := InitializeWithLoaderE(&serviceConfig{}, MapLoader{"API_KEY": "k", "PORT": 0})
+	if err == nil || !strings.Contains(err.Error(), "PORT must be between 1 and 65535") {
+		t.Fatalf("InitializeWithLoaderE() error = %v, want the invalid port reported", err)
+	}
+	if GetConfig() != nil {
+		t.Error("an invalid config was published")
+	}
+}
+
+func TestValueTypeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  bool
+		key  string
+		raw  string
+		want string
+	}{
+		{name: "port from the environment", env: true, key: "PORT", raw: "abc", want: "PORT must be an integer, got 'abc'"},
+		{name: "port", key: "PORT", raw: "abc", want: "PORT must be an integer, got 'abc'"},
+		{name: "duration", key: "SLOW_REQUEST_THRESHOLD", raw: "soon", want: "SLOW_REQUEST_THRESHOLD must be a duration (e.g. 1s, 500ms), got 'soon'"},
+		{name: "boolean", key: "LOGLEVEL_ON_METRICS_PORT", raw: "maybe", want: "LOGLEVEL_ON_METRICS_PORT must be a boolean (true or false), got 'maybe'"},
+		{name: "padded integer", key: "PORT", raw: " 9000 ", want: "PORT must be an integer, got ' 9000 '"},
+		{name: "duration without a unit", key: "SLOW_REQUEST_THRESHOLD", raw: "250", want: "SLOW_REQUEST_THRESHOLD must be a duration (e.g. 1s, 500ms), got '250'"},
+		{name: "valid integer", key: "PORT", raw: "9000"},
+		{name: "valid duration", key: "SLOW_REQUEST_THRESHOLD", raw: "250ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			var err error
+			if tt.env {
+				file := filepath.Join(t.TempDir(), "config.toml")
+				if err := os.WriteFile(file, []byte("API_KEY = \"k\"\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("CONFIG_FILE", file)
+				t.Setenv(tt.key, tt.raw)
+				err = InitializeE(&BaseConfig{})
+			} else {
+				err = InitializeWithLoaderE(&BaseConfig{}, MapLoader{"API_KEY": "k", tt.key: tt.raw})
+			}
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Initialize error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Initialize error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoMaxProcs(t *testing.T) {
+	initial := runtime.GOMAXPROCS(0)
+	t.Cleanup(func() { runtime.GOMAXPROCS(initial) })
+	original := cpuQuota
+	t.Cleanup(func() { cpuQuota = original })
+	limit := initial + 1
+	cpuQuota = func() (float64, bool, error) { return float64(limit), true, nil }
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    int
+		log     string
+	}{
+		{name: "enabled", enabled: true, want: limit, log: fmt.Sprintf("GOMAXPROCS set to %d from the CPU limit", limit)},
+		{name: "disabled", enabled: false, want: initial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			runtime.GOMAXPROCS(initial)
+			var logs bytes.Buffer
+			commonlogger.SetOutput(&logs)
+			t.Cleanup(commonlogger.Discard)
+			if err := InitializeWithLoaderE(&BaseConfig{}, MapLoader{"API_KEY": "k", "AUTO_MAXPROCS": tt.enabled}); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			if got := runtime.GOMAXPROCS(0); got != tt.want {
+				t.Errorf("GOMAXPROCS = %d, want %d", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), tt.log) {
+				t.Errorf("log lacks %q: %s", tt.log, logs.String())
+			}
+		})
+	}
+}
+
+func TestApiKeyFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content *string
+		err     string
+	}{
+		{name: "missing file", err: "error reading API_KEY_FILE"},
+		{name: "empty file", content: new(string), err: "is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			path := filepath.Join(t.TempDir(), "api-key")
+			if tt.content != nil {
+				if err := os.WriteFile(path, []byte(*tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := InitializeWithLoaderE(&BaseConfig{}, MapLoader{"API_KEY": "k", "API_KEY_FILE": path})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("InitializeWithLoaderE() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestInitializeWithOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      string
+		override string
+		want     string
+	}{
+		{name: "file only", file: "from-file", want: "from-file"},
+		{name: "env wins over the file", file: "from-file", env: "from-env", want: "from-env"},
+		{name: "override wins over the file", file: "from-file", override: "from-override", want: "from-override"},
+		{name: "override wins over env and file", file: "from-file", env: "from-env", override: "from-override", want: "from-override"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			file := filepath.Join(t.TempDir(), "config.toml")
+			content := fmt.Sprintf("API_KEY = \"k\"\nSERVICE_NAME = %q\n", tt.file)
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(ConfigFileEnv, file)
+			if tt.env != "" {
+				t.Setenv("SERVICE_NAME", tt.env)
+			}
+			overrides := map[string]interface{}{}
+			if tt.override != "" {
+				overrides["SERVICE_NAME"] = tt.override
+			}
+			InitializeWithOverrides(&BaseConfig{}, overrides)
+			if got := GetConfig().GetServiceName(); got != tt.want {
+				t.Errorf("GetServiceName() = %q, want %q", got, tt.want)
+			}
+			// The overrides survive a reload
+			if _, err := Reload(); err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			if got := GetConfig().GetServiceName(); got != tt.want {
+				t.Errorf("GetServiceName() after Reload = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A service config embedding BaseConfig satisfies Config whatever getters were added to it
+var _ Config = (*serviceConfig)(nil)
+
+func TestRoleInterfaces(t *testing.T) {
+	cfg := &serviceConfig{}
+	if err := (MapLoader{"SERVICE_NAME": "orders", "LOG_FORMAT": "json", "HEARTBEAT_CRON": "*/5 * * * *"}).Load(cfg); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		value  any
+		role   func(any) bool
+		accept bool
+	}{
+		{name: "service config is a Config", value: cfg, role: func(v any) bool { _, ok := v.(Config); return ok }, accept: true},
+		{name: "service config is a ServiceConfig", value: cfg, role: func(v any) bool { _, ok := v.(ServiceConfig); return ok }, accept: true},
+		{name: "service config is a ServerConfig", value: cfg, role: func(v any) bool { _, ok := v.(ServerConfig); return ok }, accept: true},
+		{name: "service config is a LogConfig", value: cfg, role: func(v any) bool { _, ok := v.(LogConfig); return ok }, accept: true},
+		{name: "service config is a SchedulerConfig", value: cfg, role: func(v any) bool { _, ok := v.(SchedulerConfig); return ok }, accept: true},
+		{name: "service config is a RuntimeConfig", value: cfg, role: func(v any) bool { _, ok := v.(RuntimeConfig); return ok }, accept: true},
+		{name: "a LogConfig implementation is a LogConfig", value: struct{ LogConfig }{}, role: func(v any) bool { _, ok := v.(LogConfig); return ok }, accept: true},
+		{name: "a LogConfig implementation is not a Config", value: struct{ LogConfig }{}, role: func(v any) bool { _, ok := v.(Config); return ok }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.role(tt.value); got != tt.accept {
+				t.Errorf("%T satisfies the role: %t, want %t", tt.value, got, tt.accept)
+			}
+		})
+	}
+
+	// Code depending on a role sees the values of the service config
+	var logs LogConfig = cfg
+	var scheduler SchedulerConfig = cfg
+	if logs.GetLogFormat() != "json" || scheduler.GetHeartBeatCron() != "*/5 * * * *" || Config(cfg).GetServiceName() != "orders" {
+		t.Errorf("role getters = %q, %q, %q", logs.GetLogFormat(), scheduler.GetHeartBeatCron(), Config(cfg).GetServiceName())
+	}
+}
+
+func TestInitializeE(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     error
+	}{
+		{name: "valid file", content: "API_KEY = \"k\"\nSERVICE_NAME = \"orders\"\n"},
+		{name: "missing API key", content: "SERVICE_NAME = \"orders\"\n", err: ErrApiKeyRequired},
+		{name: "malformed file", content: "API_KEY = \n", err: ErrConfigFileInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			file := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(file, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(ConfigFileEnv, file)
+			t.Setenv("API_KEY", "")
+			err := InitializeE(&BaseConfig{})
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("InitializeE() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil {
+				if GetConfig() == nil || GetConfig().GetServiceName() != "orders" {
+					t.Errorf("GetConfig() = %v after a successful InitializeE", GetConfig())
+				}
+				return
+			}
+			if GetConfig() != nil {
+				t.Error("a config was published after a failed InitializeE")
+			}
+			// After a failure the configuration can be initialized again
+			if err := InitializeWithLoaderE(&BaseConfig{}, MapLoader{"API_KEY": "k"}); err != nil || GetConfig() == nil {
+				t.Errorf("initializing again after the failure: error = %v", err)
+			}
+		})
+	}
+}
+
+// initializeExitEnv makes TestInitializeExits call Initialize, which exits the process
+const initializeExitEnv = "COMMONCONFIG_TEST_INITIALIZE_EXIT"
+
+func TestInitializeExits(t *testing.T) {
+	if os.Getenv(initializeExitEnv) != "" {
+		Initialize(&BaseConfig{})
+		return
+	}
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(file, []byte("SERVICE_NAME = \"orders\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInitializeExits$")
+	cmd.Env = append(os.Environ(), initializeExitEnv+"=1", ConfigFileEnv+"="+file, "API_KEY=")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("Initialize without an API key: error = %v, want exit status 1\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "[commonconfig] "+ErrApiKeyRequired.Error()) {
+		t.Errorf("Initialize output lacks the error: %s", out)
+	}
+}
+
+func TestSensitiveKeysMasked(t *testing.T) {
+	tests := []struct {
+		name   string
+		target Config
+	}{
+		{name: "base config", target: &BaseConfig{}},
+		{name: "service config", target: &serviceConfig{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			if err := InitializeWithLoaderE(tt.target, MapLoader{"API_KEY": "secret-key-value"}); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			m, err := utilities.ToMaskedMap(GetConfig())
+			if err != nil {
+				t.Fatalf("ToMaskedMap() error = %v", err)
+			}
+			// A new field that looks sensitive must be tagged so that /config masks it
+			for _, key := range utilities.MaskedKeys(GetConfig()) {
+				if !utilities.IsSensitiveKey(key) {
+					continue
+				}
+				if value, ok := m[key].(string); ok && value != "" && !strings.Contains(value, "****") {
+					t.Errorf("%s = %q is not masked", key, value)
+				}
+			}
+			if got := m["API_KEY"]; got != utilities.MaskValue("secret-key-value") {
+				t.Errorf("API_KEY = %v, want it masked", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package commonconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// Config file errors returned by ViperLoader, so callers can use errors.Is to tell the failures apart
+var (
+	// ErrConfigFileNotFound is reported when the config file doesn't exist; the loader then
+	// falls back to the environment variables and defaults instead of failing
+	ErrConfigFileNotFound = errors.New("config file not found")
+	// ErrConfigFileIsDirectory is returned when the config file path points to a directory
+	ErrConfigFileIsDirectory = errors.New("config file path is a directory")
+	// ErrConfigFilePermission is returned when the config file cannot be read by the process
+	ErrConfigFilePermission = errors.New("permission denied reading config file")
+	// ErrConfigFileInvalid is returned when the config file is not valid for its format, which is
+	// inferred from its extension, or when the extension is not supported
+	ErrConfigFileInvalid = errors.New("config file is not valid")
+)
+
+// classifyConfigFileError turns the error of viper.ReadInConfig into one of the config file errors,
+// with a message telling what to fix
+func classifyConfigFileError(path string, err error) error {
+	var notFound viper.ConfigFileNotFoundError
+	var parseErr viper.ConfigParseError
+	switch {
+	case errors.As(err, &notFound), errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: %s", ErrConfigFileNotFound, path)
+	case errors.Is(err, syscall.EISDIR):
+		return fmt.Errorf("%w: %s, it must point to a %s file: %w", ErrConfigFileIsDirectory, path, configFileExtensions, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%w: %s, check the file owner and mode: %w", ErrConfigFilePermission, path, err)
+	case errors.As(err, &parseErr):
+		if configType, ok := configFileType(path); ok {
+			return fmt.Errorf("%w: %s is not valid %s: %w", ErrConfigFileInvalid, path, configType, err)
+		}
+		return fmt.Errorf("%w: %s: %w", ErrConfigFileInvalid, path, err)
+	}
+	return fmt.Errorf("error loading config file %s: %w", path, err)
+}
+
+// ConfigFileEnv is the environment variable pointing ViperLoader to a config file other than .env,
+// e.g. CONFIG_FILE=/etc/service/config.yaml. The format is inferred from the file extension.
+const ConfigFileEnv = "CONFIG_FILE"
+
+// configFileTypes maps the supported config file extensions to their viper config type
+var configFileTypes = map[string]string{
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+	".toml": "toml",
+	// Like the default .env file, which is written in toml
+	".env": "toml",
+}
+
+// configFileExtensions lists the extensions of configFileTypes for the error messages
+const configFileExtensions = ".yaml, .yml, .json, .toml or .env"
+
+// configFileType returns the viper config type of the file from its extension
+func configFileType(path string) (string, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		// filepath.Ext doesn't see an extension in dot files such as /config/.env
+		ext = strings.ToLower(filepath.Base(path))
+	}
+	configType, ok := configFileTypes[ext]
+	return configType, ok
+}
+
+// configFileFromEnv returns the config file set in CONFIG_FILE and its type, or an empty path when unset
+func configFileFromEnv() (string, string, error) {
+	path := strings.TrimSpace(os.Getenv(ConfigFileEnv))
+	if path == "" {
+		return "", "", nil
+	}
+	configType, ok := configFileType(path)
+	if !ok {
+		return "", "", fmt.Errorf("%w: %s=%s, the extension must be %s", ErrConfigFileInvalid, ConfigFileEnv, path, configFileExtensions)
+	}
+	return path, configType, nil
+}
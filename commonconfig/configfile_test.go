@@ -0,0 +1,152 @@
+package commonconfig
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestClassifyConfigFileError(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		err     error
+		want    error
+		message string
+	}{
+		{name: "missing", err: &fs.PathError{Op: "open", Path: "c.toml", Err: syscall.ENOENT}, want: ErrConfigFileNotFound},
+		{name: "viper not found", err: viper.ConfigFileNotFoundError{}, want: ErrConfigFileNotFound},
+		{name: "directory", err: &fs.PathError{Op: "read", Path: "c.toml", Err: syscall.EISDIR}, want: ErrConfigFileIsDirectory,
+			message: "it must point to a .yaml, .yml, .json, .toml or .env file"},
+		{name: "permission denied", err: &fs.PathError{Op: "open", Path: "c.toml", Err: syscall.EACCES}, want: ErrConfigFilePermission},
+		{name: "invalid", err: viper.ConfigParseError{}, want: ErrConfigFileInvalid, message: "c.toml is not valid toml"},
+		{name: "invalid yaml", path: "c.yaml", err: viper.ConfigParseError{}, want: ErrConfigFileInvalid, message: "c.yaml is not valid yaml"},
+		{name: "invalid dot env", path: "/config/.env", err: viper.ConfigParseError{}, want: ErrConfigFileInvalid, message: "/config/.env is not valid toml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = "c.toml"
+			}
+			err := classifyConfigFileError(path, tt.err)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("classifyConfigFileError() = %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("classifyConfigFileError() = %v, want a message with %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string) string
+		want  error
+	}{
+		{name: "directory", want: ErrConfigFileIsDirectory, setup: func(t *testing.T, dir string) string {
+			path := filepath.Join(dir, "config.toml")
+			if err := os.Mkdir(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			return path
+		}},
+		{name: "permission denied", want: ErrConfigFilePermission, setup: func(t *testing.T, dir string) string {
+			if os.Geteuid() == 0 {
+				t.Skip("root can read files without permission")
+			}
+			path := filepath.Join(dir, "config.toml")
+			if err := os.WriteFile(path, []byte("API_KEY = \"k\"\n"), 0o000); err != nil {
+				t.Fatal(err)
+			}
+			return path
+		}},
+		{name: "missing file set explicitly", want: ErrConfigFileNotFound, setup: func(t *testing.T, dir string) string {
+			return filepath.Join(dir, "missing.toml")
+		}},
+		{name: "invalid toml", want: ErrConfigFileInvalid, setup: func(t *testing.T, dir string) string {
+			path := filepath.Join(dir, "config.toml")
+			if err := os.WriteFile(path, []byte("API_KEY = \n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			return path
+		}},
+		{name: "missing default file is not fatal", setup: func(t *testing.T, dir string) string {
+			t.Chdir(dir)
+			t.Setenv("API_KEY", "k")
+			return ""
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			t.Setenv(ConfigFileEnv, tt.setup(t, t.TempDir()))
+			err := InitializeE(&BaseConfig{})
+			if tt.want == nil && err != nil {
+				t.Fatalf("InitializeE() error = %v", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("InitializeE() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		fallback bool
+		err      error
+	}{
+		{name: "yaml", file: "config.yaml", content: "API_KEY: k\nSERVICE_NAME: orders\nPORT: 9100\nSLOW_REQUEST_THRESHOLD: 2s\n"},
+		{name: "yml", file: "config.yml", content: "API_KEY: k\nSERVICE_NAME: orders\nPORT: 9100\nSLOW_REQUEST_THRESHOLD: 2s\n"},
+		{name: "json", file: "config.json", content: `{"API_KEY": "k", "SERVICE_NAME": "orders", "PORT": 9100, "SLOW_REQUEST_THRESHOLD": "2s"}`},
+		{name: "toml", file: "config.toml", content: "API_KEY = \"k\"\nSERVICE_NAME = \"orders\"\nPORT = 9100\nSLOW_REQUEST_THRESHOLD = \"2s\"\n"},
+		{name: "dot env", file: ".env", content: "API_KEY = \"k\"\nSERVICE_NAME = \"orders\"\nPORT = 9100\nSLOW_REQUEST_THRESHOLD = \"2s\"\n"},
+		{name: "upper case extension", file: "CONFIG.YAML", content: "API_KEY: k\nSERVICE_NAME: orders\nPORT: 9100\nSLOW_REQUEST_THRESHOLD: 2s\n"},
+		{name: "unset falls back to .env in the working directory", file: ".env", fallback: true,
+			content: "API_KEY = \"k\"\nSERVICE_NAME = \"orders\"\nPORT = 9100\nSLOW_REQUEST_THRESHOLD = \"2s\"\n"},
+		{name: "unsupported extension", file: "config.ini", content: "API_KEY=k\n", err: ErrConfigFileInvalid},
+		{name: "yaml in a json file", file: "config.json", content: "API_KEY: k\n", err: ErrConfigFileInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.fallback {
+				t.Chdir(filepath.Dir(path))
+				path = ""
+			}
+			t.Setenv(ConfigFileEnv, path)
+			err := InitializeE(&BaseConfig{})
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("InitializeE() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InitializeE() error = %v", err)
+			}
+			cfg := GetConfig()
+			if cfg.GetServiceName() != "orders" || cfg.GetPort() != 9100 || cfg.GetSlowRequestThreshold() != 2*time.Second {
+				t.Errorf("loaded service %q, port %d, slow request threshold %s; want orders, 9100, 2s",
+					cfg.GetServiceName(), cfg.GetPort(), cfg.GetSlowRequestThreshold())
+			}
+		})
+	}
+}
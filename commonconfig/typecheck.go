@@ -0,0 +1,121 @@
+package commonconfig
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// checkValueTypes reports the string values (typically coming from environment variables) that cannot
+// be converted to the type of their field, e.g. "PORT must be an integer, got 'abc'", instead of
+// the decoding error of Unmarshal
+func checkValueTypes(v *viper.Viper, target Config) error {
+	t := reflect.TypeOf(target)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return errors.Join(checkStructTypes(v, t)...)
+}
+
+// bindEnvKeys binds every key of the target to its environment variable. AutomaticEnv alone only
+// applies to the keys viper already knows from the defaults or the config file, so without a config
+// file the keys without a default, such as API_KEY, would not be read from the environment.
+func bindEnvKeys(v *viper.Viper, target Config) {
+	t := reflect.TypeOf(target)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for _, field := range configFields(t) {
+		v.BindEnv(field.key)
+	}
+}
+
+// configField is a config field with its mapstructure key
+type configField struct {
+	key string
+	typ reflect.Type
+}
+
+// configFields returns the fields of t with their mapstructure keys, including the squashed ones
+func configFields(t reflect.Type) []configField {
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tagParts := strings.Split(field.Tag.Get("mapstructure"), ",")
+		key := strings.TrimSpace(tagParts[0])
+		squash := field.Anonymous
+		for _, part := range tagParts[1:] {
+			if strings.TrimSpace(part) == "squash" {
+				squash = true
+			}
+		}
+		if squash && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(field.Type)...)
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+		fields = append(fields, configField{key: key, typ: field.Type})
+	}
+	return fields
+}
+
+func checkStructTypes(v *viper.Viper, t reflect.Type) []error {
+	var errs []error
+	for _, field := range configFields(t) {
+		raw, ok := v.Get(field.key).(string)
+		if !ok {
+			continue
+		}
+		if err := checkValueType(field.key, raw, field.typ); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func checkValueType(key string, raw string, t reflect.Type) error {
+	if t == durationType {
+		if _, err := time.ParseDuration(raw); err != nil {
+			return fmt.Errorf("%s must be a duration (e.g. 1s, 500ms), got '%s'", key, raw)
+		}
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(raw, 0, t.Bits()); err != nil {
+			return fmt.Errorf("%s must be an integer, got '%s'", key, raw)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(raw, 0, t.Bits()); err != nil {
+			return fmt.Errorf("%s must be a non-negative integer, got '%s'", key, raw)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(raw, t.Bits()); err != nil {
+			return fmt.Errorf("%s must be a number, got '%s'", key, raw)
+		}
+	case reflect.Bool:
+		// viper decodes an empty string as false
+		if raw == "" {
+			return nil
+		}
+		if _, err := strconv.ParseBool(raw); err != nil {
+			return fmt.Errorf("%s must be a boolean (true or false), got '%s'", key, raw)
+		}
+	}
+	return nil
+}
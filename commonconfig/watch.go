@@ -0,0 +1,107 @@
+package commonconfig
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+var (
+	watching atomic.Bool
+	// stopWatch stops the current watcher, nil when not watching. Guarded by watchMu.
+	watchMu   sync.Mutex
+	stopWatch func()
+)
+
+// WatchConfig reloads the configuration whenever the process receives SIGHUP, e.g. after the config map
+// of a Kubernetes deployment changed, so that LOG_LEVEL and the other runtime settings apply without
+// a restart. target must be the config passed to Initialize. It is not updated: after a reload it goes
+// stale, and the reloaded values must be read with GetConfig, see Reload.
+// While watching, commonapi.StartAPI no longer shuts down on SIGHUP. Call the returned function to stop.
+func WatchConfig(target Config) (stop func()) {
+	if target == nil || target != conf {
+		commonlogger.Error("WatchConfig: the target must be the config passed to Initialize")
+		return func() {}
+	}
+	if !watching.CompareAndSwap(false, true) {
+		commonlogger.Warn("WatchConfig: the config is already watched")
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+	utilities.Go(func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				commonlogger.Info("Received SIGHUP, reloading the configuration")
+				if _, err := Reload(); err != nil {
+					commonlogger.Error(fmt.Sprintf("Failed to reload the configuration, keeping the current one: %s", err.Error()))
+				}
+			}
+		}
+	})
+	commonlogger.Info("Watching the configuration, send SIGHUP to reload it")
+	stop = sync.OnceFunc(func() {
+		signal.Stop(signals)
+		close(done)
+		watching.Store(false)
+	})
+	watchMu.Lock()
+	stopWatch = stop
+	watchMu.Unlock()
+	return stop
+}
+
+// stopWatchingConfig stops the watcher started by WatchConfig, if any
+func stopWatchingConfig() {
+	watchMu.Lock()
+	stop := stopWatch
+	stopWatch = nil
+	watchMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// IsWatchingConfig reports whether WatchConfig is reloading the configuration on SIGHUP
+func IsWatchingConfig() bool {
+	return watching.Load()
+}
+
+// keepRestartOnlySettings puts back in fresh the settings that are only read at startup, logging
+// the changes as ignored. Configs that don't embed BaseConfig are left as they are.
+func keepRestartOnlySettings(current, fresh Config) {
+	before, ok := current.(interface{ baseConfig() *BaseConfig })
+	if !ok {
+		return
+	}
+	after, ok := fresh.(interface{ baseConfig() *BaseConfig })
+	if !ok {
+		return
+	}
+	old, next := before.baseConfig(), after.baseConfig()
+	ignore := func(key string, from, to any) {
+		commonlogger.Warn(fmt.Sprintf("Config key %s changed from %v to %v but requires a restart, ignored", key, from, to))
+	}
+	if next.Port != old.Port {
+		ignore("PORT", old.Port, next.Port)
+		next.Port = old.Port
+	}
+	if next.MetricsPort != old.MetricsPort {
+		ignore("METRICS_PORT", old.MetricsPort, next.MetricsPort)
+		next.MetricsPort = old.MetricsPort
+	}
+	if next.ServiceName != old.ServiceName {
+		ignore("SERVICE_NAME", old.ServiceName, next.ServiceName)
+		next.ServiceName = old.ServiceName
+	}
+}
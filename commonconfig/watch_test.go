@@ -0,0 +1,241 @@
+package commonconfig
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+)
+
+// syncBuffer is a bytes.Buffer safe for the watcher goroutine logging into it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// lockedLoader is a MapLoader the test can change while the watcher goroutine reads it
+type lockedLoader struct {
+	mu     sync.Mutex
+	values MapLoader
+}
+
+func (l *lockedLoader) Load(target Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.values.Load(target)
+}
+
+func (l *lockedLoader) set(key string, value any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if value == nil {
+		delete(l.values, key)
+		return
+	}
+	l.values[key] = value
+}
+
+// eventually fails the test if condition doesn't become true within a few seconds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestWatchConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		value  any
+		check  func(c Config) bool
+		level  slog.Level
+		logged string
+	}{
+		{name: "log level applied", key: "LOG_LEVEL", value: "DEBUG", level: slog.LevelDebug, logged: "Config key LOG_LEVEL changed: INFO -> DEBUG",
+			check: func(c Config) bool { return c.GetLogLevel() == "DEBUG" }},
+		{name: "port change ignored", key: "PORT", value: 9000, level: slog.LevelInfo, logged: "Config key PORT changed from 8001 to 9000 but requires a restart, ignored",
+			check: func(c Config) bool { return c.GetPort() == 8001 }},
+		{name: "service name change ignored", key: "SERVICE_NAME", value: "payments", level: slog.LevelInfo, logged: "Config key SERVICE_NAME changed from orders to payments but requires a restart, ignored",
+			check: func(c Config) bool { return c.GetServiceName() == "orders" }},
+		{name: "failed reload keeps the config", key: "API_KEY", value: nil, level: slog.LevelInfo, logged: "Failed to reload the configuration, keeping the current one",
+			check: func(c Config) bool { return c.GetApiKey() == "k" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			t.Cleanup(func() { commonlogger.SetLogLevel("INFO") })
+			loader := &lockedLoader{values: MapLoader{"API_KEY": "k", "SERVICE_NAME": "orders", "LOG_LEVEL": "INFO"}}
+			target := &BaseConfig{}
+			if err := InitializeWithLoaderE(target, loader); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			logs := &syncBuffer{}
+			commonlogger.SetOutput(logs)
+			t.Cleanup(commonlogger.Discard)
+
+			stop := WatchConfig(target)
+			t.Cleanup(stop)
+			if !IsWatchingConfig() {
+				t.Fatal("IsWatchingConfig() = false after WatchConfig")
+			}
+			loader.set(tt.key, tt.value)
+			if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+				t.Fatalf("sending SIGHUP: %v", err)
+			}
+			eventually(t, "the reload", func() bool { return strings.Contains(logs.String(), tt.logged) })
+			if !tt.check(GetConfig()) {
+				t.Errorf("unexpected config after the reload %+v", GetConfig())
+			}
+			if got := commonlogger.GetLogLevel().Level(); got != tt.level {
+				t.Errorf("log level = %v, want %v", got, tt.level)
+			}
+		})
+	}
+}
+
+func TestWatchConfigTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   func(initialized Config) Config
+		twice    bool
+		watching bool
+		logged   string
+	}{
+		{name: "config passed to Initialize", target: func(c Config) Config { return c }, watching: true},
+		{name: "other config", target: func(Config) Config { return &BaseConfig{} }, logged: "the target must be the config passed to Initialize"},
+		{name: "nil config", target: func(Config) Config { return nil }, logged: "the target must be the config passed to Initialize"},
+		{name: "already watched", target: func(c Config) Config { return c }, twice: true, watching: true, logged: "the config is already watched"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			target := &BaseConfig{}
+			if err := InitializeWithLoaderE(target, MapLoader{"API_KEY": "k"}); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			logs := &syncBuffer{}
+			commonlogger.SetOutput(logs)
+			t.Cleanup(commonlogger.Discard)
+
+			stop := WatchConfig(tt.target(target))
+			if tt.twice {
+				t.Cleanup(stop)
+				stop = WatchConfig(target)
+			}
+			if got := IsWatchingConfig(); got != tt.watching {
+				t.Errorf("IsWatchingConfig() = %t, want %t", got, tt.watching)
+			}
+			if tt.logged != "" && !strings.Contains(logs.String(), tt.logged) {
+				t.Errorf("log lacks %q: %s", tt.logged, logs.String())
+			}
+			if !tt.twice {
+				stop()
+				if IsWatchingConfig() {
+					t.Error("IsWatchingConfig() = true after stop")
+				}
+			}
+		})
+	}
+}
+
+func TestReloadConcurrentReaders(t *testing.T) {
+	resetConfig(t)
+	t.Cleanup(func() { commonlogger.SetLogLevel("INFO") })
+	loader := &lockedLoader{values: MapLoader{"API_KEY": "k", "ENVIRONMENT": "env-0", "SERVICE_NAME": "orders"}}
+	if err := InitializeWithLoaderE(&BaseConfig{}, loader); err != nil {
+		t.Fatalf("InitializeWithLoaderE() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Every published config is complete, never a mix of two loads
+				c := GetConfig()
+				if c.GetApiKey() != "k" || c.GetServiceName() != "orders" || !strings.HasPrefix(c.GetEnvironment(), "env-") {
+					t.Errorf("GetConfig() returned a torn config %+v", c)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 50; i++ {
+		loader.set("ENVIRONMENT", "env-"+strings.Repeat("x", i))
+		if _, err := Reload(); err != nil {
+			t.Fatalf("Reload() error = %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestResetForTestStopsWatching(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop calls the stop function of the first watcher before the reset
+		stop bool
+	}{
+		{name: "watcher running"},
+		{name: "watcher already stopped", stop: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			first := &BaseConfig{}
+			if err := InitializeWithLoaderE(first, MapLoader{"API_KEY": "k"}); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			stop := WatchConfig(first)
+			if tt.stop {
+				stop()
+			}
+			ResetForTest()
+			if IsWatchingConfig() {
+				t.Fatal("IsWatchingConfig() = true after ResetForTest")
+			}
+			// Stopping again is a no-op
+			stop()
+
+			logs := &syncBuffer{}
+			commonlogger.SetOutput(logs)
+			t.Cleanup(commonlogger.Discard)
+			second := &BaseConfig{}
+			if err := InitializeWithLoaderE(second, MapLoader{"API_KEY": "k"}); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			t.Cleanup(WatchConfig(second))
+			if !IsWatchingConfig() || strings.Contains(logs.String(), "already watched") {
+				t.Errorf("the next config cannot be watched after ResetForTest: %s", logs.String())
+			}
+		})
+	}
+}
@@ -1,36 +1,55 @@
 package commonlogger
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
-	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fabioluissilva/microservicetemplate/utilities"
 )
 
 var (
-	logLevel    *slog.LevelVar
-	logger      *slog.Logger
+	logLevel *slog.LevelVar
+	// logger is replaced when the output or the format changes, e.g. on a config reload,
+	// while every goroutine reads it
+	logger      atomic.Pointer[slog.Logger]
 	once        sync.Once
 	serviceName string
 )
 
 func GetLogger() *slog.Logger {
-	once.Do(initializeLogger)
-	return logger
+	// initializeLogger guards itself with once, calling it through once.Do again would deadlock
+	initializeLogger()
+	return logger.Load()
 }
 
 func GetLogLevel() *slog.LevelVar {
 	return logLevel
 }
 
-func logWithLevel(level func(string, ...interface{}), msg string, args ...interface{}) {
+func logWithLevel(level slog.Level, sampled bool, msg string, args ...interface{}) {
+	logger := GetLogger()
+	// Records filtered out by the level must not count against the sampling window of the call site
+	if !logger.Enabled(context.Background(), level) {
+		return
+	}
 	pkg, label, line := utilities.CallerLabel(3)
+	if sampled {
+		allowed, dropped := logSampler.allow(fmt.Sprintf("%s:%d", label, line), time.Now())
+		if !allowed {
+			return
+		}
+		if dropped > 0 {
+			args = append(args, "sampled_dropped", dropped)
+		}
+	}
 	if GetLogLevel().Level() < slog.LevelInfo {
-		level(fmt.Sprintf("[%s:%d] %s", label, line, msg), args...)
+		logger.Log(context.Background(), level, fmt.Sprintf("[%s:%d] %s", label, line, msg), args...)
 	} else {
-		level(fmt.Sprintf("[%s] %s", pkg, msg), args...)
+		logger.Log(context.Background(), level, fmt.Sprintf("[%s] %s", pkg, msg), args...)
 	}
 }
 
@@ -43,20 +62,20 @@ func appendServiceName(args ...interface{}) []interface{} {
 
 func Debug(msg string, args ...interface{}) {
 	args = appendServiceName(args...)
-	logWithLevel(GetLogger().Debug, msg, args...)
+	logWithLevel(slog.LevelDebug, true, msg, args...)
 }
 
 func Info(msg string, args ...interface{}) {
 	args = appendServiceName(args...)
-	logWithLevel(GetLogger().Info, msg, args...)
+	logWithLevel(slog.LevelInfo, true, msg, args...)
 }
 func Warn(msg string, args ...interface{}) {
 	args = appendServiceName(args...)
-	logWithLevel(GetLogger().Warn, msg, args...)
+	logWithLevel(slog.LevelWarn, false, msg, args...)
 }
 func Error(msg string, args ...interface{}) {
 	args = appendServiceName(args...)
-	logWithLevel(GetLogger().Error, msg, args...)
+	logWithLevel(slog.LevelError, false, msg, args...)
 }
 
 func SetLogLevel(level string) {
@@ -78,13 +97,19 @@ func SetServiceName(name string) {
 	serviceName = name
 }
 
+// init logs the panics recovered by utilities.Go
+func init() {
+	utilities.OnPanic(func(recovered any, stack []byte) {
+		Error(fmt.Sprintf("Recovered from a panic in a goroutine: %v", recovered), "stack", string(stack))
+	})
+}
+
 func initializeLogger() {
 	// By Default the log level is set to Debug
 	once.Do(func() {
 		logLevel = new(slog.LevelVar)
 		logLevel.Set(slog.LevelDebug)
-		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
-		slog.SetDefault(logger)
-		logger.Debug("Logger initialized")
+		resetHandler()
+		logger.Load().Debug("Logger initialized")
 	})
 }
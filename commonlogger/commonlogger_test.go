@@ -0,0 +1,408 @@
+package commonlogger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+func TestMain(m *testing.M) {
+	Discard()
+	// TestDiscard runs the test binary again to log right after a Discard before any other call
+	if os.Getenv(discardFirstEnv) != "" {
+		Debug("debug record")
+		Error("error record")
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// discardFirstEnv makes TestMain log after Discard and exit without running the tests
+const discardFirstEnv = "COMMONLOGGER_TEST_DISCARD_FIRST"
+
+// syncBuffer is a bytes.Buffer safe for the goroutines logging into it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs writes the records at every level to the returned buffer until the test ends
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	SetOutput(buf)
+	SetLevel(slog.LevelDebug)
+	t.Cleanup(Discard)
+	return buf
+}
+
+func TestSampling(t *testing.T) {
+	tests := []struct {
+		name   string
+		log    func(string, ...interface{})
+		logged int
+	}{
+		{name: "debug", log: Debug, logged: 3},
+		{name: "info", log: Info, logged: 3},
+		{name: "warn", log: Warn, logged: 10},
+		{name: "error", log: Error, logged: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLogs(t)
+			SetSampling(3, time.Hour)
+			t.Cleanup(func() { SetSampling(0, 0) })
+			for i := 0; i < 10; i++ {
+				tt.log("hot path")
+			}
+			if got := strings.Count(buf.String(), "hot path"); got != tt.logged {
+				t.Errorf("logged %d records, want %d", got, tt.logged)
+			}
+		})
+	}
+}
+
+func TestSamplingFilteredLevel(t *testing.T) {
+	tests := []struct {
+		name   string
+		log    func(string, ...interface{})
+		logged int
+	}{
+		{name: "debug filtered by the level", log: Debug, logged: 3},
+		{name: "debug context filtered by the level", log: func(msg string, args ...interface{}) { DebugContext(context.Background(), msg, args...) }, logged: 3},
+		{name: "scoped debug filtered by the level", log: With("component", "mq").Debug, logged: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLogs(t)
+			SetSampling(3, time.Hour)
+			t.Cleanup(func() { SetSampling(0, 0) })
+			hotPath := func() { tt.log("hot path") }
+
+			// The records dropped by the level don't use the sampling window of the call site
+			SetLevel(slog.LevelInfo)
+			for i := 0; i < 10; i++ {
+				hotPath()
+			}
+			SetLevel(slog.LevelDebug)
+			for i := 0; i < 3; i++ {
+				hotPath()
+			}
+			if got := strings.Count(buf.String(), "hot path"); got != tt.logged {
+				t.Errorf("logged %d records, want %d", got, tt.logged)
+			}
+			if strings.Contains(buf.String(), "sampled_dropped") {
+				t.Errorf("records filtered by the level were counted as sampled: %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestSamplingDisabled(t *testing.T) {
+	buf := captureLogs(t)
+	SetSampling(0, time.Hour)
+	for i := 0; i < 10; i++ {
+		Debug("hot path")
+	}
+	if got := strings.Count(buf.String(), "hot path"); got != 10 {
+		t.Errorf("logged %d records with sampling disabled, want 10", got)
+	}
+}
+
+func TestSamplerWindows(t *testing.T) {
+	s := &sampler{every: 2, interval: time.Second, windows: make(map[string]*sampleWindow)}
+	start := time.Now()
+	tests := []struct {
+		name    string
+		key     string
+		at      time.Duration
+		allowed bool
+		dropped int
+	}{
+		{name: "first record", key: "a:1", at: 0, allowed: true},
+		{name: "within the limit", key: "a:1", at: 100 * time.Millisecond, allowed: true},
+		{name: "over the limit", key: "a:1", at: 200 * time.Millisecond, allowed: false},
+		{name: "over the limit again", key: "a:1", at: 300 * time.Millisecond, allowed: false},
+		{name: "other call site", key: "b:2", at: 300 * time.Millisecond, allowed: true},
+		{name: "next window reports the drops", key: "a:1", at: time.Second, allowed: true, dropped: 2},
+		{name: "drops are reported once", key: "a:1", at: 1100 * time.Millisecond, allowed: true},
+	}
+	for _, tt := range tests {
+		allowed, dropped := s.allow(tt.key, start.Add(tt.at))
+		if allowed != tt.allowed || dropped != tt.dropped {
+			t.Errorf("%s: allow() = %t, %d, want %t, %d", tt.name, allowed, dropped, tt.allowed, tt.dropped)
+		}
+	}
+}
+
+func TestScopedLogger(t *testing.T) {
+	logger := With("component", "mqengine")
+	child := logger.With("queue", "orders")
+	tests := []struct {
+		name  string
+		log   func(string, ...interface{})
+		attrs []string
+		not   []string
+	}{
+		{name: "debug", log: logger.Debug, attrs: []string{"level=DEBUG", "component=mqengine"}},
+		{name: "info", log: logger.Info, attrs: []string{"level=INFO", "component=mqengine"}},
+		{name: "warn", log: logger.Warn, attrs: []string{"level=WARN", "component=mqengine"}},
+		{name: "error", log: logger.Error, attrs: []string{"level=ERROR", "component=mqengine"}},
+		{name: "child adds attributes", log: child.Info, attrs: []string{"component=mqengine", "queue=orders"}},
+		{name: "parent unchanged by child", log: logger.Info, attrs: []string{"component=mqengine"}, not: []string{"queue=orders"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLogs(t)
+			SetServiceName("svc")
+			t.Cleanup(func() { SetServiceName("") })
+			tt.log("connected", "attempt", 2)
+			line := buf.String()
+			for _, attr := range append(tt.attrs, "service=svc", "attempt=2") {
+				if !strings.Contains(line, attr) {
+					t.Errorf("record lacks %s: %s", attr, line)
+				}
+			}
+			for _, attr := range tt.not {
+				if strings.Contains(line, attr) {
+					t.Errorf("record has %s: %s", attr, line)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		check  func(v any) error
+	}{
+		{name: "default", format: "", check: func(v any) error { return parseTime(v, time.RFC3339Nano) }},
+		{name: "rfc3339", format: "rfc3339", check: func(v any) error {
+			s, _ := v.(string)
+			if strings.Contains(s, ".") {
+				return fmt.Errorf("%q has fractional seconds", s)
+			}
+			return parseTime(v, time.RFC3339)
+		}},
+		{name: "rfc3339nano", format: "RFC3339Nano", check: func(v any) error { return parseTime(v, time.RFC3339Nano) }},
+		{name: "unix", format: "unix", check: func(v any) error { return epoch(v, time.Now().Unix()) }},
+		{name: "unixmilli", format: "unixmilli", check: func(v any) error { return epoch(v, time.Now().UnixMilli()) }},
+		{name: "unknown", format: "unknown", check: func(v any) error { return parseTime(v, time.RFC3339Nano) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLogs(t)
+			SetLogFormat("json")
+			SetTimeFormat(tt.format)
+			t.Cleanup(func() {
+				SetTimeFormat("")
+				SetLogFormat("text")
+			})
+			Info("timestamped")
+			var record map[string]any
+			if err := json.Unmarshal([]byte(buf.String()), &record); err != nil {
+				t.Fatalf("invalid JSON record %q: %v", buf.String(), err)
+			}
+			if err := tt.check(record["time"]); err != nil {
+				t.Errorf("time: %v", err)
+			}
+		})
+	}
+}
+
+// parseTime checks that v is a string timestamp in the layout
+func parseTime(v any, layout string) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%v is not a string", v)
+	}
+	_, err := time.Parse(layout, s)
+	return err
+}
+
+// epoch checks that v is a number close to now, in the same unit
+func epoch(v any, now int64) error {
+	n, ok := v.(float64)
+	if !ok {
+		return fmt.Errorf("%v is not a number", v)
+	}
+	if diff := now - int64(n); diff < 0 || diff > 5000 {
+		return fmt.Errorf("%d is too far from %d", int64(n), now)
+	}
+	return nil
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		args    []interface{}
+		want    []string
+		leaked  string
+	}{
+		{name: "password masked", enabled: true, args: []interface{}{"password", "hunter2hunter2"}, want: []string{"password=hu****r2"}, leaked: "hunter2hunter2"},
+		{name: "api key masked", enabled: true, args: []interface{}{"apikey", "abc"}, want: []string{"apikey=****"}, leaked: "=abc"},
+		{name: "nested key masked", enabled: true, args: []interface{}{slog.Group("db", "token", "tok-123456")}, want: []string{"db.token=to****56"}, leaked: "tok-123456"},
+		{name: "other keys kept", enabled: true, args: []interface{}{"user", "alice"}, want: []string{"user=alice"}},
+		{name: "disabled", enabled: false, args: []interface{}{"password", "hunter2hunter2"}, want: []string{"password=hunter2hunter2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			SetRedaction(tt.enabled)
+			t.Cleanup(func() { SetRedaction(false) })
+			Warn(t.Name(), tt.args...)
+			for _, want := range tt.want {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("log lacks %s: %s", want, logs.String())
+				}
+			}
+			if tt.leaked != "" && strings.Contains(logs.String(), tt.leaked) {
+				t.Errorf("log leaks %s: %s", tt.leaked, logs.String())
+			}
+		})
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	t.Run("before the first log call", func(t *testing.T) {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), discardFirstEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil || len(out) != 0 {
+			t.Errorf("logging after Discard wrote %q (error %v), want nothing", out, err)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		discard bool
+		level   slog.Level
+		logged  []string
+	}{
+		{name: "every level", level: slog.LevelDebug, logged: []string{"debug record", "info record", "warn record", "error record"}},
+		{name: "warn and above", level: slog.LevelWarn, logged: []string{"warn record", "error record"}},
+		{name: "discarded", discard: true, level: slog.LevelDebug},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			SetLevel(tt.level)
+			if tt.discard {
+				Discard()
+			}
+			Debug("debug record")
+			Info("info record")
+			Warn("warn record")
+			Error("error record")
+			for _, record := range []string{"debug record", "info record", "warn record", "error record"} {
+				if logged := strings.Contains(logs.String(), record); logged != slices.Contains(tt.logged, record) {
+					t.Errorf("%s logged %t, want %t: %s", record, logged, !logged, logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestGoroutinePanicLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		panic any
+		log   string
+	}{
+		{name: "string", panic: "boom", log: "Recovered from a panic in a goroutine: boom"},
+		{name: "error", panic: fmt.Errorf("broken"), log: "Recovered from a panic in a goroutine: broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			utilities.Go(func() { panic(tt.panic) })
+			deadline := time.Now().Add(time.Second)
+			for !strings.Contains(logs.String(), tt.log) {
+				if time.Now().After(deadline) {
+					t.Fatalf("the panic was not logged: %s", logs.String())
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), "stack=") {
+				t.Errorf("the panic was not logged as an error with the stack: %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   LogFormat
+	}{
+		{name: "json", format: "json", want: LogFormatJSON},
+		{name: "upper case json", format: " JSON ", want: LogFormatJSON},
+		{name: "text", format: "text", want: LogFormatText},
+		{name: "unknown falls back to text", format: "xml", want: LogFormatText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			SetServiceName("orders")
+			SetLevel(slog.LevelWarn)
+			SetLogFormat(tt.format)
+			t.Cleanup(func() {
+				SetServiceName("")
+				SetLogFormat("text")
+			})
+			if got := GetLogFormat(); got != tt.want {
+				t.Errorf("GetLogFormat() = %q, want %q", got, tt.want)
+			}
+			// The level set before the switch still applies
+			Info("filtered out")
+			Warn("kept", "queue", "payments")
+
+			out := strings.TrimSpace(logs.String())
+			if strings.Contains(out, "filtered out") || strings.Count(out, "\n") != 0 {
+				t.Fatalf("want only the warning logged, got %q", out)
+			}
+			if tt.want == LogFormatText {
+				for _, field := range []string{"level=WARN", "service=orders", "queue=payments"} {
+					if !strings.Contains(out, field) {
+						t.Errorf("text record %q lacks %s", out, field)
+					}
+				}
+				return
+			}
+			var record map[string]any
+			if err := json.Unmarshal([]byte(out), &record); err != nil {
+				t.Fatalf("invalid JSON record %q: %v", out, err)
+			}
+			if record["level"] != "WARN" || record["service"] != "orders" || record["queue"] != "payments" || !strings.HasSuffix(fmt.Sprint(record["msg"]), "kept") {
+				t.Errorf("JSON record = %v, want level WARN, service orders and queue payments", record)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package commonlogger
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey struct{}
+
+// ContextWith returns a copy of ctx carrying attributes that are added to every record
+// logged through the *Context functions with it, e.g. a job name and run ID
+func ContextWith(ctx context.Context, args ...interface{}) context.Context {
+	attrs := append(contextAttrs(ctx), args...)
+	return context.WithValue(ctx, contextKey{}, attrs)
+}
+
+func contextAttrs(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(contextKey{}).([]interface{})
+	// copy so contexts derived from the same parent don't share the backing array
+	return append([]interface{}{}, attrs...)
+}
+
+func DebugContext(ctx context.Context, msg string, args ...interface{}) {
+	args = appendServiceName(append(contextAttrs(ctx), args...)...)
+	logWithLevel(slog.LevelDebug, true, msg, args...)
+}
+
+func InfoContext(ctx context.Context, msg string, args ...interface{}) {
+	args = appendServiceName(append(contextAttrs(ctx), args...)...)
+	logWithLevel(slog.LevelInfo, true, msg, args...)
+}
+
+func WarnContext(ctx context.Context, msg string, args ...interface{}) {
+	args = appendServiceName(append(contextAttrs(ctx), args...)...)
+	logWithLevel(slog.LevelWarn, false, msg, args...)
+}
+
+func ErrorContext(ctx context.Context, msg string, args ...interface{}) {
+	args = appendServiceName(append(contextAttrs(ctx), args...)...)
+	logWithLevel(slog.LevelError, false, msg, args...)
+}
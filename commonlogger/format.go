@@ -0,0 +1,40 @@
+package commonlogger
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// LogFormat is the encoding of the log records
+type LogFormat string
+
+const (
+	// LogFormatText writes key=value records, the default
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON writes one JSON object per record, for log pipelines such as Loki
+	LogFormatJSON LogFormat = "json"
+)
+
+var logFormat atomic.Value // LogFormat
+
+// SetLogFormat switches the records to the "text" or "json" format. Unknown formats fall back to text.
+// The level, the time format, the redaction and the service name are kept. Call it during startup,
+// before the first log line, so that all the records share the same format.
+func SetLogFormat(format string) {
+	switch f := LogFormat(strings.ToLower(strings.TrimSpace(format))); f {
+	case LogFormatJSON:
+		logFormat.Store(f)
+	default:
+		logFormat.Store(LogFormatText)
+	}
+	initializeLogger()
+	resetHandler()
+}
+
+// GetLogFormat returns the current format of the records
+func GetLogFormat() LogFormat {
+	if format, ok := logFormat.Load().(LogFormat); ok {
+		return format
+	}
+	return LogFormatText
+}
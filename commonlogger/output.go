@@ -0,0 +1,54 @@
+package commonlogger
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+var (
+	// handlerMu serializes the replacements of the logger and guards output
+	handlerMu sync.Mutex
+	// output is where the records are written, stdout unless changed with SetOutput
+	output io.Writer = os.Stdout
+)
+
+// newHandler creates the handler of the logger writing to w in the current format
+func newHandler(w io.Writer) slog.Handler {
+	options := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: replaceAttr}
+	if GetLogFormat() == LogFormatJSON {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// resetHandler replaces the logger with one using a new handler, after the output or the format changed
+func resetHandler() {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	l := slog.New(newHandler(output))
+	logger.Store(l)
+	slog.SetDefault(l)
+}
+
+// SetOutput makes the logger write its records to w. It can be called before the first log call,
+// in which case nothing is ever written to stdout.
+func SetOutput(w io.Writer) {
+	handlerMu.Lock()
+	output = w
+	handlerMu.Unlock()
+	initializeLogger()
+	resetHandler()
+}
+
+// Discard silences the logger entirely, e.g. in tests that don't care about log output
+func Discard() {
+	SetOutput(io.Discard)
+}
+
+// SetLevel sets the minimum level of the records that are logged
+func SetLevel(level slog.Level) {
+	initializeLogger()
+	logLevel.Set(level)
+}
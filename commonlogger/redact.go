@@ -0,0 +1,30 @@
+package commonlogger
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+var redact atomic.Bool
+
+// SetRedaction enables or disables masking of the values of log attributes whose keys match
+// the sensitive key pattern of utilities (password, token, apikey, secret...). It is off by default.
+func SetRedaction(enabled bool) {
+	redact.Store(enabled)
+}
+
+// redactAttr is the handler ReplaceAttr hook that masks sensitive attribute values.
+// Attributes inside groups are visited one by one, so nested keys are redacted too.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if !redact.Load() || a.Value.Kind() == slog.KindGroup || !utilities.IsSensitiveKey(a.Key) {
+		return a
+	}
+	return slog.String(a.Key, utilities.MaskValue(a.Value.String()))
+}
+
+// replaceAttr chains the ReplaceAttr hooks of the logger handler
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	return replaceTime(groups, redactAttr(groups, a))
+}
@@ -0,0 +1,57 @@
+package commonlogger
+
+import (
+	"sync"
+	"time"
+)
+
+// sampler limits the number of records logged per call site within an interval
+type sampler struct {
+	mu       sync.Mutex
+	every    int
+	interval time.Duration
+	windows  map[string]*sampleWindow
+}
+
+type sampleWindow struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+var logSampler = &sampler{windows: make(map[string]*sampleWindow)}
+
+// SetSampling limits Debug and Info records to at most every records per interval for each call site.
+// Passing every <= 0 or interval <= 0 disables sampling. Warn and Error records are never sampled.
+func SetSampling(every int, interval time.Duration) {
+	logSampler.mu.Lock()
+	defer logSampler.mu.Unlock()
+	logSampler.every = every
+	logSampler.interval = interval
+	logSampler.windows = make(map[string]*sampleWindow)
+}
+
+// allow reports whether a record for the call site can be logged, and how many records
+// were dropped for it in the previous window
+func (s *sampler) allow(key string, now time.Time) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.every <= 0 || s.interval <= 0 {
+		return true, 0
+	}
+	window, ok := s.windows[key]
+	if !ok || now.Sub(window.start) >= s.interval {
+		dropped := 0
+		if ok {
+			dropped = window.dropped
+		}
+		s.windows[key] = &sampleWindow{start: now, count: 1}
+		return true, dropped
+	}
+	if window.count >= s.every {
+		window.dropped++
+		return false, 0
+	}
+	window.count++
+	return true, 0
+}
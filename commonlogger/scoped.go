@@ -0,0 +1,42 @@
+package commonlogger
+
+import "log/slog"
+
+// ScopedLogger logs with a fixed set of attributes bound to every record,
+// e.g. the component the records come from
+type ScopedLogger struct {
+	attrs []interface{}
+}
+
+// With returns a ScopedLogger that adds args (and the service name) to every record, e.g.
+//
+//	var logger = commonlogger.With("component", "mqengine")
+//	logger.Info("Connected")
+func With(args ...interface{}) ScopedLogger {
+	return ScopedLogger{attrs: append([]interface{}{}, args...)}
+}
+
+// With returns a ScopedLogger with args added to the attributes already bound
+func (l ScopedLogger) With(args ...interface{}) ScopedLogger {
+	return ScopedLogger{attrs: append(append([]interface{}{}, l.attrs...), args...)}
+}
+
+func (l ScopedLogger) args(args []interface{}) []interface{} {
+	return appendServiceName(append(append([]interface{}{}, l.attrs...), args...)...)
+}
+
+func (l ScopedLogger) Debug(msg string, args ...interface{}) {
+	logWithLevel(slog.LevelDebug, true, msg, l.args(args)...)
+}
+
+func (l ScopedLogger) Info(msg string, args ...interface{}) {
+	logWithLevel(slog.LevelInfo, true, msg, l.args(args)...)
+}
+
+func (l ScopedLogger) Warn(msg string, args ...interface{}) {
+	logWithLevel(slog.LevelWarn, false, msg, l.args(args)...)
+}
+
+func (l ScopedLogger) Error(msg string, args ...interface{}) {
+	logWithLevel(slog.LevelError, false, msg, l.args(args)...)
+}
@@ -0,0 +1,54 @@
+package commonlogger
+
+import (
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TimeFormat selects how the time attribute of log records is rendered
+type TimeFormat string
+
+const (
+	// TimeFormatDefault keeps the handler's default rendering
+	TimeFormatDefault     TimeFormat = ""
+	TimeFormatRFC3339     TimeFormat = "rfc3339"
+	TimeFormatRFC3339Nano TimeFormat = "rfc3339nano"
+	// TimeFormatUnix renders the time as seconds since the Unix epoch
+	TimeFormatUnix TimeFormat = "unix"
+	// TimeFormatUnixMilli renders the time as milliseconds since the Unix epoch
+	TimeFormatUnixMilli TimeFormat = "unixmilli"
+)
+
+var timeFormat atomic.Value // TimeFormat
+
+// SetTimeFormat sets how record timestamps are rendered. Unknown formats fall back to the default.
+func SetTimeFormat(format string) {
+	switch f := TimeFormat(strings.ToLower(strings.TrimSpace(format))); f {
+	case TimeFormatRFC3339, TimeFormatRFC3339Nano, TimeFormatUnix, TimeFormatUnixMilli:
+		timeFormat.Store(f)
+	default:
+		timeFormat.Store(TimeFormatDefault)
+	}
+}
+
+// replaceTime is the handler ReplaceAttr hook that formats the top-level time attribute
+func replaceTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 || a.Key != slog.TimeKey || a.Value.Kind() != slog.KindTime {
+		return a
+	}
+	format, _ := timeFormat.Load().(TimeFormat)
+	t := a.Value.Time()
+	switch format {
+	case TimeFormatRFC3339:
+		return slog.String(a.Key, t.Format(time.RFC3339))
+	case TimeFormatRFC3339Nano:
+		return slog.String(a.Key, t.Format(time.RFC3339Nano))
+	case TimeFormatUnix:
+		return slog.Int64(a.Key, t.Unix())
+	case TimeFormatUnixMilli:
+		return slog.Int64(a.Key, t.UnixMilli())
+	}
+	return a
+}
@@ -1,10 +1,17 @@
 package commonmetrics
 
 import (
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/fabioluissilva/microservicetemplate/commonconfig"
 	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // To extend metrics in your service, call commonmetrics.New* helpers
@@ -15,53 +22,222 @@ import (
 
 // Helper functions for creating Prometheus metrics with service name prefix
 func NewCounter(suffix, help string) prometheus.Counter {
-	return promauto.NewCounter(prometheus.CounterOpts{
+	return factory().NewCounter(prometheus.CounterOpts{
 		Name: getServiceName() + suffix,
 		Help: help,
 	})
 }
 
 func NewGauge(suffix, help string) prometheus.Gauge {
-	return promauto.NewGauge(prometheus.GaugeOpts{
+	return factory().NewGauge(prometheus.GaugeOpts{
 		Name: getServiceName() + suffix,
 		Help: help,
 	})
 }
 
+// NewGaugeFunc creates a gauge whose value is computed by fn each time it is scraped
+func NewGaugeFunc(suffix, help string, fn func() float64) prometheus.GaugeFunc {
+	return factory().NewGaugeFunc(prometheus.GaugeOpts{
+		Name: getServiceName() + suffix,
+		Help: help,
+	}, fn)
+}
+
+func NewGaugeVec(suffix, help string, labels []string) *prometheus.GaugeVec {
+	return factory().NewGaugeVec(prometheus.GaugeOpts{
+		Name: getServiceName() + suffix,
+		Help: help,
+	}, labels)
+}
+
 func NewHistogram(suffix, help string, buckets []float64) prometheus.Histogram {
-	return promauto.NewHistogram(prometheus.HistogramOpts{
+	return factory().NewHistogram(prometheus.HistogramOpts{
 		Name:    getServiceName() + suffix,
 		Help:    help,
 		Buckets: buckets,
 	})
 }
 
+func NewHistogramVec(suffix, help string, buckets []float64, labels []string) *prometheus.HistogramVec {
+	return factory().NewHistogramVec(prometheus.HistogramOpts{
+		Name:    getServiceName() + suffix,
+		Help:    help,
+		Buckets: buckets,
+	}, labels)
+}
+
+// ObserveDuration starts a timer and returns a function that observes the elapsed seconds into h.
+// Defer the returned function to time the enclosing call:
+//
+//	defer commonmetrics.ObserveDuration(myHistogram)()
+func ObserveDuration(h prometheus.Observer) func() {
+	start := utilities.Now()
+	return func() {
+		h.Observe(utilities.Since(start).Seconds())
+	}
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = newRegistry()
+)
+
+// newRegistry creates a registry with the Go runtime and process collectors registered,
+// matching what the Prometheus default registry exposes
+func newRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return r
+}
+
+// Registry returns the registry the service metrics are registered on and served from.
+// Use Register to add external collectors so that they survive Reset.
+func Registry() *prometheus.Registry {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry
+}
+
+func factory() promauto.Factory {
+	return promauto.With(Registry())
+}
+
+// Handler serves the metrics of the current registry in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		promhttp.HandlerFor(Registry(), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
 // getServiceName ensures the configuration is loaded before accessing the service name
 func getServiceName() string {
 	return commonconfig.GetConfig().GetServiceName()
 }
 
 var (
-	HeartbeatCount         prometheus.Counter
-	HeartbeatMessage       prometheus.Gauge
-	ServiceStartTime       prometheus.Gauge
-	NumberOfErrors         prometheus.Counter
-	NumberOfPings          prometheus.Counter
-	UnauthorizedRequests   prometheus.Counter
-	NumberOfConfigRequests prometheus.Counter
-	NumberOfStatusRequests prometheus.Counter
+	HeartbeatCount          prometheus.Counter
+	HeartbeatMessage        prometheus.Gauge
+	HeartbeatDrift          prometheus.Gauge
+	ServiceStartTime        prometheus.Gauge
+	UptimeSeconds           prometheus.GaugeFunc
+	NumberOfErrors          prometheus.Counter
+	NumberOfPings           prometheus.Counter
+	UnauthorizedRequests    prometheus.Counter
+	NumberOfConfigRequests  prometheus.Counter
+	NumberOfStatusRequests  prometheus.Counter
+	ConcurrentRequests      *prometheus.GaugeVec
+	SlowRequests            prometheus.Counter
+	JobDuration             *prometheus.HistogramVec
+	ConsumerHandlerTimeouts *prometheus.CounterVec
+	ConsumerResubscriptions *prometheus.CounterVec
+	HTTPRequestDuration     *prometheus.HistogramVec
+	HTTPResponses           *prometheus.CounterVec
+	HTTPResponseSize        *prometheus.HistogramVec
+	HTTPInflightRequests    prometheus.Gauge
+	Goroutines              prometheus.Gauge
+	GoroutinePanics         prometheus.Counter
+
+	startTime = utilities.Now()
 )
 
+// StartTime returns the time the service was started
+func StartTime() time.Time {
+	return startTime
+}
+
+// Uptime returns how long the service has been running
+func Uptime() time.Duration {
+	return utilities.Since(startTime)
+}
+
 // InitializeMetrics initializes all Prometheus metrics after configuration is loaded
 func InitializeMetrics() {
-	HeartbeatCount = NewCounter("_heartbeat_count", "The total number of executed heartbeats")
-	HeartbeatMessage = NewGauge("_heartbeat_message", "The last heartbeat received")
-	ServiceStartTime = NewGauge("_service_start_time", "The last time the service was started")
-	NumberOfErrors = NewCounter("_error_count", "The total number of errors")
-	NumberOfPings = NewCounter("_ping_count", "Number of pings requested")
-	UnauthorizedRequests = NewCounter("_unauthorized_requests_count", "The total number of unauthorized requests")
-	NumberOfConfigRequests = NewCounter("_config_requests_count", "The total number of configuration requests")
-	NumberOfStatusRequests = NewCounter("_status_requests_count", "The total number of status requests")
-	ServiceStartTime.SetToCurrentTime()
+	startTime = utilities.Now()
+	registerMetrics()
+	if cfg := commonconfig.GetConfig(); cfg.GetGoroutineMonitorInterval() > 0 {
+		StartGoroutineMonitor(cfg.GetGoroutineMonitorInterval(), cfg.GetGoroutineThreshold())
+	}
 	commonlogger.Debug("Metrics initialized successfully", "package", "metrics")
 }
+
+// Reset replaces the registry with an empty one and registers the template metrics and the
+// collectors added with Register again, clearing the state of the template metrics. The exported
+// metric variables keep pointing at the same collectors, so it is safe while requests are served.
+// Metrics created by the service with the New* helpers are not registered again.
+// It is meant for test and staging environments only.
+func Reset() {
+	registryMu.Lock()
+	registry = newRegistry()
+	registryMu.Unlock()
+	resetTemplateMetrics()
+	registerExternal()
+	commonlogger.Warn("Metrics registry has been reset", "package", "metrics")
+}
+
+// init assigns unregistered metrics to the template metric variables, so that using them before
+// InitializeMetrics is a no-op instead of a nil pointer panic
+func init() {
+	assignMetrics(promauto.With(nil), "uninitialized")
+	utilities.OnPanic(func(any, []byte) { GoroutinePanics.Inc() })
+}
+
+func registerMetrics() {
+	metrics := assignMetrics(factory(), getServiceName())
+	templateMu.Lock()
+	templateMetrics = metrics
+	templateMu.Unlock()
+}
+
+// assignMetrics creates the template metrics with the factory, prefixing their names, and returns them
+func assignMetrics(f promauto.Factory, prefix string) []templateMetric {
+	var metrics []templateMetric
+	track := func(c prometheus.Collector, reset func()) {
+		metrics = append(metrics, templateMetric{collector: c, reset: reset})
+	}
+	counter := func(suffix, help string) prometheus.Counter {
+		c := newResettableCounter(f, prometheus.CounterOpts{Name: prefix + suffix, Help: help})
+		track(c, c.reset)
+		return c
+	}
+	gauge := func(suffix, help string) prometheus.Gauge {
+		g := f.NewGauge(prometheus.GaugeOpts{Name: prefix + suffix, Help: help})
+		track(g, func() { g.Set(0) })
+		return g
+	}
+	HeartbeatCount = counter("_heartbeat_count", "The total number of executed heartbeats")
+	HeartbeatMessage = gauge("_heartbeat_message", "The last heartbeat received")
+	HeartbeatDrift = gauge("_heartbeat_drift_seconds", "The delay between the expected and the actual time of the last heartbeat")
+	ServiceStartTime = f.NewGauge(prometheus.GaugeOpts{Name: prefix + "_service_start_time", Help: "The last time the service was started"})
+	track(ServiceStartTime, nil)
+	UptimeSeconds = f.NewGaugeFunc(prometheus.GaugeOpts{Name: prefix + "_uptime_seconds", Help: "The number of seconds since the service was started"}, func() float64 {
+		return Uptime().Seconds()
+	})
+	track(UptimeSeconds, nil)
+	NumberOfErrors = counter("_error_count", "The total number of errors")
+	NumberOfPings = counter("_ping_count", "Number of pings requested")
+	UnauthorizedRequests = counter("_unauthorized_requests_count", "The total number of unauthorized requests")
+	NumberOfConfigRequests = counter("_config_requests_count", "The total number of configuration requests")
+	NumberOfStatusRequests = counter("_status_requests_count", "The total number of status requests")
+	SlowRequests = counter("_slow_requests_total", "The total number of requests slower than the configured threshold")
+	ConcurrentRequests = f.NewGaugeVec(prometheus.GaugeOpts{Name: prefix + "_concurrent_requests", Help: "The number of requests currently running on concurrency-limited endpoints"}, []string{"path"})
+	track(ConcurrentRequests, ConcurrentRequests.Reset)
+	JobDuration = f.NewHistogramVec(prometheus.HistogramOpts{Name: prefix + "_job_duration_seconds", Help: "The duration of scheduled job runs", Buckets: prometheus.DefBuckets}, []string{"job"})
+	track(JobDuration, JobDuration.Reset)
+	ConsumerHandlerTimeouts = f.NewCounterVec(prometheus.CounterOpts{Name: prefix + "_consumer_handler_timeouts_total", Help: "The total number of deliveries whose consumer handler exceeded its timeout"}, []string{"queue"})
+	track(ConsumerHandlerTimeouts, ConsumerHandlerTimeouts.Reset)
+	ConsumerResubscriptions = f.NewCounterVec(prometheus.CounterOpts{Name: prefix + "_consumer_resubscriptions_total", Help: "The total number of attempts to re-register a consumer whose delivery channel closed, by result"}, []string{"queue", "result"})
+	track(ConsumerResubscriptions, ConsumerResubscriptions.Reset)
+	HTTPRequestDuration = f.NewHistogramVec(prometheus.HistogramOpts{Name: prefix + "_http_request_duration_seconds", Help: "The duration of HTTP requests", Buckets: prometheus.DefBuckets}, []string{"route", "method"})
+	track(HTTPRequestDuration, HTTPRequestDuration.Reset)
+	HTTPResponses = f.NewCounterVec(prometheus.CounterOpts{Name: prefix + "_http_responses_total", Help: "The total number of HTTP responses by status code"}, []string{"route", "method", "code"})
+	track(HTTPResponses, HTTPResponses.Reset)
+	HTTPResponseSize = f.NewHistogramVec(prometheus.HistogramOpts{Name: prefix + "_http_response_size_bytes", Help: "The size of HTTP response bodies", Buckets: prometheus.ExponentialBuckets(100, 10, 6)}, []string{"route"})
+	track(HTTPResponseSize, HTTPResponseSize.Reset)
+	// The requests in flight are still counted down once served, so their gauge is not cleared
+	HTTPInflightRequests = f.NewGauge(prometheus.GaugeOpts{Name: prefix + "_http_inflight_requests", Help: "The number of HTTP requests currently being served"})
+	track(HTTPInflightRequests, nil)
+	Goroutines = gauge("_goroutines", "The number of goroutines, sampled by the goroutine monitor")
+	GoroutinePanics = counter("_goroutine_panics_total", "The total number of panics recovered in background goroutines")
+	ServiceStartTime.Set(float64(startTime.Unix()))
+	return metrics
+}
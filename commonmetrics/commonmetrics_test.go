@@ -0,0 +1,145 @@
+package commonmetrics
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+func TestMain(m *testing.M) {
+	commonlogger.Discard()
+	if err := commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, commonconfig.MapLoader{"API_KEY": "k", "SERVICE_NAME": "svc"}); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize the test config: %s\n", err.Error())
+		os.Exit(1)
+	}
+	InitializeMetrics()
+	os.Exit(m.Run())
+}
+
+// findMetric returns the metric of the family with the labels from the gathered JSON
+func findMetric(t *testing.T, name string, labels map[string]string) (MetricFamily, Metric) {
+	t.Helper()
+	families, err := GatherJSON()
+	if err != nil {
+		t.Fatalf("GatherJSON() error = %v", err)
+	}
+	for _, family := range families {
+		if family.Name != name {
+			continue
+		}
+		for _, metric := range family.Metrics {
+			if fmt.Sprint(metric.Labels) == fmt.Sprint(labels) {
+				return family, metric
+			}
+		}
+	}
+	t.Fatalf("metric %s%v not found in the gathered JSON", name, labels)
+	return MetricFamily{}, Metric{}
+}
+
+func TestGatherJSON(t *testing.T) {
+	Reset()
+	NumberOfErrors.Add(3)
+	ConsumerHandlerTimeouts.WithLabelValues("orders").Inc()
+	JobDuration.WithLabelValues("report").Observe(0.2)
+	JobDuration.WithLabelValues("report").Observe(3)
+
+	tests := []struct {
+		name   string
+		metric string
+		labels map[string]string
+		kind   string
+		check  func(m Metric) bool
+	}{
+		{name: "counter", metric: "svc_error_count", kind: "COUNTER", check: func(m Metric) bool {
+			return m.Value != nil && *m.Value == 3
+		}},
+		{name: "labeled counter", metric: "svc_consumer_handler_timeouts_total", labels: map[string]string{"queue": "orders"}, kind: "COUNTER", check: func(m Metric) bool {
+			return m.Value != nil && *m.Value == 1
+		}},
+		{name: "histogram", metric: "svc_job_duration_seconds", labels: map[string]string{"job": "report"}, kind: "HISTOGRAM", check: func(m Metric) bool {
+			return m.Value == nil && m.Count != nil && *m.Count == 2 && m.Sum != nil && *m.Sum == 3.2 && m.Buckets["0.25"] == 1 && m.Buckets["5"] == 2
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			family, metric := findMetric(t, tt.metric, tt.labels)
+			if family.Type != tt.kind {
+				t.Errorf("type = %s, want %s", family.Type, tt.kind)
+			}
+			if !tt.check(metric) {
+				t.Errorf("unexpected metric %+v", metric)
+			}
+		})
+	}
+}
+
+// fakeClock is a utilities.Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// observer records the observed values
+type observer []float64
+
+func (o *observer) Observe(v float64) {
+	*o = append(*o, v)
+}
+
+func TestObserveDuration(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	utilities.SetClock(clock)
+	t.Cleanup(func() { utilities.SetClock(nil) })
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    float64
+	}{
+		{name: "instant", elapsed: 0, want: 0},
+		{name: "milliseconds", elapsed: 250 * time.Millisecond, want: 0.25},
+		{name: "seconds", elapsed: 3 * time.Second, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o observer
+			func() {
+				defer ObserveDuration(&o)()
+				clock.advance(tt.elapsed)
+			}()
+			if len(o) != 1 || o[0] != tt.want {
+				t.Errorf("observed %v, want [%v]", o, tt.want)
+			}
+		})
+	}
+}
+
+func TestObserveDurationWallClock(t *testing.T) {
+	var o observer
+	func() {
+		defer ObserveDuration(&o)()
+		time.Sleep(50 * time.Millisecond)
+	}()
+	if len(o) != 1 || o[0] < 0.05 || o[0] > 1 {
+		t.Errorf("observed %v, want about 0.05s", o)
+	}
+}
@@ -0,0 +1,63 @@
+package commonmetrics
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+)
+
+var (
+	monitorMu   sync.Mutex
+	stopMonitor func()
+)
+
+// StartGoroutineMonitor samples runtime.NumGoroutine every interval into the goroutines gauge and logs
+// a warning when the count goes past threshold (0 disables the warning), to spot leaks before they
+// exhaust the memory. The warning is logged again only after the count went back under the threshold.
+// Starting a monitor stops the previous one; the returned function stops it.
+func StartGoroutineMonitor(interval time.Duration, threshold int) (stop func()) {
+	monitorMu.Lock()
+	defer monitorMu.Unlock()
+	if stopMonitor != nil {
+		stopMonitor()
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() { once.Do(func() { close(done) }) }
+	stopMonitor = stop
+
+	utilities.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		warned := false
+		for {
+			count := sampleGoroutines()
+			switch {
+			case threshold > 0 && count > threshold && !warned:
+				warned = true
+				commonlogger.Warn(fmt.Sprintf("Number of goroutines (%d) is above the threshold of %d, possible goroutine leak", count, threshold),
+					"goroutines", count, "threshold", threshold)
+			case warned && count <= threshold:
+				warned = false
+				commonlogger.Info(fmt.Sprintf("Number of goroutines (%d) is back under the threshold of %d", count, threshold))
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	return stop
+}
+
+// sampleGoroutines sets the goroutines gauge to the current number of goroutines and returns it
+func sampleGoroutines() int {
+	count := runtime.NumGoroutine()
+	Goroutines.Set(float64(count))
+	return count
+}
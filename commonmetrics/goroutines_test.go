@@ -0,0 +1,93 @@
+package commonmetrics
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// syncBuffer is a bytes.Buffer safe for the monitor goroutine logging into it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// eventually fails the test if condition doesn't become true within a second
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestGoroutineMonitor(t *testing.T) {
+	logs := &syncBuffer{}
+	commonlogger.SetOutput(logs)
+	t.Cleanup(commonlogger.Discard)
+
+	const spawned = 50
+	baseline := runtime.NumGoroutine()
+	// The monitor goroutine alone stays under the threshold, the spawned goroutines go past it
+	threshold := baseline + spawned/2
+	stop := StartGoroutineMonitor(5*time.Millisecond, threshold)
+	t.Cleanup(stop)
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	steps := []struct {
+		name   string
+		action func()
+		check  func(gauge float64) bool
+		log    string
+	}{
+		{name: "idle", action: func() {}, check: func(g float64) bool { return g > 0 && g <= float64(threshold) }},
+		{name: "goroutines spawned", action: func() {
+			for range spawned {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-release
+				}()
+			}
+		}, check: func(g float64) bool { return g >= float64(baseline+spawned) },
+			log: "is above the threshold"},
+		{name: "goroutines exited", action: func() {
+			close(release)
+			wg.Wait()
+		}, check: func(g float64) bool { return g <= float64(threshold) },
+			log: "is back under the threshold"},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.action()
+			eventually(t, "the goroutines gauge", func() bool { return step.check(testutil.ToFloat64(Goroutines)) })
+			if step.log != "" {
+				eventually(t, "the log "+step.log, func() bool { return strings.Contains(logs.String(), step.log) })
+			}
+		})
+	}
+	if n := strings.Count(logs.String(), "is above the threshold"); n != 1 {
+		t.Errorf("the leak warning was logged %d times, want once: %s", n, logs.String())
+	}
+}
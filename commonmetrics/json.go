@@ -0,0 +1,85 @@
+package commonmetrics
+
+import (
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricFamily is a JSON friendly representation of a Prometheus metric family
+type MetricFamily struct {
+	Name    string   `json:"name"`
+	Help    string   `json:"help"`
+	Type    string   `json:"type"`
+	Metrics []Metric `json:"metrics"`
+}
+
+// Metric is a single sample of a metric family. Value is set for counters, gauges and untyped
+// metrics; histograms and summaries report their count, sum and buckets or quantiles.
+type Metric struct {
+	Labels    map[string]string  `json:"labels,omitempty"`
+	Value     *float64           `json:"value,omitempty"`
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// GatherJSON gathers the registry and converts the metric families to their JSON representation
+func GatherJSON() ([]MetricFamily, error) {
+	families, err := Registry().Gather()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]MetricFamily, 0, len(families))
+	for _, family := range families {
+		jsonFamily := MetricFamily{
+			Name:    family.GetName(),
+			Help:    family.GetHelp(),
+			Type:    family.GetType().String(),
+			Metrics: make([]Metric, 0, len(family.GetMetric())),
+		}
+		for _, m := range family.GetMetric() {
+			jsonFamily.Metrics = append(jsonFamily.Metrics, toJSONMetric(m))
+		}
+		out = append(out, jsonFamily)
+	}
+	return out, nil
+}
+
+func toJSONMetric(m *dto.Metric) Metric {
+	metric := Metric{}
+	if len(m.GetLabel()) > 0 {
+		metric.Labels = make(map[string]string, len(m.GetLabel()))
+		for _, label := range m.GetLabel() {
+			metric.Labels[label.GetName()] = label.GetValue()
+		}
+	}
+	switch {
+	case m.Counter != nil:
+		metric.Value = m.Counter.Value
+	case m.Gauge != nil:
+		metric.Value = m.Gauge.Value
+	case m.Untyped != nil:
+		metric.Value = m.Untyped.Value
+	case m.Histogram != nil:
+		metric.Count = m.Histogram.SampleCount
+		metric.Sum = m.Histogram.SampleSum
+		metric.Buckets = make(map[string]uint64, len(m.Histogram.GetBucket()))
+		for _, bucket := range m.Histogram.GetBucket() {
+			metric.Buckets[formatFloat(bucket.GetUpperBound())] = bucket.GetCumulativeCount()
+		}
+	case m.Summary != nil:
+		metric.Count = m.Summary.SampleCount
+		metric.Sum = m.Summary.SampleSum
+		metric.Quantiles = make(map[string]float64, len(m.Summary.GetQuantile()))
+		for _, quantile := range m.Summary.GetQuantile() {
+			metric.Quantiles[formatFloat(quantile.GetQuantile())] = quantile.GetValue()
+		}
+	}
+	return metric
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,69 @@
+package commonmetrics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	externalMu sync.Mutex
+	// external are the collectors registered with Register, registered again by Reset
+	external []prometheus.Collector
+)
+
+// Register adds collectors from external instrumentation libraries (database drivers, HTTP clients...)
+// to the registry served at /metrics. A collector that is already registered is skipped with a warning
+// instead of failing; other registration errors are returned joined.
+func Register(cs ...prometheus.Collector) error {
+	var errs []error
+	for _, c := range cs {
+		added, err := register(c)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if !added {
+			continue
+		}
+		externalMu.Lock()
+		external = append(external, c)
+		externalMu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// MustRegister is Register panicking on errors, like prometheus.MustRegister
+func MustRegister(cs ...prometheus.Collector) {
+	if err := Register(cs...); err != nil {
+		panic(err)
+	}
+}
+
+// register registers the collector and reports whether it was added. A duplicate registration
+// is not an error.
+func register(c prometheus.Collector) (bool, error) {
+	err := Registry().Register(c)
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		commonlogger.Warn(fmt.Sprintf("Collector %T is already registered, skipping it", c), "package", "metrics")
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to register collector %T: %w", c, err)
+	}
+	return true, nil
+}
+
+// registerExternal registers the external collectors again, after the registry was replaced
+func registerExternal() {
+	externalMu.Lock()
+	defer externalMu.Unlock()
+	for _, c := range external {
+		if _, err := register(c); err != nil {
+			commonlogger.Error(err.Error(), "package", "metrics")
+		}
+	}
+}
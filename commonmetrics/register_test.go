@@ -0,0 +1,56 @@
+package commonmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrape returns the body served by Handler at /metrics
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	return string(body)
+}
+
+func TestRegister(t *testing.T) {
+	driver := prometheus.NewCounter(prometheus.CounterOpts{Name: "db_driver_queries_total", Help: "Queries run by the driver"})
+	driver.Add(7)
+	conflicting := prometheus.NewGauge(prometheus.GaugeOpts{Name: "db_driver_queries_total", Help: "Another help"})
+
+	steps := []struct {
+		name   string
+		action func() error
+		err    bool
+	}{
+		{name: "external collector", action: func() error { return Register(driver) }},
+		{name: "duplicate registration is skipped", action: func() error { return Register(driver) }},
+		{name: "conflicting collector fails", action: func() error { return Register(conflicting) }, err: true},
+		{name: "collector survives Reset", action: func() error { Reset(); return nil }},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := step.action(); (err != nil) != step.err {
+				t.Fatalf("error = %v, want error %t", err, step.err)
+			}
+			if body := scrape(t); !strings.Contains(body, "db_driver_queries_total 7") {
+				t.Errorf("the scrape lacks the external collector:\n%s", body)
+			}
+		})
+	}
+
+	t.Run("MustRegister panics on errors", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("MustRegister() did not panic on a conflicting collector")
+			}
+		}()
+		MustRegister(conflicting)
+	})
+}
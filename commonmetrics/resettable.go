@@ -0,0 +1,74 @@
+package commonmetrics
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// resettableCounter is a counter whose value Reset can clear, which prometheus.Counter doesn't allow.
+// It is exposed as a regular counter.
+type resettableCounter struct {
+	prometheus.CounterFunc
+	bits atomic.Uint64
+}
+
+func newResettableCounter(f promauto.Factory, opts prometheus.CounterOpts) *resettableCounter {
+	c := &resettableCounter{}
+	c.CounterFunc = f.NewCounterFunc(opts, c.value)
+	return c
+}
+
+func (c *resettableCounter) value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (c *resettableCounter) Inc() {
+	c.Add(1)
+}
+
+// Add panics if v is negative, like prometheus.Counter
+func (c *resettableCounter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease in value")
+	}
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (c *resettableCounter) reset() {
+	c.bits.Store(0)
+}
+
+// templateMetric is a template metric with the function clearing its state, nil to keep it
+type templateMetric struct {
+	collector prometheus.Collector
+	reset     func()
+}
+
+var (
+	templateMu sync.Mutex
+	// templateMetrics are the metrics created by the last assignMetrics. Reset clears them and registers
+	// them on the new registry, instead of replacing the exported variables read by the handlers.
+	templateMetrics []templateMetric
+)
+
+// resetTemplateMetrics clears the state of the template metrics and registers them on the current registry
+func resetTemplateMetrics() {
+	templateMu.Lock()
+	defer templateMu.Unlock()
+	r := Registry()
+	for _, m := range templateMetrics {
+		if m.reset != nil {
+			m.reset()
+		}
+		r.MustRegister(m.collector)
+	}
+}
@@ -0,0 +1,112 @@
+package commonmqengine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// defaultBatchFlushInterval is used when WithBatchAck is given no flush interval, so that
+// a partial batch is never left unacknowledged
+const defaultBatchFlushInterval = time.Second
+
+type batchAck struct {
+	size          int
+	flushInterval time.Duration
+}
+
+// WithBatchAck acknowledges successfully handled messages in batches: the last delivery of a batch is
+// acked with multiple=true once size messages were handled or flushInterval elapsed. A message whose
+// handler fails is nacked on its own after the batch before it is acked.
+// Batch-ack consumers run a single worker on a channel of their own, as a multiple ack covers every
+// earlier delivery of the channel.
+func WithBatchAck(size int, flushInterval time.Duration) ConsumerOption {
+	return func(c *managedConsumer) {
+		if size <= 1 {
+			return
+		}
+		if flushInterval <= 0 {
+			flushInterval = defaultBatchFlushInterval
+		}
+		c.batch = &batchAck{size: size, flushInterval: flushInterval}
+	}
+}
+
+// consumeOnOwnChannel starts a manual-ack consumer on a dedicated channel of the engine connection
+// and returns the channel with the deliveries. An empty tag lets the library generate one.
+func consumeOnOwnChannel(queueName string, tag string) (*amqp091.Channel, <-chan amqp091.Delivery, error) {
+	if err := connect(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return nil, nil, fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := ensureChannel(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return nil, nil, fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, recordError(fmt.Errorf("%w: failed to open consumer Channel: %w", ErrNotConnected, err))
+	}
+	if err := applyPrefetch(ch); err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	deliveries, err := ch.Consume(queueName, tag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, nil, recordError(fmt.Errorf("failed to register consumer: %w", err))
+	}
+	logger.Info(fmt.Sprintf("Consumer registered on its own channel for queue: %s", queueName))
+	return ch, countDeliveries(deliveries, false), nil
+}
+
+// workBatch handles deliveries one by one and acknowledges the successful ones in batches
+func (c *managedConsumer) workBatch(deliveries <-chan amqp091.Delivery) {
+	ticker := time.NewTicker(c.batch.flushInterval)
+	defer ticker.Stop()
+
+	pending := 0
+	var last amqp091.Delivery
+	flush := func() {
+		if pending == 0 {
+			return
+		}
+		if err := last.Ack(true); err != nil {
+			logger.Error(fmt.Sprintf("Failed to ack batch of %d messages up to %s on queue %s: %s", pending, last.MessageId, c.queue, err.Error()))
+		}
+		pending = 0
+	}
+
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				// The channel is gone: the pending messages will be redelivered
+				logger.Warn(fmt.Sprintf("Delivery channel closed for queue %s with %d messages not acked", c.queue, pending))
+				return
+			}
+			if c.quarantineIfPoisoned(delivery, flush) {
+				continue
+			}
+			if err := c.process(delivery); err != nil {
+				logger.Error(fmt.Sprintf("Handler failed for message %s on queue %s: %s", delivery.MessageId, c.queue, err.Error()))
+				flush()
+				if nackErr := delivery.Nack(false, false); nackErr != nil {
+					logger.Error(fmt.Sprintf("Failed to nack message %s: %s", delivery.MessageId, nackErr.Error()))
+				}
+				continue
+			}
+			pending++
+			last = delivery
+			if pending >= c.batch.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
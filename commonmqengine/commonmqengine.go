@@ -3,12 +3,17 @@ package commonmqengine
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
 	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
 	"github.com/rabbitmq/amqp091-go"
 )
 
@@ -23,11 +28,15 @@ import (
 // 	WithHost("rabbit.internal"),
 // 	WithPort(5672),
 // 	WithVHost("myapp"),
+// 	WithDialTimeout(5*time.Second),
+// 	WithHeartbeat(10*time.Second),
+// 	WithTracing(true),
 // 	WithQueues(
 // 		NewQueue("orders",
 // 			WithExchange("orders-ex"),
 // 			WithRoutingKey("orders.*"),
 // 			WithDurable(true),
+// 			WithConsumerConcurrency(4),
 // 			WithArgs(map[string]interface{}{
 // 				"x-message-ttl": int32(60000),
 // 				"x-dead-letter-exchange":    "",// Default Exchange for direct delivery
@@ -41,23 +50,56 @@ import (
 // )
 
 type QueueConfiguration struct {
-	ExchangeName string
-	RoutingKey   string
-	Name         string
-	Durable      bool
-	AutoDelete   bool
-	Exclusive    bool
-	NoWait       bool
-	Args         map[string]interface{}
+	ExchangeName        string
+	RoutingKey          string
+	Name                string
+	Durable             bool
+	AutoDelete          bool
+	Exclusive           bool
+	NoWait              bool
+	Args                map[string]interface{}
+	ConsumerConcurrency int
+	// DeadLetterQueue receives the messages of this queue that exhausted their retries
+	DeadLetterQueue string
+	// ExchangeType is the kind of exchange declared by DeclareTopology (direct, fanout, topic or headers).
+	// It defaults to direct.
+	ExchangeType string
 }
 
 type MQConfiguration struct {
-	Username string
-	Password string
-	MqHost   string
-	MqPort   int
-	VHost    string
-	Queues   []QueueConfiguration
+	Username    string
+	Password    string
+	MqHost      string
+	MqPort      int
+	VHost       string
+	Queues      []QueueConfiguration
+	DialTimeout time.Duration
+	Heartbeat   time.Duration
+	Locale      string
+	// DefaultAppId is used as the AppId of published messages when no system is given.
+	// It defaults to the service name.
+	DefaultAppId string
+	// RequireConnectionAtStartup makes InitMQEngine fail when the broker is unreachable
+	// instead of starting in degraded mode with a background reconnector
+	RequireConnectionAtStartup bool
+	// AllowAutoAck acknowledges that auto-ack consumers are intended and silences the warning
+	AllowAutoAck bool
+	// Tracing propagates W3C trace context (traceparent/tracestate) through message headers
+	Tracing bool
+	// ValidateRoutingKeys rejects malformed routing keys before publishing
+	ValidateRoutingKeys bool
+	// Mandatory publishes with the mandatory flag so unroutable messages are returned and logged
+	// instead of being silently dropped by the broker
+	Mandatory bool
+	// PoisonThreshold is the number of deliveries after which managed consumers quarantine a message
+	// in its queue's dead-letter queue. 0 disables it.
+	PoisonThreshold int
+	// MaxConsumers is the maximum number of consumers that can be registered at the same time.
+	// 0 means no limit.
+	MaxConsumers int
+	// PrefetchCount is the number of unacknowledged messages the broker delivers to each consumer
+	// before waiting for acks, applied with channel.Qos. 0 means no limit.
+	PrefetchCount int
 }
 
 /* =========================
@@ -68,10 +110,13 @@ type MQOption func(*MQConfiguration)
 
 func NewMQConfiguration(opts ...MQOption) *MQConfiguration {
 	cfg := &MQConfiguration{
-		MqHost: "localhost",
-		MqPort: 5672,
-		VHost:  "/",
-		Queues: []QueueConfiguration{},
+		MqHost:      "localhost",
+		MqPort:      5672,
+		VHost:       "/",
+		Queues:      []QueueConfiguration{},
+		DialTimeout: 30 * time.Second,
+		Heartbeat:   10 * time.Second,
+		Locale:      "en_US",
 	}
 	for _, opt := range opts {
 		opt(cfg)
@@ -98,6 +143,60 @@ func WithVHost(vhost string) MQOption {
 	return func(c *MQConfiguration) { c.VHost = vhost }
 }
 
+// WithDialTimeout bounds the TCP dial and AMQP handshake so unreachable brokers don't hang forever
+func WithDialTimeout(timeout time.Duration) MQOption {
+	return func(c *MQConfiguration) { c.DialTimeout = timeout }
+}
+
+func WithHeartbeat(interval time.Duration) MQOption {
+	return func(c *MQConfiguration) { c.Heartbeat = interval }
+}
+
+func WithLocale(locale string) MQOption {
+	return func(c *MQConfiguration) { c.Locale = locale }
+}
+
+func WithDefaultAppId(appId string) MQOption {
+	return func(c *MQConfiguration) { c.DefaultAppId = appId }
+}
+
+// WithRequireConnectionAtStartup selects between failing fast (true) and starting in degraded mode
+// with a background reconnector (false, the default) when RabbitMQ is unreachable at startup
+func WithRequireConnectionAtStartup(require bool) MQOption {
+	return func(c *MQConfiguration) { c.RequireConnectionAtStartup = require }
+}
+
+// WithAllowAutoAck opts in to auto-ack consumers without a warning being logged
+func WithAllowAutoAck(allow bool) MQOption {
+	return func(c *MQConfiguration) { c.AllowAutoAck = allow }
+}
+
+// WithTracing enables W3C trace context propagation over message headers
+func WithTracing(enabled bool) MQOption {
+	return func(c *MQConfiguration) { c.Tracing = enabled }
+}
+
+// WithRoutingKeyValidation rejects malformed routing keys (empty segments, wildcards) before publishing
+func WithRoutingKeyValidation(enabled bool) MQOption {
+	return func(c *MQConfiguration) { c.ValidateRoutingKeys = enabled }
+}
+
+// WithMandatory publishes messages as mandatory and reports the ones the broker could not route
+func WithMandatory(enabled bool) MQOption {
+	return func(c *MQConfiguration) { c.Mandatory = enabled }
+}
+
+// WithMaxConsumers limits the number of consumers registered at the same time. 0 means no limit.
+func WithMaxConsumers(n int) MQOption {
+	return func(c *MQConfiguration) { c.MaxConsumers = n }
+}
+
+// WithPrefetchCount limits the unacknowledged messages delivered to each consumer, so that a slow
+// consumer applies backpressure instead of buffering the queue in memory. 0 means no limit.
+func WithPrefetchCount(n int) MQOption {
+	return func(c *MQConfiguration) { c.PrefetchCount = n }
+}
+
 func WithQueue(q QueueConfiguration) MQOption {
 	return func(c *MQConfiguration) { c.Queues = append(c.Queues, q) }
 }
@@ -114,12 +213,13 @@ type QueueOption func(*QueueConfiguration)
 
 func NewQueue(name string, opts ...QueueOption) QueueConfiguration {
 	q := QueueConfiguration{
-		Name:       name,
-		Durable:    true, // good default
-		AutoDelete: false,
-		Exclusive:  false,
-		NoWait:     false,
-		Args:       make(map[string]interface{}),
+		Name:                name,
+		Durable:             true, // good default
+		AutoDelete:          false,
+		Exclusive:           false,
+		NoWait:              false,
+		Args:                make(map[string]interface{}),
+		ConsumerConcurrency: 1,
 	}
 	for _, opt := range opts {
 		opt(&q)
@@ -131,6 +231,12 @@ func WithExchange(name string) QueueOption {
 	return func(q *QueueConfiguration) { q.ExchangeName = name }
 }
 
+// WithExchangeType sets the kind of the queue's exchange: amqp091.ExchangeDirect, ExchangeFanout,
+// ExchangeTopic or ExchangeHeaders
+func WithExchangeType(kind string) QueueOption {
+	return func(q *QueueConfiguration) { q.ExchangeType = kind }
+}
+
 func WithRoutingKey(key string) QueueOption {
 	return func(q *QueueConfiguration) { q.RoutingKey = key }
 }
@@ -155,71 +261,246 @@ func WithArgs(args map[string]interface{}) QueueOption {
 	return func(q *QueueConfiguration) { q.Args = args }
 }
 
+// WithConsumerConcurrency sets how many workers a managed consumer runs for this queue (default 1)
+func WithConsumerConcurrency(n int) QueueOption {
+	return func(q *QueueConfiguration) { q.ConsumerConcurrency = n }
+}
+
+// WithDeadLetterQueue sets the queue MoveMessageToRetry sends this queue's messages to once
+// they have exhausted their retries
+func WithDeadLetterQueue(name string) QueueOption {
+	return func(q *QueueConfiguration) { q.DeadLetterQueue = name }
+}
+
+// Overflow behaviours accepted by WithOverflow
+const (
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+// WithMessageTTL sets how long a message can stay in the queue (x-message-ttl)
+func WithMessageTTL(ttl time.Duration) QueueOption {
+	return func(q *QueueConfiguration) { setQueueArg(q, "x-message-ttl", ttl.Milliseconds()) }
+}
+
+// WithMaxLength limits the number of ready messages in the queue (x-max-length)
+func WithMaxLength(n int) QueueOption {
+	return func(q *QueueConfiguration) { setQueueArg(q, "x-max-length", int64(n)) }
+}
+
+// WithOverflow sets what happens when the queue is full (x-overflow): drop-head (default on the broker),
+// reject-publish or reject-publish-dlx. It requires a max length.
+func WithOverflow(behaviour string) QueueOption {
+	return func(q *QueueConfiguration) { setQueueArg(q, "x-overflow", behaviour) }
+}
+
+func setQueueArg(q *QueueConfiguration, key string, value interface{}) {
+	if q.Args == nil {
+		q.Args = make(map[string]interface{})
+	}
+	q.Args[key] = value
+}
+
+// validateQueueArgs checks the arguments of a queue before it is declared: every value must have
+// a type AMQP can encode, and the limit arguments must form a valid combination. Problems are
+// reported clearly, naming the offending key, instead of as a cryptic channel exception.
+func validateQueueArgs(q QueueConfiguration) error {
+	keys := make([]string, 0, len(q.Args))
+	for key := range q.Args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := (amqp091.Table{key: q.Args[key]}).Validate(); err != nil {
+			return fmt.Errorf("argument %q has a type that cannot be sent over AMQP (%T): %w", key, q.Args[key], err)
+		}
+	}
+	for _, key := range []string{"x-message-ttl", "x-max-length", "x-max-length-bytes"} {
+		value, ok := q.Args[key]
+		if !ok {
+			continue
+		}
+		n, isInt := argToInt64(value)
+		if !isInt {
+			return fmt.Errorf("%s must be an integer, got %T", key, value)
+		}
+		if n < 0 {
+			return fmt.Errorf("%s must not be negative, got %d", key, n)
+		}
+	}
+	if value, ok := q.Args["x-overflow"]; ok {
+		switch value {
+		case OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+		default:
+			return fmt.Errorf("x-overflow must be one of %s, %s or %s, got %v", OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX, value)
+		}
+		_, hasMaxLength := q.Args["x-max-length"]
+		_, hasMaxBytes := q.Args["x-max-length-bytes"]
+		if !hasMaxLength && !hasMaxBytes {
+			return fmt.Errorf("x-overflow requires x-max-length or x-max-length-bytes")
+		}
+		if value == OverflowRejectPublishDLX {
+			if _, ok := q.Args["x-dead-letter-exchange"]; !ok {
+				return fmt.Errorf("x-overflow %s requires x-dead-letter-exchange", OverflowRejectPublishDLX)
+			}
+		}
+	}
+	return nil
+}
+
+func argToInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
 var (
 	channel  *amqp091.Channel
 	conn     *amqp091.Connection
 	mu       sync.Mutex
 	mqconfig MQConfiguration
+	// dialer opens the AMQP connection; it is a variable so it can be replaced in tests
+	dialer = amqp091.DialConfig
+	// logger tags every record of the engine with component=mqengine
+	logger = commonlogger.With("component", "mqengine")
 )
 
+// amqpConfig builds the amqp091 connection settings from the MQ configuration
+func amqpConfig(cfg MQConfiguration) amqp091.Config {
+	config := amqp091.Config{
+		Heartbeat: cfg.Heartbeat,
+		Locale:    cfg.Locale,
+	}
+	if cfg.DialTimeout > 0 {
+		config.Dial = amqp091.DefaultDial(cfg.DialTimeout)
+	}
+	return config
+}
+
 func GetChannel() *amqp091.Channel {
 	mu.Lock()
 	defer mu.Unlock()
 	return channel
 }
 
+// connect dials RabbitMQ when the engine has no open connection. The dial, which lasts up to DialTimeout
+// while the broker is unreachable, runs without holding mu so that State, Stats and the probes using
+// them keep answering during an outage. Everything using the connection calls it before taking mu.
+func connect() error {
+	mu.Lock()
+	if conn != nil && !conn.IsClosed() {
+		mu.Unlock()
+		return nil
+	}
+	url, urlObfuscated := buildUrl(mqconfig)
+	config := amqpConfig(mqconfig)
+	mu.Unlock()
+
+	logger.Warn(fmt.Sprintf("connect: connection is not initialized or is closed. Reconnecting to RabbitMQ at URL: %s", urlObfuscated))
+	connection, err := dialer(url, config)
+	if err != nil {
+		logger.Error(fmt.Sprintf("connect: Failed to connect to RabbitMQ: %s", err))
+		return recordError(fmt.Errorf("connect: %w: failed to connect to RabbitMQ: %w", ErrNotConnected, err))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if currentUrl, _ := buildUrl(mqconfig); (conn != nil && !conn.IsClosed()) || currentUrl != url {
+		// Connected by another caller in the meantime, or the settings changed while dialing
+		connection.Close()
+		return nil
+	}
+	conn = connection
+	watchClose("connection", conn.NotifyClose(make(chan *amqp091.Error, 1)))
+	return nil
+}
+
+// ensureChannel opens the channel of the engine if needed. The caller must hold mu and have called connect.
 func ensureChannel() error {
 	var err error
-	url, urlObfuscated := buildUrl()
+	_, urlObfuscated := buildUrl(mqconfig)
 
 	if conn == nil || conn.IsClosed() {
-		commonlogger.Warn(fmt.Sprintf("ensureChannel: connection is not initialized or is closed. Reconnecting to RabbitMQ at URL: %s", urlObfuscated))
-		conn, err = amqp091.Dial(url)
-		if err != nil {
-			commonlogger.Error(fmt.Sprintf("ensureChannel: Failed to connect to RabbitMQ: %s", err))
-			return fmt.Errorf("ensureChannel: Failed to connect to RabbitMQ: %w", err)
-		}
+		return recordError(fmt.Errorf("ensureChannel: %w: the connection to %s is closed", ErrNotConnected, urlObfuscated))
 	}
 
 	if channel == nil || channel.IsClosed() {
 		channel, err = conn.Channel()
-		commonlogger.Warn("ensureChannel: channel is not open. Opening Channel")
+		logger.Warn("ensureChannel: channel is not open. Opening Channel")
 		if err != nil {
-			commonlogger.Error(fmt.Sprintf("ensureChannel: Failed to open Channel: %s", err))
-			return fmt.Errorf("ensureChannel: Failed to open Channel: %w", err)
+			logger.Error(fmt.Sprintf("ensureChannel: Failed to open Channel: %s", err))
+			return recordError(fmt.Errorf("ensureChannel: %w: failed to open Channel: %w", ErrNotConnected, err))
+		}
+		watchClose("channel", channel.NotifyClose(make(chan *amqp091.Error, 1)))
+		if err := applyPrefetch(channel); err != nil {
+			return err
 		}
+		if mqconfig.Mandatory {
+			returns := channel.NotifyReturn(make(chan amqp091.Return, 16))
+			utilities.Go(func() { watchReturns(returns) })
+		}
+	}
+	logger.Debug(fmt.Sprintf("ensureChannel: Channel is open and ready to use at url: %s", urlObfuscated))
+	return nil
+}
+
+// applyPrefetch sets the configured PrefetchCount on a channel. The caller must hold mu.
+func applyPrefetch(ch *amqp091.Channel) error {
+	if mqconfig.PrefetchCount <= 0 {
+		return nil
+	}
+	if err := ch.Qos(mqconfig.PrefetchCount, 0, false); err != nil {
+		return recordError(fmt.Errorf("failed to set the prefetch count to %d: %w", mqconfig.PrefetchCount, err))
 	}
-	commonlogger.Debug(fmt.Sprintf("ensureChannel: Channel is open and ready to use at url: %s", urlObfuscated))
 	return nil
 }
 
-func buildUrl() (string, string) {
-	password := mqconfig.Password
+func buildUrl(cfg MQConfiguration) (string, string) {
+	password := cfg.Password
 	obfuscatedPassword := password
 	if password != "" && len(password) > 4 {
 		obfuscatedPassword = password[:4] + "..."
 	}
-	url := fmt.Sprintf("amqp://%s:%s@%s:%d/%s", mqconfig.Username, mqconfig.Password, mqconfig.MqHost, mqconfig.MqPort, mqconfig.VHost)
-	urlObfuscated := fmt.Sprintf("amqp://%s:%s@%s:%d/%s", mqconfig.Username, obfuscatedPassword, mqconfig.MqHost, mqconfig.MqPort, mqconfig.VHost)
-	commonlogger.Debug("Engine: Connection URL: " + urlObfuscated)
+	url := fmt.Sprintf("amqp://%s:%s@%s:%d/%s", cfg.Username, cfg.Password, cfg.MqHost, cfg.MqPort, cfg.VHost)
+	urlObfuscated := fmt.Sprintf("amqp://%s:%s@%s:%d/%s", cfg.Username, obfuscatedPassword, cfg.MqHost, cfg.MqPort, cfg.VHost)
+	logger.Debug("Engine: Connection URL: " + urlObfuscated)
 	return url, urlObfuscated
 }
 
 func ConnectRabbitMQ(ctx context.Context) error {
 	mu.Lock()
-	defer mu.Unlock()
+	logger.Info(fmt.Sprintf("Connecting to RabbitMQ at Host: %s Port: %d VHost: %s", mqconfig.MqHost, mqconfig.MqPort, mqconfig.VHost))
+	mu.Unlock()
 
-	commonlogger.Info(fmt.Sprintf("Connecting to RabbitMQ at Host: %s Port: %d VHost: %s", mqconfig.MqHost, mqconfig.MqPort, mqconfig.VHost))
 	// Connect to RabbitMQ server
-
+	if err := connect(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
 	err := ensureChannel()
 	if err != nil {
-		commonlogger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
 		return fmt.Errorf("failed to ensure channel is open: %w", err)
 	}
 
 	for _, queue := range mqconfig.Queues {
-		commonlogger.Info(fmt.Sprintf("Declaring Queue: %s", queue.Name))
+		logger.Info(fmt.Sprintf("Declaring Queue: %s", queue.Name))
+		if err := validateQueueArgs(queue); err != nil {
+			return recordError(fmt.Errorf("%w: %s - %w", ErrDeclareFailed, queue.Name, err))
+		}
 		_, err = channel.QueueDeclare(
 			queue.Name,                // name
 			queue.Durable,             // durable
@@ -229,26 +510,113 @@ func ConnectRabbitMQ(ctx context.Context) error {
 			amqp091.Table(queue.Args), // arguments converted to amqp091.Table
 		)
 		if err != nil {
-			return fmt.Errorf("failed to declare queue: %s - %w", queue.Name, err)
+			var amqpErr *amqp091.Error
+			if errors.As(err, &amqpErr) && amqpErr.Code == amqp091.PreconditionFailed {
+				err = fmt.Errorf("%w (the queue already exists with different arguments)", err)
+			}
+			return recordError(fmt.Errorf("%w: %s - %w", ErrDeclareFailed, queue.Name, err))
 		}
-		commonlogger.Info(fmt.Sprintf("Queue %s declared and bound successfully", queue.Name))
+		logger.Info(fmt.Sprintf("Queue %s declared and bound successfully", queue.Name))
 	}
+	return nil
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to declare retry queue: %w", err)
+/* =========================
+   Publish options
+   ========================= */
+
+// PublishOption customizes a message before it is published
+type PublishOption func(*publishing)
+
+// publishing is a message about to be published with its routing key
+type publishing struct {
+	amqp091.Publishing
+	routingKey string
+}
+
+// WithDeliveryMode overrides the delivery mode (amqp091.Transient or amqp091.Persistent)
+func WithDeliveryMode(mode uint8) PublishOption {
+	return func(p *publishing) { p.DeliveryMode = mode }
+}
+
+// WithPersistent marks the message as persistent or transient
+func WithPersistent(persistent bool) PublishOption {
+	return func(p *publishing) {
+		if persistent {
+			p.DeliveryMode = amqp091.Persistent
+		} else {
+			p.DeliveryMode = amqp091.Transient
+		}
+	}
+}
+
+// WithExpiration sets the per-message TTL: the broker drops the message (or dead-letters it) when it
+// has not been consumed within d, independently of the queue TTL. d is rounded down to milliseconds.
+// A negative d makes SendMessageToQueue fail with ErrInvalidExpiration.
+func WithExpiration(d time.Duration) PublishOption {
+	return func(p *publishing) { p.Expiration = strconv.FormatInt(d.Milliseconds(), 10) }
+}
+
+// WithPublishRoutingKey publishes the message to the queue's exchange with key as routing key instead
+// of the queue name, e.g. "orders.eu.created" on a topic exchange. With routing key validation enabled,
+// a malformed key makes SendMessageToQueue fail with ErrInvalidRoutingKey before anything is sent.
+func WithPublishRoutingKey(key string) PublishOption {
+	return func(p *publishing) { p.routingKey = key }
+}
+
+// validateExpiration checks that the expiration of a message is empty or a non-negative number of milliseconds
+func validateExpiration(expiration string) error {
+	if expiration == "" {
+		return nil
+	}
+	if ms, err := strconv.ParseInt(expiration, 10, 64); err != nil || ms < 0 {
+		return fmt.Errorf("%w: %q, expected a non-negative number of milliseconds", ErrInvalidExpiration, expiration)
 	}
 	return nil
 }
 
-func SendMessageToQueue(queuename string, message string, system string, contenttype string, correlationId string, headers map[string]interface{}) (string, error) {
-	mu.Lock()
-	defer mu.Unlock()
+// SendMessageToQueue publishes a message to a configured queue. Messages sent to durable queues
+// are persistent by default and the AppId defaults to the configured DefaultAppId when system is empty.
+func SendMessageToQueue(queuename string, message string, system string, contenttype string, correlationId string, headers map[string]interface{}, opts ...PublishOption) (string, error) {
+	return SendMessageToQueueCtx(context.Background(), queuename, message, system, contenttype, correlationId, headers, opts...)
+}
 
-	err := ensureChannel()
-	if err != nil {
-		commonlogger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
-		return "", fmt.Errorf("failed to ensure channel is open: %w", err)
+// SendMessageToQueueCtx is SendMessageToQueue bounded by ctx: when ctx is done before the message
+// is published, it returns promptly with an error wrapping ctx.Err(), e.g. context.DeadlineExceeded.
+// Pass the request context from a handler so that a slow broker can't exceed the handler's own timeout:
+//
+//	commonmqengine.SendMessageToQueueCtx(r.Context(), "orders", body, "", "application/json", id, nil)
+//
+// A publish already handed to the broker when ctx is done still completes in the background.
+// When tracing is enabled, the trace context carried by ctx is propagated in the message headers,
+// unless headers already has a traceparent; see WithTraceContext and WithoutTraceContext.
+func SendMessageToQueueCtx(ctx context.Context, queuename string, message string, system string, contenttype string, correlationId string, headers map[string]interface{}, opts ...PublishOption) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrPublishFailed, err)
+	}
+	if ctx.Done() == nil {
+		return sendMessageToQueue(ctx, queuename, message, system, contenttype, correlationId, headers, opts...)
+	}
+	type result struct {
+		message string
+		err     error
+	}
+	done := make(chan result, 1)
+	utilities.Go(func() {
+		sent, err := sendMessageToQueue(ctx, queuename, message, system, contenttype, correlationId, headers, opts...)
+		done <- result{sent, err}
+	})
+	select {
+	case res := <-done:
+		return res.message, res.err
+	case <-ctx.Done():
+		return "", recordError(fmt.Errorf("%w: %w", ErrPublishFailed, ctx.Err()))
 	}
+}
+
+func sendMessageToQueue(ctx context.Context, queuename string, message string, system string, contenttype string, correlationId string, headers map[string]interface{}, opts ...PublishOption) (string, error) {
+	// The message is checked before connecting, so that an invalid one fails the same way during an outage
+	mu.Lock()
 	var queueConfig *QueueConfiguration
 	for _, queue := range mqconfig.Queues {
 		if queue.Name == queuename {
@@ -256,55 +624,121 @@ func SendMessageToQueue(queuename string, message string, system string, content
 			break
 		}
 	}
-
 	if queueConfig == nil {
-		return "", fmt.Errorf("queue configuration not found for queue: %s", queuename)
+		mu.Unlock()
+		return "", fmt.Errorf("%w: %s", ErrQueueNotConfigured, queuename)
+	}
+	msg, err := newPublishing(ctx, *queueConfig, message, system, contenttype, correlationId, headers, opts)
+	mu.Unlock()
+	if err != nil {
+		return "", err
 	}
 
-	commonlogger.Info(fmt.Sprintf("Sending message to queue: %s", queuename))
-	// Publish a message to the queue
-	headersMap := amqp091.Table{}
-	if headers != nil {
-		headersMap = amqp091.Table(headers)
+	if err := connect(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return "", fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The context may have expired while connecting or waiting for the lock, don't publish a message nobody waits for
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrPublishFailed, err)
+	}
+	err = ensureChannel()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return "", fmt.Errorf("failed to ensure channel is open: %w", err)
 	}
-	err = channel.PublishWithContext(context.Background(),
+	logger.Info(fmt.Sprintf("Sending message to queue: %s", queuename))
+	// Publish a message to the queue
+	err = channel.PublishWithContext(ctx,
 		queueConfig.ExchangeName, // exchange
-		queueConfig.Name,         // routing key
-		false,                    // mandatory
+		msg.routingKey,           // routing key
+		mqconfig.Mandatory,       // mandatory
 		false,                    // immediate
-		amqp091.Publishing{
+		msg.Publishing)
+
+	if err != nil {
+		return "", recordError(fmt.Errorf("%w: %w", ErrPublishFailed, err))
+	}
+	publishedTotal.Add(1)
+	return message, nil
+}
+
+// newPublishing builds the message published to the queue and validates it. The caller must hold mu.
+func newPublishing(ctx context.Context, queueConfig QueueConfiguration, message string, system string, contenttype string, correlationId string, headers map[string]interface{}, opts []PublishOption) (publishing, error) {
+	// Copied so that the trace context isn't added to the caller's map
+	headersMap := amqp091.Table{}
+	for key, value := range headers {
+		headersMap[key] = value
+	}
+	if system == "" {
+		system = mqconfig.DefaultAppId
+	}
+	msg := publishing{
+		Publishing: amqp091.Publishing{
 			ContentType:   contenttype,
 			Body:          []byte(message),
 			CorrelationId: correlationId,
 			AppId:         system,
 			Headers:       headersMap,
-		})
-
-	if err != nil {
-		return "", fmt.Errorf("failed to publish message: %w", err)
+		},
+		routingKey: queueConfig.Name,
 	}
-	return message, nil
+	if queueConfig.Durable {
+		msg.DeliveryMode = amqp091.Persistent
+	}
+	if _, set := headersMap[TraceParentHeader]; mqconfig.Tracing && !set {
+		injectTrace(ctx, &msg.Publishing)
+	}
+	for _, opt := range opts {
+		opt(&msg)
+	}
+	if mqconfig.ValidateRoutingKeys {
+		if err := ValidateRoutingKey(msg.routingKey); err != nil {
+			return publishing{}, err
+		}
+	}
+	if err := validateExpiration(msg.Expiration); err != nil {
+		return publishing{}, err
+	}
+	return msg, nil
 }
 
 // ConsumeFromQueue reads a message from the RabbitMQ queue
 // If autoAck is true, the message will be acknowledged automatically when consumed
 // Otherwise, the caller is responsible for acknowledging the message
 func ConsumeFromQueue(queueName string, autoAck bool) (<-chan amqp091.Delivery, error) {
+	_, deliveries, err := consumeFromQueue(queueName, "", autoAck)
+	return deliveries, err
+}
 
+// consumeFromQueue consumes the queue on the engine channel under the consumer tag, generated by the
+// library when empty, and returns the channel with the deliveries
+func consumeFromQueue(queueName string, tag string, autoAck bool) (*amqp091.Channel, <-chan amqp091.Delivery, error) {
+	if err := connect(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return nil, nil, fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
 	mu.Lock()
 	defer mu.Unlock()
 
 	err := ensureChannel()
 	if err != nil {
-		commonlogger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
-		return nil, fmt.Errorf("failed to ensure channel is open: %w", err)
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return nil, nil, fmt.Errorf("failed to ensure channel is open: %w", err)
 	}
 
-	commonlogger.Info(fmt.Sprintf("Starting to consume from queue: %s", queueName))
+	logger.Info(fmt.Sprintf("Starting to consume from queue: %s", queueName))
+	if autoAck && !mqconfig.AllowAutoAck {
+		logger.Warn(fmt.Sprintf("Consuming from queue %s with auto-ack: messages are lost if the handler fails. "+
+			"Use RegisterConsumer or manual ack instead, or set WithAllowAutoAck(true) if this is intended", queueName))
+	}
 
 	deliveries, err := channel.Consume(
 		queueName, // queue name
-		"",        // consumer tag (empty string generates a unique tag)
+		tag,       // consumer tag (empty string generates a unique tag)
 		autoAck,   // auto-ack
 		false,     // exclusive
 		false,     // no-local
@@ -312,11 +746,11 @@ func ConsumeFromQueue(queueName string, autoAck bool) (<-chan amqp091.Delivery,
 		nil,       // arguments
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register consumer: %w", err)
+		return nil, nil, recordError(fmt.Errorf("failed to register consumer: %w", err))
 	}
 
-	commonlogger.Info("Consumer registered successfully")
-	return deliveries, nil
+	logger.Info("Consumer registered successfully")
+	return channel, countDeliveries(deliveries, autoAck), nil
 }
 
 func SaveMessageToFile(correlationId string, body string, headers map[string]interface{}) error {
@@ -341,26 +775,45 @@ func SaveMessageToFile(correlationId string, body string, headers map[string]int
 	return nil
 }
 
+// OriginalQueueHeader records the queue a message was first consumed from, so that it can be
+// dead-lettered to that queue's DLQ after going through the retry queue
+const OriginalQueueHeader = "X-Original-Queue"
+
+// MoveMessageToRetry republishes a failed message to the retry queue with an incremented retry count.
+// Once maxRetries is exceeded it goes to the dead-letter queue of the queue it was consumed from
+// (see WithDeadLetterQueue), or to deadLetterQueue when that queue has none configured.
 func MoveMessageToRetry(message amqp091.Delivery, retryQueue string, deadLetterQueue string, retryTTL int, maxRetries int32) error {
+	if err := connect(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
 	mu.Lock()
 	defer mu.Unlock()
 
 	err := ensureChannel()
 	if err != nil {
-		commonlogger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
 		return fmt.Errorf("failed to ensure channel is open: %w", err)
 	}
 
+	if message.Headers == nil {
+		message.Headers = amqp091.Table{}
+	}
 	headers := message.Headers
 	retryCount := int32(0)
 
 	if headers["X-Retry-Count"] != nil {
-		if val, ok := headers["X-Retry-Count"].(int32); ok {
-			retryCount = val
+		// The header is decoded with the integer width it was encoded with
+		if val, ok := argToInt64(headers["X-Retry-Count"]); ok {
+			retryCount = int32(val)
 		}
 		headers["X-Retry-Count"] = retryCount + 1
 	} else {
-		headers["X-Retry-Count"] = 1
+		headers["X-Retry-Count"] = int32(1)
+	}
+	if _, ok := headers[OriginalQueueHeader].(string); !ok && message.Exchange == "" {
+		// Messages published on the default exchange are routed by queue name
+		headers[OriginalQueueHeader] = message.RoutingKey
 	}
 
 	if retryTTL > 0 {
@@ -370,30 +823,54 @@ func MoveMessageToRetry(message amqp091.Delivery, retryQueue string, deadLetterQ
 	}
 
 	if retryCount >= int32(maxRetries+1) {
-		commonlogger.Debug("Max Retry Attempts reached. Moving to Dead Letter Queue.")
+		if originalQueue, ok := headers[OriginalQueueHeader].(string); ok {
+			if queueDLQ := deadLetterQueueFor(originalQueue); queueDLQ != "" {
+				deadLetterQueue = queueDLQ
+			}
+		}
+		logger.Debug(fmt.Sprintf("Max Retry Attempts reached. Moving to Dead Letter Queue: %s", deadLetterQueue))
 		message.Expiration = ""
 		retryQueue = deadLetterQueue
 	}
 
-	err = CopyMessageToQueue(message, retryQueue)
+	err = copyMessageToQueue(message, retryQueue)
 	if err != nil {
 		return fmt.Errorf("failed to copy message to retry queue: %w", err)
 	}
-	commonlogger.Debug(fmt.Sprintf("Message moved to retry queue: %s with headers: %v, retryCount: %d and expiration: %s", retryQueue, headers, retryCount, message.Expiration))
+	logger.Debug(fmt.Sprintf("Message moved to retry queue: %s with headers: %v, retryCount: %d and expiration: %s", retryQueue, headers, retryCount, message.Expiration))
 	return nil
 }
 
+// deadLetterQueueFor returns the dead-letter queue configured for a queue, if any.
+// The caller must hold mu.
+func deadLetterQueueFor(queueName string) string {
+	for _, queue := range mqconfig.Queues {
+		if queue.Name == queueName {
+			return queue.DeadLetterQueue
+		}
+	}
+	return ""
+}
+
 func CopyMessageToQueue(message amqp091.Delivery, targetQueue string) error {
+	if err := connect(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		return fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
 	mu.Lock()
 	defer mu.Unlock()
-	// retryTTL := 0
 
 	err := ensureChannel()
 	if err != nil {
-		commonlogger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
+		logger.Error(fmt.Sprintf("Failed to ensure channel is open: %s", err))
 		return fmt.Errorf("failed to ensure channel is open: %w", err)
 	}
+	return copyMessageToQueue(message, targetQueue)
+}
 
+// copyMessageToQueue publishes a copy of the message to the queue. The caller must hold mu
+// and have ensured the channel is open.
+func copyMessageToQueue(message amqp091.Delivery, targetQueue string) error {
 	headers := message.Headers
 
 	publishing := amqp091.Publishing{
@@ -405,11 +882,13 @@ func CopyMessageToQueue(message amqp091.Delivery, targetQueue string) error {
 		ReplyTo:       message.ReplyTo,
 		MessageId:     message.MessageId,
 		Timestamp:     message.Timestamp,
+		DeliveryMode:  message.DeliveryMode,
+		Expiration:    message.Expiration,
 	}
 
-	commonlogger.Debug(fmt.Sprintf("Copying message to queue: %s with headers: %v", targetQueue, headers))
+	logger.Debug(fmt.Sprintf("Copying message to queue: %s with headers: %v", targetQueue, headers))
 	// Publish the message to the target queue
-	err = channel.PublishWithContext(
+	err := channel.PublishWithContext(
 		context.Background(),
 		"", // default exchange to publish to the queue directly
 		targetQueue,
@@ -418,12 +897,14 @@ func CopyMessageToQueue(message amqp091.Delivery, targetQueue string) error {
 		publishing,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to copy message: %w", err)
+		return recordError(fmt.Errorf("%w: failed to copy message: %w", ErrPublishFailed, err))
 	}
+	publishedTotal.Add(1)
 	return nil
 }
 
 func Close() {
+	stopConsumers()
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -455,30 +936,49 @@ func GetConnection() *amqp091.Connection {
 	return nil
 }
 
-// IsHealthy checks if the RabbitMQ connection and channel are healthy.
+// IsHealthy checks if the RabbitMQ connection and channel are open, see State
 func IsHealthy() bool {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if conn == nil || channel == nil {
-		commonlogger.Error("RabbitMQ connection or channel is not initialized")
-		return false
-	}
-
-	if conn.IsClosed() {
-		commonlogger.Error("RabbitMQ connection is closed")
+	if state := State(); state != StateConnected {
+		logger.Error(fmt.Sprintf("RabbitMQ is not healthy: %s", state))
 		return false
 	}
-
 	return true
 }
 
+// InitMQEngine stores the configuration, connects to RabbitMQ and declares the configured queues.
+// It returns the connection error when RequireConnectionAtStartup is set and otherwise keeps retrying
+// in the background. When the broker closes the connection later on, it reconnects in the background
+// until ctx is cancelled. It can be called again, e.g. with more queues: declaring an existing queue
+// with the same arguments is a no-op, and the current connection is dropped if the broker settings changed.
 func InitMQEngine(ctx context.Context, config MQConfiguration) error {
+	if config.DefaultAppId == "" && commonconfig.GetConfig() != nil {
+		config.DefaultAppId = commonconfig.GetConfig().GetServiceName()
+	}
+	mu.Lock()
+	previousUrl, _ := buildUrl(mqconfig)
+	newUrl, urlObfuscated := buildUrl(config)
+	if conn != nil && previousUrl != newUrl {
+		logger.Info(fmt.Sprintf("RabbitMQ settings changed, reconnecting to %s", urlObfuscated))
+		if channel != nil {
+			channel.Close()
+		}
+		conn.Close()
+		channel = nil
+		conn = nil
+	}
 	mqconfig = config
+	reconnectCtx = ctx
+	mu.Unlock()
+	initialized.Store(true)
 	if err := ConnectRabbitMQ(ctx); err != nil {
-		commonlogger.Error(fmt.Sprintf("Failed to connect to RabbitMQ: %s", err))
-		return err
+		if config.RequireConnectionAtStartup {
+			logger.Error(fmt.Sprintf("Failed to connect to RabbitMQ: %s", err))
+			return err
+		}
+		logger.Warn(fmt.Sprintf("Failed to connect to RabbitMQ, starting in degraded mode: %s", err))
+		startReconnector(ctx)
+		return nil
 	}
-	commonlogger.Info(fmt.Sprintf("RabbitMQ Engine initialized successfully: host=%s, port=%d, vhost=%s", mqconfig.MqHost, mqconfig.MqPort, mqconfig.VHost))
+	logger.Info(fmt.Sprintf("RabbitMQ Engine initialized successfully: host=%s, port=%d, vhost=%s", config.MqHost, config.MqPort, config.VHost))
 	return nil
 }
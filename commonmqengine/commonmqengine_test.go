@@ -0,0 +1,453 @@
+package commonmqengine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestMain(m *testing.M) {
+	commonlogger.Discard()
+	os.Exit(m.Run())
+}
+
+// syncBuffer is a bytes.Buffer safe for the goroutines of the engine logging into it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs makes the logger write to the returned buffer until the end of the test
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	commonlogger.SetOutput(buf)
+	t.Cleanup(commonlogger.Discard)
+	return buf
+}
+
+func TestStats(t *testing.T) {
+	b := useFakeBroker(t)
+	startEngine(t, WithHost("rabbit.test"), WithVHost("orders"), WithQueues(NewQueue("orders"), NewQueue("audit")))
+
+	before := Stats()
+	if !before.Connected {
+		t.Fatal("Stats().Connected = false after InitMQEngine")
+	}
+	if before.Host != "rabbit.test" || before.VHost != "orders" || before.Port != 5672 {
+		t.Errorf("Stats() = %s:%d/%s, want rabbit.test:5672/orders", before.Host, before.Port, before.VHost)
+	}
+
+	tests := []struct {
+		name      string
+		queue     string
+		published uint64
+		err       error
+	}{
+		{name: "configured queue", queue: "orders", published: 1},
+		{name: "another configured queue", queue: "audit", published: 1},
+		{name: "unknown queue", queue: "missing", published: 0, err: ErrQueueNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := Stats().Published
+			_, err := SendMessageToQueue(tt.queue, "hello", "", "text/plain", "id-1", nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("SendMessageToQueue() error = %v, want %v", err, tt.err)
+			}
+			if got := Stats().Published - start; got != tt.published {
+				t.Errorf("published_total increased by %d, want %d", got, tt.published)
+			}
+		})
+	}
+	eventually(t, "the messages to reach the broker", func() bool { return len(b.messages("orders")) == 1 })
+
+	stats := Stats()
+	if len(stats.Queues) != 2 || stats.Queues[0] != "orders" || stats.Queues[1] != "audit" {
+		t.Errorf("Stats().Queues = %v, want [orders audit]", stats.Queues)
+	}
+}
+
+func TestAmqpConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []MQOption
+		heartbeat time.Duration
+		locale    string
+		dial      bool
+	}{
+		{name: "defaults", heartbeat: 10 * time.Second, locale: "en_US", dial: true},
+		{name: "custom", opts: []MQOption{WithHeartbeat(3 * time.Second), WithLocale("pt_PT"), WithDialTimeout(time.Second)}, heartbeat: 3 * time.Second, locale: "pt_PT", dial: true},
+		{name: "no dial timeout", opts: []MQOption{WithDialTimeout(0)}, heartbeat: 10 * time.Second, locale: "en_US", dial: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, tt.opts...)
+			if len(b.dials) != 1 {
+				t.Fatalf("%d dials, want 1", len(b.dials))
+			}
+			config := b.dials[0].config
+			if config.Heartbeat != tt.heartbeat || config.Locale != tt.locale || (config.Dial != nil) != tt.dial {
+				t.Errorf("dialed with heartbeat %s, locale %q, dial set %v; want %s, %q, %v",
+					config.Heartbeat, config.Locale, config.Dial != nil, tt.heartbeat, tt.locale, tt.dial)
+			}
+		})
+	}
+}
+
+func TestDefaultMessageProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		durable bool
+		system  string
+		opts    []PublishOption
+		persist bool
+		appId   string
+	}{
+		{name: "durable queue", durable: true, persist: true, appId: "svc"},
+		{name: "transient queue", durable: false, appId: "svc"},
+		{name: "persistence overridden", durable: true, opts: []PublishOption{WithPersistent(false)}, appId: "svc"},
+		{name: "transient queue made persistent", durable: false, opts: []PublishOption{WithPersistent(true)}, persist: true, appId: "svc"},
+		{name: "explicit system", durable: true, system: "billing", persist: true, appId: "billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithDefaultAppId("svc"), WithQueues(NewQueue("orders", WithDurable(tt.durable))))
+			if _, err := SendMessageToQueue("orders", "hello", tt.system, "text/plain", "id-1", nil, tt.opts...); err != nil {
+				t.Fatalf("SendMessageToQueue() error = %v", err)
+			}
+			eventually(t, "the message to reach the broker", func() bool { return len(b.publishedTo("orders")) == 1 })
+			message := b.publishedTo("orders")[0]
+			if persistent := message.DeliveryMode == amqp091.Persistent; persistent != tt.persist {
+				t.Errorf("DeliveryMode = %d, persistent = %t, want %t", message.DeliveryMode, persistent, tt.persist)
+			}
+			if message.AppId != tt.appId {
+				t.Errorf("AppId = %q, want %q", message.AppId, tt.appId)
+			}
+		})
+	}
+}
+
+func TestRequireConnectionAtStartup(t *testing.T) {
+	tests := []struct {
+		name    string
+		require bool
+		err     error
+		state   ConnectionState
+	}{
+		{name: "fail fast", require: true, err: ErrNotConnected, state: StateDisconnected},
+		{name: "degraded", require: false, state: StateReconnecting},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastReconnect(t)
+			b := useFakeBroker(t)
+			b.setDialHook(func(string) error { return errors.New("connection refused") })
+
+			err := InitMQEngine(testContext(t), *NewMQConfiguration(WithRequireConnectionAtStartup(tt.require), WithQueues(NewQueue("orders"))))
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("InitMQEngine() error = %v, want %v", err, tt.err)
+			}
+			if got := State(); got != tt.state {
+				t.Fatalf("State() = %s against an unreachable broker, want %s", got, tt.state)
+			}
+
+			// Once the broker is reachable the degraded engine connects on its own
+			b.setDialHook(nil)
+			if tt.require {
+				time.Sleep(50 * time.Millisecond)
+				if got := State(); got != StateDisconnected {
+					t.Errorf("State() = %s after the broker came back, want %s", got, StateDisconnected)
+				}
+				return
+			}
+			eventually(t, "the engine to reconnect", func() bool { return State() == StateConnected })
+			if _, err := SendMessageToQueue("orders", "hello", "", "text/plain", "id-1", nil); err != nil {
+				t.Errorf("SendMessageToQueue() after reconnecting error = %v", err)
+			}
+		})
+	}
+}
+
+func TestAutoAckWarning(t *testing.T) {
+	tests := []struct {
+		name    string
+		autoAck bool
+		allow   bool
+		warned  bool
+	}{
+		{name: "manual ack", autoAck: false},
+		{name: "auto-ack", autoAck: true, warned: true},
+		{name: "auto-ack allowed", autoAck: true, allow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeBroker(t)
+			startEngine(t, WithAllowAutoAck(tt.allow), WithQueues(NewQueue("orders")))
+			logs := captureLogs(t)
+
+			if _, err := ConsumeFromQueue("orders", tt.autoAck); err != nil {
+				t.Fatalf("ConsumeFromQueue() error = %v", err)
+			}
+			warned := strings.Contains(logs.String(), "level=WARN") && strings.Contains(logs.String(), "Consuming from queue orders with auto-ack")
+			if warned != tt.warned {
+				t.Errorf("auto-ack warning logged %t, want %t: %s", warned, tt.warned, logs.String())
+			}
+		})
+	}
+}
+
+func TestMoveMessageToRetryDeadLetterQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		message amqp091.Delivery
+		target  string
+		retries int32
+	}{
+		{name: "retry", message: amqp091.Delivery{RoutingKey: "orders"}, target: "retry", retries: 1},
+		{name: "exhausted from orders", message: amqp091.Delivery{RoutingKey: "orders", Headers: amqp091.Table{"X-Retry-Count": int32(2)}},
+			target: "orders.dlq", retries: 3},
+		{name: "exhausted from invoices", message: amqp091.Delivery{RoutingKey: "invoices", Headers: amqp091.Table{"X-Retry-Count": int32(2)}},
+			target: "invoices.dlq", retries: 3},
+		{name: "exhausted back from the retry queue", message: amqp091.Delivery{RoutingKey: "retry", Headers: amqp091.Table{"X-Retry-Count": int32(2), OriginalQueueHeader: "invoices"}},
+			target: "invoices.dlq", retries: 3},
+		{name: "queue without its own DLQ", message: amqp091.Delivery{RoutingKey: "audit", Headers: amqp091.Table{"X-Retry-Count": int32(2)}},
+			target: "dlq", retries: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(
+				NewQueue("orders", WithDeadLetterQueue("orders.dlq")),
+				NewQueue("invoices", WithDeadLetterQueue("invoices.dlq")),
+				NewQueue("audit"),
+			))
+			tt.message.Body = []byte("failed")
+			if err := MoveMessageToRetry(tt.message, "retry", "dlq", 1000, 1); err != nil {
+				t.Fatalf("MoveMessageToRetry() error = %v", err)
+			}
+			eventually(t, "the message to reach "+tt.target, func() bool { return len(b.publishedTo(tt.target)) == 1 })
+			for _, queue := range []string{"retry", "orders.dlq", "invoices.dlq", "dlq"} {
+				if queue != tt.target && len(b.publishedTo(queue)) != 0 {
+					t.Errorf("the message also went to %s", queue)
+				}
+			}
+			headers := b.publishedTo(tt.target)[0].Headers
+			if count, _ := argToInt64(headers["X-Retry-Count"]); count != int64(tt.retries) {
+				t.Errorf("X-Retry-Count = %v, want %d", headers["X-Retry-Count"], tt.retries)
+			}
+		})
+	}
+}
+
+func TestQueueDeclareFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue QueueConfiguration
+		want  fakeDeclare
+	}{
+		{name: "defaults", queue: NewQueue("orders"), want: fakeDeclare{Name: "orders", Durable: true}},
+		{name: "transient auto-delete", queue: NewQueue("audit", WithDurable(false), WithAutoDelete(true)),
+			want: fakeDeclare{Name: "audit", AutoDelete: true}},
+		{name: "exclusive", queue: NewQueue("replies", WithDurable(false), WithExclusive(true)),
+			want: fakeDeclare{Name: "replies", Exclusive: true}},
+		{name: "dead letter arguments", queue: NewQueue("retry", WithArgs(map[string]interface{}{
+			"x-message-ttl": int32(60000), "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "orders",
+		})), want: fakeDeclare{Name: "retry", Durable: true, Args: amqp091.Table{
+			"x-message-ttl": int32(60000), "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "orders",
+		}}},
+	}
+	b := useFakeBroker(t)
+	queues := make([]QueueConfiguration, 0, len(tests))
+	for _, tt := range tests {
+		queues = append(queues, tt.queue)
+	}
+	startEngine(t, WithQueues(queues...))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			declare, ok := b.declared(tt.want.Name)
+			if !ok {
+				t.Fatalf("queue %s was not declared", tt.want.Name)
+			}
+			if len(declare.Args) == 0 {
+				declare.Args = nil
+			}
+			if !reflect.DeepEqual(declare, tt.want) {
+				t.Errorf("declared %+v, want %+v", declare, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithExpiration(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []PublishOption
+		expiration string
+		err        error
+	}{
+		{name: "no expiration", expiration: ""},
+		{name: "seconds", opts: []PublishOption{WithExpiration(30 * time.Second)}, expiration: "30000"},
+		{name: "rounded down to milliseconds", opts: []PublishOption{WithExpiration(1500 * time.Microsecond)}, expiration: "1"},
+		{name: "zero", opts: []PublishOption{WithExpiration(0)}, expiration: "0"},
+		{name: "negative", opts: []PublishOption{WithExpiration(-time.Second)}, err: ErrInvalidExpiration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("prices", WithArgs(map[string]interface{}{"x-message-ttl": int32(60000)}))))
+			_, err := SendMessageToQueue("prices", "1.23", "", "text/plain", "id-1", nil, tt.opts...)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("SendMessageToQueue() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				time.Sleep(20 * time.Millisecond)
+				if n := len(b.publishedTo("prices")); n != 0 {
+					t.Errorf("%d messages published with an invalid expiration", n)
+				}
+				return
+			}
+			eventually(t, "the message to reach the broker", func() bool { return len(b.publishedTo("prices")) == 1 })
+			if got := b.publishedTo("prices")[0].Expiration; got != tt.expiration {
+				t.Errorf("Expiration = %q, want %q", got, tt.expiration)
+			}
+		})
+	}
+}
+
+func TestInitMQEngineAgain(t *testing.T) {
+	b := useFakeBroker(t)
+	ctx := testContext(t)
+	declares := func(queue string) int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		n := 0
+		for _, declare := range b.declares {
+			if declare.Name == queue {
+				n++
+			}
+		}
+		return n
+	}
+	steps := []struct {
+		name     string
+		opts     []MQOption
+		dials    int
+		vhost    string
+		declares map[string]int
+	}{
+		{name: "first call", opts: []MQOption{WithQueues(NewQueue("orders"))},
+			dials: 1, vhost: "/", declares: map[string]int{"orders": 1}},
+		{name: "same settings with one more queue keeps the connection", opts: []MQOption{WithQueues(NewQueue("orders"), NewQueue("audit"))},
+			dials: 1, vhost: "/", declares: map[string]int{"orders": 2, "audit": 1}},
+		{name: "changed settings reconnect", opts: []MQOption{WithVHost("billing"), WithQueues(NewQueue("orders"))},
+			dials: 2, vhost: "billing", declares: map[string]int{"orders": 3, "audit": 1}},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := InitMQEngine(ctx, *NewMQConfiguration(step.opts...)); err != nil {
+				t.Fatalf("InitMQEngine() error = %v", err)
+			}
+			if got := b.dialCount(); got != step.dials {
+				t.Errorf("%d dials, want %d", got, step.dials)
+			}
+			if got := Stats().VHost; got != step.vhost {
+				t.Errorf("Stats().VHost = %q, want %q", got, step.vhost)
+			}
+			for queue, want := range step.declares {
+				if got := declares(queue); got != want {
+					t.Errorf("queue %s declared %d times, want %d", queue, got, want)
+				}
+			}
+			if State() != StateConnected {
+				t.Errorf("State() = %s, want %s", State(), StateConnected)
+			}
+		})
+	}
+}
+
+func TestSendMessageToQueueCtx(t *testing.T) {
+	const slowDial = 500 * time.Millisecond
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		slow     bool
+		err      error
+		returnIn time.Duration
+	}{
+		{name: "no deadline", err: nil, returnIn: time.Second},
+		{name: "deadline met", timeout: time.Second, returnIn: time.Second},
+		{name: "expired context", timeout: -time.Second, err: context.DeadlineExceeded, returnIn: 50 * time.Millisecond},
+		{name: "short deadline with a slow broker", timeout: 50 * time.Millisecond, slow: true, err: context.DeadlineExceeded, returnIn: 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			if tt.slow {
+				// The engine starts degraded and connects on the first publish, to a broker slow to answer
+				b.setDialHook(func(string) error { return errors.New("connection refused") })
+			}
+			startEngine(t, WithQueues(NewQueue("orders")))
+			if tt.slow {
+				b.setDialHook(func(string) error { time.Sleep(slowDial); return nil })
+			}
+
+			// The context of an HTTP request with a deadline, as a handler would pass it
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			req := httptest.NewRequest(http.MethodPost, "/orders", nil).WithContext(ctx)
+
+			start := time.Now()
+			_, err := SendMessageToQueueCtx(req.Context(), "orders", "hello", "", "text/plain", "id-1", nil)
+			if elapsed := time.Since(start); elapsed > tt.returnIn {
+				t.Errorf("SendMessageToQueueCtx() returned after %s, want within %s", elapsed, tt.returnIn)
+			}
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("SendMessageToQueueCtx() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, ErrPublishFailed) {
+					t.Errorf("SendMessageToQueueCtx() error = %v, want ErrPublishFailed", err)
+				}
+				if tt.slow {
+					// The publish abandoned by the caller is not sent once the broker answers
+					time.Sleep(slowDial + 100*time.Millisecond)
+				}
+				if n := len(b.publishedTo("orders")); n != 0 {
+					t.Errorf("%d messages published after the deadline", n)
+				}
+				return
+			}
+			eventually(t, "the message to reach the broker", func() bool { return len(b.publishedTo("orders")) == 1 })
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package commonmqengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+	"github.com/google/uuid"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// ConsumerHandler processes a single delivery. Returning nil acks the message,
+// returning an error nacks it without requeue so that it is dead-lettered. A panic in the handler
+// is recovered and handled like an error wrapping ErrHandlerPanic.
+type ConsumerHandler func(amqp091.Delivery) error
+
+// ConsumerHandlerCtx is a ConsumerHandler receiving a context, which carries the trace context of the
+// message and is cancelled when the handler timeout (see WithHandlerTimeout) is exceeded
+type ConsumerHandlerCtx func(ctx context.Context, delivery amqp091.Delivery) error
+
+// ConsumerOption customizes a managed consumer
+type ConsumerOption func(*managedConsumer)
+
+// WithHandlerTimeout limits the time the handler can spend on a delivery. When it is exceeded the
+// handler's context is cancelled and the message is nacked, so that it goes to the retry/dead-letter path.
+func WithHandlerTimeout(timeout time.Duration) ConsumerOption {
+	return func(c *managedConsumer) { c.timeout = timeout }
+}
+
+// WithConcurrency overrides the queue's ConsumerConcurrency for this consumer
+func WithConcurrency(n int) ConsumerOption {
+	return func(c *managedConsumer) {
+		if n > 0 {
+			c.workers = n
+		}
+	}
+}
+
+type managedConsumer struct {
+	queue   string
+	workers int
+	handler ConsumerHandlerCtx
+	timeout time.Duration
+	stop    chan struct{}
+	// done is closed when the consumer has stopped and its workers returned
+	done       chan struct{}
+	batch      *batchAck
+	ownChannel bool
+
+	// channelMu guards the channel the consumer is subscribed on, which is the engine channel
+	// unless it has a dedicated one, and its consumer tag
+	channelMu sync.Mutex
+	channel   *amqp091.Channel
+	tag       string
+	closed    bool
+}
+
+// withOwnChannel makes the consumer consume on a dedicated channel, which is closed when it is stopped
+func withOwnChannel() ConsumerOption {
+	return func(c *managedConsumer) { c.ownChannel = true }
+}
+
+// resubscribeBackoff is the wait before each attempt to re-register a consumer whose channel closed
+var resubscribeBackoff = utilities.ExponentialBackoff(time.Second, time.Minute)
+
+var (
+	consumersMu sync.Mutex
+	consumers   = map[string]*managedConsumer{}
+)
+
+// queueConcurrency returns the configured consumer concurrency for a queue, defaulting to 1
+func queueConcurrency(queueName string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, queue := range mqconfig.Queues {
+		if queue.Name == queueName && queue.ConsumerConcurrency > 0 {
+			return queue.ConsumerConcurrency
+		}
+	}
+	return 1
+}
+
+// maxRegisteredConsumers returns the configured MaxConsumers
+func maxRegisteredConsumers() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return mqconfig.MaxConsumers
+}
+
+// RegisterConsumer starts a managed consumer on the queue. It runs as many workers as the
+// queue's ConsumerConcurrency, all sharing the same delivery channel and handler.
+// If the delivery channel closes (e.g. after a connection loss) the consumer re-registers itself.
+// When MaxConsumers is set, registering beyond it returns ErrTooManyConsumers.
+func RegisterConsumer(queueName string, handler ConsumerHandler, opts ...ConsumerOption) error {
+	if handler == nil {
+		return fmt.Errorf("consumer handler for queue %s is nil", queueName)
+	}
+	return RegisterConsumerCtx(queueName, func(_ context.Context, delivery amqp091.Delivery) error {
+		return handler(delivery)
+	}, opts...)
+}
+
+// RegisterConsumerCtx is RegisterConsumer for a handler that receives a context
+func RegisterConsumerCtx(queueName string, handler ConsumerHandlerCtx, opts ...ConsumerOption) error {
+	if handler == nil {
+		return fmt.Errorf("consumer handler for queue %s is nil", queueName)
+	}
+	consumersMu.Lock()
+	if _, exists := consumers[queueName]; exists {
+		consumersMu.Unlock()
+		return fmt.Errorf("a consumer is already registered for queue: %s", queueName)
+	}
+	maxConsumers := maxRegisteredConsumers()
+	if maxConsumers > 0 && len(consumers) >= maxConsumers {
+		registered := len(consumers)
+		consumersMu.Unlock()
+		logger.Warn(fmt.Sprintf("Refusing consumer for queue %s: %d/%d consumers registered", queueName, registered, maxConsumers))
+		return fmt.Errorf("%w: %d consumers registered, cannot add queue %s", ErrTooManyConsumers, registered, queueName)
+	}
+	consumer := &managedConsumer{
+		queue:   queueName,
+		workers: queueConcurrency(queueName),
+		handler: handler,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(consumer)
+	}
+	if consumer.batch != nil && consumer.workers > 1 {
+		logger.Warn(fmt.Sprintf("Batch ack consumer for queue %s runs a single worker instead of %d", queueName, consumer.workers))
+		consumer.workers = 1
+	}
+	consumers[queueName] = consumer
+	registered := len(consumers)
+	consumersMu.Unlock()
+	if maxConsumers > 0 {
+		logger.Info(fmt.Sprintf("Registered consumer for queue %s (%d/%d consumers)", queueName, registered, maxConsumers))
+	} else {
+		logger.Info(fmt.Sprintf("Registered consumer for queue %s (%d consumers)", queueName, registered))
+	}
+
+	deliveries, err := consumer.subscribe()
+	if err != nil {
+		consumersMu.Lock()
+		delete(consumers, queueName)
+		consumersMu.Unlock()
+		return err
+	}
+
+	utilities.Go(func() { consumer.run(deliveries) })
+	return nil
+}
+
+// RegisterConsumers starts a managed consumer for each queue, sharing the handler and options.
+// Every queue is attempted; the errors of the ones that failed are joined.
+func RegisterConsumers(queues []string, handler ConsumerHandler, opts ...ConsumerOption) error {
+	var errs []error
+	for _, queueName := range queues {
+		if err := RegisterConsumer(queueName, handler, opts...); err != nil {
+			logger.Error(fmt.Sprintf("Failed to register consumer for queue %s: %s", queueName, err.Error()))
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ConsumerWorkers returns the number of workers running for the managed consumer of a queue
+func ConsumerWorkers(queueName string) int {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	if consumer, exists := consumers[queueName]; exists {
+		return consumer.workers
+	}
+	return 0
+}
+
+// stopConsumers stops every managed consumer from re-registering and forgets them
+func stopConsumers() {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	for queueName, consumer := range consumers {
+		close(consumer.stop)
+		delete(consumers, queueName)
+	}
+}
+
+// run processes deliveries with the configured workers and re-registers the consumer
+// whenever the delivery channel closes, until the consumer is stopped. The channel closes on a
+// connection loss and also when the broker cancels the consumer, e.g. because its queue was deleted.
+// The attempts back off exponentially up to a minute.
+func (c *managedConsumer) run(deliveries <-chan amqp091.Delivery) {
+	defer close(c.done)
+	for {
+		logger.Info(fmt.Sprintf("Starting %d consumer workers for queue: %s", c.workers, c.queue))
+		var wg sync.WaitGroup
+		for i := 0; i < c.workers; i++ {
+			wg.Add(1)
+			utilities.Go(func() {
+				defer wg.Done()
+				c.work(deliveries)
+			})
+		}
+		wg.Wait()
+		c.dropSubscription()
+
+		for attempt := 1; ; attempt++ {
+			delay := resubscribeBackoff(attempt)
+			select {
+			case <-c.stop:
+				logger.Info(fmt.Sprintf("Consumer for queue %s stopped", c.queue))
+				return
+			case <-time.After(delay):
+			}
+			var err error
+			deliveries, err = c.subscribe()
+			if errors.Is(err, errConsumerStopped) {
+				continue
+			}
+			if err == nil {
+				commonmetrics.ConsumerResubscriptions.WithLabelValues(c.queue, "success").Inc()
+				logger.Info(fmt.Sprintf("Re-registered consumer for queue %s after %d attempts", c.queue, attempt))
+				break
+			}
+			commonmetrics.ConsumerResubscriptions.WithLabelValues(c.queue, "failure").Inc()
+			logger.Error(fmt.Sprintf("Failed to re-register consumer for queue %s (attempt %d): %s", c.queue, attempt, err.Error()))
+		}
+	}
+}
+
+// errConsumerStopped is returned by subscribe when the consumer was stopped while subscribing
+var errConsumerStopped = errors.New("consumer stopped")
+
+// subscribe starts consuming the queue with manual ack, under a consumer tag of its own
+func (c *managedConsumer) subscribe() (<-chan amqp091.Delivery, error) {
+	tag := fmt.Sprintf("%s-%s", c.queue, uuid.NewString())
+	var ch *amqp091.Channel
+	var deliveries <-chan amqp091.Delivery
+	var err error
+	if c.dedicated() {
+		ch, deliveries, err = consumeOnOwnChannel(c.queue, tag)
+	} else {
+		ch, deliveries, err = consumeFromQueue(c.queue, tag, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	if c.closed {
+		if c.dedicated() {
+			ch.Close()
+		} else if err := ch.Cancel(tag, false); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to cancel consumer for queue %s: %s", c.queue, err.Error()))
+		}
+		return nil, errConsumerStopped
+	}
+	c.channel, c.tag = ch, tag
+	return deliveries, nil
+}
+
+// dedicated reports whether the consumer runs on a channel of its own rather than the engine channel
+func (c *managedConsumer) dedicated() bool {
+	return c.batch != nil || c.ownChannel
+}
+
+// dropSubscription cancels the consumer tag once the workers returned, so that the broker doesn't keep
+// sending deliveries to a consumer nobody reads before it subscribes again. A dedicated channel is closed.
+func (c *managedConsumer) dropSubscription() {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	if c.channel == nil {
+		return
+	}
+	if c.dedicated() {
+		c.channel.Close()
+	} else if !c.channel.IsClosed() {
+		if err := c.channel.Cancel(c.tag, false); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to cancel consumer %s for queue %s: %s", c.tag, c.queue, err.Error()))
+		}
+	}
+	c.channel = nil
+}
+
+// cancel stops the broker from sending deliveries to the consumer, which ends them once the ones
+// already received are handled, and prevents it from subscribing again. The channel stays open
+// so that those deliveries can still be acked; a dedicated one is closed right away if the cancel fails.
+func (c *managedConsumer) cancel() {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	c.closed = true
+	if c.channel == nil {
+		return
+	}
+	if err := c.channel.Cancel(c.tag, false); err != nil && c.dedicated() {
+		logger.Warn(fmt.Sprintf("Failed to cancel consumer for queue %s, closing its channel: %s", c.queue, err.Error()))
+		c.channel.Close()
+		c.channel = nil
+	}
+}
+
+// closeChannel closes the dedicated channel of the consumer
+func (c *managedConsumer) closeChannel() {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	if c.channel != nil && c.dedicated() {
+		c.channel.Close()
+		c.channel = nil
+	}
+}
+
+// unregisterConsumer stops the managed consumer of a queue and waits for its workers to return.
+// Only consumers on a dedicated channel can be stopped on their own.
+func unregisterConsumer(queueName string) {
+	consumersMu.Lock()
+	consumer, exists := consumers[queueName]
+	if exists {
+		close(consumer.stop)
+		delete(consumers, queueName)
+	}
+	consumersMu.Unlock()
+	if !exists {
+		return
+	}
+	consumer.cancel()
+	<-consumer.done
+	consumer.closeChannel()
+	logger.Info(fmt.Sprintf("Consumer for queue %s unregistered", queueName))
+}
+
+// Consume dispatches the deliveries of the queue to handler until ctx is cancelled. A nil error acks
+// the message, an error nacks it without requeue, so that it goes to the retry/dead-letter path.
+// The consumer runs on its own channel, receiving at most PrefetchCount unacknowledged messages
+// (see WithPrefetchCount), and is re-registered if the channel closes, e.g. after a reconnection.
+// Consume blocks until ctx is cancelled and the running handlers returned, then returns nil.
+func Consume(ctx context.Context, queueName string, handler func(amqp091.Delivery) error) error {
+	if err := RegisterConsumer(queueName, handler, withOwnChannel()); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	unregisterConsumer(queueName)
+	return nil
+}
+
+func (c *managedConsumer) work(deliveries <-chan amqp091.Delivery) {
+	if c.batch != nil {
+		c.workBatch(deliveries)
+		return
+	}
+	for delivery := range deliveries {
+		c.handle(delivery)
+	}
+	logger.Warn(fmt.Sprintf("Delivery channel closed for queue: %s", c.queue))
+}
+
+func (c *managedConsumer) handle(delivery amqp091.Delivery) {
+	if c.quarantineIfPoisoned(delivery, nil) {
+		return
+	}
+	if err := c.process(delivery); err != nil {
+		logger.Error(fmt.Sprintf("Handler failed for message %s on queue %s: %s", delivery.MessageId, c.queue, err.Error()))
+		if nackErr := delivery.Nack(false, false); nackErr != nil {
+			logger.Error(fmt.Sprintf("Failed to nack message %s: %s", delivery.MessageId, nackErr.Error()))
+		}
+		return
+	}
+	if ackErr := delivery.Ack(false); ackErr != nil {
+		logger.Error(fmt.Sprintf("Failed to ack message %s: %s", delivery.MessageId, ackErr.Error()))
+	}
+}
+
+// process runs the handler on the delivery, giving up on it when the handler timeout is exceeded
+func (c *managedConsumer) process(delivery amqp091.Delivery) error {
+	ctx := ContextFromDelivery(context.Background(), delivery)
+	if c.timeout <= 0 {
+		return c.call(ctx, delivery)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	result := make(chan error, 1)
+	utilities.Go(func() {
+		result <- c.call(ctx, delivery)
+	})
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		// The handler keeps running in the background, its result is ignored
+		commonmetrics.ConsumerHandlerTimeouts.WithLabelValues(c.queue).Inc()
+		return fmt.Errorf("%w after %s", ErrHandlerTimeout, c.timeout)
+	}
+}
+
+// call runs the handler, recovering from a panic so that the delivery is nacked like a failure
+// instead of staying unacked with the worker gone
+func (c *managedConsumer) call(ctx context.Context, delivery amqp091.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			commonmetrics.NumberOfErrors.Inc()
+			logger.Error(fmt.Sprintf("Handler panicked for message %s on queue %s: %v", delivery.MessageId, c.queue, r), "stack", string(debug.Stack()))
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	return c.handler(ctx, delivery)
+}
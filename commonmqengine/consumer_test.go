@@ -0,0 +1,448 @@
+package commonmqengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// message returns a fake message with the body
+func message(body string) fakeMessage {
+	return fakeMessage{Publishing: amqp091.Publishing{Body: []byte(body), MessageId: body}}
+}
+
+func TestConsumerConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		queue   QueueConfiguration
+		opts    []ConsumerOption
+		workers int
+	}{
+		{name: "queue default", queue: NewQueue("orders"), workers: 1},
+		{name: "queue concurrency", queue: NewQueue("orders", WithConsumerConcurrency(3)), workers: 3},
+		{name: "option override", queue: NewQueue("orders", WithConsumerConcurrency(3)), opts: []ConsumerOption{WithConcurrency(5)}, workers: 5},
+		{name: "invalid override ignored", queue: NewQueue("orders", WithConsumerConcurrency(2)), opts: []ConsumerOption{WithConcurrency(0)}, workers: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(tt.queue))
+
+			// Every worker holds a message until all of them are busy at the same time
+			var busy atomic.Int32
+			release := make(chan struct{})
+			handler := func(amqp091.Delivery) error {
+				if busy.Add(1) == int32(tt.workers) {
+					close(release)
+				}
+				select {
+				case <-release:
+					return nil
+				case <-time.After(5 * time.Second):
+					return errors.New("the workers did not run concurrently")
+				}
+			}
+			if err := RegisterConsumer("orders", handler, tt.opts...); err != nil {
+				t.Fatalf("RegisterConsumer failed: %v", err)
+			}
+			if got := ConsumerWorkers("orders"); got != tt.workers {
+				t.Errorf("ConsumerWorkers() = %d, want %d", got, tt.workers)
+			}
+			for i := 0; i < tt.workers; i++ {
+				b.enqueue("orders", message("m"))
+			}
+			eventually(t, "the messages to be settled", func() bool { return len(b.settled()) == tt.workers })
+			for _, ack := range b.settled() {
+				if ack.Nack {
+					t.Errorf("message %d was nacked, the workers did not run concurrently", ack.Tag)
+				}
+			}
+		})
+	}
+}
+
+func TestConsumerHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler ConsumerHandler
+		nack    bool
+	}{
+		{name: "success", handler: func(amqp091.Delivery) error { return nil }},
+		{name: "error", handler: func(amqp091.Delivery) error { return errors.New("failed") }, nack: true},
+		{name: "panic", handler: func(amqp091.Delivery) error { panic("boom") }, nack: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders")))
+			if err := RegisterConsumer("orders", tt.handler); err != nil {
+				t.Fatalf("RegisterConsumer failed: %v", err)
+			}
+			b.enqueue("orders", message("first"))
+			b.enqueue("orders", message("second"))
+			// The worker survives a panic and handles the next message
+			eventually(t, "the messages to be settled", func() bool { return len(b.settled()) == 2 })
+			for _, ack := range b.settled() {
+				if ack.Nack != tt.nack || ack.Requeue {
+					t.Errorf("settlement = %+v, want nack %v without requeue", ack, tt.nack)
+				}
+			}
+		})
+	}
+
+	t.Run("error wraps ErrHandlerPanic", func(t *testing.T) {
+		c := &managedConsumer{queue: "orders", handler: func(context.Context, amqp091.Delivery) error { panic("boom") }}
+		if err := c.call(context.Background(), amqp091.Delivery{}); !errors.Is(err, ErrHandlerPanic) {
+			t.Errorf("call() error = %v, want ErrHandlerPanic", err)
+		}
+	})
+}
+
+func TestRegisterConsumers(t *testing.T) {
+	tests := []struct {
+		name      string
+		queues    []string
+		consuming []string
+		err       bool
+	}{
+		{name: "two queues", queues: []string{"orders", "audit"}, consuming: []string{"orders", "audit"}},
+		{name: "missing queue", queues: []string{"orders", "missing"}, consuming: []string{"orders"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders"), NewQueue("audit")))
+
+			received := make(chan string, len(tt.consuming))
+			handler := func(delivery amqp091.Delivery) error {
+				received <- delivery.MessageId
+				return nil
+			}
+			err := RegisterConsumers(tt.queues, handler, WithConcurrency(2))
+			if (err != nil) != tt.err {
+				t.Fatalf("RegisterConsumers() error = %v, want error %t", err, tt.err)
+			}
+			for _, queue := range tt.consuming {
+				if got := ConsumerWorkers(queue); got != 2 {
+					t.Errorf("ConsumerWorkers(%s) = %d, want 2", queue, got)
+				}
+				b.enqueue(queue, message(queue))
+			}
+
+			got := map[string]bool{}
+			for range tt.consuming {
+				select {
+				case queue := <-received:
+					got[queue] = true
+				case <-time.After(5 * time.Second):
+					t.Fatalf("received messages from %v, want %v", got, tt.consuming)
+				}
+			}
+			for _, queue := range tt.consuming {
+				if !got[queue] {
+					t.Errorf("no message received from queue %s", queue)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		flush    time.Duration
+		messages []string
+		want     []fakeAck
+	}{
+		{name: "full batch", size: 3, flush: time.Hour, messages: []string{"a", "b", "c"},
+			want: []fakeAck{{Tag: 3, Multiple: true}}},
+		{name: "partial batch flushed", size: 10, flush: 20 * time.Millisecond, messages: []string{"a", "b"},
+			want: []fakeAck{{Tag: 2, Multiple: true}}},
+		{name: "failed message nacked on its own", size: 5, flush: 20 * time.Millisecond, messages: []string{"a", "fail", "c", "d"},
+			want: []fakeAck{{Tag: 1, Multiple: true}, {Tag: 2, Nack: true}, {Tag: 4, Multiple: true}}},
+		{name: "batch of one acks every message", size: 1, flush: time.Hour, messages: []string{"a", "b"},
+			want: []fakeAck{{Tag: 1}, {Tag: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders")))
+			handler := func(delivery amqp091.Delivery) error {
+				if string(delivery.Body) == "fail" {
+					return errors.New("failed")
+				}
+				return nil
+			}
+			if err := RegisterConsumer("orders", handler, WithBatchAck(tt.size, tt.flush)); err != nil {
+				t.Fatalf("RegisterConsumer failed: %v", err)
+			}
+			for _, body := range tt.messages {
+				b.enqueue("orders", message(body))
+			}
+			eventually(t, "the messages to be settled", func() bool { return len(b.settled()) >= len(tt.want) })
+			if got := b.settled(); !slices.Equal(got, tt.want) {
+				t.Errorf("settled = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		work      time.Duration
+		settled   fakeAck
+		timedOut  float64
+		cancelled bool
+	}{
+		{name: "handler exceeds the timeout", timeout: 20 * time.Millisecond, work: time.Hour, settled: fakeAck{Tag: 1, Nack: true}, timedOut: 1, cancelled: true},
+		{name: "handler within the timeout", timeout: time.Second, settled: fakeAck{Tag: 1}},
+		{name: "no timeout", settled: fakeAck{Tag: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders")))
+			timeouts := commonmetrics.ConsumerHandlerTimeouts.WithLabelValues("orders")
+			before := testutil.ToFloat64(timeouts)
+			cancelled := make(chan bool, 1)
+			handler := func(ctx context.Context, delivery amqp091.Delivery) error {
+				select {
+				case <-ctx.Done():
+					cancelled <- true
+				case <-time.After(tt.work):
+					cancelled <- false
+				}
+				return nil
+			}
+			if err := RegisterConsumerCtx("orders", handler, WithHandlerTimeout(tt.timeout)); err != nil {
+				t.Fatalf("RegisterConsumerCtx failed: %v", err)
+			}
+			b.enqueue("orders", message("slow"))
+			eventually(t, "the message to be settled", func() bool { return len(b.settled()) == 1 })
+
+			if got := b.settled(); !slices.Equal(got, []fakeAck{tt.settled}) {
+				t.Errorf("settled = %+v, want %+v", got, tt.settled)
+			}
+			if got := testutil.ToFloat64(timeouts) - before; got != tt.timedOut {
+				t.Errorf("handler timeouts grew by %v, want %v", got, tt.timedOut)
+			}
+			select {
+			case got := <-cancelled:
+				if got != tt.cancelled {
+					t.Errorf("handler context cancelled = %t, want %t", got, tt.cancelled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the handler did not return")
+			}
+		})
+	}
+}
+
+func TestMaxConsumers(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		refused string
+	}{
+		{name: "no limit", max: 0},
+		{name: "limit above the consumers", max: 4},
+		{name: "limit reached", max: 2, refused: "invoices"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeBroker(t)
+			startEngine(t, WithMaxConsumers(tt.max), WithQueues(NewQueue("orders"), NewQueue("audit"), NewQueue("invoices")))
+			logs := captureLogs(t)
+			handler := func(amqp091.Delivery) error { return nil }
+			for _, queue := range []string{"orders", "audit", "invoices"} {
+				err := RegisterConsumer(queue, handler)
+				if queue != tt.refused {
+					if err != nil {
+						t.Fatalf("RegisterConsumer(%s) error = %v", queue, err)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrTooManyConsumers) {
+					t.Fatalf("RegisterConsumer(%s) error = %v, want ErrTooManyConsumers", queue, err)
+				}
+				if ConsumerWorkers(queue) != 0 {
+					t.Errorf("the refused consumer of %s was registered", queue)
+				}
+				if want := fmt.Sprintf("Refusing consumer for queue %s: 2/2 consumers registered", queue); !strings.Contains(logs.String(), want) {
+					t.Errorf("logs lack %q: %s", want, logs.String())
+				}
+			}
+			want := "(2 consumers)"
+			if tt.max > 0 {
+				want = fmt.Sprintf("(2/%d consumers)", tt.max)
+			}
+			if !strings.Contains(logs.String(), "Registered consumer for queue audit "+want) {
+				t.Errorf("logs lack the consumer count %s: %s", want, logs.String())
+			}
+		})
+	}
+}
+
+func TestConsumerResubscription(t *testing.T) {
+	tests := []struct {
+		name         string
+		deleteQueue  bool
+		dedicated    bool
+		wantFailures bool
+	}{
+		{name: "consumer cancelled by the broker"},
+		{name: "consumer on its own channel cancelled", dedicated: true},
+		{name: "queue deleted and declared again", deleteQueue: true, wantFailures: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := resubscribeBackoff
+			resubscribeBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+			t.Cleanup(func() { resubscribeBackoff = previous })
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders")))
+			successes := commonmetrics.ConsumerResubscriptions.WithLabelValues("orders", "success")
+			failures := commonmetrics.ConsumerResubscriptions.WithLabelValues("orders", "failure")
+			successesBefore, failuresBefore := testutil.ToFloat64(successes), testutil.ToFloat64(failures)
+
+			handled := make(chan string, 1)
+			var opts []ConsumerOption
+			if tt.dedicated {
+				opts = append(opts, withOwnChannel())
+			}
+			handler := func(d amqp091.Delivery) error {
+				handled <- string(d.Body)
+				return nil
+			}
+			if err := RegisterConsumer("orders", handler, opts...); err != nil {
+				t.Fatalf("RegisterConsumer() error = %v", err)
+			}
+			eventually(t, "the consumer to subscribe", func() bool { return b.consumerCount("orders") == 1 })
+
+			if tt.deleteQueue {
+				b.mu.Lock()
+				delete(b.queues, "orders")
+				b.mu.Unlock()
+			}
+			b.cancelConsumers("orders")
+			if tt.wantFailures {
+				eventually(t, "a failed re-registration", func() bool { return testutil.ToFloat64(failures) > failuresBefore })
+				b.enqueue("orders", message("after"))
+			}
+			eventually(t, "the consumer to re-register", func() bool { return testutil.ToFloat64(successes) > successesBefore })
+			if got := testutil.ToFloat64(successes) - successesBefore; got != 1 {
+				t.Errorf("successful re-registrations = %v, want 1", got)
+			}
+			if got := b.consumerCount("orders"); got != 1 {
+				t.Errorf("consumers on the queue = %d, want 1", got)
+			}
+			if !tt.wantFailures {
+				if got := testutil.ToFloat64(failures) - failuresBefore; got != 0 {
+					t.Errorf("failed re-registrations = %v, want 0", got)
+				}
+				b.enqueue("orders", message("after"))
+			}
+			select {
+			case body := <-handled:
+				if body != "after" {
+					t.Errorf("handled %q, want the message sent after the re-registration", body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the re-registered consumer did not handle the message")
+			}
+		})
+	}
+}
+
+func TestConsume(t *testing.T) {
+	failing := func(delivery amqp091.Delivery) error {
+		if string(delivery.Body) == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	tests := []struct {
+		name     string
+		handler  func(amqp091.Delivery) error
+		prefetch int
+		messages []string
+		want     []fakeAck
+		wantErr  bool
+	}{
+		{name: "handled message acked", handler: failing, messages: []string{"a"}, want: []fakeAck{{Tag: 1}}},
+		{name: "failed message nacked without requeue", handler: failing, messages: []string{"fail"}, want: []fakeAck{{Tag: 1, Nack: true}}},
+		{name: "prefetch count applied", handler: failing, prefetch: 5, messages: []string{"a", "fail", "c"},
+			want: []fakeAck{{Tag: 1}, {Tag: 2, Nack: true}, {Tag: 3}}},
+		{name: "nil handler", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders")), WithPrefetchCount(tt.prefetch))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := make(chan error, 1)
+			go func() { result <- Consume(ctx, "orders", tt.handler) }()
+			if tt.wantErr {
+				select {
+				case err := <-result:
+					if err == nil {
+						t.Error("Consume() error = nil, want an error")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("Consume() did not return")
+				}
+				return
+			}
+
+			eventually(t, "the consumer to subscribe", func() bool { return b.consumerCount("orders") == 1 })
+			for _, body := range tt.messages {
+				b.enqueue("orders", message(body))
+			}
+			eventually(t, "the messages to be settled", func() bool { return len(b.settled()) >= len(tt.want) })
+			if got := b.settled(); !slices.Equal(got, tt.want) {
+				t.Errorf("settled = %+v, want %+v", got, tt.want)
+			}
+			b.mu.Lock()
+			qos := slices.Clone(b.qos)
+			b.mu.Unlock()
+			if tt.prefetch > 0 && !slices.Contains(qos, tt.prefetch) {
+				t.Errorf("qos = %v, want the prefetch count %d", qos, tt.prefetch)
+			}
+			if tt.prefetch == 0 && len(qos) != 0 {
+				t.Errorf("qos = %v, want none without a prefetch count", qos)
+			}
+
+			// Cancelling the context stops the consumer and returns nil
+			cancel()
+			select {
+			case err := <-result:
+				if err != nil {
+					t.Errorf("Consume() error = %v, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Consume() did not return after the context was cancelled")
+			}
+			eventually(t, "the consumer to be cancelled", func() bool { return b.consumerCount("orders") == 0 })
+			consumersMu.Lock()
+			_, registered := consumers["orders"]
+			consumersMu.Unlock()
+			if registered {
+				t.Error("the consumer is still registered after Consume returned")
+			}
+		})
+	}
+}
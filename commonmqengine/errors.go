@@ -0,0 +1,27 @@
+package commonmqengine
+
+import "errors"
+
+// Sentinel errors wrapped by the engine so callers can use errors.Is to tell failures apart
+var (
+	// ErrNotConnected is returned when the connection or channel to RabbitMQ cannot be established
+	ErrNotConnected = errors.New("not connected to RabbitMQ")
+	// ErrDeclareFailed is returned when a queue cannot be declared
+	ErrDeclareFailed = errors.New("failed to declare queue")
+	// ErrPublishFailed is returned when a message cannot be published
+	ErrPublishFailed = errors.New("failed to publish message")
+	// ErrQueueNotConfigured is returned when publishing to a queue missing from the MQ configuration
+	ErrQueueNotConfigured = errors.New("queue configuration not found for queue")
+	// ErrInvalidRoutingKey is returned when routing key validation is enabled and the key is malformed
+	ErrInvalidRoutingKey = errors.New("invalid routing key")
+	// ErrUnroutable is recorded when the broker returns a mandatory message it could not route
+	ErrUnroutable = errors.New("message could not be routed")
+	// ErrInvalidExpiration is returned when a message is published with a negative or malformed expiration
+	ErrInvalidExpiration = errors.New("invalid message expiration")
+	// ErrHandlerTimeout is returned when a consumer handler exceeds its timeout
+	ErrHandlerTimeout = errors.New("consumer handler timed out")
+	// ErrHandlerPanic is returned when a consumer handler panics
+	ErrHandlerPanic = errors.New("consumer handler panicked")
+	// ErrTooManyConsumers is returned when registering a consumer would exceed MaxConsumers
+	ErrTooManyConsumers = errors.New("too many consumers registered")
+)
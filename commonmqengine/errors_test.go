@@ -0,0 +1,79 @@
+package commonmqengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSentinelErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, b *fakeBroker) error
+		want error
+	}{
+		{
+			name: "broker unreachable",
+			run: func(t *testing.T, b *fakeBroker) error {
+				b.dialHook = func(string) error { return errors.New("connection refused") }
+				return InitMQEngine(testContext(t), *NewMQConfiguration(WithRequireConnectionAtStartup(true)))
+			},
+			want: ErrNotConnected,
+		},
+		{
+			name: "declaration refused",
+			run: func(t *testing.T, b *fakeBroker) error {
+				b.failDeclare["orders"] = true
+				return InitMQEngine(testContext(t), *NewMQConfiguration(WithRequireConnectionAtStartup(true), WithQueues(NewQueue("orders"))))
+			},
+			want: ErrDeclareFailed,
+		},
+		{
+			name: "publish cancelled",
+			run: func(t *testing.T, b *fakeBroker) error {
+				startEngine(t, WithQueues(NewQueue("orders")))
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				_, err := SendMessageToQueueCtx(ctx, "orders", "m", "", "", "", nil)
+				return err
+			},
+			want: ErrPublishFailed,
+		},
+		{
+			name: "queue not configured",
+			run: func(t *testing.T, b *fakeBroker) error {
+				startEngine(t, WithQueues(NewQueue("orders")))
+				_, err := SendMessageToQueue("payments", "m", "", "", "", nil)
+				return err
+			},
+			want: ErrQueueNotConfigured,
+		},
+		{
+			name: "invalid routing key",
+			run: func(t *testing.T, b *fakeBroker) error {
+				startEngine(t, WithRoutingKeyValidation(true), WithQueues(NewQueue("orders")))
+				_, err := SendMessageToQueue("orders", "m", "", "", "", nil, WithPublishRoutingKey("orders..eu"))
+				return err
+			},
+			want: ErrInvalidRoutingKey,
+		},
+		{
+			name: "invalid expiration",
+			run: func(t *testing.T, b *fakeBroker) error {
+				startEngine(t, WithQueues(NewQueue("orders")))
+				_, err := SendMessageToQueue("orders", "m", "", "", "", nil, WithExpiration(-time.Second))
+				return err
+			},
+			want: ErrInvalidExpiration,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(t, useFakeBroker(t))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want one wrapping %v", err, tt.want)
+			}
+		})
+	}
+}
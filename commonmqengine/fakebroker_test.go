@@ -0,0 +1,1057 @@
+package commonmqengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker is an in-memory RabbitMQ speaking AMQP 0-9-1 over net.Pipe, so that the engine is tested
+// with the real client. It routes messages published on the default exchange to the queue named by the
+// routing key, and the ones published on other exchanges through the bindings.
+type fakeBroker struct {
+	mu sync.Mutex
+
+	// dialHook runs before each dial, e.g. to fail it or slow it down
+	dialHook func(url string) error
+	// failDeclare makes the declaration of these queues fail with PRECONDITION_FAILED
+	failDeclare map[string]bool
+
+	dials     []fakeDial
+	conns     []*fakeConn
+	queues    map[string]*fakeQueue
+	declares  []fakeDeclare
+	exchanges map[string]string
+	bindings  []fakeBinding
+	published []fakeMessage
+	acks      []fakeAck
+	qos       []int
+	cancels   []string
+	consumers []*fakeConsumer
+	nextTag   int
+}
+
+type fakeDial struct {
+	url    string
+	config amqp091.Config
+}
+
+type fakeDeclare struct {
+	Name       string
+	Passive    bool
+	Durable    bool
+	Exclusive  bool
+	AutoDelete bool
+	Args       amqp091.Table
+}
+
+type fakeBinding struct {
+	queue, exchange, key string
+}
+
+// fakeMessage is a message as published by the client, Body included
+type fakeMessage struct {
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	amqp091.Publishing
+}
+
+// fakeAck is an ack (Nack false) or a nack/reject received from the client
+type fakeAck struct {
+	Tag      uint64
+	Multiple bool
+	Nack     bool
+	Requeue  bool
+}
+
+type fakeQueue struct {
+	name     string
+	messages []fakeMessage
+}
+
+type fakeConsumer struct {
+	tag     string
+	queue   string
+	conn    *fakeConn
+	channel uint16
+	noAck   bool
+}
+
+// unacked is a message delivered to the client and not settled yet
+type unacked struct {
+	queue   string
+	message fakeMessage
+}
+
+// fakeConn is the server side of a client connection
+type fakeConn struct {
+	broker *fakeBroker
+	conn   net.Conn
+	out    chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	// guarded by broker.mu
+	deliveryTags map[uint16]uint64
+	unacked      map[uint16]map[uint64]unacked
+	publishing   map[uint16]*pendingPublish
+}
+
+// pendingPublish is a basic.publish waiting for its content frames
+type pendingPublish struct {
+	message fakeMessage
+	size    uint64
+	body    bytes.Buffer
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		failDeclare: map[string]bool{},
+		queues:      map[string]*fakeQueue{},
+		exchanges:   map[string]string{},
+	}
+}
+
+// useFakeBroker makes the engine dial a new fake broker until the end of the test, which also resets the engine
+func useFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	b := newFakeBroker()
+	previous := dialer
+	dialer = b.dial
+	t.Cleanup(func() {
+		// The contexts of the test are cancelled by now, so the reconnector stops
+		eventually(t, "the reconnector to stop", func() bool { return !reconnecting.Load() })
+		consumersMu.Lock()
+		var done []chan struct{}
+		for _, consumer := range consumers {
+			done = append(done, consumer.done)
+		}
+		consumersMu.Unlock()
+		Close()
+		b.shutdown()
+		// Close only signals the consumers, so wait for them before the next test swaps the package state
+		for _, d := range done {
+			select {
+			case <-d:
+			case <-time.After(5 * time.Second):
+				t.Error("a consumer did not stop after Close")
+			}
+		}
+		mu.Lock()
+		dialer = previous
+		mqconfig = MQConfiguration{}
+		reconnectCtx = context.Background()
+		mu.Unlock()
+		initialized.Store(false)
+	})
+	return b
+}
+
+// startEngine initializes the engine on the fake broker with the options, stopping its reconnector with the test
+func startEngine(t *testing.T, opts ...MQOption) {
+	t.Helper()
+	if err := InitMQEngine(testContext(t), *NewMQConfiguration(opts...)); err != nil {
+		t.Fatalf("InitMQEngine failed: %v", err)
+	}
+}
+
+// testContext returns a context cancelled when the test ends, to bound the engine's background work
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// eventually fails the test unless cond becomes true within a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fastReconnect makes the background reconnector retry every few milliseconds until the test ends
+func fastReconnect(t *testing.T) {
+	t.Helper()
+	previous := reconnectBackoff
+	reconnectBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+	t.Cleanup(func() { reconnectBackoff = previous })
+}
+
+// setDialHook replaces the hook run on every dial, e.g. to make the broker unreachable
+func (b *fakeBroker) setDialHook(hook func(url string) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialHook = hook
+}
+
+// dial has the signature of amqp091.DialConfig
+func (b *fakeBroker) dial(url string, config amqp091.Config) (*amqp091.Connection, error) {
+	b.mu.Lock()
+	b.dials = append(b.dials, fakeDial{url: url, config: config})
+	hook := b.dialHook
+	b.mu.Unlock()
+	if hook != nil {
+		if err := hook(url); err != nil {
+			return nil, err
+		}
+	}
+	uri, err := amqp091.ParseURI(url)
+	if err != nil {
+		return nil, err
+	}
+	config.SASL = []amqp091.Authentication{uri.PlainAuth()}
+	config.Vhost = uri.Vhost
+	// The fake broker doesn't send heartbeats
+	config.Heartbeat = 0
+
+	client, server := net.Pipe()
+	c := &fakeConn{
+		broker:       b,
+		conn:         server,
+		out:          make(chan []byte, 4096),
+		done:         make(chan struct{}),
+		deliveryTags: map[uint16]uint64{},
+		unacked:      map[uint16]map[uint64]unacked{},
+		publishing:   map[uint16]*pendingPublish{},
+	}
+	b.mu.Lock()
+	b.conns = append(b.conns, c)
+	b.mu.Unlock()
+	go c.write()
+	go c.serve()
+	connection, err := amqp091.Open(client, config)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+// shutdown closes every connection, as a broker going away would
+func (b *fakeBroker) shutdown() {
+	b.mu.Lock()
+	conns := append([]*fakeConn(nil), b.conns...)
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// closeConnections closes the open connections with an error, like a RabbitMQ restart
+func (b *fakeBroker) closeConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.send(0, 10, 50, newWire().short(320).shortstr("CONNECTION_FORCED - broker forced connection closure").short(0).short(0).bytes())
+	}
+}
+
+// cancelConsumers cancels the consumers of the queue from the broker side, as when the queue is deleted
+func (b *fakeBroker) cancelConsumers(queue string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.consumers[:0]
+	for _, consumer := range b.consumers {
+		if consumer.queue != queue {
+			kept = append(kept, consumer)
+			continue
+		}
+		consumer.conn.send(consumer.channel, 60, 30, newWire().shortstr(consumer.tag).octet(1).bytes())
+	}
+	b.consumers = kept
+}
+
+// enqueue puts a message on a queue, declaring it if needed, and delivers it to a consumer if any
+func (b *fakeBroker) enqueue(queue string, message fakeMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue(queue).messages = append(b.queue(queue).messages, message)
+	b.dispatch()
+}
+
+// queue returns the queue, creating it. The caller must hold mu.
+func (b *fakeBroker) queue(name string) *fakeQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &fakeQueue{name: name}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// messages returns the messages waiting in the queue
+func (b *fakeBroker) messages(queue string) []fakeMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		return append([]fakeMessage(nil), q.messages...)
+	}
+	return nil
+}
+
+// publishedTo returns the messages published with the routing key
+func (b *fakeBroker) publishedTo(routingKey string) []fakeMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []fakeMessage
+	for _, message := range b.published {
+		if message.RoutingKey == routingKey {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// settled returns the acks and nacks received
+func (b *fakeBroker) settled() []fakeAck {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]fakeAck(nil), b.acks...)
+}
+
+// declared returns the last declaration of the queue received by the broker
+func (b *fakeBroker) declared(name string) (fakeDeclare, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.declares) - 1; i >= 0; i-- {
+		if b.declares[i].Name == name {
+			return b.declares[i], true
+		}
+	}
+	return fakeDeclare{}, false
+}
+
+// dialCount returns the number of dials
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.dials)
+}
+
+// consumerCount returns the number of consumers on the queue
+func (b *fakeBroker) consumerCount(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, consumer := range b.consumers {
+		if consumer.queue == queue {
+			n++
+		}
+	}
+	return n
+}
+
+// dispatch delivers the queued messages to the consumers of their queue. The caller must hold mu.
+func (b *fakeBroker) dispatch() {
+	for _, consumer := range b.consumers {
+		q, ok := b.queues[consumer.queue]
+		if !ok {
+			continue
+		}
+		for len(q.messages) > 0 {
+			message := q.messages[0]
+			q.messages = q.messages[1:]
+			tag := consumer.conn.deliver(consumer.channel, consumer.queue, message, !consumer.noAck)
+			args := newWire().shortstr(consumer.tag).longlong(tag).bit(message.Redelivered).shortstr(message.Exchange).shortstr(message.RoutingKey)
+			consumer.conn.sendContent(consumer.channel, 60, 60, args.bytes(), message)
+		}
+	}
+}
+
+// route puts a published message on the queues it is routed to. The caller must hold mu.
+func (b *fakeBroker) route(message fakeMessage) {
+	b.published = append(b.published, message)
+	if message.Exchange == "" {
+		b.queue(message.RoutingKey).messages = append(b.queue(message.RoutingKey).messages, message)
+		b.dispatch()
+		return
+	}
+	for _, binding := range b.bindings {
+		if binding.exchange == message.Exchange && routingKeyMatches(binding.key, message.RoutingKey) {
+			b.queue(binding.queue).messages = append(b.queue(binding.queue).messages, message)
+		}
+	}
+	b.dispatch()
+}
+
+// routingKeyMatches matches a routing key against a binding key with the topic wildcards
+func routingKeyMatches(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+// deliver assigns the next delivery tag of the channel to the message. The caller must hold broker.mu.
+func (c *fakeConn) deliver(channel uint16, queue string, message fakeMessage, track bool) uint64 {
+	c.deliveryTags[channel]++
+	tag := c.deliveryTags[channel]
+	if track {
+		if c.unacked[channel] == nil {
+			c.unacked[channel] = map[uint64]unacked{}
+		}
+		c.unacked[channel][tag] = unacked{queue: queue, message: message}
+	}
+	return tag
+}
+
+// settle forgets the unacked messages covered by the tag and requeues them if asked. The caller must hold broker.mu.
+func (c *fakeConn) settle(channel uint16, tag uint64, multiple bool, requeue bool) {
+	for unackedTag, u := range c.unacked[channel] {
+		if unackedTag == tag || (multiple && unackedTag < tag) || (multiple && tag == 0) {
+			delete(c.unacked[channel], unackedTag)
+			if requeue {
+				u.message.Redelivered = true
+				q := c.broker.queue(u.queue)
+				q.messages = append([]fakeMessage{u.message}, q.messages...)
+			}
+		}
+	}
+}
+
+// closeChannel drops the consumers of the channel and requeues its unacked messages. The caller must hold broker.mu.
+func (c *fakeConn) closeChannel(channel uint16) {
+	b := c.broker
+	kept := b.consumers[:0]
+	for _, consumer := range b.consumers {
+		if consumer.conn != c || consumer.channel != channel {
+			kept = append(kept, consumer)
+		}
+	}
+	b.consumers = kept
+	c.settle(channel, 0, true, true)
+	delete(c.publishing, channel)
+}
+
+func (c *fakeConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+		b := c.broker
+		b.mu.Lock()
+		for channel := range c.unacked {
+			c.closeChannel(channel)
+		}
+		kept := b.consumers[:0]
+		for _, consumer := range b.consumers {
+			if consumer.conn != c {
+				kept = append(kept, consumer)
+			}
+		}
+		b.consumers = kept
+		b.dispatch()
+		b.mu.Unlock()
+	})
+}
+
+// write sends the queued frames in order, so that the broker never blocks on a client
+func (c *fakeConn) write() {
+	for {
+		select {
+		case frame := <-c.out:
+			if _, err := c.conn.Write(frame); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *fakeConn) queueFrames(frames []byte) {
+	select {
+	case c.out <- frames:
+	case <-c.done:
+	}
+}
+
+// send queues a method frame
+func (c *fakeConn) send(channel uint16, class, method uint16, args []byte) {
+	c.queueFrames(methodFrame(channel, class, method, args))
+}
+
+// sendContent queues a method frame followed by the content of the message
+func (c *fakeConn) sendContent(channel uint16, class, method uint16, args []byte, message fakeMessage) {
+	frames := methodFrame(channel, class, method, args)
+	header := newWire().short(60).short(0).longlong(uint64(len(message.Body)))
+	writeProperties(header, message.Publishing)
+	frames = append(frames, frame(2, channel, header.bytes())...)
+	if len(message.Body) > 0 {
+		frames = append(frames, frame(3, channel, message.Body)...)
+	}
+	c.queueFrames(frames)
+}
+
+// closeWithError closes the channel from the broker side, as RabbitMQ does on a channel exception
+func (c *fakeConn) closeWithError(channel uint16, code uint16, text string, class, method uint16) {
+	c.closeChannel(channel)
+	c.send(channel, 20, 40, newWire().short(code).shortstr(text).short(class).short(method).bytes())
+}
+
+func (c *fakeConn) serve() {
+	defer c.close()
+	protocol := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, protocol); err != nil {
+		return
+	}
+	c.send(0, 10, 10, newWire().octet(0).octet(9).table(amqp091.Table{"product": "fakebroker"}).longstr("PLAIN").longstr("en_US").bytes())
+	for {
+		typ, channel, payload, err := readFrame(c.conn)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 1:
+			r := &wireReader{r: bytes.NewReader(payload)}
+			class, method := r.short(), r.short()
+			if !c.handleMethod(channel, class, method, r) {
+				return
+			}
+		case 2:
+			c.handleHeader(channel, payload)
+		case 3:
+			c.handleBody(channel, payload)
+		}
+	}
+}
+
+// handleMethod answers a method sent by the client and reports whether the connection stays open
+func (c *fakeConn) handleMethod(channel uint16, class, method uint16, r *wireReader) bool {
+	b := c.broker
+	switch uint32(class)<<16 | uint32(method) {
+	case 10<<16 | 11: // connection.start-ok
+		c.send(0, 10, 30, newWire().short(2047).long(131072).short(0).bytes())
+	case 10<<16 | 31: // connection.tune-ok
+	case 10<<16 | 40: // connection.open
+		c.send(0, 10, 41, newWire().shortstr("").bytes())
+	case 10<<16 | 50: // connection.close
+		c.send(0, 10, 51, nil)
+		// Let the writer flush the close-ok before the pipe closes
+		for len(c.out) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(5 * time.Millisecond)
+		return false
+	case 10<<16 | 51: // connection.close-ok
+		return false
+	case 20<<16 | 10: // channel.open
+		c.send(channel, 20, 11, newWire().longstr("").bytes())
+	case 20<<16 | 40: // channel.close
+		b.mu.Lock()
+		c.closeChannel(channel)
+		b.dispatch()
+		b.mu.Unlock()
+		c.send(channel, 20, 41, nil)
+	case 20<<16 | 41: // channel.close-ok
+	case 40<<16 | 10: // exchange.declare
+		r.short()
+		name, kind, bits, _ := r.shortstr(), r.shortstr(), r.octet(), r.table()
+		b.mu.Lock()
+		b.exchanges[name] = kind
+		b.mu.Unlock()
+		if bits&0x10 == 0 {
+			c.send(channel, 40, 11, nil)
+		}
+	case 50<<16 | 10: // queue.declare
+		r.short()
+		name, bits, args := r.shortstr(), r.octet(), r.table()
+		declare := fakeDeclare{Name: name, Passive: bits&0x1 != 0, Durable: bits&0x2 != 0, Exclusive: bits&0x4 != 0, AutoDelete: bits&0x8 != 0, Args: args}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.declares = append(b.declares, declare)
+		q, exists := b.queues[name]
+		switch {
+		case declare.Passive && !exists:
+			c.closeWithError(channel, 404, fmt.Sprintf("NOT_FOUND - no queue '%s'", name), 50, 10)
+			return true
+		case b.failDeclare[name]:
+			c.closeWithError(channel, 406, fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name), 50, 10)
+			return true
+		case !exists:
+			q = b.queue(name)
+		}
+		consumers := 0
+		for _, consumer := range b.consumers {
+			if consumer.queue == name {
+				consumers++
+			}
+		}
+		if bits&0x10 == 0 {
+			c.send(channel, 50, 11, newWire().shortstr(name).long(uint32(len(q.messages))).long(uint32(consumers)).bytes())
+		}
+	case 50<<16 | 20: // queue.bind
+		r.short()
+		queue, exchange, key, bits, _ := r.shortstr(), r.shortstr(), r.shortstr(), r.octet(), r.table()
+		b.mu.Lock()
+		b.bindings = append(b.bindings, fakeBinding{queue: queue, exchange: exchange, key: key})
+		b.mu.Unlock()
+		if bits&0x1 == 0 {
+			c.send(channel, 50, 21, nil)
+		}
+	case 60<<16 | 10: // basic.qos
+		r.long()
+		count := r.short()
+		b.mu.Lock()
+		b.qos = append(b.qos, int(count))
+		b.mu.Unlock()
+		c.send(channel, 60, 11, nil)
+	case 60<<16 | 20: // basic.consume
+		r.short()
+		queue, tag, bits, _ := r.shortstr(), r.shortstr(), r.octet(), r.table()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, exists := b.queues[queue]; !exists {
+			c.closeWithError(channel, 404, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue), 60, 20)
+			return true
+		}
+		if tag == "" {
+			b.nextTag++
+			tag = fmt.Sprintf("ctag-%d", b.nextTag)
+		}
+		b.consumers = append(b.consumers, &fakeConsumer{tag: tag, queue: queue, conn: c, channel: channel, noAck: bits&0x2 != 0})
+		if bits&0x8 == 0 {
+			c.send(channel, 60, 21, newWire().shortstr(tag).bytes())
+		}
+		b.dispatch()
+	case 60<<16 | 30: // basic.cancel
+		tag, bits := r.shortstr(), r.octet()
+		b.mu.Lock()
+		b.cancels = append(b.cancels, tag)
+		kept := b.consumers[:0]
+		for _, consumer := range b.consumers {
+			if consumer.tag != tag {
+				kept = append(kept, consumer)
+			}
+		}
+		b.consumers = kept
+		b.mu.Unlock()
+		if bits&0x1 == 0 {
+			c.send(channel, 60, 31, newWire().shortstr(tag).bytes())
+		}
+	case 60<<16 | 40: // basic.publish
+		r.short()
+		exchange, key := r.shortstr(), r.shortstr()
+		b.mu.Lock()
+		c.publishing[channel] = &pendingPublish{message: fakeMessage{Exchange: exchange, RoutingKey: key}}
+		b.mu.Unlock()
+	case 60<<16 | 70: // basic.get
+		r.short()
+		queue, noAck := r.shortstr(), r.octet()&0x1 != 0
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		q, exists := b.queues[queue]
+		if !exists {
+			c.closeWithError(channel, 404, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue), 60, 70)
+			return true
+		}
+		if len(q.messages) == 0 {
+			c.send(channel, 60, 72, newWire().shortstr("").bytes())
+			return true
+		}
+		message := q.messages[0]
+		q.messages = q.messages[1:]
+		tag := c.deliver(channel, queue, message, !noAck)
+		args := newWire().longlong(tag).bit(message.Redelivered).shortstr(message.Exchange).shortstr(message.RoutingKey).long(uint32(len(q.messages)))
+		c.sendContent(channel, 60, 71, args.bytes(), message)
+	case 60<<16 | 80: // basic.ack
+		tag, multiple := r.longlong(), r.octet()&0x1 != 0
+		b.mu.Lock()
+		b.acks = append(b.acks, fakeAck{Tag: tag, Multiple: multiple})
+		c.settle(channel, tag, multiple, false)
+		b.mu.Unlock()
+	case 60<<16 | 90: // basic.reject
+		tag, requeue := r.longlong(), r.octet()&0x1 != 0
+		b.mu.Lock()
+		b.acks = append(b.acks, fakeAck{Tag: tag, Nack: true, Requeue: requeue})
+		c.settle(channel, tag, false, requeue)
+		b.dispatch()
+		b.mu.Unlock()
+	case 60<<16 | 120: // basic.nack
+		tag, bits := r.longlong(), r.octet()
+		b.mu.Lock()
+		b.acks = append(b.acks, fakeAck{Tag: tag, Multiple: bits&0x1 != 0, Nack: true, Requeue: bits&0x2 != 0})
+		c.settle(channel, tag, bits&0x1 != 0, bits&0x2 != 0)
+		b.dispatch()
+		b.mu.Unlock()
+	default:
+		c.send(0, 10, 50, newWire().short(540).shortstr(fmt.Sprintf("NOT_IMPLEMENTED - %d.%d", class, method)).short(class).short(method).bytes())
+	}
+	return true
+}
+
+// handleHeader reads the properties of a pending publish
+func (c *fakeConn) handleHeader(channel uint16, payload []byte) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending, ok := c.publishing[channel]
+	if !ok {
+		return
+	}
+	r := &wireReader{r: bytes.NewReader(payload)}
+	r.short()
+	r.short()
+	pending.size = r.longlong()
+	pending.message.Publishing = readProperties(r)
+	if pending.size == 0 {
+		delete(c.publishing, channel)
+		b.route(pending.message)
+	}
+}
+
+// handleBody appends a body frame to a pending publish, routing the message once complete
+func (c *fakeConn) handleBody(channel uint16, payload []byte) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending, ok := c.publishing[channel]
+	if !ok {
+		return
+	}
+	pending.body.Write(payload)
+	if uint64(pending.body.Len()) >= pending.size {
+		pending.message.Body = pending.body.Bytes()
+		delete(c.publishing, channel)
+		b.route(pending.message)
+	}
+}
+
+func frame(typ byte, channel uint16, payload []byte) []byte {
+	w := newWire().octet(typ).short(channel).long(uint32(len(payload)))
+	w.buf.Write(payload)
+	return w.octet(0xCE).bytes()
+}
+
+func methodFrame(channel uint16, class, method uint16, args []byte) []byte {
+	w := newWire().short(class).short(method)
+	w.buf.Write(args)
+	return frame(1, channel, w.bytes())
+}
+
+func readFrame(r io.Reader) (byte, uint16, []byte, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[len(payload)-1] != 0xCE {
+		return 0, 0, nil, fmt.Errorf("invalid frame end")
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:3]), payload[:len(payload)-1], nil
+}
+
+// Property flags of the content header
+const (
+	propContentType     = 0x8000
+	propContentEncoding = 0x4000
+	propHeaders         = 0x2000
+	propDeliveryMode    = 0x1000
+	propPriority        = 0x0800
+	propCorrelationId   = 0x0400
+	propReplyTo         = 0x0200
+	propExpiration      = 0x0100
+	propMessageId       = 0x0080
+	propTimestamp       = 0x0040
+	propType            = 0x0020
+	propUserId          = 0x0010
+	propAppId           = 0x0008
+)
+
+func writeProperties(w *wire, p amqp091.Publishing) {
+	var flags uint16
+	props := newWire()
+	str := func(flag uint16, value string) {
+		if value != "" {
+			flags |= flag
+			props.shortstr(value)
+		}
+	}
+	str(propContentType, p.ContentType)
+	str(propContentEncoding, p.ContentEncoding)
+	if len(p.Headers) > 0 {
+		flags |= propHeaders
+		props.table(p.Headers)
+	}
+	if p.DeliveryMode != 0 {
+		flags |= propDeliveryMode
+		props.octet(p.DeliveryMode)
+	}
+	if p.Priority != 0 {
+		flags |= propPriority
+		props.octet(p.Priority)
+	}
+	str(propCorrelationId, p.CorrelationId)
+	str(propReplyTo, p.ReplyTo)
+	str(propExpiration, p.Expiration)
+	str(propMessageId, p.MessageId)
+	if !p.Timestamp.IsZero() {
+		flags |= propTimestamp
+		props.longlong(uint64(p.Timestamp.Unix()))
+	}
+	str(propType, p.Type)
+	str(propUserId, p.UserId)
+	str(propAppId, p.AppId)
+	w.short(flags)
+	w.buf.Write(props.bytes())
+}
+
+func readProperties(r *wireReader) amqp091.Publishing {
+	var p amqp091.Publishing
+	flags := r.short()
+	str := func(flag uint16, value *string) {
+		if flags&flag != 0 {
+			*value = r.shortstr()
+		}
+	}
+	str(propContentType, &p.ContentType)
+	str(propContentEncoding, &p.ContentEncoding)
+	if flags&propHeaders != 0 {
+		p.Headers = r.table()
+	}
+	if flags&propDeliveryMode != 0 {
+		p.DeliveryMode = r.octet()
+	}
+	if flags&propPriority != 0 {
+		p.Priority = r.octet()
+	}
+	str(propCorrelationId, &p.CorrelationId)
+	str(propReplyTo, &p.ReplyTo)
+	str(propExpiration, &p.Expiration)
+	str(propMessageId, &p.MessageId)
+	if flags&propTimestamp != 0 {
+		p.Timestamp = time.Unix(int64(r.longlong()), 0)
+	}
+	str(propType, &p.Type)
+	str(propUserId, &p.UserId)
+	str(propAppId, &p.AppId)
+	return p
+}
+
+// wire encodes AMQP fields
+type wire struct {
+	buf bytes.Buffer
+}
+
+func newWire() *wire {
+	return &wire{}
+}
+
+func (w *wire) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *wire) octet(v byte) *wire {
+	w.buf.WriteByte(v)
+	return w
+}
+
+func (w *wire) bit(v bool) *wire {
+	if v {
+		return w.octet(1)
+	}
+	return w.octet(0)
+}
+
+func (w *wire) short(v uint16) *wire {
+	binary.Write(&w.buf, binary.BigEndian, v)
+	return w
+}
+
+func (w *wire) long(v uint32) *wire {
+	binary.Write(&w.buf, binary.BigEndian, v)
+	return w
+}
+
+func (w *wire) longlong(v uint64) *wire {
+	binary.Write(&w.buf, binary.BigEndian, v)
+	return w
+}
+
+func (w *wire) shortstr(v string) *wire {
+	w.buf.WriteByte(byte(len(v)))
+	w.buf.WriteString(v)
+	return w
+}
+
+func (w *wire) longstr(v string) *wire {
+	w.long(uint32(len(v)))
+	w.buf.WriteString(v)
+	return w
+}
+
+func (w *wire) table(t amqp091.Table) *wire {
+	fields := newWire()
+	for key, value := range t {
+		fields.shortstr(key)
+		fields.field(value)
+	}
+	return w.longstr(string(fields.bytes()))
+}
+
+func (w *wire) field(value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		w.octet('t').bit(v)
+	case byte:
+		w.octet('B').octet(v)
+	case int8:
+		w.octet('b').octet(byte(v))
+	case int16:
+		w.octet('s').short(uint16(v))
+	case int:
+		w.octet('I').long(uint32(v))
+	case int32:
+		w.octet('I').long(uint32(v))
+	case int64:
+		w.octet('l').longlong(uint64(v))
+	case float32:
+		w.octet('f').long(math.Float32bits(v))
+	case float64:
+		w.octet('d').longlong(math.Float64bits(v))
+	case string:
+		w.octet('S').longstr(v)
+	case []byte:
+		w.octet('x').longstr(string(v))
+	case time.Time:
+		w.octet('T').longlong(uint64(v.Unix()))
+	case amqp091.Table:
+		w.octet('F').table(v)
+	case []interface{}:
+		items := newWire()
+		for _, item := range v {
+			items.field(item)
+		}
+		w.octet('A').longstr(string(items.bytes()))
+	case nil:
+		w.octet('V')
+	default:
+		panic(fmt.Sprintf("fake broker: cannot encode %T", value))
+	}
+}
+
+// wireReader decodes AMQP fields, returning zero values once the input is exhausted
+type wireReader struct {
+	r io.Reader
+}
+
+func (r *wireReader) read(v interface{}) {
+	binary.Read(r.r, binary.BigEndian, v)
+}
+
+func (r *wireReader) octet() byte {
+	var v byte
+	r.read(&v)
+	return v
+}
+
+func (r *wireReader) short() uint16 {
+	var v uint16
+	r.read(&v)
+	return v
+}
+
+func (r *wireReader) long() uint32 {
+	var v uint32
+	r.read(&v)
+	return v
+}
+
+func (r *wireReader) longlong() uint64 {
+	var v uint64
+	r.read(&v)
+	return v
+}
+
+func (r *wireReader) shortstr() string {
+	b := make([]byte, r.octet())
+	io.ReadFull(r.r, b)
+	return string(b)
+}
+
+func (r *wireReader) longstr() string {
+	b := make([]byte, r.long())
+	io.ReadFull(r.r, b)
+	return string(b)
+}
+
+func (r *wireReader) table() amqp091.Table {
+	t := amqp091.Table{}
+	fields := &wireReader{r: strings.NewReader(r.longstr())}
+	for fields.r.(*strings.Reader).Len() > 0 {
+		key := fields.shortstr()
+		t[key] = fields.field()
+	}
+	return t
+}
+
+func (r *wireReader) field() interface{} {
+	switch r.octet() {
+	case 't':
+		return r.octet() != 0
+	case 'B':
+		return r.octet()
+	case 'b':
+		return int8(r.octet())
+	case 's':
+		return int16(r.short())
+	case 'I':
+		return int32(r.long())
+	case 'l':
+		return int64(r.longlong())
+	case 'f':
+		return math.Float32frombits(r.long())
+	case 'd':
+		return math.Float64frombits(r.longlong())
+	case 'S':
+		return r.longstr()
+	case 'x':
+		return []byte(r.longstr())
+	case 'T':
+		return time.Unix(int64(r.longlong()), 0)
+	case 'F':
+		return r.table()
+	case 'A':
+		items := &wireReader{r: strings.NewReader(r.longstr())}
+		var values []interface{}
+		for items.r.(*strings.Reader).Len() > 0 {
+			values = append(values, items.field())
+		}
+		return values
+	}
+	return nil
+}
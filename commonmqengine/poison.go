@@ -0,0 +1,98 @@
+package commonmqengine
+
+import (
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// PoisonHeader marks the messages quarantined by the poison-message detector
+const PoisonHeader = "X-Poison"
+
+// WithPoisonThreshold quarantines the messages delivered to managed consumers more than n times:
+// they are sent straight to the queue's dead-letter queue with an X-Poison=true header instead of
+// being handled again. 0 disables the detector.
+func WithPoisonThreshold(n int) MQOption {
+	return func(c *MQConfiguration) { c.PoisonThreshold = n }
+}
+
+// redeliveryCount estimates how many times a message has already been delivered, from the retry count
+// set by MoveMessageToRetry, the x-delivery-count header of quorum queues and the redelivered flag
+func redeliveryCount(delivery amqp091.Delivery) int64 {
+	var count int64
+	for _, header := range []string{"X-Retry-Count", "x-delivery-count"} {
+		if n, ok := argToInt64(delivery.Headers[header]); ok && n > count {
+			count = n
+		}
+	}
+	if count == 0 && delivery.Redelivered {
+		count = 1
+	}
+	return count
+}
+
+// isPoisoned reports whether the delivery was redelivered more than the poison threshold
+func isPoisoned(delivery amqp091.Delivery) (int64, bool) {
+	mu.Lock()
+	threshold := mqconfig.PoisonThreshold
+	mu.Unlock()
+	if threshold <= 0 {
+		return 0, false
+	}
+	count := redeliveryCount(delivery)
+	return count, count > int64(threshold)
+}
+
+// quarantineIfPoisoned sends the delivery to the queue's dead-letter queue when it was redelivered
+// more than the poison threshold, settling it, and reports whether it did so.
+// before is called first, so a batch consumer can ack the deliveries handled before this one.
+func (c *managedConsumer) quarantineIfPoisoned(delivery amqp091.Delivery, before func()) bool {
+	count, poisoned := isPoisoned(delivery)
+	if !poisoned {
+		return false
+	}
+	if before != nil {
+		before()
+	}
+
+	logger.Warn(fmt.Sprintf("Quarantining poison message %s from queue %s after %d deliveries", delivery.MessageId, c.queue, count))
+	if err := c.quarantine(delivery); err != nil {
+		logger.Error(fmt.Sprintf("Failed to quarantine message %s: %s", delivery.MessageId, err.Error()))
+		// Let the broker dead-letter it, if the queue has a dead-letter exchange
+		if nackErr := delivery.Nack(false, false); nackErr != nil {
+			logger.Error(fmt.Sprintf("Failed to nack message %s: %s", delivery.MessageId, nackErr.Error()))
+		}
+		return true
+	}
+	if ackErr := delivery.Ack(false); ackErr != nil {
+		logger.Error(fmt.Sprintf("Failed to ack message %s: %s", delivery.MessageId, ackErr.Error()))
+	}
+	return true
+}
+
+func (c *managedConsumer) quarantine(delivery amqp091.Delivery) error {
+	if err := connect(); err != nil {
+		return fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	deadLetterQueue := deadLetterQueueFor(c.queue)
+	if deadLetterQueue == "" {
+		return fmt.Errorf("no dead-letter queue configured for queue %s", c.queue)
+	}
+	if err := ensureChannel(); err != nil {
+		return fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	headers := amqp091.Table{}
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+	headers[PoisonHeader] = true
+	if _, ok := headers[OriginalQueueHeader]; !ok {
+		headers[OriginalQueueHeader] = c.queue
+	}
+	delivery.Headers = headers
+	delivery.Expiration = ""
+	return copyMessageToQueue(delivery, deadLetterQueue)
+}
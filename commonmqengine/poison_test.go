@@ -0,0 +1,87 @@
+package commonmqengine
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestRedeliveryCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp091.Delivery
+		want     int64
+	}{
+		{name: "first delivery", want: 0},
+		{name: "redelivered flag", delivery: amqp091.Delivery{Redelivered: true}, want: 1},
+		{name: "retry count", delivery: amqp091.Delivery{Headers: amqp091.Table{"X-Retry-Count": int32(4)}}, want: 4},
+		{name: "quorum delivery count", delivery: amqp091.Delivery{Headers: amqp091.Table{"x-delivery-count": int64(6)}}, want: 6},
+		{name: "highest count wins", delivery: amqp091.Delivery{Redelivered: true, Headers: amqp091.Table{"X-Retry-Count": int32(3), "x-delivery-count": int64(2)}}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redeliveryCount(tt.delivery); got != tt.want {
+				t.Errorf("redeliveryCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoisonQuarantine(t *testing.T) {
+	tests := []struct {
+		name        string
+		threshold   int
+		dlq         string
+		message     fakeMessage
+		handled     bool
+		quarantined bool
+		settled     fakeAck
+	}{
+		{name: "below the threshold", threshold: 3, dlq: "orders.dlq",
+			message: fakeMessage{Publishing: amqp091.Publishing{Headers: amqp091.Table{"X-Retry-Count": int32(3)}}}, handled: true, settled: fakeAck{Tag: 1}},
+		{name: "retried too many times", threshold: 3, dlq: "orders.dlq",
+			message: fakeMessage{Publishing: amqp091.Publishing{Headers: amqp091.Table{"X-Retry-Count": int32(4)}}}, quarantined: true, settled: fakeAck{Tag: 1}},
+		{name: "redelivered by the broker too many times", threshold: 3, dlq: "orders.dlq",
+			message: fakeMessage{Redelivered: true, Publishing: amqp091.Publishing{Headers: amqp091.Table{"x-delivery-count": int64(5)}}}, quarantined: true, settled: fakeAck{Tag: 1}},
+		{name: "detector disabled", threshold: 0, dlq: "orders.dlq",
+			message: fakeMessage{Publishing: amqp091.Publishing{Headers: amqp091.Table{"X-Retry-Count": int32(40)}}}, handled: true, settled: fakeAck{Tag: 1}},
+		{name: "no dead-letter queue", threshold: 3,
+			message: fakeMessage{Publishing: amqp091.Publishing{Headers: amqp091.Table{"X-Retry-Count": int32(4)}}}, settled: fakeAck{Tag: 1, Nack: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			var opts []QueueOption
+			if tt.dlq != "" {
+				opts = append(opts, WithDeadLetterQueue(tt.dlq))
+			}
+			startEngine(t, WithPoisonThreshold(tt.threshold), WithQueues(NewQueue("orders", opts...)))
+			var handled atomic.Bool
+			if err := RegisterConsumer("orders", func(amqp091.Delivery) error { handled.Store(true); return nil }); err != nil {
+				t.Fatalf("RegisterConsumer failed: %v", err)
+			}
+			tt.message.Body = []byte("poison")
+			b.enqueue("orders", tt.message)
+			eventually(t, "the message to be settled", func() bool { return len(b.settled()) == 1 })
+
+			if got := b.settled(); !slices.Equal(got, []fakeAck{tt.settled}) {
+				t.Errorf("settled = %+v, want %+v", got, tt.settled)
+			}
+			if handled.Load() != tt.handled {
+				t.Errorf("handled = %t, want %t", handled.Load(), tt.handled)
+			}
+			quarantined := b.publishedTo("orders.dlq")
+			if (len(quarantined) == 1) != tt.quarantined {
+				t.Fatalf("%d messages sent to orders.dlq, quarantined %t", len(quarantined), tt.quarantined)
+			}
+			if tt.quarantined {
+				headers := quarantined[0].Headers
+				if headers[PoisonHeader] != true || headers[OriginalQueueHeader] != "orders" {
+					t.Errorf("quarantined headers = %v, want %s=true and %s=orders", headers, PoisonHeader, OriginalQueueHeader)
+				}
+			}
+		})
+	}
+}
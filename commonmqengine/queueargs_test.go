@@ -0,0 +1,101 @@
+package commonmqengine
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []QueueOption
+		args amqp091.Table
+		err  string
+	}{
+		{name: "ttl and max length", opts: []QueueOption{WithMessageTTL(30 * time.Second), WithMaxLength(1000)},
+			args: amqp091.Table{"x-message-ttl": int64(30000), "x-max-length": int64(1000)}},
+		{name: "overflow", opts: []QueueOption{WithMaxLength(10), WithOverflow(OverflowRejectPublish)},
+			args: amqp091.Table{"x-max-length": int64(10), "x-overflow": "reject-publish"}},
+		{name: "overflow without max length", opts: []QueueOption{WithOverflow(OverflowDropHead)},
+			err: "x-overflow requires x-max-length or x-max-length-bytes"},
+		{name: "unknown overflow", opts: []QueueOption{WithMaxLength(10), WithOverflow("drop-tail")},
+			err: "x-overflow must be one of"},
+		{name: "reject-publish-dlx without dead letter exchange", opts: []QueueOption{WithMaxLength(10), WithOverflow(OverflowRejectPublishDLX)},
+			err: "requires x-dead-letter-exchange"},
+		{name: "negative max length", opts: []QueueOption{WithMaxLength(-1)},
+			err: "x-max-length must not be negative"},
+		{name: "negative ttl", opts: []QueueOption{WithMessageTTL(-time.Second)},
+			err: "x-message-ttl must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			err := InitMQEngine(testContext(t), *NewMQConfiguration(WithRequireConnectionAtStartup(true), WithQueues(NewQueue("orders", tt.opts...))))
+			if tt.err != "" {
+				if !errors.Is(err, ErrDeclareFailed) || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("InitMQEngine() error = %v, want ErrDeclareFailed with %q", err, tt.err)
+				}
+				if _, ok := b.declared("orders"); ok {
+					t.Error("the invalid queue was sent to the broker")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InitMQEngine() error = %v", err)
+			}
+			declare, ok := b.declared("orders")
+			if !ok {
+				t.Fatal("the queue was not declared")
+			}
+			if !reflect.DeepEqual(declare.Args, tt.args) {
+				t.Errorf("declared arguments = %v, want %v", declare.Args, tt.args)
+			}
+		})
+	}
+}
+
+func TestQueueArgTypes(t *testing.T) {
+	type settings struct{ Limit int }
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		err  string
+	}{
+		{name: "supported types", args: map[string]interface{}{
+			"x-queue-type": "quorum", "x-max-length": 10, "x-single-active-consumer": true,
+			"x-custom": amqp091.Table{"nested": int64(1)}, "x-list": []interface{}{"a", 1},
+		}},
+		{name: "struct value", args: map[string]interface{}{"x-queue-type": "classic", "x-settings": settings{Limit: 1}},
+			err: `argument "x-settings" has a type that cannot be sent over AMQP (commonmqengine.settings)`},
+		{name: "unsigned integer", args: map[string]interface{}{"x-max-priority": uint(10)},
+			err: `argument "x-max-priority" has a type that cannot be sent over AMQP (uint)`},
+		{name: "nested unsupported value", args: map[string]interface{}{"x-custom": amqp091.Table{"limit": settings{}}},
+			err: `argument "x-custom"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			err := InitMQEngine(testContext(t), *NewMQConfiguration(WithRequireConnectionAtStartup(true), WithQueues(NewQueue("orders", WithArgs(tt.args)))))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("InitMQEngine() error = %v", err)
+				}
+				if _, ok := b.declared("orders"); !ok {
+					t.Error("the queue was not declared")
+				}
+				return
+			}
+			if !errors.Is(err, ErrDeclareFailed) || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("InitMQEngine() error = %v, want ErrDeclareFailed with %q", err, tt.err)
+			}
+			if _, ok := b.declared("orders"); ok {
+				t.Error("the invalid queue was sent to the broker")
+			}
+		})
+	}
+}
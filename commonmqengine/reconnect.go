@@ -0,0 +1,110 @@
+package commonmqengine
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// reconnectBackoff is the wait before each background connection attempt: it doubles from one second
+// up to a minute, with some jitter so that the replicas of a service don't reconnect in lockstep
+var reconnectBackoff = utilities.JitteredBackoff(utilities.ExponentialBackoff(time.Second, time.Minute), 0.2)
+
+var (
+	reconnecting atomic.Bool
+	// initialized is set once InitMQEngine has been called
+	initialized atomic.Bool
+	// reconnectCtx bounds the reconnections started when the broker closes the connection. Guarded by mu.
+	reconnectCtx = context.Background()
+)
+
+// startReconnector keeps trying to connect and declare the queues in the background
+// until it succeeds or the context is cancelled. Only one reconnector runs at a time.
+// Managed consumers, including the ones started by Consume, re-subscribe on their own once connected.
+func startReconnector(ctx context.Context) {
+	if !reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	utilities.Go(func() {
+		defer reconnecting.Store(false)
+		// The connection has just failed, so wait before retrying
+		select {
+		case <-ctx.Done():
+			logger.Warn("Background reconnector stopped before reaching RabbitMQ")
+			return
+		case <-time.After(reconnectBackoff(1)):
+		}
+		attempt := 0
+		err := utilities.Retry(ctx, 0, reconnectBackoff, func() error {
+			attempt++
+			if err := ConnectRabbitMQ(ctx); err != nil {
+				logger.Warn(fmt.Sprintf("Reconnection attempt %d to RabbitMQ failed: %s", attempt, err))
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Warn("Background reconnector stopped before reaching RabbitMQ")
+			return
+		}
+		logger.Info(fmt.Sprintf("Reconnected to RabbitMQ after %d attempts", attempt))
+	})
+}
+
+// watchClose starts the reconnector when the broker closes the connection or the channel with an
+// error, e.g. on a RabbitMQ restart. Close sends no error, so closing them on purpose doesn't reconnect.
+func watchClose(what string, closed <-chan *amqp091.Error) {
+	utilities.Go(func() {
+		amqpErr, ok := <-closed
+		if !ok || amqpErr == nil {
+			return
+		}
+		recordError(fmt.Errorf("%w: %s closed: %w", ErrNotConnected, what, amqpErr))
+		logger.Warn(fmt.Sprintf("RabbitMQ %s closed: %s, reconnecting in the background", what, amqpErr.Error()))
+		mu.Lock()
+		ctx := reconnectCtx
+		mu.Unlock()
+		startReconnector(ctx)
+	})
+}
+
+// ConnectionState describes the connection of the engine to RabbitMQ
+type ConnectionState string
+
+const (
+	// StateNotInitialized means InitMQEngine has not been called, the service doesn't use RabbitMQ
+	StateNotInitialized ConnectionState = "not_initialized"
+	// StateConnected means the connection and the channel are open
+	StateConnected ConnectionState = "connected"
+	// StateReconnecting means the connection was lost and the background reconnector is running
+	StateReconnecting ConnectionState = "reconnecting"
+	// StateDisconnected means the connection is down and no reconnection is in progress
+	StateDisconnected ConnectionState = "disconnected"
+)
+
+// State returns the current state of the connection to RabbitMQ
+func State() ConnectionState {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case conn != nil && !conn.IsClosed() && channel != nil && !channel.IsClosed():
+		return StateConnected
+	case reconnecting.Load():
+		return StateReconnecting
+	case !initialized.Load():
+		return StateNotInitialized
+	}
+	return StateDisconnected
+}
+
+// ConnectionRequired reports whether the engine was configured with RequireConnectionAtStartup,
+// that is whether the service cannot work without RabbitMQ
+func ConnectionRequired() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return mqconfig.RequireConnectionAtStartup
+}
@@ -0,0 +1,124 @@
+package commonmqengine
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		// failedDials is the number of reconnection attempts failing before the broker is back
+		failedDials int
+		consume     bool
+	}{
+		{name: "broker restart"},
+		{name: "broker unreachable for a few attempts", failedDials: 3},
+		{name: "consumer re-subscribed", consume: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastReconnect(t)
+			previous := resubscribeBackoff
+			resubscribeBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+			t.Cleanup(func() { resubscribeBackoff = previous })
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders")))
+
+			handled := make(chan string, 1)
+			if tt.consume {
+				go Consume(testContext(t), "orders", func(d amqp091.Delivery) error {
+					handled <- string(d.Body)
+					return nil
+				})
+				eventually(t, "the consumer to subscribe", func() bool { return b.consumerCount("orders") == 1 })
+			}
+
+			var failures atomic.Int32
+			release := make(chan struct{})
+			if tt.failedDials > 0 {
+				b.setDialHook(func(string) error {
+					if failures.Add(1) <= int32(tt.failedDials) {
+						return errors.New("connection refused")
+					}
+					<-release
+					return nil
+				})
+			}
+			dials := b.dialCount()
+			b.closeConnections()
+			if tt.failedDials > 0 {
+				eventually(t, "the failed attempts", func() bool { return failures.Load() > int32(tt.failedDials) })
+				if got := State(); got != StateReconnecting {
+					t.Errorf("State() while the broker is down = %s, want %s", got, StateReconnecting)
+				}
+				if IsHealthy() {
+					t.Error("IsHealthy() = true while the broker is down")
+				}
+				close(release)
+			}
+			eventually(t, "the reconnection attempt", func() bool { return b.dialCount() > dials })
+			eventually(t, "the reconnection", func() bool { return State() == StateConnected && !reconnecting.Load() })
+			if !IsHealthy() {
+				t.Error("IsHealthy() = false after the reconnection")
+			}
+			// A re-subscribing consumer may dial alongside the reconnector, the extra connection is dropped
+			if got := b.dialCount() - dials; got != tt.failedDials+1 && !tt.consume {
+				t.Errorf("dials = %d, want %d", got, tt.failedDials+1)
+			}
+			if _, err := SendMessageToQueue("orders", "after", "", "text/plain", "id-1", nil); err != nil {
+				t.Errorf("SendMessageToQueue() after the reconnection error = %v", err)
+			}
+			if !tt.consume {
+				return
+			}
+			eventually(t, "the consumer to re-subscribe", func() bool { return b.consumerCount("orders") == 1 })
+			select {
+			case body := <-handled:
+				if body != "after" {
+					t.Errorf("handled %q, want the message sent after the reconnection", body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the re-subscribed consumer did not handle the message")
+			}
+		})
+	}
+}
+
+func TestCloseDoesNotReconnect(t *testing.T) {
+	fastReconnect(t)
+	b := useFakeBroker(t)
+	startEngine(t, WithQueues(NewQueue("orders")))
+
+	Close()
+	time.Sleep(50 * time.Millisecond)
+	if got := b.dialCount(); got != 1 {
+		t.Errorf("dials after Close = %d, want 1", got)
+	}
+	if got := State(); got != StateDisconnected {
+		t.Errorf("State() after Close = %s, want %s", got, StateDisconnected)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 800 * time.Millisecond, max: 1200 * time.Millisecond},
+		{attempt: 2, min: 1600 * time.Millisecond, max: 2400 * time.Millisecond},
+		{attempt: 4, min: 6400 * time.Millisecond, max: 9600 * time.Millisecond},
+		{attempt: 20, min: 48 * time.Second, max: 72 * time.Second},
+	}
+	for _, tt := range tests {
+		for range 20 {
+			if got := reconnectBackoff(tt.attempt); got < tt.min || got > tt.max {
+				t.Errorf("reconnectBackoff(%d) = %s, want between %s and %s", tt.attempt, got, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package commonmqengine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// maxRoutingKeyLength is the AMQP 0-9-1 limit for a routing key (a short string)
+const maxRoutingKeyLength = 255
+
+// ValidateRoutingKey checks that a routing key used for publishing is made of non-empty,
+// dot-separated words. Wildcards (* and #) are only meaningful in bindings, so they are rejected.
+func ValidateRoutingKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: routing key is empty", ErrInvalidRoutingKey)
+	}
+	if len(key) > maxRoutingKeyLength {
+		return fmt.Errorf("%w: routing key is longer than %d bytes", ErrInvalidRoutingKey, maxRoutingKeyLength)
+	}
+	for i, segment := range strings.Split(key, ".") {
+		if segment == "" {
+			return fmt.Errorf("%w: %q has an empty segment at position %d", ErrInvalidRoutingKey, key, i+1)
+		}
+		if strings.ContainsAny(segment, "*#") {
+			return fmt.Errorf("%w: %q contains a wildcard, which is only valid in bindings", ErrInvalidRoutingKey, key)
+		}
+	}
+	return nil
+}
+
+// watchReturns logs the mandatory messages returned by the broker until the channel closes
+func watchReturns(returns <-chan amqp091.Return) {
+	for ret := range returns {
+		err := recordError(fmt.Errorf("%w: exchange %q routing key %q: %d %s",
+			ErrUnroutable, ret.Exchange, ret.RoutingKey, ret.ReplyCode, ret.ReplyText))
+		logger.Warn(fmt.Sprintf("Message %s was returned by the broker: %s", ret.MessageId, err))
+	}
+}
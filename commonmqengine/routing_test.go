@@ -0,0 +1,70 @@
+package commonmqengine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestValidateRoutingKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{key: "orders", valid: true},
+		{key: "orders.eu.created", valid: true},
+		{key: "orders-v2.eu_west", valid: true},
+		{key: ""},
+		{key: "orders..created"},
+		{key: ".orders"},
+		{key: "orders."},
+		{key: "orders.*"},
+		{key: "orders.#"},
+		{key: string(make([]byte, 256))},
+	}
+	for _, tt := range tests {
+		err := ValidateRoutingKey(tt.key)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateRoutingKey(%.20q) error = %v, want valid %t", tt.key, err, tt.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidRoutingKey) {
+			t.Errorf("ValidateRoutingKey(%.20q) error = %v, want ErrInvalidRoutingKey", tt.key, err)
+		}
+	}
+}
+
+func TestPublishRoutingKeyValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		validation bool
+		key        string
+		err        error
+		published  bool
+	}{
+		{name: "valid key", validation: true, key: "orders.eu.created", published: true},
+		{name: "empty segment rejected", validation: true, key: "orders..created", err: ErrInvalidRoutingKey},
+		{name: "wildcard rejected", validation: true, key: "orders.*", err: ErrInvalidRoutingKey},
+		{name: "validation disabled", validation: false, key: "orders..created", published: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			queue := NewQueue("orders", WithExchange("events"), WithExchangeType(amqp091.ExchangeTopic), WithRoutingKey("orders.#"))
+			startEngine(t, WithRoutingKeyValidation(tt.validation), WithQueues(queue))
+
+			before := Stats().Published
+			_, err := SendMessageToQueue("orders", "hello", "", "text/plain", "id-1", nil, WithPublishRoutingKey(tt.key))
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("SendMessageToQueue() error = %v, want %v", err, tt.err)
+			}
+			if tt.published {
+				eventually(t, "the message to be published", func() bool { return len(b.publishedTo(tt.key)) == 1 })
+				return
+			}
+			if got := Stats().Published - before; got != 0 {
+				t.Errorf("%d messages published, want the invalid key rejected before publishing", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package commonmqengine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// deliveryToPublishing copies the body, headers and properties of a delivery into a new publishing
+func deliveryToPublishing(message amqp091.Delivery) amqp091.Publishing {
+	return amqp091.Publishing{
+		Headers:         message.Headers,
+		ContentType:     message.ContentType,
+		ContentEncoding: message.ContentEncoding,
+		DeliveryMode:    message.DeliveryMode,
+		Priority:        message.Priority,
+		CorrelationId:   message.CorrelationId,
+		ReplyTo:         message.ReplyTo,
+		Expiration:      message.Expiration,
+		MessageId:       message.MessageId,
+		Timestamp:       message.Timestamp,
+		Type:            message.Type,
+		UserId:          message.UserId,
+		AppId:           message.AppId,
+		Body:            message.Body,
+	}
+}
+
+// shovelOne moves a single message from source to dest. It returns false when the source is empty.
+func shovelOne(ctx context.Context, source string, dest string) (bool, error) {
+	if err := connect(); err != nil {
+		return false, fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := ensureChannel(); err != nil {
+		return false, fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+	message, ok, err := channel.Get(source, false)
+	if err != nil {
+		return false, recordError(fmt.Errorf("failed to get message from queue %s: %w", source, err))
+	}
+	if !ok {
+		return false, nil
+	}
+	err = channel.PublishWithContext(ctx, "", dest, false, false, deliveryToPublishing(message))
+	if err != nil {
+		// Put the message back on the source queue so nothing is lost
+		message.Nack(false, true)
+		return false, recordError(fmt.Errorf("%w: failed to republish message to queue %s: %w", ErrPublishFailed, dest, err))
+	}
+	publishedTotal.Add(1)
+	if err := message.Ack(false); err != nil {
+		return false, recordError(fmt.Errorf("failed to ack message on queue %s: %w", source, err))
+	}
+	return true, nil
+}
+
+// ShovelQueue moves up to max messages from source to dest, preserving headers and properties.
+// Each message is acked on the source only after it has been republished to dest.
+// It stops when the source is empty, max is reached or the context is cancelled,
+// and returns the number of messages moved. A max of 0 or less moves every message.
+func ShovelQueue(ctx context.Context, source string, dest string, max int) (int, error) {
+	if source == dest {
+		return 0, fmt.Errorf("source and destination queues must differ: %s", source)
+	}
+	logger.Info(fmt.Sprintf("Shoveling up to %d messages from queue %s to %s", max, source, dest))
+	moved := 0
+	for max <= 0 || moved < max {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		ok, err := shovelOne(ctx, source, dest)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Shovel from %s to %s stopped after %d messages: %s", source, dest, moved, err.Error()))
+			return moved, err
+		}
+		if !ok {
+			break
+		}
+		moved++
+	}
+	logger.Info(fmt.Sprintf("Shoveled %d messages from queue %s to %s", moved, source, dest))
+	return moved, nil
+}
@@ -0,0 +1,58 @@
+package commonmqengine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestShovelQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		dest     string
+		messages int
+		max      int
+		moved    int
+		wantErr  bool
+	}{
+		{name: "up to max", source: "failed", dest: "orders", messages: 3, max: 2, moved: 2},
+		{name: "every message", source: "failed", dest: "orders", messages: 3, max: 0, moved: 3},
+		{name: "max above the queue length", source: "failed", dest: "orders", messages: 2, max: 10, moved: 2},
+		{name: "empty source", source: "failed", dest: "orders", messages: 0, max: 0, moved: 0},
+		{name: "same queue", source: "orders", dest: "orders", messages: 1, max: 0, moved: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			startEngine(t, WithQueues(NewQueue("orders"), NewQueue("failed")))
+			for i := 0; i < tt.messages; i++ {
+				m := message("m")
+				m.Headers = amqp091.Table{"X-Retry-Count": int32(3)}
+				m.CorrelationId = "c-1"
+				b.enqueue(tt.source, m)
+			}
+
+			moved, err := ShovelQueue(context.Background(), tt.source, tt.dest, tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ShovelQueue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if moved != tt.moved {
+				t.Errorf("ShovelQueue() moved %d, want %d", moved, tt.moved)
+			}
+			if tt.wantErr {
+				return
+			}
+			eventually(t, "the messages to reach the destination", func() bool { return len(b.messages(tt.dest)) == tt.moved })
+			if left := len(b.messages(tt.source)); left != tt.messages-tt.moved {
+				t.Errorf("%d messages left in the source, want %d", left, tt.messages-tt.moved)
+			}
+			for _, m := range b.messages(tt.dest) {
+				if m.Headers["X-Retry-Count"] != int32(3) || m.CorrelationId != "c-1" {
+					t.Errorf("the headers and properties were not preserved: %+v", m.Publishing)
+				}
+			}
+		})
+	}
+}
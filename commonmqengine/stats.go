@@ -0,0 +1,181 @@
+package commonmqengine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/utilities"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// EngineStats is a point-in-time snapshot of the MQ engine state, intended for debugging
+type EngineStats struct {
+	Connected   bool      `json:"connected"`
+	Host        string    `json:"host"`
+	Port        int       `json:"port"`
+	VHost       string    `json:"vhost"`
+	Queues      []string  `json:"queues"`
+	InFlight    int64     `json:"in_flight"`
+	Published   uint64    `json:"published_total"`
+	Consumed    uint64    `json:"consumed_total"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+var (
+	publishedTotal atomic.Uint64
+	consumedTotal  atomic.Uint64
+	inFlight       atomic.Int64
+
+	lastErrorMu sync.Mutex
+	lastError   error
+	lastErrorAt time.Time
+)
+
+// recordError keeps track of the last error returned by the engine and passes it through
+func recordError(err error) error {
+	if err == nil {
+		return nil
+	}
+	lastErrorMu.Lock()
+	defer lastErrorMu.Unlock()
+	lastError = err
+	lastErrorAt = time.Now()
+	return err
+}
+
+// Stats returns a snapshot of the connection state, configured queues and message counters
+func Stats() EngineStats {
+	mu.Lock()
+	stats := EngineStats{
+		Connected: conn != nil && !conn.IsClosed() && channel != nil && !channel.IsClosed(),
+		Host:      mqconfig.MqHost,
+		Port:      mqconfig.MqPort,
+		VHost:     mqconfig.VHost,
+		Queues:    make([]string, 0, len(mqconfig.Queues)),
+	}
+	for _, queue := range mqconfig.Queues {
+		stats.Queues = append(stats.Queues, queue.Name)
+	}
+	mu.Unlock()
+
+	stats.InFlight = inFlight.Load()
+	stats.Published = publishedTotal.Load()
+	stats.Consumed = consumedTotal.Load()
+
+	lastErrorMu.Lock()
+	if lastError != nil {
+		stats.LastError = lastError.Error()
+		stats.LastErrorAt = lastErrorAt
+	}
+	lastErrorMu.Unlock()
+	return stats
+}
+
+// trackingAcknowledger wraps the channel acknowledger of a delivery so that messages
+// handed to a consumer are counted as in-flight until they are acked, nacked or rejected
+type trackingAcknowledger struct {
+	amqp091.Acknowledger
+	mu          sync.Mutex
+	outstanding map[uint64]struct{}
+}
+
+func newTrackingAcknowledger(ack amqp091.Acknowledger) *trackingAcknowledger {
+	return &trackingAcknowledger{Acknowledger: ack, outstanding: make(map[uint64]struct{})}
+}
+
+func (t *trackingAcknowledger) track(tag uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.outstanding[tag] = struct{}{}
+	inFlight.Add(1)
+}
+
+func (t *trackingAcknowledger) settle(tag uint64, multiple bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for outstandingTag := range t.outstanding {
+		if outstandingTag == tag || (multiple && outstandingTag < tag) {
+			delete(t.outstanding, outstandingTag)
+			inFlight.Add(-1)
+		}
+	}
+}
+
+func (t *trackingAcknowledger) Ack(tag uint64, multiple bool) error {
+	t.settle(tag, multiple)
+	return t.Acknowledger.Ack(tag, multiple)
+}
+
+func (t *trackingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	t.settle(tag, multiple)
+	return t.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (t *trackingAcknowledger) Reject(tag uint64, requeue bool) error {
+	t.settle(tag, false)
+	return t.Acknowledger.Reject(tag, requeue)
+}
+
+// countDeliveries forwards deliveries while updating the consumed and in-flight counters.
+// In-flight tracking only applies to manual-ack consumers.
+func countDeliveries(deliveries <-chan amqp091.Delivery, autoAck bool) <-chan amqp091.Delivery {
+	out := make(chan amqp091.Delivery)
+	utilities.Go(func() {
+		defer close(out)
+		var tracker *trackingAcknowledger
+		for delivery := range deliveries {
+			consumedTotal.Add(1)
+			if !autoAck && delivery.Acknowledger != nil {
+				if tracker == nil {
+					tracker = newTrackingAcknowledger(delivery.Acknowledger)
+				}
+				tracker.track(delivery.DeliveryTag)
+				delivery.Acknowledger = tracker
+			}
+			out <- delivery
+		}
+		if tracker != nil {
+			// The channel is gone, outstanding deliveries will be redelivered by the broker
+			tracker.mu.Lock()
+			inFlight.Add(-int64(len(tracker.outstanding)))
+			tracker.outstanding = make(map[uint64]struct{})
+			tracker.mu.Unlock()
+		}
+	})
+	return out
+}
+
+// QueueStats is the state of a queue as reported by the broker
+type QueueStats struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+}
+
+// GetQueueStats inspects the queue on the broker without declaring it. It fails when the engine is
+// not connected, without trying to connect, or when the queue does not exist. The inspection runs on a
+// short-lived channel, as the broker closes the channel when the queue is missing, which must not
+// affect the engine's channel.
+func GetQueueStats(queueName string) (QueueStats, error) {
+	mu.Lock()
+	err := ensureChannel()
+	connection := conn
+	mu.Unlock()
+	if err != nil {
+		return QueueStats{}, fmt.Errorf("failed to ensure channel is open: %w", err)
+	}
+
+	ch, err := connection.Channel()
+	if err != nil {
+		return QueueStats{}, recordError(fmt.Errorf("%w: failed to open a channel to inspect queue %s: %w", ErrNotConnected, queueName, err))
+	}
+	defer ch.Close()
+	queue, err := ch.QueueDeclarePassive(queueName, false, false, false, false, nil)
+	if err != nil {
+		return QueueStats{}, recordError(fmt.Errorf("failed to inspect queue %s: %w", queueName, err))
+	}
+	return QueueStats{Name: queue.Name, Messages: queue.Messages, Consumers: queue.Consumers}, nil
+}
@@ -0,0 +1,70 @@
+package commonmqengine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGetQueueStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		queue    string
+		messages int
+		err      string
+	}{
+		{name: "existing queue", queue: "orders", messages: 2},
+		{name: "empty queue", queue: "audit", messages: 0},
+		{name: "missing queue", queue: "missing", err: "failed to inspect queue missing"},
+	}
+	b := useFakeBroker(t)
+	startEngine(t, WithQueues(NewQueue("orders"), NewQueue("audit")))
+	b.enqueue("orders", message("first"))
+	b.enqueue("orders", message("second"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := GetQueueStats(tt.queue)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("GetQueueStats(%q) error = %v, want %q", tt.queue, err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("GetQueueStats(%q) error = %v", tt.queue, err)
+			} else if stats.Name != tt.queue || stats.Messages != tt.messages {
+				t.Errorf("GetQueueStats(%q) = %+v, want %d messages", tt.queue, stats, tt.messages)
+			}
+			// Inspecting a missing queue must not close the channel the engine publishes on
+			if _, err := SendMessageToQueue("orders", "after", "", "text/plain", "id-1", nil); err != nil {
+				t.Errorf("SendMessageToQueue() after GetQueueStats error = %v", err)
+			}
+		})
+	}
+}
+
+func TestGetQueueStatsNotConnected(t *testing.T) {
+	tests := []struct {
+		name string
+		init bool
+	}{
+		{name: "engine not initialized"},
+		{name: "connection lost", init: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			if tt.init {
+				startEngine(t, WithQueues(NewQueue("orders")))
+				b.shutdown()
+				eventually(t, "the connection to close", func() bool { return State() != StateConnected })
+			}
+			dials := b.dialCount()
+			if _, err := GetQueueStats("orders"); !errors.Is(err, ErrNotConnected) {
+				t.Errorf("GetQueueStats() error = %v, want ErrNotConnected", err)
+			}
+			// Inspecting a queue doesn't connect, e.g. for every readiness probe while the broker is down
+			if got := b.dialCount(); got != dials {
+				t.Errorf("GetQueueStats() dialed %d times, want none", got-dials)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package commonmqengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareTopology connects with its own connection, declares the exchanges, queues and bindings
+// of cfg and closes the connection. It doesn't touch the engine started by InitMQEngine, so it can be
+// used as a standalone provisioning step (e.g. in CI). Every declaration is attempted; the errors of
+// the ones that failed are joined.
+func DeclareTopology(ctx context.Context, cfg MQConfiguration) error {
+	url, urlObfuscated := buildUrl(cfg)
+	logger.Info(fmt.Sprintf("Declaring topology on %s", urlObfuscated))
+	connection, err := dialer(url, amqpConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("%w: failed to connect to RabbitMQ: %w", ErrNotConnected, err)
+	}
+	defer connection.Close()
+
+	// A failed declaration closes the channel, so a new one is opened for the next declaration
+	var ch *amqp091.Channel
+	openChannel := func() error {
+		if ch != nil && !ch.IsClosed() {
+			return nil
+		}
+		ch, err = connection.Channel()
+		if err != nil {
+			return fmt.Errorf("%w: failed to open Channel: %w", ErrNotConnected, err)
+		}
+		return nil
+	}
+	defer func() {
+		if ch != nil {
+			ch.Close()
+		}
+	}()
+
+	var errs []error
+	declaredExchanges := map[string]bool{}
+	for _, queue := range cfg.Queues {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if err := validateQueueArgs(queue); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s - %w", ErrDeclareFailed, queue.Name, err))
+			continue
+		}
+		if err := openChannel(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if _, err := ch.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, queue.NoWait, amqp091.Table(queue.Args)); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s - %w", ErrDeclareFailed, queue.Name, err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("Queue %s declared", queue.Name))
+
+		// Queues on the default exchange are bound by name implicitly
+		if queue.ExchangeName == "" {
+			continue
+		}
+		if !declaredExchanges[queue.ExchangeName] {
+			kind := queue.ExchangeType
+			if kind == "" {
+				kind = amqp091.ExchangeDirect
+			}
+			if err := openChannel(); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			if err := ch.ExchangeDeclare(queue.ExchangeName, kind, queue.Durable, queue.AutoDelete, false, queue.NoWait, nil); err != nil {
+				errs = append(errs, fmt.Errorf("failed to declare exchange %s: %w", queue.ExchangeName, err))
+				continue
+			}
+			declaredExchanges[queue.ExchangeName] = true
+			logger.Info(fmt.Sprintf("Exchange %s (%s) declared", queue.ExchangeName, kind))
+		}
+		routingKey := queue.RoutingKey
+		if routingKey == "" {
+			routingKey = queue.Name
+		}
+		if err := openChannel(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if err := ch.QueueBind(queue.Name, routingKey, queue.ExchangeName, queue.NoWait, nil); err != nil {
+			errs = append(errs, fmt.Errorf("failed to bind queue %s to exchange %s with key %s: %w", queue.Name, queue.ExchangeName, routingKey, err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("Queue %s bound to exchange %s with key %s", queue.Name, queue.ExchangeName, routingKey))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,85 @@
+package commonmqengine
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDeclareTopology(t *testing.T) {
+	queues := []QueueConfiguration{
+		NewQueue("orders"),
+		NewQueue("invoices", WithExchange("billing"), WithExchangeType("topic"), WithRoutingKey("invoice.*")),
+		NewQueue("audit"),
+	}
+	tests := []struct {
+		name      string
+		fail      []string
+		args      map[string]interface{}
+		dialErr   error
+		declared  []string
+		skipped   []string
+		wantErr   error
+		errQueues []string
+	}{
+		{name: "all declarations succeed", declared: []string{"orders", "invoices", "audit"}},
+		{name: "failures are aggregated", fail: []string{"orders", "audit"}, declared: []string{"orders", "invoices", "audit"},
+			wantErr: ErrDeclareFailed, errQueues: []string{"orders", "audit"}},
+		{name: "invalid arguments are not sent", fail: []string{"audit"}, args: map[string]interface{}{"x-max-length": -1},
+			declared: []string{"invoices", "audit"}, skipped: []string{"orders"}, wantErr: ErrDeclareFailed, errQueues: []string{"orders", "audit"}},
+		{name: "dial failure", dialErr: errors.New("connection refused"), wantErr: ErrNotConnected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useFakeBroker(t)
+			for _, name := range tt.fail {
+				b.failDeclare[name] = true
+			}
+			if tt.dialErr != nil {
+				b.setDialHook(func(string) error { return tt.dialErr })
+			}
+			cfg := *NewMQConfiguration(WithQueues(queues...))
+			if tt.args != nil {
+				cfg.Queues = slices.Clone(cfg.Queues)
+				cfg.Queues[0].Args = tt.args
+			}
+
+			err := DeclareTopology(context.Background(), cfg)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("DeclareTopology() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DeclareTopology() error = %v, want %v", err, tt.wantErr)
+			}
+			for _, name := range tt.errQueues {
+				if !strings.Contains(err.Error(), name) {
+					t.Errorf("DeclareTopology() error = %v, lacks queue %s", err, name)
+				}
+			}
+			for _, name := range tt.declared {
+				if _, ok := b.declared(name); !ok {
+					t.Errorf("queue %s was not declared", name)
+				}
+			}
+			for _, name := range tt.skipped {
+				if _, ok := b.declared(name); ok {
+					t.Errorf("queue %s was sent to the broker", name)
+				}
+			}
+			if tt.dialErr != nil {
+				return
+			}
+			b.mu.Lock()
+			kind, bindings := b.exchanges["billing"], slices.Clone(b.bindings)
+			b.mu.Unlock()
+			if kind != "topic" || !slices.Contains(bindings, fakeBinding{queue: "invoices", exchange: "billing", key: "invoice.*"}) {
+				t.Errorf("exchange billing = %q with bindings %v, want topic with invoices bound to invoice.*", kind, bindings)
+			}
+			if IsConnected() {
+				t.Error("DeclareTopology left the engine connected")
+			}
+		})
+	}
+}
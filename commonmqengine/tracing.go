@@ -0,0 +1,104 @@
+package commonmqengine
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// W3C trace context header names, see https://www.w3.org/TR/trace-context/
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+var traceParentRe = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// TraceContext holds the W3C trace context propagated with a message
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+}
+
+// Valid reports whether the traceparent is well formed
+func (tc TraceContext) Valid() bool {
+	return traceParentRe.MatchString(tc.TraceParent)
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a copy of ctx carrying the trace context
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceFromContext returns the trace context carried by ctx, if any
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	if ctx == nil {
+		return TraceContext{}, false
+	}
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	if !ok || !tc.Valid() {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// WithTraceContext injects the trace context found in ctx into the message headers, instead of the one
+// SendMessageToQueueCtx takes from its own context. It does nothing unless tracing is enabled in the MQ configuration.
+func WithTraceContext(ctx context.Context) PublishOption {
+	return func(p *publishing) {
+		// Publish options are applied while the engine lock is held
+		if !mqconfig.Tracing {
+			return
+		}
+		injectTrace(ctx, &p.Publishing)
+	}
+}
+
+// WithoutTraceContext publishes the message without trace context headers, e.g. for messages that
+// start a new trace on the consumer side
+func WithoutTraceContext() PublishOption {
+	return func(p *publishing) {
+		delete(p.Headers, TraceParentHeader)
+		delete(p.Headers, TraceStateHeader)
+	}
+}
+
+func injectTrace(ctx context.Context, p *amqp091.Publishing) {
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		return
+	}
+	if p.Headers == nil {
+		p.Headers = amqp091.Table{}
+	}
+	p.Headers[TraceParentHeader] = tc.TraceParent
+	if tc.TraceState != "" {
+		p.Headers[TraceStateHeader] = tc.TraceState
+	}
+}
+
+// ContextFromDelivery returns a copy of ctx carrying the trace context found in the delivery headers,
+// so that work done for the message links to the publisher's trace. ctx is returned unchanged
+// when tracing is disabled or the delivery has no valid traceparent.
+func ContextFromDelivery(ctx context.Context, delivery amqp091.Delivery) context.Context {
+	mu.Lock()
+	tracing := mqconfig.Tracing
+	mu.Unlock()
+	if !tracing {
+		return ctx
+	}
+	return extractTrace(ctx, delivery.Headers)
+}
+
+func extractTrace(ctx context.Context, headers amqp091.Table) context.Context {
+	traceParent, _ := headers[TraceParentHeader].(string)
+	traceState, _ := headers[TraceStateHeader].(string)
+	tc := TraceContext{TraceParent: traceParent, TraceState: traceState}
+	if !tc.Valid() {
+		return ctx
+	}
+	return ContextWithTrace(ctx, tc)
+}
@@ -0,0 +1,73 @@
+package commonmqengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	trace := TraceContext{TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", TraceState: "vendor=value"}
+	tests := []struct {
+		name    string
+		tracing bool
+		trace   *TraceContext
+		opts    []PublishOption
+		want    *TraceContext
+	}{
+		{name: "propagated", tracing: true, trace: &trace, want: &trace},
+		{name: "tracing disabled", tracing: false, trace: &trace},
+		{name: "no trace in the context", tracing: true},
+		{name: "removed from the message", tracing: true, trace: &trace, opts: []PublishOption{WithoutTraceContext()}},
+		{name: "invalid traceparent", tracing: true, trace: &TraceContext{TraceParent: "not-a-trace"}},
+		{name: "explicit context", tracing: true, opts: []PublishOption{WithTraceContext(ContextWithTrace(context.Background(), trace))}, want: &trace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeBroker(t)
+			startEngine(t, WithTracing(tt.tracing), WithQueues(NewQueue("orders")))
+			type received struct {
+				headers amqp091.Table
+				trace   TraceContext
+				found   bool
+			}
+			deliveries := make(chan received, 1)
+			err := RegisterConsumerCtx("orders", func(ctx context.Context, delivery amqp091.Delivery) error {
+				tc, found := TraceFromContext(ctx)
+				deliveries <- received{headers: delivery.Headers, trace: tc, found: found}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("RegisterConsumerCtx() error = %v", err)
+			}
+
+			ctx := context.Background()
+			if tt.trace != nil {
+				ctx = ContextWithTrace(ctx, *tt.trace)
+			}
+			if _, err := SendMessageToQueueCtx(ctx, "orders", "hello", "", "text/plain", "id-1", nil, tt.opts...); err != nil {
+				t.Fatalf("SendMessageToQueueCtx() error = %v", err)
+			}
+
+			select {
+			case got := <-deliveries:
+				if tt.want == nil {
+					if got.found || got.headers[TraceParentHeader] != nil {
+						t.Errorf("trace propagated: headers %v, context %+v", got.headers, got.trace)
+					}
+					return
+				}
+				if got.headers[TraceParentHeader] != tt.want.TraceParent || got.headers[TraceStateHeader] != tt.want.TraceState {
+					t.Errorf("headers = %v, want the trace context %+v", got.headers, *tt.want)
+				}
+				if !got.found || got.trace != *tt.want {
+					t.Errorf("consumer context trace = %+v (found %t), want %+v", got.trace, got.found, *tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the message was not consumed")
+			}
+		})
+	}
+}
@@ -1,83 +1,326 @@
 package commonscheduler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fabioluissilva/microservicetemplate/commonconfig"
 	"github.com/fabioluissilva/microservicetemplate/commonlogger"
 	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/fabioluissilva/microservicetemplate/utilities"
 	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
 )
 
-var scheduler gocron.Scheduler
+// Scheduler is an independent scheduler instance with its own jobs, e.g. one for fast jobs and one
+// for slow ones. The package-level functions act on the default instance, which also runs the heartbeat.
+type Scheduler struct {
+	name      string
+	heartbeat bool
+	mu        sync.Mutex
+	scheduler gocron.Scheduler
+	jobs      []CronJob
+	// schedulerMu also guards scheduler, which is written holding both locks, for the readers that
+	// cannot take mu: the heartbeat runs while Shutdown holds mu waiting for the running jobs
+	schedulerMu sync.Mutex
+	// runningJobs counts the job runs currently in progress
+	runningJobs atomic.Int64
+}
+
+// DefaultSchedulerName is the name of the instance used by the package-level functions
+const DefaultSchedulerName = "default"
+
+var (
+	instancesMu sync.Mutex
+	instances   = map[string]*Scheduler{}
+	// defaultScheduler is the instance behind the package-level functions
+	defaultScheduler = GetScheduler(DefaultSchedulerName)
+)
+
+// GetScheduler returns the scheduler instance with the given name, creating it on first use.
+// Only the default instance runs the heartbeat job.
+func GetScheduler(name string) *Scheduler {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	if s, ok := instances[name]; ok {
+		return s
+	}
+	s := &Scheduler{name: name, heartbeat: name == DefaultSchedulerName}
+	instances[name] = s
+	return s
+}
+
+// Name returns the name of the scheduler instance
+func (s *Scheduler) Name() string {
+	return s.name
+}
 
+// heartbeatTag identifies the heartbeat job, which must be scheduled exactly once
+const heartbeatTag = "heartbeatjob"
+
+// CronJob describes a scheduled job. Either Job or JobCtx must be set; JobCtx receives a context
+// carrying the job name and a per-run ID, to be used with the commonlogger *Context functions.
+// Singleton prevents a run from starting while the previous one is still in progress,
+// using OverlapPolicy to decide whether the overlapping run is skipped (default) or waits.
 type CronJob struct {
-	Name     string   `json:"name"`
-	CronExpr string   `json:"cron_expr"`
-	Job      func()   `json:"-"`
-	Tags     []string `json:"tags"`
+	Name          string                    `json:"name"`
+	CronExpr      string                    `json:"cron_expr"`
+	Job           func()                    `json:"-"`
+	JobCtx        func(ctx context.Context) `json:"-"`
+	Tags          []string                  `json:"tags"`
+	Singleton     bool                      `json:"singleton"`
+	OverlapPolicy OverlapPolicy             `json:"overlap_policy,omitempty"`
 }
 
-var jobs []CronJob
+// OverlapPolicy decides what happens to a singleton job run that overlaps the previous one
+type OverlapPolicy string
+
+const (
+	// OverlapSkip drops the overlapping run and waits for the next scheduled time
+	OverlapSkip OverlapPolicy = "skip"
+	// OverlapWait queues the overlapping run until the previous one has finished
+	OverlapWait OverlapPolicy = "wait"
+)
+
+// options returns the gocron options for the job
+func (job CronJob) options() []gocron.JobOption {
+	options := []gocron.JobOption{gocron.WithName(job.Name), gocron.WithTags(job.Tags...)}
+	if job.Singleton {
+		var mode gocron.LimitMode = gocron.LimitModeReschedule
+		if job.OverlapPolicy == OverlapWait {
+			mode = gocron.LimitModeWait
+		}
+		options = append(options, gocron.WithSingletonMode(mode))
+	}
+	return options
+}
+
+// task wraps the job function so every run gets a context tagged with the job name and a run ID
+func (job CronJob) task(runningJobs *atomic.Int64) func() {
+	return func() {
+		runningJobs.Add(1)
+		defer runningJobs.Add(-1)
+		ctx := commonlogger.ContextWith(context.Background(), "job", job.Name, "run_id", uuid.NewString())
+		defer commonmetrics.ObserveDuration(commonmetrics.JobDuration.WithLabelValues(job.Name))()
+		start := utilities.Now()
+		defer func() {
+			end := utilities.Now()
+			execution := Execution{Start: start, End: end, DurationMs: end.Sub(start).Milliseconds()}
+			// Record a panicking run in the history, then let the panic go on
+			if r := recover(); r != nil {
+				execution.Error = fmt.Sprintf("panic: %v", r)
+				recordExecution(job.Name, execution)
+				panic(r)
+			}
+			recordExecution(job.Name, execution)
+		}()
+		if job.JobCtx != nil {
+			job.JobCtx(ctx)
+			return
+		}
+		job.Job()
+	}
+}
 
 type JobInfo struct {
-	Name    string   `json:"name"`
-	Tags    []string `json:"tags"`
-	NextRun string   `json:"next_run"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+	// NextRun is nil when the job has no upcoming run (e.g. a one-time job that already ran)
+	NextRun *string `json:"next_run"`
 }
 
 func GetJobsInfo() []JobInfo {
+	return defaultScheduler.GetJobsInfo()
+}
+
+// GetJobsInfo returns the jobs scheduled by the instance with their next run
+func (s *Scheduler) GetJobsInfo() []JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var infos []JobInfo
-	for _, job := range scheduler.Jobs() {
-		nextRun, _ := job.NextRun()
+	if s.scheduler == nil {
+		return infos
+	}
+	for _, job := range s.scheduler.Jobs() {
 		info := JobInfo{
-			Name:    job.Tags()[0], // or use a custom tag for name
-			Tags:    job.Tags(),
-			NextRun: nextRun.Format("2006-01-02 15:04:05"),
+			Name: job.Name(),
+			Tags: job.Tags(),
+		}
+		if nextRun, err := job.NextRun(); err == nil && !nextRun.IsZero() {
+			formatted := nextRun.Format("2006-01-02 15:04:05")
+			info.NextRun = &formatted
 		}
 		infos = append(infos, info)
 	}
 	return infos
 }
 
+var (
+	heartbeatMu       sync.Mutex
+	expectedHeartbeat time.Time
+)
+
 func Heartbeat() {
+	now := utilities.Now()
 	if commonconfig.GetConfig().GetHeartBeatDebug() {
 		commonlogger.Debug("Sending Heartbeat...")
 	}
 	commonmetrics.HeartbeatCount.Inc()
 	commonmetrics.HeartbeatMessage.SetToCurrentTime()
+	recordHeartbeatDrift(now)
+}
+
+// recordHeartbeatDrift sets the drift between the time the heartbeat was expected by the
+// cron schedule and the time it actually ran, then remembers when the next one is due
+func recordHeartbeatDrift(now time.Time) {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	if !expectedHeartbeat.IsZero() {
+		drift := now.Sub(expectedHeartbeat).Seconds()
+		commonmetrics.HeartbeatDrift.Set(drift)
+		if commonconfig.GetConfig().GetHeartBeatDebug() {
+			commonlogger.Debug(fmt.Sprintf("Heartbeat drift: %.3fs", drift))
+		}
+	}
+	expectedHeartbeat = nextHeartbeat(now)
+}
+
+// nextHeartbeat returns the first scheduled run of the heartbeat job after now, or the zero time if unknown.
+// The run currently executing may still be listed by gocron, hence looking at the next two runs.
+func nextHeartbeat(now time.Time) time.Time {
+	scheduler := defaultScheduler.current()
+	if scheduler == nil {
+		return time.Time{}
+	}
+	for _, job := range scheduler.Jobs() {
+		if !slices.Contains(job.Tags(), heartbeatTag) {
+			continue
+		}
+		nextRuns, err := job.NextRuns(2)
+		if err != nil {
+			return time.Time{}
+		}
+		for _, nextRun := range nextRuns {
+			if nextRun.After(now) {
+				return nextRun
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// current returns the gocron scheduler of the instance, nil when it is not running
+func (s *Scheduler) current() gocron.Scheduler {
+	s.schedulerMu.Lock()
+	defer s.schedulerMu.Unlock()
+	return s.scheduler
+}
+
+// setCurrent replaces the gocron scheduler of the instance. The caller must hold mu.
+func (s *Scheduler) setCurrent(scheduler gocron.Scheduler) {
+	s.schedulerMu.Lock()
+	defer s.schedulerMu.Unlock()
+	s.scheduler = scheduler
 }
 
-// RegisterJobs receives a slice of CronJob and appends them to the heartbeat job
-func RegisterJobs(extraJobs []CronJob) {
-	// Always start with the heartbeat job
-	jobs = []CronJob{
-		{
+// RegisterJobs receives a slice of CronJob and appends them to the registered jobs, which always start
+// with the heartbeat job. It returns the jobs that were added: the heartbeat is only added once and
+// jobs without a function or with the name of an already registered job are skipped.
+func RegisterJobs(extraJobs []CronJob) []CronJob {
+	return defaultScheduler.RegisterJobs(extraJobs)
+}
+
+// RegisterJobs appends the jobs to the ones registered on the instance, see the package-level RegisterJobs.
+// Instances other than the default one don't get a heartbeat job.
+func (s *Scheduler) RegisterJobs(extraJobs []CronJob) []CronJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registerJobs(extraJobs)
+}
+
+func (s *Scheduler) registerJobs(extraJobs []CronJob) []CronJob {
+	var added []CronJob
+	if s.heartbeat && !slices.ContainsFunc(s.jobs, isHeartbeat) {
+		heartbeat := CronJob{
 			Name:     "heartbeatjob",
 			CronExpr: commonconfig.GetConfig().GetHeartBeatCron(),
 			Job:      Heartbeat,
-			Tags:     []string{"heartbeatjob"},
-		},
+			Tags:     []string{heartbeatTag},
+		}
+		s.jobs = append([]CronJob{heartbeat}, s.jobs...)
+		added = append(added, heartbeat)
+	}
+	// Append any additional jobs, skipping the ones without a function as gocron would panic when they fire
+	for _, job := range extraJobs {
+		if job.Job == nil && job.JobCtx == nil {
+			commonlogger.Error("RegisterJobs: Skipping " + job.Name + ": Job function is nil")
+			continue
+		}
+		if isHeartbeat(job) || slices.ContainsFunc(s.jobs, func(registered CronJob) bool { return registered.Name == job.Name }) {
+			commonlogger.Warn("RegisterJobs: Skipping " + job.Name + ": a job with the same name or tag is already registered")
+			continue
+		}
+		s.jobs = append(s.jobs, job)
+		added = append(added, job)
+	}
+	return added
+}
+
+func isHeartbeat(job CronJob) bool {
+	return slices.Contains(job.Tags, heartbeatTag)
+}
+
+// scheduledWithTag reports whether the scheduler already runs a job with the tag
+func (s *Scheduler) scheduledWithTag(tag string) bool {
+	for _, job := range s.scheduler.Jobs() {
+		if slices.Contains(job.Tags(), tag) {
+			return true
+		}
 	}
-	// Append any additional jobs
-	jobs = append(jobs, extraJobs...)
+	return false
 }
 
+// InitScheduler creates and starts the scheduler with the heartbeat, the jobs declared in
+// SCHEDULER_JOBS and the given jobs. Calling it again adds the new jobs to the running scheduler;
+// the heartbeat and the config jobs are never scheduled twice.
 func InitScheduler(extraJobs []CronJob) {
-	var err error
-	scheduler, err = gocron.NewScheduler()
-	if err != nil {
-		commonlogger.Error(fmt.Sprintf("InitScheduler: Error creating scheduler: %s", err.Error()))
-		return
-	}
-	commonlogger.Debug("InitScheduler: Registering jobs...")
-	RegisterJobs(extraJobs)
-	for _, job := range jobs {
+	defaultScheduler.Init(extraJobs)
+}
+
+// Init creates and starts the instance with the given jobs, see InitScheduler
+func (s *Scheduler) Init(extraJobs []CronJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := false
+	if s.scheduler == nil {
+		scheduler, err := gocron.NewScheduler()
+		if err != nil {
+			commonlogger.Error(fmt.Sprintf("InitScheduler: Error creating scheduler %s: %s", s.name, err.Error()))
+			return
+		}
+		s.setCurrent(scheduler)
+		start = true
+	}
+	// The default instance also runs the jobs declared in the config, resolved when it is created
+	if start && s.heartbeat {
+		extraJobs = append(ConfigJobs(), extraJobs...)
+	}
+	commonlogger.Debug(fmt.Sprintf("InitScheduler: Registering jobs on scheduler %s...", s.name))
+	for _, job := range s.registerJobs(extraJobs) {
+		if isHeartbeat(job) && s.scheduledWithTag(heartbeatTag) {
+			continue
+		}
 		commonlogger.Debug("InitScheduler: Setting Cron for " + job.Name + ": " + job.CronExpr)
-		cronJob, err := scheduler.NewJob(
+		cronJob, err := s.scheduler.NewJob(
 			gocron.CronJob(job.CronExpr, false),
-			gocron.NewTask(job.Job),
-			gocron.WithTags(job.Tags...),
+			gocron.NewTask(job.task(&s.runningJobs)),
+			job.options()...,
 		)
 		if err != nil {
 			commonlogger.Error("InitScheduler: Error starting " + job.Name + ": " + err.Error())
@@ -85,14 +328,80 @@ func InitScheduler(extraJobs []CronJob) {
 		}
 		commonlogger.Debug("InitScheduler: Started " + job.Name + " with ID: " + cronJob.ID().String())
 	}
-	commonlogger.Debug("InitScheduler: Starting Scheduler...")
-	scheduler.Start()
+	if start {
+		commonlogger.Debug(fmt.Sprintf("InitScheduler: Starting Scheduler %s...", s.name))
+		s.scheduler.Start()
+	}
+}
+
+// Shutdown stops the scheduler, waiting for the running jobs to finish.
+// It returns the number of job runs that were in progress and had to be drained.
+func Shutdown() (int, error) {
+	return defaultScheduler.Shutdown()
+}
+
+// Shutdown stops the instance, waiting for its running jobs to finish, see the package-level Shutdown
+func (s *Scheduler) Shutdown() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scheduler == nil {
+		return 0, nil
+	}
+	drained := int(s.runningJobs.Load())
+	if err := s.scheduler.Shutdown(); err != nil {
+		commonlogger.Error(fmt.Sprintf("Shutdown: Error stopping scheduler %s: %s", s.name, err.Error()))
+		return drained, fmt.Errorf("failed to stop scheduler %s: %w", s.name, err)
+	}
+	s.setCurrent(nil)
+	s.jobs = nil
+	commonlogger.Debug(fmt.Sprintf("Shutdown: Scheduler %s stopped, %d running jobs drained", s.name, drained))
+	return drained, nil
+}
+
+// ShutdownAll stops every scheduler instance and forgets the job history. It returns the total
+// number of drained job runs and the errors of the instances that failed to stop.
+func ShutdownAll() (int, error) {
+	instancesMu.Lock()
+	all := make([]*Scheduler, 0, len(instances))
+	for _, s := range instances {
+		all = append(all, s)
+	}
+	instancesMu.Unlock()
+
+	total := 0
+	var errs []error
+	for _, s := range all {
+		drained, err := s.Shutdown()
+		total += drained
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	resetJobHistory()
+	return total, errors.Join(errs...)
 }
 
 func ListGocronJobs() []gocron.Job {
-	return scheduler.Jobs()
+	return defaultScheduler.ListGocronJobs()
+}
+
+// ListGocronJobs returns the gocron jobs of the instance
+func (s *Scheduler) ListGocronJobs() []gocron.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scheduler == nil {
+		return nil
+	}
+	return s.scheduler.Jobs()
 }
 
 func GetScheduledJobs() []CronJob {
-	return jobs
+	return defaultScheduler.GetScheduledJobs()
+}
+
+// GetScheduledJobs returns the jobs registered on the instance
+func (s *Scheduler) GetScheduledJobs() []CronJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs
 }
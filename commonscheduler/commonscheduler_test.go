@@ -0,0 +1,453 @@
+package commonscheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
+	"github.com/go-co-op/gocron/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	commonlogger.Discard()
+	if err := commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, commonconfig.MapLoader{"API_KEY": "test-api-key"}); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize the test config: %s\n", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testScheduler returns a scheduler instance of its own for the test, stopped when the test ends
+func testScheduler(t *testing.T) *Scheduler {
+	t.Helper()
+	s := GetScheduler(t.Name())
+	t.Cleanup(func() {
+		if _, err := s.Shutdown(); err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	})
+	return s
+}
+
+// jobNames returns the names of the jobs scheduled by gocron on the instance
+func jobNames(s *Scheduler) []string {
+	var names []string
+	for _, job := range s.ListGocronJobs() {
+		names = append(names, job.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestNilJobSkipped(t *testing.T) {
+	tests := []struct {
+		name      string
+		jobs      []CronJob
+		scheduled []string
+	}{
+		{name: "nil job", jobs: []CronJob{{Name: "nil", CronExpr: "* * * * *"}}},
+		{name: "job", jobs: []CronJob{{Name: "job", CronExpr: "* * * * *", Job: func() {}}}, scheduled: []string{"job"}},
+		{name: "context job", jobs: []CronJob{{Name: "ctx", CronExpr: "* * * * *", JobCtx: func(context.Context) {}}}, scheduled: []string{"ctx"}},
+		{name: "nil job among others", jobs: []CronJob{
+			{Name: "first", CronExpr: "* * * * *", Job: func() {}},
+			{Name: "nil", CronExpr: "* * * * *"},
+			{Name: "last", CronExpr: "* * * * *", Job: func() {}},
+		}, scheduled: []string{"first", "last"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testScheduler(t)
+			s.Init(tt.jobs)
+			if got := jobNames(s); !slices.Equal(got, tt.scheduled) {
+				t.Errorf("scheduled jobs = %v, want %v", got, tt.scheduled)
+			}
+			for _, job := range s.GetScheduledJobs() {
+				if job.Job == nil && job.JobCtx == nil {
+					t.Errorf("job %s without a function was registered", job.Name)
+				}
+			}
+		})
+	}
+}
+
+// setExpectedHeartbeat sets the time the next heartbeat is expected, restoring it when the test ends
+func setExpectedHeartbeat(t *testing.T, expected time.Time) {
+	t.Helper()
+	heartbeatMu.Lock()
+	previous := expectedHeartbeat
+	expectedHeartbeat = expected
+	heartbeatMu.Unlock()
+	t.Cleanup(func() {
+		heartbeatMu.Lock()
+		expectedHeartbeat = previous
+		heartbeatMu.Unlock()
+	})
+}
+
+func TestHeartbeatDrift(t *testing.T) {
+	expected := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		expected time.Time
+		ran      time.Time
+		drift    float64
+	}{
+		{name: "on time", expected: expected, ran: expected, drift: 0},
+		{name: "delayed", expected: expected, ran: expected.Add(2500 * time.Millisecond), drift: 2.5},
+		{name: "much delayed", expected: expected, ran: expected.Add(90 * time.Second), drift: 90},
+		{name: "first heartbeat leaves the gauge", ran: expected.Add(time.Second), drift: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commonmetrics.HeartbeatDrift.Set(-1)
+			setExpectedHeartbeat(t, tt.expected)
+			recordHeartbeatDrift(tt.ran)
+			if got := testutil.ToFloat64(commonmetrics.HeartbeatDrift); got != tt.drift {
+				t.Errorf("heartbeat_drift_seconds = %v, want %v", got, tt.drift)
+			}
+		})
+	}
+}
+
+func TestHeartbeatExpectedFromSchedule(t *testing.T) {
+	InitScheduler(nil)
+	t.Cleanup(func() { Shutdown() })
+	setExpectedHeartbeat(t, time.Time{})
+
+	// Stay clear of the minute boundary, when the heartbeat job itself runs
+	if untilNext := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)); untilNext < 2*time.Second {
+		time.Sleep(untilNext + time.Second)
+	}
+	now := time.Now()
+	recordHeartbeatDrift(now)
+	heartbeatMu.Lock()
+	next := expectedHeartbeat
+	heartbeatMu.Unlock()
+	// The default HEARTBEAT_CRON runs every minute
+	if want := now.Truncate(time.Minute).Add(time.Minute); !next.Equal(want) {
+		t.Fatalf("expected heartbeat = %s, want %s", next, want)
+	}
+
+	recordHeartbeatDrift(next.Add(3 * time.Second))
+	if got := testutil.ToFloat64(commonmetrics.HeartbeatDrift); got != 3 {
+		t.Errorf("heartbeat_drift_seconds = %v for a heartbeat 3s late, want 3", got)
+	}
+}
+
+func TestJobRunLogContext(t *testing.T) {
+	var logs bytes.Buffer
+	commonlogger.SetOutput(&logs)
+	t.Cleanup(commonlogger.Discard)
+
+	runID := regexp.MustCompile(`job=report run_id=([0-9a-f-]{36})\b`)
+	tests := []struct {
+		name string
+		job  CronJob
+		tags bool
+	}{
+		{name: "context job", job: CronJob{Name: "report", JobCtx: func(ctx context.Context) {
+			commonlogger.InfoContext(ctx, "generating the report")
+		}}, tags: true},
+		{name: "plain job", job: CronJob{Name: "report", Job: func() {
+			commonlogger.Info("generating the report")
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running atomic.Int64
+			seen := map[string]bool{}
+			for run := 0; run < 2; run++ {
+				logs.Reset()
+				tt.job.task(&running)()
+				match := runID.FindStringSubmatch(logs.String())
+				if !tt.tags {
+					if match != nil {
+						t.Errorf("log of a job without context is tagged: %s", logs.String())
+					}
+					continue
+				}
+				if match == nil {
+					t.Fatalf("log line lacks the job name and run ID: %s", logs.String())
+				}
+				if seen[match[1]] {
+					t.Errorf("run ID %s reused by another run", match[1])
+				}
+				seen[match[1]] = true
+			}
+		})
+	}
+}
+
+func TestSingletonJobs(t *testing.T) {
+	tests := []struct {
+		name      string
+		singleton bool
+		policy    OverlapPolicy
+		overlap   bool
+	}{
+		{name: "not singleton", overlap: true},
+		{name: "singleton skips", singleton: true, policy: OverlapSkip},
+		{name: "singleton waits", singleton: true, policy: OverlapWait},
+		{name: "singleton default policy", singleton: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, maxRunning, runs atomic.Int32
+			job := CronJob{Name: "slow", Singleton: tt.singleton, OverlapPolicy: tt.policy, Job: func() {
+				now := running.Add(1)
+				defer running.Add(-1)
+				for {
+					highest := maxRunning.Load()
+					if now <= highest || maxRunning.CompareAndSwap(highest, now) {
+						break
+					}
+				}
+				runs.Add(1)
+				time.Sleep(50 * time.Millisecond)
+			}}
+
+			scheduler, err := gocron.NewScheduler()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var runningJobs atomic.Int64
+			// Fire every 10ms, much faster than the job runs
+			if _, err := scheduler.NewJob(gocron.DurationJob(10*time.Millisecond), gocron.NewTask(job.task(&runningJobs)), job.options()...); err != nil {
+				t.Fatal(err)
+			}
+			scheduler.Start()
+			time.Sleep(300 * time.Millisecond)
+			if err := scheduler.Shutdown(); err != nil {
+				t.Fatal(err)
+			}
+
+			if runs.Load() < 2 {
+				t.Fatalf("the job ran %d times, want it fired repeatedly", runs.Load())
+			}
+			if overlapped := maxRunning.Load() > 1; overlapped != tt.overlap {
+				t.Errorf("runs overlapped %t (up to %d at once), want %t", overlapped, maxRunning.Load(), tt.overlap)
+			}
+		})
+	}
+}
+
+func TestJobInfoNextRun(t *testing.T) {
+	s := testScheduler(t)
+	s.Init([]CronJob{{Name: "cron", CronExpr: "* * * * *", Job: func() {}}})
+	ran := make(chan struct{})
+	_, err := s.current().NewJob(gocron.OneTimeJob(gocron.OneTimeJobStartImmediately()), gocron.NewTask(func() { close(ran) }), gocron.WithName("once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the one-time job did not run")
+	}
+
+	tests := []struct {
+		job     string
+		nextRun bool
+		json    string
+	}{
+		{job: "cron", nextRun: true},
+		{job: "once", nextRun: false, json: `"next_run":null`},
+	}
+	infos := s.GetJobsInfo()
+	for _, tt := range tests {
+		t.Run(tt.job, func(t *testing.T) {
+			i := slices.IndexFunc(infos, func(info JobInfo) bool { return info.Name == tt.job })
+			if i < 0 {
+				t.Fatalf("job %s missing from %+v", tt.job, infos)
+			}
+			info := infos[i]
+			if (info.NextRun != nil) != tt.nextRun {
+				t.Fatalf("NextRun = %v, want set %t", info.NextRun, tt.nextRun)
+			}
+			if info.NextRun != nil {
+				if _, err := time.ParseInLocation("2006-01-02 15:04:05", *info.NextRun, time.Local); err != nil || strings.HasPrefix(*info.NextRun, "0001") {
+					t.Errorf("NextRun = %q, want a real timestamp", *info.NextRun)
+				}
+			}
+			if tt.json != "" {
+				data, err := json.Marshal(info)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(data), tt.json) {
+					t.Errorf("JSON %s lacks %s", data, tt.json)
+				}
+			}
+		})
+	}
+}
+
+func TestHeartbeatRegisteredOnce(t *testing.T) {
+	t.Cleanup(func() { Shutdown() })
+	calls := []struct {
+		name string
+		jobs []CronJob
+	}{
+		{name: "first init"},
+		{name: "second init", jobs: []CronJob{{Name: "report", CronExpr: "* * * * *", Job: func() {}}}},
+		{name: "duplicate heartbeat job", jobs: []CronJob{{Name: "other-heartbeat", CronExpr: "* * * * *", Job: Heartbeat, Tags: []string{heartbeatTag}}}},
+	}
+	for _, call := range calls {
+		t.Run(call.name, func(t *testing.T) {
+			InitScheduler(call.jobs)
+			registered := 0
+			for _, job := range GetScheduledJobs() {
+				if isHeartbeat(job) {
+					registered++
+				}
+			}
+			scheduled := 0
+			for _, job := range ListGocronJobs() {
+				if slices.Contains(job.Tags(), heartbeatTag) {
+					scheduled++
+				}
+			}
+			if registered != 1 || scheduled != 1 {
+				t.Errorf("%d heartbeat jobs registered and %d scheduled, want 1 each", registered, scheduled)
+			}
+		})
+	}
+	if got := jobNames(defaultScheduler); !slices.Equal(got, []string{"heartbeatjob", "report"}) {
+		t.Errorf("scheduled jobs = %v, want [heartbeatjob report]", got)
+	}
+}
+
+// useConfig loads the config from values until the end of the test
+func useConfig(t *testing.T, values commonconfig.MapLoader) {
+	t.Helper()
+	commonconfig.ResetForTest()
+	if err := commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, values); err != nil {
+		t.Fatalf("failed to initialize the config: %v", err)
+	}
+	t.Cleanup(func() {
+		commonconfig.ResetForTest()
+		commonconfig.InitializeWithLoaderE(&commonconfig.BaseConfig{}, commonconfig.MapLoader{"API_KEY": "test-api-key"})
+	})
+}
+
+func TestJobHistory(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		runs   int
+		panics int
+		want   int
+		errors int
+		// shutdown stops every scheduler before reading the history
+		shutdown bool
+	}{
+		{name: "accumulates", size: 3, runs: 2, want: 2},
+		{name: "capped at the size", size: 3, runs: 5, want: 3},
+		{name: "oldest runs dropped", size: 2, runs: 3, panics: 1, want: 2},
+		{name: "panicking run recorded", size: 3, runs: 2, panics: 1, want: 2, errors: 1},
+		{name: "disabled", size: 0, runs: 2},
+		{name: "forgotten on shutdown", size: 3, runs: 2, shutdown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, commonconfig.MapLoader{"API_KEY": "test-api-key", "JOB_HISTORY_SIZE": tt.size})
+			t.Cleanup(resetJobHistory)
+			run := 0
+			job := CronJob{Name: t.Name(), Job: func() {
+				run++
+				if run <= tt.panics {
+					panic("boom")
+				}
+			}}
+			var running atomic.Int64
+			for i := 0; i < tt.runs; i++ {
+				func() {
+					defer func() { recover() }()
+					job.task(&running)()
+				}()
+			}
+			if tt.shutdown {
+				if _, err := ShutdownAll(); err != nil {
+					t.Fatalf("ShutdownAll() error = %v", err)
+				}
+			}
+
+			history := GetJobHistory(job.Name)
+			if len(history) != tt.want {
+				t.Fatalf("history has %d executions, want %d", len(history), tt.want)
+			}
+			failed := 0
+			for i, execution := range history {
+				if execution.Error != "" {
+					failed++
+					if execution.Error != "panic: boom" {
+						t.Errorf("execution error = %q, want %q", execution.Error, "panic: boom")
+					}
+				}
+				if execution.End.Before(execution.Start) || (i > 0 && execution.Start.Before(history[i-1].Start)) {
+					t.Errorf("execution %d out of order: %+v", i, execution)
+				}
+			}
+			if failed != tt.errors {
+				t.Errorf("%d executions with an error, want %d", failed, tt.errors)
+			}
+		})
+	}
+}
+
+func TestNamedSchedulers(t *testing.T) {
+	instances := []struct {
+		name string
+		jobs []CronJob
+		want []string
+	}{
+		{name: "fast", jobs: []CronJob{{Name: "poll", CronExpr: "* * * * *", Job: func() {}}}, want: []string{"poll"}},
+		{name: "slow", jobs: []CronJob{
+			{Name: "report", CronExpr: "0 * * * *", Job: func() {}},
+			{Name: "cleanup", CronExpr: "0 3 * * *", Job: func() {}},
+		}, want: []string{"cleanup", "report"}},
+	}
+	schedulers := map[string]*Scheduler{}
+	for _, instance := range instances {
+		s := GetScheduler(t.Name() + "/" + instance.name)
+		t.Cleanup(func() { s.Shutdown() })
+		s.Init(instance.jobs)
+		schedulers[instance.name] = s
+	}
+	for _, instance := range instances {
+		t.Run(instance.name, func(t *testing.T) {
+			s := schedulers[instance.name]
+			if GetScheduler(s.Name()) != s {
+				t.Error("GetScheduler returned another instance for the same name")
+			}
+			if got := jobNames(s); !slices.Equal(got, instance.want) {
+				t.Errorf("jobs = %v, want %v", got, instance.want)
+			}
+			if len(s.GetJobsInfo()) != len(instance.want) {
+				t.Errorf("GetJobsInfo() = %v, want %d jobs", s.GetJobsInfo(), len(instance.want))
+			}
+		})
+	}
+
+	if _, err := schedulers["fast"].Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if got := jobNames(schedulers["fast"]); len(got) != 0 {
+		t.Errorf("stopped scheduler still has jobs %v", got)
+	}
+	if got := jobNames(schedulers["slow"]); !slices.Equal(got, instances[1].want) {
+		t.Errorf("stopping fast changed the jobs of slow to %v", got)
+	}
+}
@@ -0,0 +1,68 @@
+package commonscheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+)
+
+var (
+	handlersMu sync.Mutex
+	handlers   = map[string]func(ctx context.Context){}
+)
+
+// RegisterJobHandler makes fn available under name to the jobs declared in SCHEDULER_JOBS, e.g.
+//
+//	commonscheduler.RegisterJobHandler("cleanup", cleanup)
+//
+// with SCHEDULER_JOBS="Cleanup|*/5 * * * *|cleanup". Register the handlers before InitScheduler.
+func RegisterJobHandler(name string, fn func(ctx context.Context)) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[name] = fn
+}
+
+func jobHandler(name string) (func(ctx context.Context), bool) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	fn, ok := handlers[name]
+	return fn, ok && fn != nil
+}
+
+// parseJobSpec builds a job from a "name|cron expression|handler" spec, tagged "config"
+func parseJobSpec(spec string) (CronJob, error) {
+	fields := strings.Split(spec, "|")
+	if len(fields) != 3 {
+		return CronJob{}, fmt.Errorf("invalid job spec %q: expected name|cron expression|handler", spec)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+		if fields[i] == "" {
+			return CronJob{}, fmt.Errorf("invalid job spec %q: empty field", spec)
+		}
+	}
+	fn, ok := jobHandler(fields[2])
+	if !ok {
+		return CronJob{}, fmt.Errorf("invalid job spec %q: no handler registered as %s", spec, fields[2])
+	}
+	return CronJob{Name: fields[0], CronExpr: fields[1], JobCtx: fn, Tags: []string{"config"}}, nil
+}
+
+// ConfigJobs returns the jobs declared in SCHEDULER_JOBS. Invalid specs and specs whose handler
+// is not registered are logged and skipped.
+func ConfigJobs() []CronJob {
+	var jobs []CronJob
+	for _, spec := range commonconfig.GetConfig().GetSchedulerJobs() {
+		job, err := parseJobSpec(spec)
+		if err != nil {
+			commonlogger.Error("SCHEDULER_JOBS: Skipping job: " + err.Error())
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
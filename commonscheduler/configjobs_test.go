@@ -0,0 +1,82 @@
+package commonscheduler
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+)
+
+func TestParseJobSpec(t *testing.T) {
+	RegisterJobHandler("cleanup", func(context.Context) {})
+	tests := []struct {
+		name string
+		spec string
+		job  CronJob
+		err  string
+	}{
+		{name: "valid", spec: "Cleanup|*/5 * * * *|cleanup", job: CronJob{Name: "Cleanup", CronExpr: "*/5 * * * *"}},
+		{name: "spaces are trimmed", spec: " Cleanup | 0 3 * * * | cleanup ", job: CronJob{Name: "Cleanup", CronExpr: "0 3 * * *"}},
+		{name: "missing field", spec: "Cleanup|*/5 * * * *", err: "expected name|cron expression|handler"},
+		{name: "empty field", spec: "Cleanup||cleanup", err: "empty field"},
+		{name: "unknown handler", spec: "Cleanup|*/5 * * * *|purge", err: "no handler registered as purge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := parseJobSpec(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseJobSpec(%q) error = %v, want %q", tt.spec, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJobSpec(%q) error = %v", tt.spec, err)
+			}
+			if job.Name != tt.job.Name || job.CronExpr != tt.job.CronExpr || job.JobCtx == nil || !slices.Equal(job.Tags, []string{"config"}) {
+				t.Errorf("parseJobSpec(%q) = %+v, want %+v with the handler and the config tag", tt.spec, job, tt.job)
+			}
+		})
+	}
+}
+
+func TestConfigJobs(t *testing.T) {
+	ran := make(chan string, 1)
+	RegisterJobHandler("report", func(context.Context) { ran <- "report" })
+	tests := []struct {
+		name      string
+		jobs      string
+		scheduled []string
+	}{
+		{name: "no config jobs", jobs: "", scheduled: []string{"heartbeatjob"}},
+		{name: "config job", jobs: "Report|0 0 1 1 *|report", scheduled: []string{"Report", "heartbeatjob"}},
+		{name: "invalid specs are skipped", jobs: "Report|0 0 1 1 *|report; Broken|0 0 1 1 *; Purge|0 0 1 1 *|purge",
+			scheduled: []string{"Report", "heartbeatjob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, commonconfig.MapLoader{"API_KEY": "test-api-key", "SCHEDULER_JOBS": tt.jobs})
+			InitScheduler(nil)
+			t.Cleanup(func() { Shutdown() })
+			if got := jobNames(defaultScheduler); !slices.Equal(got, tt.scheduled) {
+				t.Fatalf("scheduled jobs = %v, want %v", got, tt.scheduled)
+			}
+			for _, job := range ListGocronJobs() {
+				if job.Name() != "Report" {
+					continue
+				}
+				if err := job.RunNow(); err != nil {
+					t.Fatalf("RunNow() error = %v", err)
+				}
+				select {
+				case <-ran:
+				case <-time.After(time.Second):
+					t.Fatal("the registered handler did not run")
+				}
+			}
+		})
+	}
+}
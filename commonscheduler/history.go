@@ -0,0 +1,95 @@
+package commonscheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+)
+
+// Execution is a past run of a job
+type Execution struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// jobHistory is a ring buffer keeping the last executions of a job
+type jobHistory struct {
+	executions []Execution
+	next       int
+	full       bool
+}
+
+var (
+	historyMu sync.Mutex
+	histories = map[string]*jobHistory{}
+)
+
+// resetJobHistory forgets the executions of every job
+func resetJobHistory() {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	clear(histories)
+}
+
+// historySize returns the number of executions kept per job, from JOB_HISTORY_SIZE
+func historySize() int {
+	if cfg := commonconfig.GetConfig(); cfg != nil {
+		return cfg.GetJobHistorySize()
+	}
+	return 0
+}
+
+// recordExecution adds an execution to the history of the job, dropping the oldest one when full
+func recordExecution(name string, execution Execution) {
+	size := historySize()
+	if size <= 0 {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	history, ok := histories[name]
+	if !ok || len(history.executions) != size {
+		// First run, or the size changed on a config reload: start over with the kept entries
+		resized := &jobHistory{executions: make([]Execution, size)}
+		if ok {
+			for _, previous := range history.list() {
+				resized.add(previous)
+			}
+		}
+		history = resized
+		histories[name] = history
+	}
+	history.add(execution)
+}
+
+func (h *jobHistory) add(execution Execution) {
+	h.executions[h.next] = execution
+	h.next = (h.next + 1) % len(h.executions)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the executions from the oldest to the newest
+func (h *jobHistory) list() []Execution {
+	if !h.full {
+		return append([]Execution{}, h.executions[:h.next]...)
+	}
+	return append(append([]Execution{}, h.executions[h.next:]...), h.executions[:h.next]...)
+}
+
+// GetJobHistory returns the last executions of the job, from the oldest to the newest.
+// At most JOB_HISTORY_SIZE executions are kept per job; jobs with the same name in different
+// scheduler instances share their history.
+func GetJobHistory(name string) []Execution {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	history, ok := histories[name]
+	if !ok {
+		return []Execution{}
+	}
+	return history.list()
+}
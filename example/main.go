@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/fabioluissilva/microservicetemplate/commonapi"
 	"github.com/fabioluissilva/microservicetemplate/commonconfig"
@@ -12,31 +13,18 @@ import (
 	"github.com/fabioluissilva/microservicetemplate/commonmetrics"
 	"github.com/fabioluissilva/microservicetemplate/commonmqengine"
 	"github.com/fabioluissilva/microservicetemplate/commonscheduler"
+	"github.com/rabbitmq/amqp091-go"
 )
 
+// ServiceConfig adds the service's own settings to the template ones. Embedding BaseConfig
+// provides all the Config getters, so only the getters of new settings need to be written.
 type ServiceConfig struct {
 	commonconfig.BaseConfig `mapstructure:",squash"`
 	Test                    string `mapstructure:"TEST"`
 }
 
-func (c *ServiceConfig) GetApiKey() string {
-	return c.ApiKey
-}
-func (c *ServiceConfig) GetVersion() string {
-	return c.Version
-}
-func (c *ServiceConfig) GetLogLevel() string {
-	return c.LogLevel
-}
-func (c *ServiceConfig) GetServiceName() string {
-	return c.ServiceName
-}
-func (c *ServiceConfig) GetMetricsPort() int {
-	return c.MetricsPort
-}
-func (c *ServiceConfig) GetPort() int {
-	return c.Port
-}
+// Fails to compile if ServiceConfig stops implementing commonconfig.Config
+var _ commonconfig.Config = (*ServiceConfig)(nil)
 
 func customPingHandlerWithoutAPIKey(w http.ResponseWriter, r *http.Request) {
 
@@ -53,36 +41,33 @@ func customPingHandlerWithAPIKey(w http.ResponseWriter, r *http.Request) {
 		commonlogger.Error("Error marshalling response to JSON: ", "error", err.Error())
 		return
 	}
-	commonmqengine.SendMessageToQueue("ordersretry", string(responseJSON), "", "application/json", "1", nil)
+	// Bounded by the request context, so a slow broker cannot outlive the request
+	commonmqengine.SendMessageToQueueCtx(r.Context(), "ordersretry", string(responseJSON), "", "application/json", "1", nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	commonlogger.Info("Custom Ping with API KEY Handler called")
 	json.NewEncoder(w).Encode(response)
 }
 
-func customScheduledJob() {
-	commonlogger.Debug("Custom Scheduled Job executed")
+func customScheduledJob(ctx context.Context) {
+	// Logging with the job context tags the record with the job name and run ID
+	commonlogger.DebugContext(ctx, "Custom Scheduled Job executed")
 	// You can add more logic here, like sending metrics or logging
 }
 
-func consumeMessages() {
-	commonlogger.Debug("[Engine - ConsumeMessages] Starting to consume messages")
-	deliveries, err := commonmqengine.ConsumeFromQueue("orders", true)
-
-	if err != nil {
-		commonlogger.Error(fmt.Sprintf("Error consuming from queue: %s", err.Error()))
-		return
-	}
-
-	for delivery := range deliveries {
-		commonlogger.Info(fmt.Sprintf("Processing delivery: %s", delivery.MessageId))
-		commonlogger.Debug(fmt.Sprintf("Delivery body: %s", delivery.Body))
-	}
+// processOrder is called for every message on the orders queue.
+// Returning nil acks the message, returning an error nacks it so it goes to the dead-letter path.
+func processOrder(delivery amqp091.Delivery) error {
+	commonlogger.Info(fmt.Sprintf("Processing delivery: %s", delivery.MessageId))
+	commonlogger.Debug(fmt.Sprintf("Delivery body: %s", delivery.Body))
+	return nil
 }
 
 func main() {
 	var config ServiceConfig
 	commonconfig.Initialize(&config)
+	// Reload the config (e.g. LOG_LEVEL) on SIGHUP instead of shutting down
+	commonconfig.WatchConfig(&config)
 	commonlogger.SetServiceName(config.GetServiceName())
 	commonmetrics.InitializeMetrics()
 	commonlogger.Info("Main Started")
@@ -91,10 +76,13 @@ func main() {
 		{
 			Name:     "Custom Scheduled Job",
 			CronExpr: "*/1 * * * *",
-			Job:      customScheduledJob,
+			JobCtx:   customScheduledJob,
 			Tags:     []string{"custom", "scheduled"},
 		},
 	}
+	// Jobs can also be declared in SCHEDULER_JOBS, e.g. "Config Job|*/5 * * * *|custom",
+	// using the handlers registered by name
+	commonscheduler.RegisterJobHandler("custom", customScheduledJob)
 	// you can pass nil if you don't have custom jobs
 	commonscheduler.InitScheduler(scheduledJobs)
 	// set RabbitMQ configuration
@@ -103,11 +91,15 @@ func main() {
 		commonmqengine.WithHost("rabbitmq.thothnet.local"),
 		commonmqengine.WithPort(5672),
 		commonmqengine.WithVHost("/"),
+		// Don't start in degraded mode: this service can't work without the broker
+		commonmqengine.WithRequireConnectionAtStartup(true),
 		commonmqengine.WithQueues(
 			commonmqengine.NewQueue("orders",
 				commonmqengine.WithExchange(""),
 				commonmqengine.WithRoutingKey(""),
 				commonmqengine.WithDurable(true),
+				// Messages of this queue that exhaust their retries go to ordersdlq
+				commonmqengine.WithDeadLetterQueue("ordersdlq"),
 			),
 			commonmqengine.NewQueue("ordersretry",
 				commonmqengine.WithExchange(""),
@@ -126,25 +118,36 @@ func main() {
 			),
 		),
 	)
-	commonmqengine.InitMQEngine(context.Background(), *mqcfg)
 
 	// Start the API server with a ping custom handler. Note that this is a separate route from the default ping handler.
 	// If you want to override the existing one, just add the same route with a different handler.
 	// commonapi exports a WithAPIKey middleware that can be used to protect routes.
+	// Routes can also be restricted to a method, e.g. "GET /orders" and "POST /orders" can point to different handlers.
 	overrides := commonapi.RouteMap{
 		"/ping2": customPingHandlerWithoutAPIKey,
 		"/ping3": commonapi.WithAPIKey(customPingHandlerWithAPIKey),
 	}
-	done, err := commonapi.StartAPI(&config, overrides)
+	server, err := commonapi.StartAPI(&config, overrides)
 	if err != nil {
 		commonlogger.Error("Error starting API: ", "error", err.Error())
-		return
+		os.Exit(1)
+	}
+	// A failure to reach RabbitMQ is fatal for this service: trigger an error-driven shutdown
+	if err := commonmqengine.InitMQEngine(context.Background(), *mqcfg); err != nil {
+		server.Shutdown(fmt.Errorf("failed to initialize MQ engine: %w", err))
+	} else {
+		if err := commonmqengine.RegisterConsumer("orders", processOrder); err != nil {
+			commonlogger.Error(fmt.Sprintf("Error consuming from queue: %s", err.Error()))
+		}
+		commonlogger.Info("Successfully started the service: ")
 	}
-	go consumeMessages()
-
-	commonlogger.Info("Successfully started the service: ")
 	// Wait for shutdown to complete
-	<-done
-	commonlogger.Info("Service shutdown complete")
+	<-server.Done
+	if server.ShutdownReason != nil {
+		commonlogger.Error("Service shutdown due to error", "error", server.ShutdownReason.Error())
+	} else {
+		commonlogger.Info("Service shutdown complete")
+	}
+	os.Exit(server.ExitCode())
 
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fabioluissilva/microservicetemplate/commonconfig"
+	"github.com/fabioluissilva/microservicetemplate/commonlogger"
+)
+
+func TestServiceConfig(t *testing.T) {
+	commonlogger.Discard()
+	tests := []struct {
+		name    string
+		values  commonconfig.MapLoader
+		service string
+		test    string
+	}{
+		{name: "own setting", values: commonconfig.MapLoader{"API_KEY": "k", "TEST": "value"}, service: "servicetemplate", test: "value"},
+		{name: "embedded settings", values: commonconfig.MapLoader{"API_KEY": "k", "SERVICE_NAME": "orders"}, service: "orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commonconfig.ResetForTest()
+			t.Cleanup(commonconfig.ResetForTest)
+			var config ServiceConfig
+			if err := commonconfig.InitializeWithLoaderE(&config, tt.values); err != nil {
+				t.Fatalf("InitializeWithLoaderE() error = %v", err)
+			}
+			if err := commonconfig.ValidateConfigImplementation(&config); err != nil {
+				t.Errorf("ValidateConfigImplementation() error = %v", err)
+			}
+			if _, ok := commonconfig.GetConfig().(*ServiceConfig); !ok {
+				t.Errorf("GetConfig() is a %T, want *ServiceConfig", commonconfig.GetConfig())
+			}
+			if config.GetServiceName() != tt.service || config.Test != tt.test {
+				t.Errorf("service %q, test %q, want %q and %q", config.GetServiceName(), config.Test, tt.service, tt.test)
+			}
+		})
+	}
+}
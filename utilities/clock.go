@@ -0,0 +1,45 @@
+package utilities
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. The template code reads the time through Now so that
+// tests can replace the wall clock with a fake one.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the wall clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time { return time.Now() }
+
+var (
+	clockMu sync.RWMutex
+	clock   Clock = RealClock{}
+)
+
+// SetClock replaces the clock returned by Now; a nil clock restores the wall clock.
+// It is meant for tests only.
+func SetClock(c Clock) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	if c == nil {
+		c = RealClock{}
+	}
+	clock = c
+}
+
+// Now returns the current time of the configured clock
+func Now() time.Time {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return clock.Now()
+}
+
+// Since returns the time elapsed since t according to the configured clock
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
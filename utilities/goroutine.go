@@ -0,0 +1,85 @@
+package utilities
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// PanicHook is called with the recovered value and the stack trace when a goroutine started with Go panics
+type PanicHook func(recovered any, stack []byte)
+
+var (
+	panicHooksMu sync.RWMutex
+	panicHooks   []panicHook
+	nextHookID   uint64
+	panicCount   atomic.Uint64
+)
+
+// panicHook is a registered PanicHook with the id used to unregister it
+type panicHook struct {
+	id   uint64
+	hook PanicHook
+}
+
+// OnPanic registers a hook called when a goroutine started with Go panics. commonlogger logs
+// the panic and commonmetrics counts it, so services rarely need their own hook.
+// Each hook runs in a goroutine of its own, so a slow or blocked hook doesn't hold back the others.
+// Call the returned function to unregister the hook, e.g. at the end of a test.
+func OnPanic(hook PanicHook) (unregister func()) {
+	panicHooksMu.Lock()
+	defer panicHooksMu.Unlock()
+	nextHookID++
+	id := nextHookID
+	panicHooks = append(panicHooks, panicHook{id: id, hook: hook})
+	return func() {
+		panicHooksMu.Lock()
+		defer panicHooksMu.Unlock()
+		panicHooks = slices.DeleteFunc(panicHooks, func(h panicHook) bool { return h.id == id })
+	}
+}
+
+// PanicCount returns the number of panics recovered by Go
+func PanicCount() uint64 {
+	return panicCount.Load()
+}
+
+// Go runs fn in a new goroutine, recovering from a panic in fn so that it doesn't crash the process.
+// The panic is passed to the hooks registered with OnPanic, or written to stderr when there are none.
+func Go(fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				handlePanic(r, debug.Stack())
+			}
+		}()
+		fn()
+	}()
+}
+
+func handlePanic(recovered any, stack []byte) {
+	panicCount.Add(1)
+	panicHooksMu.RLock()
+	hooks := slices.Clone(panicHooks)
+	panicHooksMu.RUnlock()
+	if len(hooks) == 0 {
+		fmt.Fprintf(os.Stderr, "panic in goroutine: %v\n%s", recovered, stack)
+		return
+	}
+	for _, h := range hooks {
+		go runPanicHook(h.hook, recovered, stack)
+	}
+}
+
+// runPanicHook calls the hook, writing to stderr if the hook panics itself
+func runPanicHook(hook PanicHook, recovered any, stack []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "panic in a panic hook: %v\n%s", r, debug.Stack())
+		}
+	}()
+	hook(recovered, stack)
+}
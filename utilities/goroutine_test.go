@@ -0,0 +1,111 @@
+package utilities
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGo(t *testing.T) {
+	type recovered struct {
+		value any
+		stack string
+	}
+	hooked := make(chan recovered, 1)
+	t.Cleanup(OnPanic(func(value any, stack []byte) { hooked <- recovered{value, string(stack)} }))
+
+	tests := []struct {
+		name  string
+		fn    func()
+		panic any
+	}{
+		{name: "no panic", fn: func() {}},
+		{name: "panic with a string", fn: func() { panic("boom") }, panic: "boom"},
+		{name: "panic with an error", fn: func() { panic(errors.New("broken")) }, panic: "broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := PanicCount()
+			done := make(chan struct{})
+			Go(func() {
+				defer close(done)
+				tt.fn()
+			})
+			<-done
+			if tt.panic == nil {
+				select {
+				case r := <-hooked:
+					t.Fatalf("the hook was called with %v without a panic", r.value)
+				case <-time.After(20 * time.Millisecond):
+				}
+				if got := PanicCount() - before; got != 0 {
+					t.Errorf("PanicCount() increased by %d, want 0", got)
+				}
+				return
+			}
+			select {
+			case r := <-hooked:
+				if fmt.Sprint(r.value) != tt.panic {
+					t.Errorf("the hook got %v, want %v", r.value, tt.panic)
+				}
+				if !strings.Contains(r.stack, "goroutine") {
+					t.Errorf("the hook got no stack: %q", r.stack)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the hook was not called")
+			}
+			if got := PanicCount() - before; got != 1 {
+				t.Errorf("PanicCount() increased by %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestPanicHooks(t *testing.T) {
+	blocked := make(chan struct{})
+	t.Cleanup(func() { close(blocked) })
+	tests := []struct {
+		name string
+		// first is registered before the hook checked by the test
+		first      PanicHook
+		unregister bool
+	}{
+		{name: "blocked hook", first: func(any, []byte) { <-blocked }},
+		{name: "panicking hook", first: func(any, []byte) { panic("hook failed") }},
+		{name: "unregistered hook", first: func(any, []byte) {}, unregister: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(OnPanic(tt.first))
+			called := make(chan struct{}, 1)
+			unregister := OnPanic(func(any, []byte) {
+				select {
+				case called <- struct{}{}:
+				default:
+				}
+			})
+			t.Cleanup(unregister)
+			if tt.unregister {
+				unregister()
+			}
+
+			Go(func() { panic("boom") })
+			wait := time.Second
+			if tt.unregister {
+				wait = 50 * time.Millisecond
+			}
+			select {
+			case <-called:
+				if tt.unregister {
+					t.Error("the unregistered hook was called")
+				}
+			case <-time.After(wait):
+				if !tt.unregister {
+					t.Error("the hook was not called")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package utilities
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// CPUQuotaSource returns the CPU limit of the container in cores, or false when there is none
+type CPUQuotaSource func() (float64, bool, error)
+
+// CgroupCPUQuota reads the CPU limit from the cgroup v2 cpu.max file, falling back to the
+// cgroup v1 CFS quota and period files
+func CgroupCPUQuota() (float64, bool, error) {
+	if quota, ok, err := cgroupV2CPUQuota("/sys/fs/cgroup/cpu.max"); err == nil {
+		return quota, ok, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, false, err
+	}
+	return cgroupV1CPUQuota("/sys/fs/cgroup/cpu/cpu.cfs_quota_us", "/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+}
+
+// cgroupV2CPUQuota parses "<quota> <period>", where quota is "max" when there is no limit
+func cgroupV2CPUQuota(path string) (float64, bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, fmt.Errorf("unexpected content in %s: %q", path, string(content))
+	}
+	if fields[0] == "max" {
+		return 0, false, nil
+	}
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid quota in %s: %w", path, err)
+	}
+	period := 100000.0
+	if len(fields) == 2 {
+		if period, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return 0, false, fmt.Errorf("invalid period in %s: %w", path, err)
+		}
+	}
+	if period <= 0 {
+		return 0, false, fmt.Errorf("invalid period in %s: %v", path, period)
+	}
+	return quota / period, true, nil
+}
+
+// cgroupV1CPUQuota divides the CFS quota by the period; a quota of -1 means no limit
+func cgroupV1CPUQuota(quotaPath string, periodPath string) (float64, bool, error) {
+	quota, err := readFirstInt(quotaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if quota <= 0 {
+		return 0, false, nil
+	}
+	period, err := readFirstInt(periodPath)
+	if err != nil {
+		return 0, false, err
+	}
+	if period <= 0 {
+		return 0, false, fmt.Errorf("invalid period in %s: %d", periodPath, period)
+	}
+	return float64(quota) / float64(period), true, nil
+}
+
+func readFirstInt(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("%s is empty", path)
+	}
+	return strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 64)
+}
+
+// SetMaxProcsFromQuota sets GOMAXPROCS to the CPU limit given by source, rounded down and at least 1.
+// It returns the GOMAXPROCS in effect and whether it was changed; without a limit it is left as is.
+func SetMaxProcsFromQuota(source CPUQuotaSource) (int, bool, error) {
+	quota, ok, err := source()
+	if err != nil || !ok {
+		return runtime.GOMAXPROCS(0), false, err
+	}
+	procs := int(math.Floor(quota))
+	if procs < 1 {
+		procs = 1
+	}
+	runtime.GOMAXPROCS(procs)
+	return procs, true, nil
+}
@@ -0,0 +1,88 @@
+package utilities
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSetMaxProcsFromQuota(t *testing.T) {
+	initial := runtime.GOMAXPROCS(0)
+	t.Cleanup(func() { runtime.GOMAXPROCS(initial) })
+	tests := []struct {
+		name    string
+		quota   float64
+		limited bool
+		err     error
+		want    int
+	}{
+		{name: "whole cores", quota: 2, limited: true, want: 2},
+		{name: "fraction rounded down", quota: 3.5, limited: true, want: 3},
+		{name: "at least one", quota: 0.25, limited: true, want: 1},
+		{name: "no limit", want: initial},
+		{name: "source error", err: errors.New("unreadable"), want: initial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runtime.GOMAXPROCS(initial)
+			procs, changed, err := SetMaxProcsFromQuota(func() (float64, bool, error) { return tt.quota, tt.limited, tt.err })
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("SetMaxProcsFromQuota() error = %v, want %v", err, tt.err)
+			}
+			if procs != tt.want || changed != tt.limited || runtime.GOMAXPROCS(0) != tt.want {
+				t.Errorf("SetMaxProcsFromQuota() = %d, %t with GOMAXPROCS %d, want %d, %t", procs, changed, runtime.GOMAXPROCS(0), tt.want, tt.limited)
+			}
+		})
+	}
+}
+
+func TestCgroupCPUQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		v2      string
+		v1      []string
+		quota   float64
+		limited bool
+		wantErr bool
+	}{
+		{name: "v2 limit", v2: "150000 100000\n", quota: 1.5, limited: true},
+		{name: "v2 quota without period", v2: "200000", quota: 2, limited: true},
+		{name: "v2 no limit", v2: "max 100000\n"},
+		{name: "v2 invalid", v2: "lots 100000", wantErr: true},
+		{name: "v1 limit", v1: []string{"400000\n", "100000\n"}, quota: 4, limited: true},
+		{name: "v1 no limit", v1: []string{"-1\n", "100000\n"}},
+		{name: "v1 invalid period", v1: []string{"400000\n", "0\n"}, wantErr: true},
+		{name: "no cgroup files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			write := func(name, content string) string {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			}
+			var quota float64
+			var limited bool
+			var err error
+			switch {
+			case tt.v2 != "":
+				quota, limited, err = cgroupV2CPUQuota(write("cpu.max", tt.v2))
+			case tt.v1 != nil:
+				quota, limited, err = cgroupV1CPUQuota(write("cpu.cfs_quota_us", tt.v1[0]), write("cpu.cfs_period_us", tt.v1[1]))
+			default:
+				quota, limited, err = cgroupV1CPUQuota(filepath.Join(dir, "cpu.cfs_quota_us"), filepath.Join(dir, "cpu.cfs_period_us"))
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if quota != tt.quota || limited != tt.limited {
+				t.Errorf("quota = %v, %t, want %v, %t", quota, limited, tt.quota, tt.limited)
+			}
+		})
+	}
+}
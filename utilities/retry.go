@@ -0,0 +1,82 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffFunc returns the wait before the next attempt, given the number of the attempt that just failed (starting at 1)
+type BackoffFunc func(attempt int) time.Duration
+
+// ConstantBackoff waits the same delay between all attempts
+func ConstantBackoff(delay time.Duration) BackoffFunc {
+	return func(int) time.Duration { return delay }
+}
+
+// maxBackoff caps the uncapped exponential backoffs, so that doubling the delay never overflows
+const maxBackoff = time.Duration(math.MaxInt64 / 2)
+
+// ExponentialBackoff doubles the delay after each failed attempt, starting at base and capped at max.
+// A max of 0 or less means no cap, the delay then saturates at about 146 years instead of overflowing.
+func ExponentialBackoff(base time.Duration, max time.Duration) BackoffFunc {
+	if max <= 0 {
+		max = maxBackoff
+	}
+	return func(attempt int) time.Duration {
+		delay := base
+		for i := 1; i < attempt && delay > 0; i++ {
+			delay *= 2
+			if delay >= max {
+				return max
+			}
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// JitteredBackoff randomizes the delays of backoff by up to ±fraction of their value, e.g. 0.2 for ±20%,
+// so that many clients retrying at the same time don't hit the server in lockstep
+func JitteredBackoff(backoff BackoffFunc, fraction float64) BackoffFunc {
+	return func(attempt int) time.Duration {
+		delay := backoff(attempt)
+		if fraction <= 0 || delay <= 0 {
+			return delay
+		}
+		return delay + time.Duration((rand.Float64()*2-1)*fraction*float64(delay))
+	}
+}
+
+// Retry calls fn until it succeeds, attempts are exhausted or ctx is cancelled, waiting backoff between attempts.
+// attempts of 0 or less retries until success or cancellation. It returns the last error of fn,
+// joined with the context error when cancelled.
+func Retry(ctx context.Context, attempts int, backoff BackoffFunc, fn func() error) error {
+	if backoff == nil {
+		backoff = ConstantBackoff(0)
+	}
+	var lastErr error
+	for attempt := 1; attempts <= 0 || attempt <= attempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(err, lastErr)
+		}
+		if lastErr = fn(); lastErr == nil {
+			return nil
+		}
+		if attempts > 0 && attempt == attempts {
+			break
+		}
+		timer := time.NewTimer(backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(ctx.Err(), lastErr)
+		case <-timer.C:
+		}
+	}
+	return lastErr
+}
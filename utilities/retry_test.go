@@ -0,0 +1,120 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		failures  int
+		cancelAt  int
+		calls     int
+		err       error
+		cancelled bool
+	}{
+		{name: "first attempt succeeds", attempts: 3, failures: 0, calls: 1},
+		{name: "success after failures", attempts: 5, failures: 3, calls: 4},
+		{name: "attempts exhausted", attempts: 3, failures: 10, calls: 3, err: errors.New("failure 3")},
+		{name: "unlimited attempts", attempts: 0, failures: 7, calls: 8},
+		{name: "cancelled", attempts: 0, failures: 100, cancelAt: 2, calls: 2, err: errors.New("failure 2"), cancelled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			calls := 0
+			err := Retry(ctx, tt.attempts, ConstantBackoff(time.Millisecond), func() error {
+				calls++
+				if calls == tt.cancelAt {
+					cancel()
+				}
+				if calls <= tt.failures {
+					return fmt.Errorf("failure %d", calls)
+				}
+				return nil
+			})
+			if calls != tt.calls {
+				t.Errorf("fn called %d times, want %d", calls, tt.calls)
+			}
+			if tt.err == nil {
+				if err != nil {
+					t.Errorf("Retry() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Retry() error = nil, want %q", tt.err)
+			}
+			if errors.Is(err, context.Canceled) != tt.cancelled {
+				t.Errorf("Retry() error = %v, want cancelled %t", err, tt.cancelled)
+			}
+			// errors.Join puts each error on its own line
+			if !slices.Contains(strings.Split(err.Error(), "\n"), tt.err.Error()) {
+				t.Errorf("Retry() error = %v, want the last error %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWaitingOnCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := Retry(ctx, 0, ConstantBackoff(time.Hour), func() error { return errors.New("down") })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Retry() error = %v, want the deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry() returned after %s, want it to stop waiting when cancelled", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff BackoffFunc
+		delays  []time.Duration
+	}{
+		{name: "constant", backoff: ConstantBackoff(time.Second), delays: []time.Duration{time.Second, time.Second, time.Second}},
+		{name: "exponential", backoff: ExponentialBackoff(time.Second, time.Minute), delays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{name: "exponential capped", backoff: ExponentialBackoff(time.Second, 5*time.Second), delays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.delays {
+				if got := tt.backoff(i + 1); got != want {
+					t.Errorf("backoff(%d) = %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExponentialBackoffDoesNotOverflow(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, 0)
+	for _, attempt := range []int{10, 64, 100, 1000} {
+		if got := backoff(attempt); got <= 0 {
+			t.Errorf("backoff(%d) = %s, want a positive delay", attempt, got)
+		}
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	backoff := JitteredBackoff(ConstantBackoff(time.Second), 0.2)
+	for i := 0; i < 100; i++ {
+		if got := backoff(1); got < 800*time.Millisecond || got > 1200*time.Millisecond {
+			t.Fatalf("jittered delay %s outside of 1s ±20%%", got)
+		}
+	}
+	if got := JitteredBackoff(ConstantBackoff(time.Second), 0)(1); got != time.Second {
+		t.Errorf("delay without jitter = %s, want 1s", got)
+	}
+}
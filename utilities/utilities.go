@@ -7,11 +7,40 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 )
 
 var anonRe = regexp.MustCompile(`\.func\d+$`)
 
+// DefaultSensitiveKeyPattern matches map keys whose values are masked by ToMaskedJSON and ToMaskedMap
+const DefaultSensitiveKeyPattern = `(?i)(password|passwd|secret|token|api[_-]?key|credential|private[_-]?key)`
+
+var (
+	sensitiveKeyMu sync.RWMutex
+	sensitiveKeyRe = regexp.MustCompile(DefaultSensitiveKeyPattern)
+)
+
+// SetSensitiveKeyPattern replaces the regular expression matching the map keys whose values are masked
+func SetSensitiveKeyPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid sensitive key pattern: %w", err)
+	}
+	sensitiveKeyMu.Lock()
+	defer sensitiveKeyMu.Unlock()
+	sensitiveKeyRe = re
+	return nil
+}
+
+// IsSensitiveKey reports whether a map key matches the sensitive key pattern
+func IsSensitiveKey(key string) bool {
+	sensitiveKeyMu.RLock()
+	defer sensitiveKeyMu.RUnlock()
+	return sensitiveKeyRe.MatchString(key)
+}
+
 // maskSensitive masks sensitive fields as requested.
 func maskSensitive(value string) string {
 	if len(value) >= 8 {
@@ -20,14 +49,21 @@ func maskSensitive(value string) string {
 	return "****"
 }
 
-func ToMaskedJSON(cfg any) (string, error) {
+// MaskValue masks a sensitive value the same way ToMaskedJSON does
+func MaskValue(value string) string {
+	return maskSensitive(value)
+}
+
+// structValue unwraps interface and pointer layers until it reaches a struct.
+// It returns false if a nil is found on the way.
+func structValue(cfg any, caller string) (reflect.Value, bool, error) {
 	v := reflect.ValueOf(cfg)
 
 	// Unwrap interface and pointer layers until we reach a struct
 	for {
 		if v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer {
 			if v.IsNil() {
-				return "{}", nil
+				return v, false, nil
 			}
 			v = v.Elem()
 			continue
@@ -36,7 +72,50 @@ func ToMaskedJSON(cfg any) (string, error) {
 	}
 
 	if v.Kind() != reflect.Struct {
-		return "", fmt.Errorf("ToMaskedJSON: expected struct or *struct, got %s", v.Kind())
+		return v, false, fmt.Errorf("%s: expected struct or *struct, got %s", caller, v.Kind())
+	}
+	return v, true, nil
+}
+
+// ToMaskedMap converts a struct to a map keyed by the mapstructure tags, masking sensitive fields
+func ToMaskedMap(cfg any) (map[string]any, error) {
+	v, ok, err := structValue(cfg, "ToMaskedMap")
+	if err != nil || !ok {
+		return map[string]any{}, err
+	}
+	return structToMaskedMap(v)
+}
+
+// MaskedKeys returns the sorted keys of the ToMaskedMap output. Keys of nested maps are joined to
+// their parent key with a dot, e.g. "DATABASE.PASSWORD". Tests can snapshot the list so that a new
+// field, which may need the sensitive tag, doesn't reach /config unnoticed.
+func MaskedKeys(cfg any) []string {
+	m, err := ToMaskedMap(cfg)
+	if err != nil {
+		return nil
+	}
+	keys := []string{}
+	var walk func(prefix string, m map[string]any)
+	walk = func(prefix string, m map[string]any) {
+		for key, val := range m {
+			keys = append(keys, prefix+key)
+			if child, ok := val.(map[string]any); ok {
+				walk(prefix+key+".", child)
+			}
+		}
+	}
+	walk("", m)
+	sort.Strings(keys)
+	return keys
+}
+
+func ToMaskedJSON(cfg any) (string, error) {
+	v, ok, err := structValue(cfg, "ToMaskedJSON")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "{}", nil
 	}
 
 	m, err := structToMaskedMap(v)
@@ -52,6 +131,14 @@ func ToMaskedJSON(cfg any) (string, error) {
 }
 
 func structToMaskedMap(v reflect.Value) (map[string]any, error) {
+	return structToMap(v, true, nil)
+}
+
+// structToMap converts a struct to a map keyed by the mapstructure tags. Sensitive string fields
+// are masked when mask is true, and their keys are recorded in sensitive when it is not nil.
+// String values of maps are masked when their key matches the sensitive key pattern, or all of
+// them when the map field itself is tagged sensitive.
+func structToMap(v reflect.Value, mask bool, sensitive map[string]bool) (map[string]any, error) {
 	t := v.Type()
 	out := make(map[string]any, t.NumField())
 
@@ -78,7 +165,7 @@ func structToMaskedMap(v reflect.Value) (map[string]any, error) {
 		}
 		if sf.Anonymous || hasSquash {
 			if fv.Kind() == reflect.Struct {
-				child, err := structToMaskedMap(fv)
+				child, err := structToMap(fv, mask, sensitive)
 				if err != nil {
 					return nil, err
 				}
@@ -98,7 +185,7 @@ func structToMaskedMap(v reflect.Value) (map[string]any, error) {
 
 		switch fv.Kind() {
 		case reflect.Struct:
-			child, err := structToMaskedMap(fv)
+			child, err := structToMap(fv, mask, sensitive)
 			if err != nil {
 				return nil, err
 			}
@@ -111,7 +198,7 @@ func structToMaskedMap(v reflect.Value) (map[string]any, error) {
 					elem = elem.Elem()
 				}
 				if elem.Kind() == reflect.Struct {
-					child, err := structToMaskedMap(elem)
+					child, err := structToMap(elem, mask, sensitive)
 					if err != nil {
 						return nil, err
 					}
@@ -122,20 +209,29 @@ func structToMaskedMap(v reflect.Value) (map[string]any, error) {
 			}
 			val = arr
 		case reflect.Map:
+			sensitiveField := sf.Tag.Get("sensitive") == "true"
+			if sensitiveField && sensitive != nil {
+				sensitive[key] = true
+			}
 			m := make(map[string]any, fv.Len())
 			iter := fv.MapRange()
 			for iter.Next() {
 				k := fmt.Sprint(iter.Key().Interface())
 				ev := iter.Value()
+				if ev.Kind() == reflect.Interface && !ev.IsNil() {
+					ev = ev.Elem()
+				}
 				if ev.Kind() == reflect.Pointer && !ev.IsNil() && ev.Elem().Kind() == reflect.Struct {
 					ev = ev.Elem()
 				}
 				if ev.Kind() == reflect.Struct {
-					child, err := structToMaskedMap(ev)
+					child, err := structToMap(ev, mask, sensitive)
 					if err != nil {
 						return nil, err
 					}
 					m[k] = child
+				} else if mask && ev.Kind() == reflect.String && (sensitiveField || IsSensitiveKey(k)) {
+					m[k] = maskSensitive(ev.String())
 				} else {
 					m[k] = ev.Interface()
 				}
@@ -147,8 +243,13 @@ func structToMaskedMap(v reflect.Value) (map[string]any, error) {
 
 		// Mask sensitive string leaves
 		if sf.Tag.Get("sensitive") == "true" && fv.Kind() == reflect.String {
-			s := fv.String()
-			val = maskSensitive(s)
+			if sensitive != nil {
+				sensitive[key] = true
+			}
+			if mask {
+				s := fv.String()
+				val = maskSensitive(s)
+			}
 		}
 
 		out[key] = val
@@ -156,6 +257,66 @@ func structToMaskedMap(v reflect.Value) (map[string]any, error) {
 	return out, nil
 }
 
+// Change describes a key whose value differs between two structs. Values of sensitive
+// fields are never reported, only the fact that they changed.
+type Change struct {
+	Key       string `json:"key"`
+	Old       any    `json:"old,omitempty"`
+	New       any    `json:"new,omitempty"`
+	Sensitive bool   `json:"sensitive,omitempty"`
+}
+
+// MaskedDiff compares two structs (typically two versions of a config) and returns the changed keys,
+// sorted by key. Raw values are compared, so a change of a sensitive value is detected even if
+// both masked values look the same.
+func MaskedDiff(before any, after any) ([]Change, error) {
+	sensitive := map[string]bool{}
+	toMaps := func(cfg any) (map[string]any, map[string]any, error) {
+		v, ok, err := structValue(cfg, "MaskedDiff")
+		if err != nil || !ok {
+			return map[string]any{}, map[string]any{}, err
+		}
+		raw, err := structToMap(v, false, sensitive)
+		if err != nil {
+			return nil, nil, err
+		}
+		masked, err := structToMaskedMap(v)
+		return raw, masked, err
+	}
+	rawBefore, maskedBefore, err := toMaps(before)
+	if err != nil {
+		return nil, err
+	}
+	rawAfter, maskedAfter, err := toMaps(after)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(rawBefore)+len(rawAfter))
+	for key := range rawBefore {
+		keys = append(keys, key)
+	}
+	for key := range rawAfter {
+		if _, ok := rawBefore[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []Change{}
+	for _, key := range keys {
+		if reflect.DeepEqual(rawBefore[key], rawAfter[key]) {
+			continue
+		}
+		if sensitive[key] {
+			changes = append(changes, Change{Key: key, Sensitive: true})
+			continue
+		}
+		changes = append(changes, Change{Key: key, Old: maskedBefore[key], New: maskedAfter[key]})
+	}
+	return changes, nil
+}
+
 func CallerLabel(skip int) (pkg string, label string, line int) {
 	// skip: 0=this func, 1=wrapper, 2=caller, etc.
 	pc, _, line, ok := runtime.Caller(skip)
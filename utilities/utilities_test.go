@@ -0,0 +1,159 @@
+package utilities
+
+import (
+	"reflect"
+	"testing"
+)
+
+type diffConfig struct {
+	Name    string            `mapstructure:"NAME"`
+	Port    int               `mapstructure:"PORT"`
+	ApiKey  string            `mapstructure:"API_KEY" sensitive:"true"`
+	Tags    []string          `mapstructure:"TAGS"`
+	Headers map[string]string `mapstructure:"HEADERS"`
+}
+
+func TestMaskedDiff(t *testing.T) {
+	base := diffConfig{Name: "orders", Port: 8001, ApiKey: "secret-key-1", Tags: []string{"a"}, Headers: map[string]string{"token": "abcdefgh1"}}
+	tests := []struct {
+		name   string
+		change func(c *diffConfig)
+		want   []Change
+	}{
+		{name: "nothing changed", change: func(c *diffConfig) {}, want: []Change{}},
+		{name: "one field", change: func(c *diffConfig) { c.Port = 9000 }, want: []Change{{Key: "PORT", Old: 8001, New: 9000}}},
+		{name: "several fields sorted by key", change: func(c *diffConfig) { c.Port = 9000; c.Name = "billing" }, want: []Change{
+			{Key: "NAME", Old: "orders", New: "billing"},
+			{Key: "PORT", Old: 8001, New: 9000},
+		}},
+		{name: "sensitive field omits the values", change: func(c *diffConfig) { c.ApiKey = "secret-key-2" }, want: []Change{{Key: "API_KEY", Sensitive: true}}},
+		{name: "slice", change: func(c *diffConfig) { c.Tags = []string{"a", "b"} }, want: []Change{{Key: "TAGS", Old: []any{"a"}, New: []any{"a", "b"}}}},
+		{name: "sensitive map value is masked", change: func(c *diffConfig) { c.Headers = map[string]string{"token": "abcdefgh2"} }, want: []Change{
+			{Key: "HEADERS", Old: map[string]any{"token": "ab****h1"}, New: map[string]any{"token": "ab****h2"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := base
+			after.Tags = append([]string{}, base.Tags...)
+			tt.change(&after)
+			got, err := MaskedDiff(&base, after)
+			if err != nil {
+				t.Fatalf("MaskedDiff() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MaskedDiff() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+type mapConfig struct {
+	Options map[string]string `mapstructure:"OPTIONS"`
+	Secrets map[string]string `mapstructure:"SECRETS" sensitive:"true"`
+	Extra   map[string]any    `mapstructure:"EXTRA"`
+}
+
+func TestMaskedMapValues(t *testing.T) {
+	cfg := mapConfig{
+		Options: map[string]string{"password": "hunter2hunter2", "db_token": "abc", "host": "db.local"},
+		Secrets: map[string]string{"first": "value-one-1", "second": "x"},
+		Extra:   map[string]any{"api_key": "extra-key-1", "retries": 3},
+	}
+	tests := []struct {
+		name    string
+		pattern string
+		key     string
+		want    map[string]any
+	}{
+		{name: "values of sensitive keys", key: "OPTIONS", want: map[string]any{"password": "hu****r2", "db_token": "****", "host": "db.local"}},
+		{name: "all values of a sensitive map", key: "SECRETS", want: map[string]any{"first": "va****-1", "second": "****"}},
+		{name: "interface values", key: "EXTRA", want: map[string]any{"api_key": "ex****-1", "retries": 3}},
+		{name: "custom pattern", pattern: `(?i)^host$`, key: "OPTIONS", want: map[string]any{"password": "hunter2hunter2", "db_token": "abc", "host": "db****al"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pattern != "" {
+				if err := SetSensitiveKeyPattern(tt.pattern); err != nil {
+					t.Fatalf("SetSensitiveKeyPattern() error = %v", err)
+				}
+				t.Cleanup(func() { SetSensitiveKeyPattern(DefaultSensitiveKeyPattern) })
+			}
+			m, err := ToMaskedMap(cfg)
+			if err != nil {
+				t.Fatalf("ToMaskedMap() error = %v", err)
+			}
+			if !reflect.DeepEqual(m[tt.key], tt.want) {
+				t.Errorf("%s = %v, want %v", tt.key, m[tt.key], tt.want)
+			}
+		})
+	}
+}
+
+type keysDatabase struct {
+	Host     string `mapstructure:"HOST"`
+	Password string `mapstructure:"PASSWORD" sensitive:"true"`
+}
+
+type keysBase struct {
+	Name string `mapstructure:"NAME"`
+}
+
+type keysConfig struct {
+	keysBase `mapstructure:",squash"`
+	ApiKey   string            `mapstructure:"API_KEY" sensitive:"true"`
+	Database keysDatabase      `mapstructure:"DATABASE"`
+	Replica  *keysDatabase     `mapstructure:"REPLICA"`
+	Headers  map[string]string `mapstructure:"HEADERS"`
+	Untagged int
+}
+
+func TestMaskedKeys(t *testing.T) {
+	sample := keysConfig{
+		keysBase: keysBase{Name: "orders"},
+		ApiKey:   "secret-key-1",
+		Database: keysDatabase{Host: "db.local", Password: "hunter2hunter2"},
+		Replica:  &keysDatabase{Host: "replica.local", Password: "replica-pass"},
+		Headers:  map[string]string{"token": "abcdefgh1"},
+	}
+	tests := []struct {
+		name string
+		cfg  any
+		want []string
+	}{
+		{name: "sample config", cfg: sample, want: []string{
+			"API_KEY", "DATABASE", "DATABASE.HOST", "DATABASE.PASSWORD", "HEADERS", "HEADERS.token",
+			"NAME", "REPLICA", "REPLICA.HOST", "REPLICA.PASSWORD", "Untagged",
+		}},
+		{name: "pointer to the config", cfg: &keysDatabase{}, want: []string{"HOST", "PASSWORD"}},
+		{name: "nil pointer", cfg: (*keysConfig)(nil), want: []string{}},
+		{name: "not a struct", cfg: 42, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskedKeys(tt.cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MaskedKeys() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	// The keys are those of the masked output, whose sensitive values are masked
+	m, err := ToMaskedMap(sample)
+	if err != nil {
+		t.Fatalf("ToMaskedMap() error = %v", err)
+	}
+	masked := []struct {
+		key  string
+		got  any
+		want string
+	}{
+		{key: "API_KEY", got: m["API_KEY"], want: "se****-1"},
+		{key: "DATABASE.PASSWORD", got: m["DATABASE"].(map[string]any)["PASSWORD"], want: "hu****r2"},
+		{key: "HEADERS.token", got: m["HEADERS"].(map[string]any)["token"], want: "ab****h1"},
+	}
+	for _, tt := range masked {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %q", tt.key, tt.got, tt.want)
+		}
+	}
+}